@@ -0,0 +1,41 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Admins are the accounts listed in ADMIN_EMAILS (comma-separated); they reach the
+// /api/admin/ endpoints for server maintenance.
+var adminEmails = map[string]bool{}
+
+func setupAdmins() {
+	for _, email := range strings.Split(os.Getenv("ADMIN_EMAILS"), ",") {
+		if email = strings.ToLower(strings.TrimSpace(email)); email != "" {
+			adminEmails[email] = true
+		}
+	}
+	if len(adminEmails) > 0 {
+		slog.Info("Admin accounts configured", "count", len(adminEmails))
+	}
+}
+
+func isAdmin(email string) bool {
+	return email != "" && adminEmails[strings.ToLower(email)]
+}
+
+// requireAdmin returns the signed-in admin's email, or writes 401/403 and reports false.
+func requireAdmin(w http.ResponseWriter, r *http.Request) (string, bool) {
+	email := getSessionEmail(r)
+	if email == "" {
+		http.Error(w, "Unauthorized", 401)
+		return "", false
+	}
+	if !isAdmin(email) {
+		http.Error(w, "Forbidden", 403)
+		return "", false
+	}
+	return email, true
+}
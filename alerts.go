@@ -0,0 +1,110 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+
+	"power-monitor/monitor"
+)
+
+// applyEvents writes and sends what the tracker decided, in order: events first, then
+// suppression marks, then alerts. Call it without holding mu, through queueEvents.
+func applyEvents(ev monitor.Events) {
+	for _, tr := range ev.Transitions {
+		if tr.Up {
+			slog.Info("Light ON", "device_id", tr.DeviceID, "channel", tr.Channel, "after", formatDuration(tr.Duration))
+		} else {
+			slog.Info("Light OFF", "device_id", tr.DeviceID, "channel", tr.Channel, "up_for", formatDuration(tr.Duration))
+		}
+		saveEvent(tr.DeviceID, tr.Channel, stateName(tr.Up), tr.Time, int64(tr.Duration.Seconds()), tr.Suppressed)
+	}
+	for _, ref := range ev.Suppressed {
+		markSuppressed(ref)
+	}
+	if len(ev.Transitions) > 0 {
+		mqttNotify()
+	}
+	for _, a := range ev.Alerts {
+		// A copy: the handlers change the device under mu while the alerts go out
+		mu.Lock()
+		d := devices[a.DeviceID]
+		var snapshot DeviceConfig
+		if d != nil {
+			snapshot = *d
+		}
+		mu.Unlock()
+		if d == nil {
+			continue
+		}
+		config := &snapshot
+		switch a.Kind {
+		case "up":
+			notifyUp(config, a.Channel, a.At, a.Duration)
+		case "down":
+			notifyDown(config, a.Channel, a.At, a.Duration)
+		case "unstable":
+			notifyUnstable(config, a.Channel, a.At)
+		case "stable":
+			notifyStable(config, a)
+		}
+	}
+}
+
+func markSuppressed(ref monitor.Ref) {
+	if err := storage.MarkSuppressed(ref.DeviceID, ref.Channel, ref.Time); err != nil {
+		slog.Error("Failed to mark event suppressed", "device_id", ref.DeviceID, "channel", ref.Channel, "err", err)
+		noteError("db", err)
+	}
+}
+
+func stateName(up bool) string {
+	if up {
+		return "up"
+	}
+	return "down"
+}
+
+func (d *DeviceConfig) flapWindow() time.Duration {
+	if d.FlapWindow > 0 {
+		return time.Duration(d.FlapWindow) * time.Second
+	}
+	return monitor.DefaultFlapWindow
+}
+
+// track hands the device's monitoring settings to the tracker; call it whenever they change.
+func track(d *DeviceConfig) {
+	tracker.Configure(d.ID, monitor.Settings{
+		Timeout:       getDeviceTimeout(d),
+		MinOutage:     time.Duration(d.MinOutage) * time.Second,
+		MinStableUp:   time.Duration(d.MinStableUp) * time.Second,
+		FlapThreshold: d.FlapThreshold,
+		FlapWindow:    d.flapWindow(),
+		Paused:        d.Paused,
+	})
+}
+
+func notifyUnstable(config *DeviceConfig, channel string, at time.Time) {
+	msg := renderMessage(config, newMessageData(config, "unstable", channel, at))
+	if config.Configured {
+		deliverAlert(config, msg, nil, "")
+	}
+	notifySubscribers(config, "unstable", msg)
+}
+
+func notifyStable(config *DeviceConfig, a monitor.Alert) {
+	l := localeFor(config.Locale)
+	data := newMessageData(config, "stable", a.Channel, a.At)
+	data.PowerOn = a.Up
+	data.Period = l.duration(a.At.Sub(a.FlapSince))
+	data.Outages = a.FlapOutages
+	data.Downtime = l.duration(a.FlapDowntime)
+	avatar := greenAvatar
+	if !a.Up {
+		avatar = redAvatar
+	}
+	msg := renderMessage(config, data)
+	if config.Configured {
+		deliverAlert(config, msg, nil, deviceAvatar(a.Channel, avatar))
+	}
+	notifySubscribers(config, "stable", msg)
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"power-monitor/store"
+)
+
+// With BACKUP_DIR set, a SQLite snapshot is written there every BACKUP_INTERVAL
+// (default 24h) and only the newest BACKUP_KEEP (default 7) are kept. Snapshots use the
+// online backup API, so the server keeps running while they are taken.
+
+const (
+	backupPrefix      = "power-"
+	backupTimeLayout  = "20060102-150405"
+	backupUsage       = "usage: power-monitor backup [file]"
+	restoreUsage      = "usage: power-monitor restore <file>"
+	defaultBackupKeep = 7
+)
+
+var (
+	backupDir      string
+	backupInterval = 24 * time.Hour
+	backupKeep     = defaultBackupKeep
+)
+
+func setupBackups() {
+	backupDir = os.Getenv("BACKUP_DIR")
+	if s := os.Getenv("BACKUP_INTERVAL"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d < time.Minute {
+			fatal("Invalid BACKUP_INTERVAL", "value", s)
+		}
+		backupInterval = d
+	}
+	if s := os.Getenv("BACKUP_KEEP"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			fatal("Invalid BACKUP_KEEP", "value", s)
+		}
+		backupKeep = n
+	}
+	if backupDir == "" {
+		return
+	}
+	if err := os.MkdirAll(backupDir, 0755); err != nil {
+		fatal("Invalid BACKUP_DIR", "value", backupDir, "err", err)
+	}
+	slog.Info("Backups enabled", "dir", backupDir, "interval", backupInterval.String(), "keep", backupKeep)
+}
+
+// backupScheduler takes a backup whenever the newest one in backupDir is older than
+// backupInterval, so restarts don't reset the schedule.
+func backupScheduler() {
+	if backupDir == "" {
+		return
+	}
+	if db.Postgres() {
+		slog.Warn("BACKUP_DIR ignored", "err", store.ErrNoBackup)
+		return
+	}
+	for {
+		next := time.Now()
+		if files, err := listBackups(backupDir); err == nil && len(files) > 0 {
+			if info, err := os.Stat(files[len(files)-1]); err == nil {
+				next = info.ModTime().Add(backupInterval)
+			}
+		}
+		time.Sleep(time.Until(next))
+
+		path, err := backupToDir(db, backupDir, time.Now())
+		if err != nil {
+			slog.Error("Backup failed", "err", err)
+			noteError("backup", err)
+			time.Sleep(time.Hour)
+			continue
+		}
+		slog.Info("Backed up", "path", path)
+		if err := rotateBackups(backupDir, backupKeep); err != nil {
+			slog.Error("Failed to rotate backups", "err", err)
+			noteError("backup", err)
+		}
+	}
+}
+
+// backupToDir writes a timestamped backup into dir and returns its path.
+func backupToDir(db *store.DB, dir string, now time.Time) (string, error) {
+	path := filepath.Join(dir, backupPrefix+now.Format(backupTimeLayout)+".db")
+	return path, db.Backup(path)
+}
+
+// listBackups returns the backups in dir, oldest first.
+func listBackups(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, backupPrefix) || !strings.HasSuffix(name, ".db") {
+			continue
+		}
+		stamp := strings.TrimSuffix(strings.TrimPrefix(name, backupPrefix), ".db")
+		if _, err := time.Parse(backupTimeLayout, stamp); err != nil {
+			continue
+		}
+		files = append(files, filepath.Join(dir, name))
+	}
+	sort.Strings(files) // the timestamp sorts chronologically
+	return files, nil
+}
+
+// rotateBackups deletes all but the newest keep backups in dir.
+func rotateBackups(dir string, keep int) error {
+	files, err := listBackups(dir)
+	if err != nil {
+		return err
+	}
+	for len(files) > keep {
+		if err := os.Remove(files[0]); err != nil {
+			return err
+		}
+		files = files[1:]
+	}
+	return nil
+}
+
+// backupCommand runs "power-monitor backup [file]": a snapshot to file, or into
+// BACKUP_DIR with rotation. It is safe while the server runs.
+func backupCommand(args []string) error {
+	if len(args) > 1 {
+		return errors.New(backupUsage)
+	}
+	s, err := store.Open(databaseURL())
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	if len(args) == 1 {
+		if err := s.DB().Backup(args[0]); err != nil {
+			return err
+		}
+		fmt.Printf("backed up to %s\n", args[0])
+		return nil
+	}
+	setupBackups()
+	if backupDir == "" {
+		return errors.New("BACKUP_DIR is not set; " + backupUsage)
+	}
+	path, err := backupToDir(s.DB(), backupDir, time.Now())
+	if err != nil {
+		return err
+	}
+	fmt.Printf("backed up to %s\n", path)
+	return rotateBackups(backupDir, backupKeep)
+}
+
+// restoreCommand runs "power-monitor restore <file>", replacing the SQLite database
+// with a backup and migrating it to the current schema. Stop the server first.
+func restoreCommand(args []string) error {
+	if len(args) != 1 {
+		return errors.New(restoreUsage)
+	}
+	dsn := databaseURL()
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		return store.ErrNoBackup
+	}
+	version, err := store.Restore(args[0], dsn)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("restored %s (schema version %04d), previous database saved as %s\n", args[0], version, dsn+".before-restore")
+
+	s, err := store.Open(dsn)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	applied, err := s.DB().MigrateUp()
+	for _, m := range applied {
+		fmt.Printf("applied %04d_%s\n", m.Version, m.Name)
+	}
+	return err
+}
+
+// adminBackupHandler downloads a fresh snapshot of the database.
+func adminBackupHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	email, ok := requireAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	dir, err := os.MkdirTemp("", "power-backup")
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	defer os.RemoveAll(dir)
+	path, err := backupToDir(db, dir, time.Now())
+	if err == store.ErrNoBackup {
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	}
+	if err != nil {
+		requestLog(r).Error("Backup failed", "email", email, "err", err)
+		http.Error(w, "Backup failed", 500)
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err == nil {
+		w.Header().Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+	}
+	w.Header().Set("Content-Type", "application/vnd.sqlite3")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(path)))
+	requestLog(r).Info("Backup downloaded", "email", email)
+	io.Copy(w, f)
+}
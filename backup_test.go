@@ -0,0 +1,34 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRotateBackups(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Date(2024, 12, 28, 3, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		name := backupPrefix + start.AddDate(0, 0, i).Format(backupTimeLayout) + ".db"
+		os.WriteFile(filepath.Join(dir, name), nil, 0644)
+	}
+	// Other files in the directory are left alone
+	for _, name := range []string{"power-latest.db", "notes.txt", backupPrefix + "20241201-030000.db.tmp"} {
+		os.WriteFile(filepath.Join(dir, name), nil, 0644)
+	}
+
+	if err := rotateBackups(dir, 2); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := listBackups(dir)
+	if len(files) != 2 || filepath.Base(files[0]) != "power-20241231-030000.db" ||
+		filepath.Base(files[1]) != "power-20250101-030000.db" {
+		t.Errorf("kept %v, want the two newest", files)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 5 {
+		t.Errorf("%d files left, want 2 backups and 3 others", len(entries))
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// publicVisibility reports whether a device is shared on any public page and the
+// strictest visibility settings among those pages. Callers must hold mu.
+func publicVisibility(deviceID string) (hideName, hideTimes, shared bool) {
+	for _, p := range publicPages {
+		for _, id := range p.DeviceIDs {
+			if id == deviceID {
+				shared = true
+				hideName = hideName || p.HideName
+				hideTimes = hideTimes || p.HideTimes
+			}
+		}
+	}
+	return
+}
+
+// publicDeviceState is a snapshot of a shared device for badges and widgets.
+type publicDeviceState struct {
+	Name      string
+	Up        bool
+	Since     time.Time
+	HideTimes bool
+	Location  *time.Location
+}
+
+func lookupPublicDevice(deviceID string) (publicDeviceState, bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	d, exists := devices[deviceID]
+	hideName, hideTimes, shared := publicVisibility(deviceID)
+	if !exists || !shared {
+		return publicDeviceState{}, false
+	}
+	s := publicDeviceState{Name: d.Name, HideTimes: hideTimes, Location: deviceLocation(d)}
+	if hideName {
+		s.Name = ""
+	}
+	if st, known := tracker.Status(deviceID); known {
+		s.Up = st.Up
+		s.Since = st.Since
+	}
+	return s, true
+}
+
+// shortDuration renders a compact English duration for badges: "25m", "3h", "2d 4h".
+func shortDuration(d time.Duration) string {
+	if d < 0 {
+		d = 0
+	}
+	days := int(d.Hours()) / 24
+	h := int(d.Hours()) % 24
+	m := int(d.Minutes()) % 60
+	switch {
+	case days > 0 && h > 0:
+		return fmt.Sprintf("%dd %dh", days, h)
+	case days > 0:
+		return fmt.Sprintf("%dd", days)
+	case h > 0:
+		return fmt.Sprintf("%dh", h)
+	default:
+		return fmt.Sprintf("%dm", m)
+	}
+}
+
+// badgeHandler serves /badge/{device}.svg, a shields-style "power: on 3h" badge.
+func badgeHandler(w http.ResponseWriter, r *http.Request) {
+	deviceID := strings.TrimSuffix(r.URL.Path[len("/badge/"):], ".svg")
+	s, ok := lookupPublicDevice(deviceID)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	label := r.URL.Query().Get("label")
+	if label == "" {
+		label = "power"
+	}
+	value, color := "off", "#ef4444"
+	if s.Up {
+		value, color = "on", "#22c55e"
+	}
+	if !s.Since.IsZero() {
+		value += " " + shortDuration(time.Since(s.Since))
+	}
+
+	w.Header().Set("Content-Type", "image/svg+xml")
+	w.Header().Set("Cache-Control", "public, max-age=60")
+	w.Write([]byte(renderBadge(label, value, color)))
+}
+
+func renderBadge(label, value, color string) string {
+	// Verdana 11px averages ~7px per glyph; good enough without font metrics
+	lw := 10 + 7*utf8.RuneCountInString(label)
+	vw := 10 + 7*utf8.RuneCountInString(value)
+	label = template.HTMLEscapeString(label)
+	value = template.HTMLEscapeString(value)
+	return fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" width="%[1]d" height="20" role="img" aria-label="%[3]s: %[4]s">
+  <linearGradient id="s" x2="0" y2="100%%"><stop offset="0" stop-color="#bbb" stop-opacity=".1"/><stop offset="1" stop-opacity=".1"/></linearGradient>
+  <clipPath id="r"><rect width="%[1]d" height="20" rx="3" fill="#fff"/></clipPath>
+  <g clip-path="url(#r)">
+    <rect width="%[2]d" height="20" fill="#555"/>
+    <rect x="%[2]d" width="%[5]d" height="20" fill="%[6]s"/>
+    <rect width="%[1]d" height="20" fill="url(#s)"/>
+  </g>
+  <g fill="#fff" text-anchor="middle" font-family="Verdana,Geneva,DejaVu Sans,sans-serif" font-size="11">
+    <text x="%[7]d" y="14">%[3]s</text>
+    <text x="%[8]d" y="14">%[4]s</text>
+  </g>
+</svg>`, lw+vw, lw, label, value, vw, color, lw/2, lw+vw/2)
+}
+
+// widgetHandler serves /widget/{device}?theme=light|dark, a small page meant for iframes.
+func widgetHandler(w http.ResponseWriter, r *http.Request) {
+	deviceID := r.URL.Path[len("/widget/"):]
+	s, ok := lookupPublicDevice(deviceID)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	theme := r.URL.Query().Get("theme")
+	if theme != "light" {
+		theme = "dark"
+	}
+	data := map[string]interface{}{
+		"Name":     s.Name,
+		"Up":       s.Up,
+		"Theme":    theme,
+		"Duration": formatDuration(time.Since(s.Since)),
+		"Since":    "",
+	}
+	if !s.HideTimes && !s.Since.IsZero() {
+		data["Since"] = s.Since.In(s.Location).Format("02.01 15:04")
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "public, max-age=60")
+	w.Header().Set("Content-Security-Policy", "frame-ancestors *")
+	if err := widgetTemplate.Execute(w, data); err != nil {
+		requestLog(r).Error("Widget failed", "device_id", deviceID, "err", err)
+	}
+}
+
+var widgetTemplate = template.Must(template.New("widget").Parse(`<!DOCTYPE html>
+<html lang="uk">
+<head>
+    <meta charset="utf-8">
+    <meta http-equiv="refresh" content="60">
+    <style>
+        * { box-sizing: border-box; margin: 0; padding: 0; }
+        body { font-family: -apple-system, BlinkMacSystemFont, sans-serif; padding: 12px; }
+        body.dark { background: #0d0d14; color: #f4f4f5; }
+        body.light { background: #ffffff; color: #18181b; }
+        .widget { display: flex; align-items: center; gap: 12px; }
+        .dot { width: 40px; height: 40px; border-radius: 50%; display: flex; align-items: center; justify-content: center; font-size: 20px; flex-shrink: 0; }
+        .up .dot { background: #22c55e; }
+        .down .dot { background: #ef4444; }
+        .name { font-size: 13px; opacity: 0.6; }
+        .status { font-size: 17px; font-weight: 700; }
+        .up .status { color: #22c55e; }
+        .down .status { color: #ef4444; }
+        .since { font-size: 12px; opacity: 0.6; }
+    </style>
+</head>
+<body class="{{.Theme}}">
+    <div class="widget {{if .Up}}up{{else}}down{{end}}">
+        <div class="dot">{{if .Up}}💡{{else}}⚡{{end}}</div>
+        <div>
+            {{if .Name}}<div class="name">{{.Name}}</div>{{end}}
+            <div class="status">{{if .Up}}Світло є{{else}}Світла немає{{end}}</div>
+            <div class="since">{{.Duration}}{{if .Since}} • з {{.Since}}{{end}}</div>
+        </div>
+    </div>
+</body>
+</html>`))
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type telegramUpdate struct {
+	UpdateID     int              `json:"update_id"`
+	Message      *telegramMessage `json:"message"`
+	ChannelPost  *telegramMessage `json:"channel_post"`
+	MyChatMember *telegramMessage `json:"my_chat_member"` // the bot added to or removed from a chat
+}
+
+type telegramMessage struct {
+	Text string        `json:"text"`
+	Chat telegramChat  `json:"chat"`
+	From *telegramUser `json:"from"`
+}
+
+type telegramUser struct {
+	LanguageCode string `json:"language_code"` // IETF tag of the user's Telegram app, e.g. "en"
+}
+
+// language is the sender's language, for replies that aren't about a device.
+func (m *telegramMessage) language() string {
+	if m.From == nil {
+		return ""
+	}
+	lang, _, _ := strings.Cut(m.From.LanguageCode, "-")
+	return strings.ToLower(lang)
+}
+
+type telegramChat struct {
+	ID        int64  `json:"id"`
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	FirstName string `json:"first_name"`
+	Username  string `json:"username"`
+}
+
+// errBotConflict is Telegram refusing getUpdates because the bot has a webhook or is
+// polled elsewhere.
+var errBotConflict = errors.New("bot is polled elsewhere or has a webhook")
+
+const (
+	botConflictBackoff = 10 * time.Minute
+	maxBotChats        = 50
+)
+
+var (
+	// botChats are the chats seen by the bots the server polls, by token. Polling confirms
+	// updates, so chat discovery has to come from here rather than from getUpdates.
+	botChats   = make(map[string]map[int64]telegramChat)
+	botChatsMu sync.Mutex
+)
+
+// botPoller keeps a long-polling loop for the subscribers' system bot, and for the bot
+// of each configured device whose owner turned on bot commands. Other device bots are
+// left alone: they may have a webhook, and the dashboard reads their updates to find chats.
+func botPoller() {
+	running := make(map[string]context.CancelFunc)
+	for {
+		tokens := make(map[string]bool)
+		if systemBotToken != "" {
+			tokens[systemBotToken] = true
+		}
+		mu.Lock()
+		for _, d := range devices {
+			if d.Configured && d.BotCommands {
+				tokens[d.BotToken] = true
+			}
+		}
+		mu.Unlock()
+
+		botChatsMu.Lock()
+		for token := range tokens {
+			if running[token] == nil {
+				ctx, cancel := context.WithCancel(context.Background())
+				running[token] = cancel
+				botChats[token] = make(map[int64]telegramChat)
+				go pollBot(ctx, token)
+			}
+		}
+		for token, cancel := range running {
+			if !tokens[token] {
+				cancel()
+				delete(running, token)
+				delete(botChats, token)
+			}
+		}
+		botChatsMu.Unlock()
+		time.Sleep(30 * time.Second)
+	}
+}
+
+func pollBot(ctx context.Context, token string) {
+	offset := 0
+	for ctx.Err() == nil {
+		updates, err := getTelegramUpdates(ctx, token, offset, 25)
+		if err != nil {
+			wait := 30 * time.Second
+			if errors.Is(err, errBotConflict) {
+				slog.Warn("Telegram bot not polled", "err", err)
+				wait = botConflictBackoff
+			}
+			select {
+			case <-ctx.Done():
+			case <-time.After(wait):
+			}
+			continue
+		}
+		for _, u := range updates {
+			offset = u.UpdateID + 1
+			msg := u.message()
+			if msg == nil {
+				continue
+			}
+			rememberBotChat(token, msg.Chat)
+			if u.MyChatMember == nil && strings.HasPrefix(msg.Text, "/") {
+				handleBotCommand(token, strconv.FormatInt(msg.Chat.ID, 10), msg)
+			}
+		}
+	}
+}
+
+func (u telegramUpdate) message() *telegramMessage {
+	switch {
+	case u.Message != nil:
+		return u.Message
+	case u.ChannelPost != nil:
+		return u.ChannelPost
+	}
+	return u.MyChatMember
+}
+
+func rememberBotChat(token string, chat telegramChat) {
+	botChatsMu.Lock()
+	defer botChatsMu.Unlock()
+	chats := botChats[token]
+	if chats != nil && (len(chats) < maxBotChats || chats[chat.ID].ID != 0) {
+		chats[chat.ID] = chat
+	}
+}
+
+// getTelegramUpdates long-polls for up to timeout seconds. Updates before offset are
+// confirmed and not returned again.
+func getTelegramUpdates(ctx context.Context, token string, offset, timeout int) ([]telegramUpdate, error) {
+	apiURL := fmt.Sprintf("https://api.telegram.org/bot%s/getUpdates?timeout=%d&offset=%d", token, timeout, offset)
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout+10)*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", apiURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		OK          bool             `json:"ok"`
+		ErrorCode   int              `json:"error_code"`
+		Description string           `json:"description"`
+		Result      []telegramUpdate `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	if result.ErrorCode == http.StatusConflict {
+		return nil, fmt.Errorf("%w: %s", errBotConflict, result.Description)
+	}
+	if !result.OK {
+		return nil, fmt.Errorf("getUpdates: %s", result.Description)
+	}
+	return result.Result, nil
+}
+
+// telegramChatsHandler lists the chats a bot has been added to or written in, for the
+// Telegram setup in the dashboard and flasher: POST {"token": "..."}. For a bot the
+// server polls these are the chats it has seen, otherwise Telegram is asked without
+// confirming anything.
+func telegramChatsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	if getSessionEmail(r) == "" {
+		http.Error(w, "Unauthorized", 401)
+		return
+	}
+	var req struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" || strings.ContainsAny(req.Token, "/?#") {
+		http.Error(w, "invalid token", 400)
+		return
+	}
+
+	chats := []telegramChat{}
+	botChatsMu.Lock()
+	seen, polled := botChats[req.Token]
+	for _, c := range seen {
+		chats = append(chats, c)
+	}
+	botChatsMu.Unlock()
+	if !polled {
+		updates, err := getTelegramUpdates(r.Context(), req.Token, 0, 1)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		found := make(map[int64]bool)
+		for _, u := range updates {
+			if msg := u.message(); msg != nil && !found[msg.Chat.ID] {
+				found[msg.Chat.ID] = true
+				chats = append(chats, msg.Chat)
+			}
+		}
+	}
+	sort.Slice(chats, func(i, j int) bool { return chats[i].ID < chats[j].ID })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"chats": chats, "polled": polled})
+}
+
+// handleBotCommand answers "/chart" (last 24h) and "/chart 7d" (last week) for every
+// device that reports to this chat through this bot.
+func handleBotCommand(token, chatID string, msg *telegramMessage) {
+	fields := strings.Fields(msg.Text)
+	command, _, _ := strings.Cut(fields[0], "@")
+	if token == systemBotToken {
+		handleSystemBotCommand(chatID, localeFor(msg.language()), command, fields[1:])
+		return
+	}
+	if command != "/chart" {
+		return
+	}
+	days := 1
+	if len(fields) > 1 {
+		switch strings.ToLower(fields[1]) {
+		case "7d", "7", "week", "тиждень", "tydzień", "woche":
+			days = 7
+		}
+	}
+
+	var targets []*DeviceConfig
+	mu.Lock()
+	for _, d := range devices {
+		if d.BotToken == token && d.ChatID == chatID {
+			snapshot := *d
+			targets = append(targets, &snapshot)
+		}
+	}
+	mu.Unlock()
+
+	for _, d := range targets {
+		chart, err := renderOutageChart(d, "", days)
+		if err != nil {
+			slog.Error("Chart render failed", "device_id", d.ID, "err", err)
+			continue
+		}
+		l := localeFor(d.Locale)
+		caption := l.text("chart_day", d.Name)
+		if days > 1 {
+			caption = l.text("chart_days", d.Name, days, l.plural3(days, l.days))
+		}
+		sendTelegramPhoto(token, chatID, caption, chart, false)
+	}
+}
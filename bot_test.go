@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"power-monitor/store"
+)
+
+// signIn adds a session for email to r.
+func signIn(t *testing.T, r *http.Request, email string) *http.Request {
+	t.Helper()
+	id := generateSessionID()
+	if err := storage.CreateSession(store.Session{ID: id, Email: email, ExpiresAt: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	r.AddCookie(&http.Cookie{Name: "session", Value: id})
+	return r
+}
+
+func TestTelegramChats(t *testing.T) {
+	if err := initDB(filepath.Join(t.TempDir(), "test.db")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	// A bot the server polls answers from the chats it has seen, the updates are gone
+	botChatsMu.Lock()
+	botChats["123:polled"] = make(map[int64]telegramChat)
+	botChatsMu.Unlock()
+	t.Cleanup(func() {
+		botChatsMu.Lock()
+		delete(botChats, "123:polled")
+		botChatsMu.Unlock()
+	})
+	rememberBotChat("123:polled", telegramChat{ID: -100, Type: "supergroup", Title: "Будинок"})
+	rememberBotChat("123:polled", telegramChat{ID: 42, Type: "private", FirstName: "Olena"})
+	rememberBotChat("123:other", telegramChat{ID: 7, Type: "private"}) // not polled, not kept
+
+	post := func(body string) *http.Request {
+		return httptest.NewRequest("POST", "/api/telegram/chats", strings.NewReader(body))
+	}
+	rec := httptest.NewRecorder()
+	telegramChatsHandler(rec, post(`{"token":"123:polled"}`))
+	if rec.Code != 401 {
+		t.Errorf("signed out: %d, want 401", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	telegramChatsHandler(rec, signIn(t, post(`{"token":"123:polled"}`), "owner@example.com"))
+	var resp struct {
+		Chats  []telegramChat `json:"chats"`
+		Polled bool           `json:"polled"`
+	}
+	json.NewDecoder(rec.Body).Decode(&resp)
+	if rec.Code != 200 || !resp.Polled || len(resp.Chats) != 2 || resp.Chats[0].Title != "Будинок" || resp.Chats[1].FirstName != "Olena" {
+		t.Errorf("polled bot: %d %+v", rec.Code, resp)
+	}
+	botChatsMu.Lock()
+	_, kept := botChats["123:other"]
+	botChatsMu.Unlock()
+	if kept {
+		t.Error("chats kept for a bot the server doesn't poll")
+	}
+
+	rec = httptest.NewRecorder()
+	telegramChatsHandler(rec, signIn(t, post(`{"token":"123:x/../getMe"}`), "owner@example.com"))
+	if rec.Code != 400 {
+		t.Errorf("token with a path: %d, want 400", rec.Code)
+	}
+}
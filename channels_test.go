@@ -0,0 +1,50 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"power-monitor/store"
+)
+
+func TestChannelStates(t *testing.T) {
+	if err := initDB(filepath.Join(t.TempDir(), "test.db")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	d := &DeviceConfig{Device: store.Device{ID: "home", Name: "home", DeviceKey: "secret", Paused: true}}
+	devices["home"] = d
+	saveDevice(d)
+	track(d)
+	t.Cleanup(func() {
+		delete(devices, "home")
+		tracker.Remove("home")
+	})
+
+	// The first report records where each channel starts, even one that is already down
+	recordPing("home", map[string]bool{"L1": true, "L2": false})
+	for name, want := range map[string]string{"L1": "up", "L2": "down"} {
+		last, err := storage.LastEvent("home", name)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if last.Type != want || !last.Suppressed {
+			t.Errorf("%s initial event = %+v, want a silent %s", name, last, want)
+		}
+	}
+
+	recordPing("home", map[string]bool{"L1": false, "L2": false})
+	if last, _ := storage.LastEvent("home", "L1"); last.Type != "down" {
+		t.Errorf("L1 after switching off = %+v", last)
+	}
+	if events, _ := storage.Events("home", "L2", time.Time{}, time.Now().Add(time.Minute)); len(events) != 1 {
+		t.Errorf("L2 events = %+v, want only the initial one", events)
+	}
+
+	// After a restart the channels come back in their last recorded state
+	states := loadChannelStates("home")
+	if len(states) != 2 || !states["L1"].IsDown || !states["L2"].IsDown {
+		t.Errorf("restored channels = %+v", states)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"strings"
+	"time"
+	"unicode"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+var (
+	chartBackground = color.RGBA{0x0d, 0x0d, 0x14, 0xff}
+	chartGrid       = color.RGBA{0x3f, 0x3f, 0x46, 0xff}
+	chartText       = color.RGBA{0xa1, 0xa1, 0xaa, 0xff}
+	chartUp         = color.RGBA{0x22, 0xc5, 0x5e, 0xff}
+	chartDown       = color.RGBA{0xef, 0x44, 0x44, 0xff}
+	chartNoData     = color.RGBA{0x27, 0x27, 0x2a, 0xff}
+)
+
+const (
+	chartWidth     = 800
+	chartRowHeight = 28
+	chartRowGap    = 10
+	chartLeft      = 90 // room for row labels
+	chartRight     = 20
+	chartTop       = 40
+	chartBottom    = 30
+)
+
+// chartRow is one horizontal bar of the chart covering [start, end).
+type chartRow struct {
+	label     string
+	start     time.Time
+	end       time.Time
+	intervals []interval
+}
+
+// renderOutageChart draws the last 24 hours (days == 1) as a single bar, or the last
+// N days as one bar per calendar day in the device timezone.
+func renderOutageChart(d *DeviceConfig, channel string, days int) ([]byte, error) {
+	loc := deviceLocation(d)
+	now := time.Now().In(loc)
+
+	var rows []chartRow
+	if days <= 1 {
+		from := now.Add(-24 * time.Hour)
+		intervals, err := loadIntervals(d.ID, channel, from, now)
+		if err != nil {
+			return nil, err
+		}
+		rows = append(rows, chartRow{label: "24h", start: from, end: now, intervals: intervals})
+	} else {
+		first := bucketStart(now, "day", loc).AddDate(0, 0, -(days - 1))
+		intervals, err := loadIntervals(d.ID, channel, first, now)
+		if err != nil {
+			return nil, err
+		}
+		for day := first; day.Before(now); day = day.AddDate(0, 0, 1) {
+			rows = append(rows, chartRow{label: day.Format("Mon 02.01"), start: day, end: day.AddDate(0, 0, 1), intervals: intervals})
+		}
+	}
+
+	title := d.Name
+	if channel != "" {
+		title += " / " + channel
+	}
+	return drawChart(asciiOnly(title), rows, loc)
+}
+
+func drawChart(title string, rows []chartRow, loc *time.Location) ([]byte, error) {
+	height := chartTop + len(rows)*(chartRowHeight+chartRowGap) + chartBottom
+	img := image.NewRGBA(image.Rect(0, 0, chartWidth, height))
+	draw.Draw(img, img.Bounds(), &image.Uniform{chartBackground}, image.Point{}, draw.Src)
+	drawText(img, 10, 22, title, color.White)
+
+	barWidth := chartWidth - chartLeft - chartRight
+	for i, row := range rows {
+		y := chartTop + i*(chartRowHeight+chartRowGap)
+		span := row.end.Sub(row.start)
+		x := func(t time.Time) int {
+			if t.Before(row.start) {
+				t = row.start
+			}
+			if t.After(row.end) {
+				t = row.end
+			}
+			return chartLeft + int(float64(barWidth)*float64(t.Sub(row.start))/float64(span))
+		}
+
+		fill(img, chartLeft, y, chartLeft+barWidth, y+chartRowHeight, chartNoData)
+		for _, iv := range row.intervals {
+			if !iv.End.After(row.start) || !iv.Start.Before(row.end) {
+				continue
+			}
+			c := chartNoData
+			switch iv.State {
+			case "up":
+				c = chartUp
+			case "down":
+				c = chartDown
+			}
+			fill(img, x(iv.Start), y, x(iv.End), y+chartRowHeight, c)
+		}
+		drawText(img, 10, y+chartRowHeight/2+4, row.label, chartText)
+	}
+
+	// Hour grid: 6-hour marks for day rows, relative to the bar start for the 24h view
+	gridBottom := chartTop + len(rows)*(chartRowHeight+chartRowGap) - chartRowGap
+	for h := 0; h <= 24; h += 6 {
+		gx := chartLeft + barWidth*h/24
+		fill(img, gx, chartTop-4, gx+1, gridBottom+4, chartGrid)
+		label := fmt.Sprintf("%02d:00", h%24)
+		if len(rows) == 1 {
+			label = rows[0].start.Add(time.Duration(h) * time.Hour).In(loc).Format("15:04")
+		}
+		drawText(img, gx-15, gridBottom+20, label, chartText)
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func fill(img *image.RGBA, x0, y0, x1, y1 int, c color.Color) {
+	draw.Draw(img, image.Rect(x0, y0, x1, y1), &image.Uniform{c}, image.Point{}, draw.Src)
+}
+
+func drawText(img *image.RGBA, x, y int, s string, c color.Color) {
+	d := &font.Drawer{
+		Dst:  img,
+		Src:  image.NewUniform(c),
+		Face: basicfont.Face7x13,
+		Dot:  fixed.P(x, y),
+	}
+	d.DrawString(s)
+}
+
+// asciiOnly transliterates Ukrainian letters and replaces any other character the
+// built-in bitmap font can't draw; the Telegram caption carries the original name.
+func asciiOnly(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if r <= 0x7e {
+			b.WriteRune(r)
+			continue
+		}
+		t, ok := translit[unicode.ToLower(r)]
+		if !ok {
+			b.WriteByte('?')
+			continue
+		}
+		if unicode.IsUpper(r) && t != "" {
+			t = strings.ToUpper(t[:1]) + t[1:]
+		}
+		b.WriteString(t)
+	}
+	return b.String()
+}
+
+var translit = map[rune]string{
+	'а': "a", 'б': "b", 'в': "v", 'г': "h", 'ґ': "g", 'д': "d", 'е': "e", 'є': "ie", 'ж': "zh",
+	'з': "z", 'и': "y", 'і': "i", 'ї': "i", 'й': "i", 'к': "k", 'л': "l", 'м': "m", 'н': "n",
+	'о': "o", 'п': "p", 'р': "r", 'с': "s", 'т': "t", 'у': "u", 'ф': "f", 'х': "kh", 'ц': "ts",
+	'ч': "ch", 'ш': "sh", 'щ': "shch", 'ь': "", 'ю': "iu", 'я': "ia", '’': "'", 'ʼ': "'",
+	'ы': "y", 'э': "e", 'ё': "e", 'ъ': "",
+}
@@ -38,6 +38,8 @@
                 const res = await fetch('/api/my-devices');
                 if (!res.ok) throw new Error('Failed');
                 const data = await res.json();
+                const pagesRes = await fetch('/api/public-pages');
+                publicPages = pagesRes.ok ? await pagesRes.json() : [];
                 render(data.owned || [], data.subscribed || []);
             } catch (e) {
                 document.getElementById('content').innerHTML =
@@ -88,7 +90,35 @@
                 html += '</div>';
             }
 
+            // Public status pages
+            if (owned.length > 0) {
+                html += `<div class="section-title">Публічні сторінки <span class="section-count">${publicPages.length}</span></div>`;
+                html += '<div class="devices-list">';
+                publicPages.forEach(p => {
+                    const names = p.device_ids.map(id => (owned.find(d => d.id === id) || {name: id}).name);
+                    html += `
+                        <div class="device-card">
+                            <div class="device-main">
+                                <div class="device-info">
+                                    <div class="device-name">${esc(p.title || p.slug)}</div>
+                                    <div class="device-meta"><span class="device-id">/s/${p.slug}</span> ${esc(names.join(', '))}</div>
+                                </div>
+                            </div>
+                            <div class="device-actions">
+                                <a href="/s/${p.slug}" target="_blank" class="device-action">🌐 Відкрити</a>
+                                <button class="device-action" onclick="showEmbedCode('${p.device_ids[0]}')">🏷️ Вбудувати</button>
+                                <button class="device-action" onclick="deletePublicPage('${p.slug}')">🗑️ Видалити</button>
+                            </div>
+                        </div>
+                    `;
+                });
+                html += '</div>';
+                html += `<div class="actions"><button class="btn btn-secondary" onclick="openPublicPageModal()">🌐 Створити публічну сторінку</button></div>`;
+            }
+            ownedDevices = owned;
+
             content.innerHTML = html;
+            owned.forEach(d => loadTemplate(d.id));
         }
 
         function renderDevice(d, isOwned) {
@@ -123,10 +153,87 @@
                                 <span class="pause-toggle-text">${d.paused ? 'Вимк' : 'Увімк'}</span>
                             </button>
                         </div>
+                        <div class="pause-row" title="Сервер читатиме повідомлення бота. Вимкніть, якщо бот використовує вебхук.">
+                            <span class="pause-label">Команда /chart у чаті</span>
+                            <button class="pause-toggle ${d.bot_commands ? '' : 'paused'}" onclick="toggleBotCommands('${d.id}', ${!d.bot_commands})">
+                                <span class="pause-toggle-slider"></span>
+                                <span class="pause-toggle-text">${d.bot_commands ? 'Увімк' : 'Вимк'}</span>
+                            </button>
+                        </div>
                         <div class="timeout-row">
                             <span class="timeout-label">Таймаут <span class="timeout-value" id="timeoutVal_${d.id}">${d.timeout || 90}с</span></span>
                             <input type="range" class="timeout-slider" id="timeout_${d.id}" min="30" max="300" step="10" value="${d.timeout || 90}" oninput="updateTimeoutLabel('${d.id}', this.value)" onchange="saveTimeout('${d.id}', this.value)">
                         </div>
+                        <div class="settings-title" style="margin-top:16px">Щоденний підсумок</div>
+                        <div class="form-row">
+                            <select class="form-input" id="digestFreq_${d.id}">
+                                <option value="" ${!d.digest_frequency ? 'selected' : ''}>Вимкнено</option>
+                                <option value="daily" ${d.digest_frequency === 'daily' ? 'selected' : ''}>Щодня</option>
+                                <option value="weekly" ${d.digest_frequency === 'weekly' ? 'selected' : ''}>Щотижня (пн)</option>
+                            </select>
+                            <input type="time" class="form-input" id="digestTime_${d.id}" value="${d.digest_time || '08:00'}">
+                        </div>
+                        <div class="form-row">
+                            <select class="form-input" id="tz_${d.id}">${timezoneOptions(d.timezone)}</select>
+                            <button class="btn-save" onclick="saveDigest('${d.id}')">Зберегти</button>
+                        </div>
+                        <div class="settings-title" style="margin-top:16px">Антиспам</div>
+                        <div class="form-row">
+                            <label class="form-label-inline">Не повідомляти про відключення коротші за, хв
+                                <input type="number" class="form-input" id="minOutage_${d.id}" min="0" max="60" value="${Math.round((d.min_outage || 0) / 60)}">
+                            </label>
+                            <label class="form-label-inline">Світло має протриматись, хв
+                                <input type="number" class="form-input" id="minStableUp_${d.id}" min="0" max="60" value="${Math.round((d.min_stable_up || 0) / 60)}">
+                            </label>
+                        </div>
+                        <div class="form-row">
+                            <label class="form-label-inline">Нестабільно після N перемикань (0 — вимк)
+                                <input type="number" class="form-input" id="flapThreshold_${d.id}" min="0" max="50" value="${d.flap_threshold || 0}">
+                            </label>
+                            <label class="form-label-inline">За, хв
+                                <input type="number" class="form-input" id="flapWindow_${d.id}" min="1" max="60" value="${Math.round((d.flap_window || 600) / 60)}">
+                            </label>
+                        </div>
+                        <div class="form-row">
+                            <button class="btn-save" onclick="saveAntiSpam('${d.id}')">Зберегти</button>
+                        </div>
+                        <div class="settings-title" style="margin-top:16px">Тихі години</div>
+                        <div class="form-row">
+                            <input type="time" class="form-input" id="quietStart_${d.id}" value="${d.quiet_start || ''}">
+                            <input type="time" class="form-input" id="quietEnd_${d.id}" value="${d.quiet_end || ''}">
+                        </div>
+                        <div class="form-row">
+                            <select class="form-input" id="quietMode_${d.id}">
+                                <option value="silent" ${d.quiet_mode !== 'hold' ? 'selected' : ''}>Без звуку</option>
+                                <option value="hold" ${d.quiet_mode === 'hold' ? 'selected' : ''}>Надіслати підсумок зранку</option>
+                            </select>
+                            <button class="btn-save" onclick="saveQuietHours('${d.id}')">Зберегти</button>
+                        </div>
+                        <div class="settings-title" style="margin-top:16px">Повідомлення</div>
+                        <div class="form-row">
+                            <select class="form-input" id="locale_${d.id}">
+                                ${[['uk', 'Українська'], ['en', 'English'], ['pl', 'Polski'], ['de', 'Deutsch']].map(([v, n]) =>
+                                    `<option value="${v}" ${(d.locale || 'uk') === v ? 'selected' : ''}>${n}</option>`).join('')}
+                            </select>
+                            <select class="form-input" id="tplKind_${d.id}" onchange="loadTemplate('${d.id}')">
+                                <option value="down">Світло зникло</option>
+                                <option value="up">Світло з'явилось</option>
+                                <option value="unstable">Нестабільне живлення</option>
+                                <option value="stable">Живлення стабілізувалось</option>
+                            </select>
+                        </div>
+                        <textarea class="form-input template-input" id="tpl_${d.id}" rows="4" placeholder="Стандартний шаблон"></textarea>
+                        <div class="template-hint">{{.Device}} {{.Channel}} {{.Time}} {{.Date}} {{.Duration}} {{.ExpectedReturn}}</div>
+                        <pre class="template-preview" id="tplPreview_${d.id}"></pre>
+                        <div class="form-row">
+                            <button class="btn-save btn-secondary" onclick="previewTemplate('${d.id}')">Перевірити</button>
+                            <button class="btn-save" onclick="saveTemplates('${d.id}')">Зберегти</button>
+                        </div>
+                        <div class="settings-title" style="margin-top:16px">Ключ пристрою (MQTT)</div>
+                        <div class="form-row">
+                            <input type="text" class="form-input device-key" value="${d.device_key || ''}" readonly onclick="this.select()">
+                            <button class="btn-save btn-secondary" onclick="regenerateKey('${d.id}')">Новий ключ</button>
+                        </div>
                     </div>
                 `;
             }
@@ -145,10 +252,12 @@
                             ${statusText}
                         </div>
                     </div>
+                    ${renderChannels(d)}
                     <div class="device-actions">
                         <a href="/history?device=${d.id}" class="device-action">📊 Історія</a>
                         ${isOwned ? `<button class="device-action" onclick="toggleSettings('${d.id}')">⚙️ Налаштування</button>` : ''}
                         ${isOwned ? `<button class="device-action" onclick="deleteDevice('${d.id}')">🗑️ Видалити</button>` : ''}
+                        ${!isOwned ? `<button class="device-action" onclick="openNotifyModal('${d.id}')">🔔 Сповіщення</button>` : ''}
                         ${!isOwned ? `<button class="device-action" onclick="unsubscribe('${d.id}')">✕ Відписатись</button>` : ''}
                     </div>
                     ${settingsHtml}
@@ -156,6 +265,18 @@
             `;
         }
 
+        function renderChannels(d) {
+            const names = Object.keys(d.channels || {}).sort();
+            if (names.length === 0) return '';
+            const chips = names.map(name => {
+                const ch = d.channels[name];
+                return `<a href="/history?device=${d.id}&channel=${encodeURIComponent(name)}" class="channel-chip ${ch.status}">
+                    <span class="status-dot"></span>${esc(name)}
+                </a>`;
+            }).join('');
+            return `<div class="device-channels">${chips}</div>`;
+        }
+
         function esc(s) {
             if (!s) return '';
             return s.replace(/&/g,'&amp;').replace(/</g,'&lt;').replace(/>/g,'&gt;').replace(/"/g,'&quot;');
@@ -222,6 +343,18 @@
             } catch (e) { alert("Помилка"); }
         }
 
+        async function toggleBotCommands(id, enabled) {
+            try {
+                const res = await fetch("/api/my-devices/" + id, {
+                    method: "PUT",
+                    headers: {"Content-Type": "application/json"},
+                    body: JSON.stringify({bot_commands: enabled})
+                });
+                if (res.ok) loadDevices();
+                else alert("Помилка");
+            } catch (e) { alert("Помилка"); }
+        }
+
         function updateTimeoutLabel(id, val) {
             document.getElementById('timeoutVal_' + id).textContent = val + 'с';
         }
@@ -237,6 +370,266 @@
             } catch (e) { alert('Помилка'); }
         }
 
+        let publicPages = [];
+        let ownedDevices = [];
+
+        function openPublicPageModal() {
+            document.getElementById('publicDevices').innerHTML = ownedDevices.map(d => `
+                <label class="checkbox-row"><input type="checkbox" value="${d.id}"> ${esc(d.name)}</label>
+            `).join('');
+            document.getElementById('publicPageModal').classList.add('open');
+            document.getElementById('publicSlug').focus();
+        }
+
+        function closePublicPageModal() {
+            document.getElementById('publicPageModal').classList.remove('open');
+            document.getElementById('publicSlug').value = '';
+            document.getElementById('publicTitle').value = '';
+        }
+
+        async function savePublicPage() {
+            const deviceIds = [...document.querySelectorAll('#publicDevices input:checked')].map(el => el.value);
+            const res = await fetch('/api/public-pages', {
+                method: 'POST',
+                headers: {'Content-Type': 'application/json'},
+                body: JSON.stringify({
+                    slug: document.getElementById('publicSlug').value.trim(),
+                    title: document.getElementById('publicTitle').value.trim(),
+                    device_ids: deviceIds,
+                    hide_times: document.getElementById('publicHideTimes').checked,
+                    hide_name: document.getElementById('publicHideName').checked
+                })
+            });
+            if (res.ok) {
+                closePublicPageModal();
+                loadDevices();
+            } else {
+                alert(await res.text() || 'Помилка');
+            }
+        }
+
+        function showEmbedCode(deviceId) {
+            const base = window.location.origin;
+            prompt('Бейдж (Markdown) або віджет (iframe):',
+                `![power](${base}/badge/${deviceId}.svg)  <iframe src="${base}/widget/${deviceId}?theme=light" width="260" height="72" frameborder="0"></iframe>`);
+        }
+
+        async function deletePublicPage(slug) {
+            if (!confirm('Видалити публічну сторінку /s/' + slug + '?')) return;
+            const res = await fetch('/api/public-pages/' + slug, {method: 'DELETE'});
+            if (res.ok) loadDevices();
+            else alert('Помилка видалення');
+        }
+
+        function timezoneOptions(current) {
+            let zones = ['Europe/Kyiv', 'Europe/Warsaw', 'Europe/Berlin', 'Europe/London', 'America/New_York'];
+            if (Intl.supportedValuesOf) zones = Intl.supportedValuesOf('timeZone');
+            if (current && !zones.includes(current)) zones = [current, ...zones];
+            return zones.map(z => `<option value="${z}" ${z === current ? 'selected' : ''}>${z}</option>`).join('');
+        }
+
+        async function saveDigest(id) {
+            try {
+                const res = await fetch('/api/my-devices/' + id, {
+                    method: 'PUT',
+                    headers: {'Content-Type': 'application/json'},
+                    body: JSON.stringify({
+                        digest_frequency: document.getElementById('digestFreq_' + id).value,
+                        digest_time: document.getElementById('digestTime_' + id).value,
+                        timezone: document.getElementById('tz_' + id).value
+                    })
+                });
+                if (res.ok) loadDevices();
+                else alert('Помилка: ' + await res.text());
+            } catch (e) { alert('Помилка'); }
+        }
+
+        async function saveAntiSpam(id) {
+            const minutes = name => (parseInt(document.getElementById(name + '_' + id).value) || 0) * 60;
+            try {
+                const res = await fetch('/api/my-devices/' + id, {
+                    method: 'PUT',
+                    headers: {'Content-Type': 'application/json'},
+                    body: JSON.stringify({
+                        min_outage: minutes('minOutage'),
+                        min_stable_up: minutes('minStableUp'),
+                        flap_threshold: parseInt(document.getElementById('flapThreshold_' + id).value) || 0,
+                        flap_window: minutes('flapWindow')
+                    })
+                });
+                if (res.ok) loadDevices();
+                else alert('Помилка: ' + await res.text());
+            } catch (e) { alert('Помилка'); }
+        }
+
+        async function saveQuietHours(id) {
+            try {
+                const res = await fetch('/api/my-devices/' + id, {
+                    method: 'PUT',
+                    headers: {'Content-Type': 'application/json'},
+                    body: JSON.stringify({
+                        quiet_start: document.getElementById('quietStart_' + id).value,
+                        quiet_end: document.getElementById('quietEnd_' + id).value,
+                        quiet_mode: document.getElementById('quietMode_' + id).value
+                    })
+                });
+                if (res.ok) loadDevices();
+                else alert('Помилка: ' + await res.text());
+            } catch (e) { alert('Помилка'); }
+        }
+
+        async function regenerateKey(id) {
+            if (!confirm('Старий ключ перестане працювати. Продовжити?')) return;
+            try {
+                const res = await fetch('/api/my-devices/' + id, {
+                    method: 'PUT',
+                    headers: {'Content-Type': 'application/json'},
+                    body: JSON.stringify({regenerate_key: true})
+                });
+                if (res.ok) loadDevices();
+                else alert('Помилка: ' + await res.text());
+            } catch (e) { alert('Помилка'); }
+        }
+
+        // Unsaved template edits per device, keyed by message kind
+        const templateDrafts = {};
+
+        function loadTemplate(id) {
+            const d = ownedDevices.find(x => x.id === id);
+            const drafts = templateDrafts[id] || (templateDrafts[id] = Object.assign({}, d && d.templates));
+            const input = document.getElementById('tpl_' + id);
+            if (input.dataset.kind) drafts[input.dataset.kind] = input.value;
+            const kind = document.getElementById('tplKind_' + id).value;
+            input.dataset.kind = kind;
+            input.value = drafts[kind] || '';
+            document.getElementById('tplPreview_' + id).textContent = '';
+        }
+
+        async function previewTemplate(id) {
+            const out = document.getElementById('tplPreview_' + id);
+            try {
+                const res = await fetch('/api/templates/preview', {
+                    method: 'POST',
+                    headers: {'Content-Type': 'application/json'},
+                    body: JSON.stringify({
+                        locale: document.getElementById('locale_' + id).value,
+                        kind: document.getElementById('tplKind_' + id).value,
+                        template: document.getElementById('tpl_' + id).value
+                    })
+                });
+                const data = await res.json();
+                out.classList.toggle('error', !res.ok);
+                out.textContent = res.ok ? data.text : data.error;
+            } catch (e) { out.textContent = 'Помилка'; }
+        }
+
+        async function saveTemplates(id) {
+            loadTemplate(id);
+            try {
+                const res = await fetch('/api/my-devices/' + id, {
+                    method: 'PUT',
+                    headers: {'Content-Type': 'application/json'},
+                    body: JSON.stringify({
+                        locale: document.getElementById('locale_' + id).value,
+                        templates: templateDrafts[id]
+                    })
+                });
+                if (res.ok) { delete templateDrafts[id]; loadDevices(); }
+                else alert('Помилка: ' + await res.text());
+            } catch (e) { alert('Помилка'); }
+        }
+
+        const channelNames = {telegram: 'Telegram', email: 'Email', webpush: 'Push у браузері'};
+        const eventNames = {down: 'Зникло', up: "З'явилось", digest: 'Підсумок'};
+        let notifyDeviceId = null;
+
+        async function openNotifyModal(id) {
+            notifyDeviceId = id;
+            const res = await fetch('/api/notification-prefs');
+            if (!res.ok) { alert('Помилка'); return; }
+            const data = await res.json();
+            const prefs = data.prefs[id] || {};
+            const quiet = (data.quiet || {})[id] || {};
+            const channels = data.channels || [];
+            let html = channels.length ? '' : '<div class="modal-desc">Сповіщення для підписників ще не налаштовані на сервері</div>';
+            channels.forEach(ch => {
+                const chosen = prefs[ch] || [];
+                const q = quiet[ch] || {};
+                html += `<div class="notify-channel" data-channel="${ch}">
+                    <div class="form-label">${channelNames[ch] || ch}
+                        ${ch === 'telegram' && !data.telegram_linked ? `<button class="btn-link" onclick="linkTelegram()">Підключити</button>` : ''}
+                    </div>
+                    ${data.events.map(e => `<label class="checkbox-row"><input type="checkbox" value="${e}" ${chosen.includes(e) ? 'checked' : ''}> ${eventNames[e] || e}</label>`).join('')}
+                    <div class="modal-desc">Тихі години (порожньо — як у пристрою)</div>
+                    <div class="form-row">
+                        <input type="time" class="form-input" data-quiet="start" value="${q.start || ''}">
+                        <input type="time" class="form-input" data-quiet="end" value="${q.end || ''}">
+                        <select class="form-input" data-quiet="mode">
+                            <option value="silent" ${q.mode !== 'hold' ? 'selected' : ''}>Без звуку</option>
+                            <option value="hold" ${q.mode === 'hold' ? 'selected' : ''}>Надіслати підсумок пізніше</option>
+                        </select>
+                    </div>
+                </div>`;
+            });
+            document.getElementById('notifyChannels').innerHTML = html;
+            document.getElementById('notifyModal').classList.add('open');
+        }
+
+        function closeNotifyModal() {
+            document.getElementById('notifyModal').classList.remove('open');
+        }
+
+        async function linkTelegram() {
+            const res = await fetch('/api/telegram/link', {method: 'POST'});
+            if (!res.ok) { alert(await res.text() || 'Помилка'); return; }
+            const data = await res.json();
+            window.open(data.url, '_blank');
+        }
+
+        // Registers the service worker and sends this browser's push subscription to the server
+        async function ensurePushSubscription() {
+            if (!('serviceWorker' in navigator) || !('PushManager' in window)) {
+                throw new Error('Браузер не підтримує push-сповіщення');
+            }
+            if (await Notification.requestPermission() !== 'granted') {
+                throw new Error('Дозвольте сповіщення в налаштуваннях браузера');
+            }
+            const reg = await navigator.serviceWorker.register('/sw.js');
+            let sub = await reg.pushManager.getSubscription();
+            if (!sub) {
+                const {public_key} = await (await fetch('/api/push/key')).json();
+                const raw = atob(public_key.replace(/-/g, '+').replace(/_/g, '/'));
+                const key = Uint8Array.from(raw, c => c.charCodeAt(0));
+                sub = await reg.pushManager.subscribe({userVisibleOnly: true, applicationServerKey: key});
+            }
+            const res = await fetch('/api/push/subscribe', {
+                method: 'POST',
+                headers: {'Content-Type': 'application/json'},
+                body: JSON.stringify(sub)
+            });
+            if (!res.ok) throw new Error(await res.text());
+        }
+
+        async function saveNotifyPrefs() {
+            for (const el of document.querySelectorAll('#notifyChannels .notify-channel')) {
+                const events = [...el.querySelectorAll('input:checked')].map(i => i.value);
+                const quiet = k => el.querySelector(`[data-quiet="${k}"]`).value;
+                if (el.dataset.channel === 'webpush' && events.length) {
+                    try { await ensurePushSubscription(); } catch (e) { alert(e.message); return; }
+                }
+                const res = await fetch('/api/notification-prefs', {
+                    method: 'PUT',
+                    headers: {'Content-Type': 'application/json'},
+                    body: JSON.stringify({
+                        device_id: notifyDeviceId, channel: el.dataset.channel, events,
+                        quiet_start: quiet('start'), quiet_end: quiet('end'), quiet_mode: quiet('mode')
+                    })
+                });
+                if (!res.ok) { alert(await res.text() || 'Помилка'); return; }
+            }
+            closeNotifyModal();
+        }
+
         function openSubscribeModal() {
             document.getElementById('subscribeModal').classList.add('open');
             document.getElementById('subscribeId').focus();
@@ -322,6 +715,27 @@
             document.getElementById('tgStep3Ind').className = 'tg-step' + (step >= 3 ? ' active' : '') + (step > 3 ? ' done' : '');
         }
 
+        // The server asks Telegram, or answers itself for a bot it already polls
+        async function findBotChats(token) {
+            const res = await fetch('/api/telegram/chats', {
+                method: 'POST',
+                headers: {'Content-Type': 'application/json'},
+                body: JSON.stringify({token: token})
+            });
+            if (!res.ok) throw new Error((await res.text()) || 'Помилка');
+            const data = await res.json();
+            const chats = new Map();
+            for (const chat of data.chats) {
+                chats.set(chat.id, {
+                    id: chat.id,
+                    title: chat.title || chat.first_name || chat.username || 'Chat',
+                    type: chat.type,
+                    username: chat.username
+                });
+            }
+            return chats;
+        }
+
         function setTgStatus(el, msg, type) {
             el.textContent = msg;
             el.className = 'tg-status ' + type;
@@ -382,26 +796,7 @@
             chatList.innerHTML = '<div class="tg-chat-empty">Шукаємо чати...</div>';
 
             try {
-                const res = await fetch(`https://api.telegram.org/bot${tgBotToken}/getUpdates?timeout=1`);
-                const data = await res.json();
-
-                if (!data.ok) throw new Error(data.description || 'Помилка');
-
-                const chats = new Map();
-                for (const update of data.result) {
-                    const msg = update.message || update.channel_post || update.my_chat_member?.chat;
-                    if (msg && msg.chat) {
-                        const chat = msg.chat;
-                        if (!chats.has(chat.id)) {
-                            chats.set(chat.id, {
-                                id: chat.id,
-                                title: chat.title || chat.first_name || chat.username || 'Chat',
-                                type: chat.type,
-                                username: chat.username
-                            });
-                        }
-                    }
-                }
+                const chats = await findBotChats(tgBotToken);
 
                 if (chats.size === 0) {
                     chatList.innerHTML = '<div class="tg-chat-empty">Чати не знайдено.<br>Додайте бота в групу та напишіть повідомлення.</div>';
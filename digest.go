@@ -0,0 +1,201 @@
+package main
+
+import (
+	"log/slog"
+	"strings"
+	"time"
+)
+
+const (
+	defaultDigestTime = "08:00"
+	digestLateLimit   = 3 * time.Hour // don't send a stale digest after long server downtime
+)
+
+// digestJob is a digest due for one device; the owner's chat gets it only if the owner
+// turned digests on, subscribers who chose "digest" always do.
+type digestJob struct {
+	config    *DeviceConfig
+	owner     bool
+	scheduled time.Time
+}
+
+// digestScheduler sends the daily/weekly summaries at each device's local digest time.
+// Devices without an owner digest setting still send a daily digest to subscribers.
+// A digest counts as sent once it reached the owner's chat, until then it is retried
+// every minute within digestLateLimit; subscribers get each one only once.
+func digestScheduler() {
+	notified := make(map[string]time.Time) // device -> scheduled time subscribers were sent
+	for {
+		time.Sleep(time.Minute)
+		now := time.Now()
+		for _, job := range dueDigests(now) {
+			d := job.config
+			if !notified[d.ID].Equal(job.scheduled) {
+				if !notifyDigest(d, now) {
+					continue
+				}
+				notified[d.ID] = job.scheduled
+			}
+			if job.owner && !sendDigest(d, now) {
+				continue
+			}
+			mu.Lock()
+			if live := devices[d.ID]; live != nil {
+				live.DigestSentAt = now
+				saveDevice(live)
+			}
+			mu.Unlock()
+		}
+	}
+}
+
+// dueDigests lists the digests whose time has come and that haven't been sent yet.
+func dueDigests(now time.Time) []digestJob {
+	wanted := devicesWithDigestSubscribers()
+
+	var due []digestJob
+	mu.Lock()
+	defer mu.Unlock()
+	for _, d := range devices {
+		owner := d.Configured && d.DigestFrequency != ""
+		if d.Paused || (!owner && !wanted[d.ID]) {
+			continue
+		}
+		snapshot := *d
+		if snapshot.DigestFrequency == "" {
+			snapshot.DigestFrequency = "daily"
+		}
+		scheduled, ok := digestSchedule(&snapshot, now)
+		if ok && !now.Before(scheduled) && now.Sub(scheduled) < digestLateLimit && d.DigestSentAt.Before(scheduled) {
+			due = append(due, digestJob{config: &snapshot, owner: owner, scheduled: scheduled})
+		}
+	}
+	return due
+}
+
+func devicesWithDigestSubscribers() map[string]bool {
+	wanted := make(map[string]bool)
+	ids, err := storage.DigestDevices()
+	if err != nil {
+		slog.Error("Failed to load digest subscribers", "err", err)
+		noteError("db", err)
+	}
+	for _, id := range ids {
+		wanted[id] = true
+	}
+	return wanted
+}
+
+// digestSchedule returns the digest time of the current day (or week, for weekly
+// digests sent on Mondays) in the device timezone.
+func digestSchedule(d *DeviceConfig, now time.Time) (time.Time, bool) {
+	loc := deviceLocation(d)
+	local := now.In(loc)
+	if d.DigestFrequency == "weekly" && local.Weekday() != time.Monday {
+		return time.Time{}, false
+	}
+	at := d.DigestTime
+	if at == "" {
+		at = defaultDigestTime
+	}
+	t, err := time.Parse("15:04", at)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Date(local.Year(), local.Month(), local.Day(), t.Hour(), t.Minute(), 0, 0, loc), true
+}
+
+// digestPeriod is the reporting window and the window it is compared with:
+// yesterday vs the 7 days before it, or last week vs the week before.
+func digestPeriod(d *DeviceConfig, now time.Time) (from, to, prevFrom time.Time) {
+	today := bucketStart(now, "day", deviceLocation(d))
+	if d.DigestFrequency == "weekly" {
+		to = bucketStart(now, "week", deviceLocation(d))
+		from = to.AddDate(0, 0, -7)
+		return from, to, from.AddDate(0, 0, -7)
+	}
+	from = today.AddDate(0, 0, -1)
+	return from, today, from.AddDate(0, 0, -7)
+}
+
+func buildDigest(d *DeviceConfig, now time.Time) (string, error) {
+	from, to, prevFrom := digestPeriod(d, now)
+	current, err := loadIntervals(d.ID, "", from, to)
+	if err != nil {
+		return "", err
+	}
+	previous, err := loadIntervals(d.ID, "", prevFrom, from)
+	if err != nil {
+		return "", err
+	}
+	cur := summarize(current)
+	prev := summarize(previous)
+
+	l := localeFor(d.Locale)
+	lines := []string{l.text("digest_daily", d.Name, from.Format("02.01"))}
+	if d.DigestFrequency == "weekly" {
+		lines[0] = l.text("digest_weekly", d.Name, from.Format("02.01"), to.AddDate(0, 0, -1).Format("02.01"))
+	}
+	if len(cur.Outages) == 0 {
+		lines = append(lines, l.text("digest_no_outages"))
+	} else {
+		lines = append(lines,
+			l.text("digest_outages", len(cur.Outages)),
+			l.text("digest_downtime", l.duration(cur.Downtime)),
+			l.text("digest_longest", l.duration(cur.Longest)))
+	}
+
+	// Daily digests compare with the average day of the previous week
+	baseline := prev.Downtime
+	than := "week"
+	if d.DigestFrequency != "weekly" {
+		baseline /= 7
+		than = "day"
+	}
+	if prev.Uptime+prev.Downtime > 0 {
+		switch diff := cur.Downtime - baseline; {
+		case diff > time.Minute:
+			lines = append(lines, l.text("digest_more_"+than, l.duration(diff)))
+		case diff < -time.Minute:
+			lines = append(lines, l.text("digest_less_"+than, l.duration(-diff)))
+		default:
+			lines = append(lines, l.text("digest_same_"+than))
+		}
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// notifyDigest queues the digest for the subscribers who want it.
+func notifyDigest(d *DeviceConfig, now time.Time) bool {
+	text, err := buildDigest(d, now)
+	if err != nil {
+		slog.Error("Digest failed", "device_id", d.ID, "err", err)
+		noteError("digest", err)
+		return false
+	}
+	notifySubscribers(d, "digest", text)
+	return true
+}
+
+// sendDigest sends the digest to the owner's chat, with the week's chart for weekly ones.
+func sendDigest(d *DeviceConfig, now time.Time) bool {
+	text, err := buildDigest(d, now)
+	if err != nil {
+		slog.Error("Digest failed", "device_id", d.ID, "err", err)
+		noteError("digest", err)
+		return false
+	}
+	slog.Info("Sending digest", "device_id", d.ID, "frequency", d.DigestFrequency)
+	if d.DigestFrequency == "weekly" {
+		if chart, err := renderOutageChart(d, "", 7); err == nil {
+			if sendTelegramPhoto(d.BotToken, d.ChatID, text, chart, false) != 0 {
+				return true
+			}
+		}
+	}
+	if sendTelegram(d.BotToken, d.ChatID, text) == 0 {
+		slog.Error("Digest not delivered", "device_id", d.ID)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"power-monitor/store"
+)
+
+func TestDigestSchedule(t *testing.T) {
+	kyiv, _ := time.LoadLocation("Europe/Kyiv")
+	ny, _ := time.LoadLocation("America/New_York")
+	tests := []struct {
+		name      string
+		frequency string
+		tz        string
+		at        string
+		now       time.Time
+		want      time.Time // zero = no digest that day
+	}{
+		{"daily, default time", "daily", "Europe/Kyiv", "", time.Date(2024, 6, 5, 12, 0, 0, 0, time.UTC),
+			time.Date(2024, 6, 5, 8, 0, 0, 0, kyiv)},
+		{"day of the device, not of the server", "daily", "America/New_York", "07:30", time.Date(2024, 6, 5, 2, 0, 0, 0, time.UTC),
+			time.Date(2024, 6, 4, 7, 30, 0, 0, ny)},
+		{"weekly on Monday", "weekly", "Europe/Kyiv", "09:00", time.Date(2024, 6, 3, 5, 0, 0, 0, time.UTC),
+			time.Date(2024, 6, 3, 9, 0, 0, 0, kyiv)},
+		{"weekly, not on Tuesday", "weekly", "Europe/Kyiv", "09:00", time.Date(2024, 6, 4, 5, 0, 0, 0, time.UTC),
+			time.Time{}},
+		// Already Monday in Kyiv while still Sunday in UTC
+		{"weekly, Monday in the device timezone", "weekly", "Europe/Kyiv", "00:30", time.Date(2024, 6, 2, 22, 0, 0, 0, time.UTC),
+			time.Date(2024, 6, 3, 0, 30, 0, 0, kyiv)},
+		{"spring forward keeps the local time", "daily", "Europe/Kyiv", "08:00", time.Date(2024, 3, 31, 12, 0, 0, 0, time.UTC),
+			time.Date(2024, 3, 31, 5, 0, 0, 0, time.UTC)},
+		{"fall back keeps the local time", "daily", "Europe/Kyiv", "08:00", time.Date(2024, 10, 27, 12, 0, 0, 0, time.UTC),
+			time.Date(2024, 10, 27, 6, 0, 0, 0, time.UTC)},
+		{"a time skipped by DST still runs that day", "daily", "Europe/Kyiv", "03:30", time.Date(2024, 3, 31, 12, 0, 0, 0, time.UTC),
+			time.Date(2024, 3, 31, 1, 30, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		d := &DeviceConfig{Device: store.Device{ID: "home", Timezone: tt.tz, DigestFrequency: tt.frequency, DigestTime: tt.at}}
+		got, ok := digestSchedule(d, tt.now)
+		if ok != !tt.want.IsZero() || !got.Equal(tt.want) {
+			t.Errorf("%s: got %v %v, want %v", tt.name, got, ok, tt.want)
+		}
+	}
+}
+
+func TestDigestPeriod(t *testing.T) {
+	kyiv, _ := time.LoadLocation("Europe/Kyiv")
+	day := func(y int, m time.Month, d int) time.Time { return time.Date(y, m, d, 0, 0, 0, 0, kyiv) }
+	tests := []struct {
+		name               string
+		frequency          string
+		now                time.Time
+		from, to, prevFrom time.Time
+		length             time.Duration
+	}{
+		{"daily", "daily", time.Date(2024, 6, 5, 8, 0, 0, 0, kyiv),
+			day(2024, 6, 4), day(2024, 6, 5), day(2024, 5, 28), 24 * time.Hour},
+		{"daily over spring forward", "daily", time.Date(2024, 4, 1, 8, 0, 0, 0, kyiv),
+			day(2024, 3, 31), day(2024, 4, 1), day(2024, 3, 24), 23 * time.Hour},
+		{"daily over fall back", "daily", time.Date(2024, 10, 28, 8, 0, 0, 0, kyiv),
+			day(2024, 10, 27), day(2024, 10, 28), day(2024, 10, 20), 25 * time.Hour},
+		{"weekly", "weekly", time.Date(2024, 6, 3, 9, 0, 0, 0, kyiv),
+			day(2024, 5, 27), day(2024, 6, 3), day(2024, 5, 20), 7 * 24 * time.Hour},
+		{"weekly over fall back", "weekly", time.Date(2024, 10, 28, 9, 0, 0, 0, kyiv),
+			day(2024, 10, 21), day(2024, 10, 28), day(2024, 10, 14), 7*24*time.Hour + time.Hour},
+	}
+	for _, tt := range tests {
+		d := &DeviceConfig{Device: store.Device{ID: "home", Timezone: "Europe/Kyiv", DigestFrequency: tt.frequency}}
+		from, to, prevFrom := digestPeriod(d, tt.now)
+		if !from.Equal(tt.from) || !to.Equal(tt.to) || !prevFrom.Equal(tt.prevFrom) || to.Sub(from) != tt.length {
+			t.Errorf("%s: %v – %v (previous from %v), want %v – %v (%v)", tt.name, from, to, prevFrom, tt.from, tt.to, tt.prevFrom)
+		}
+	}
+}
+
+func TestDigestComparison(t *testing.T) {
+	if err := initDB(filepath.Join(t.TempDir(), "test.db")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	kyiv, _ := time.LoadLocation("Europe/Kyiv")
+	at := func(day, hour int) time.Time { return time.Date(2024, 6, day, hour, 0, 0, 0, kyiv) }
+
+	// An hour without power every day of the week before, then yesterday (the 11th) as given
+	outage := func(id string, day, hour, hours int) {
+		saveEvent(id, "", "down", at(day, hour), 0, false)
+		saveEvent(id, "", "up", at(day, hour+hours), 0, false)
+	}
+	for _, id := range []string{"more", "less", "same"} {
+		saveEvent(id, "", "up", at(1, 0), 0, false)
+		for day := 4; day <= 10; day++ {
+			outage(id, day, 12, 1)
+		}
+	}
+	outage("more", 11, 10, 3)
+	outage("same", 11, 10, 1)
+
+	tests := map[string]string{
+		"more": "📈",
+		"less": "📉",
+		"same": "➖",
+	}
+	for id, want := range tests {
+		d := &DeviceConfig{Device: store.Device{ID: id, Name: id, Timezone: "Europe/Kyiv", DigestFrequency: "daily"}}
+		text, err := buildDigest(d, at(12, 8))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(text, want) {
+			t.Errorf("%s: digest %q, want %s", id, text, want)
+		}
+	}
+
+	weekly := &DeviceConfig{Device: store.Device{ID: "more", Name: "more", Timezone: "Europe/Kyiv", DigestFrequency: "weekly"}}
+	text, err := buildDigest(weekly, at(17, 9)) // Monday
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Last week (10–16) had 2 outages against 6 the week before
+	if !strings.Contains(text, "10.06–16.06") || !strings.Contains(text, ": 2\n") || !strings.Contains(text, "📉") {
+		t.Errorf("weekly digest %q", text)
+	}
+}
+
+func TestDueDigests(t *testing.T) {
+	if err := initDB(filepath.Join(t.TempDir(), "test.db")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	kyiv, _ := time.LoadLocation("Europe/Kyiv")
+	d := &DeviceConfig{Device: store.Device{ID: "home", Name: "home", BotToken: "t", ChatID: "c",
+		Timezone: "Europe/Kyiv", DigestFrequency: "daily", DigestTime: "08:00"}, Configured: true}
+	devices["home"] = d
+	t.Cleanup(func() { delete(devices, "home") })
+
+	now := time.Date(2024, 6, 5, 8, 1, 0, 0, kyiv)
+	if due := dueDigests(now); len(due) != 1 || !due[0].owner || !due[0].scheduled.Equal(now.Add(-time.Minute)) {
+		t.Fatalf("due = %+v, want the owner's digest", due)
+	}
+	// Until it was sent it stays due, within the late limit
+	if due := dueDigests(now.Add(time.Hour)); len(due) != 1 {
+		t.Errorf("unsent digest an hour later: due = %+v", due)
+	}
+	if due := dueDigests(now.Add(digestLateLimit)); len(due) != 0 {
+		t.Errorf("stale digest: due = %+v", due)
+	}
+	d.DigestSentAt = now.Add(time.Minute)
+	if due := dueDigests(now.Add(time.Hour)); len(due) != 0 {
+		t.Errorf("sent digest: due = %+v", due)
+	}
+}
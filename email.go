@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/textproto"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// SMTP settings for email notifications, from SMTP_HOST, SMTP_PORT (default 587),
+// SMTP_USERNAME, SMTP_PASSWORD and SMTP_FROM.
+var (
+	smtpHost     string
+	smtpPort     string
+	smtpUsername string
+	smtpPassword string
+	smtpFrom     string
+
+	publicURL         string // base for links in emails
+	unsubscribeSecret []byte // UNSUBSCRIBE_SECRET, or generated once and kept in the DB
+)
+
+// smtpTLSConfig is used for STARTTLS; tests swap it to trust their own certificate.
+var smtpTLSConfig = func(host string) *tls.Config {
+	return &tls.Config{ServerName: host}
+}
+
+func setupEmail() {
+	smtpHost = os.Getenv("SMTP_HOST")
+	smtpPort = os.Getenv("SMTP_PORT")
+	if smtpPort == "" {
+		smtpPort = "587"
+	}
+	smtpUsername = os.Getenv("SMTP_USERNAME")
+	smtpPassword = os.Getenv("SMTP_PASSWORD")
+	smtpFrom = os.Getenv("SMTP_FROM")
+
+	publicURL = strings.TrimRight(os.Getenv("PUBLIC_URL"), "/")
+	if publicURL == "" {
+		publicURL = "https://power-monitor.club"
+	}
+	unsubscribeSecret = []byte(os.Getenv("UNSUBSCRIBE_SECRET"))
+	if len(unsubscribeSecret) == 0 {
+		// Generated once and kept in the database, so links in sent emails keep working
+		// after a restart
+		random := make([]byte, 32)
+		rand.Read(random)
+		secret, err := storage.Secret("unsubscribe", hex.EncodeToString(random))
+		if err != nil {
+			slog.Error("Failed to load the unsubscribe secret, email delivery disabled", "err", err)
+			noteError("db", err)
+			return
+		}
+		unsubscribeSecret = []byte(secret)
+	}
+
+	if smtpHost != "" && smtpFrom != "" {
+		deliverers["email"] = deliverEmail
+	}
+}
+
+func deliverEmail(n notification) error {
+	msg, err := buildEmail(n)
+	if err != nil {
+		return err
+	}
+	return sendMail(n.Email, msg)
+}
+
+// sendMail delivers one message over SMTP, upgrading to TLS with STARTTLS. Only a
+// server on localhost may be used without it.
+func sendMail(to string, msg []byte) error {
+	c, err := smtp.Dial(net.JoinHostPort(smtpHost, smtpPort))
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if err := c.Hello("localhost"); err != nil {
+		return err
+	}
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(smtpTLSConfig(smtpHost)); err != nil {
+			return fmt.Errorf("starttls: %v", err)
+		}
+	} else if smtpHost != "localhost" && smtpHost != "127.0.0.1" {
+		return fmt.Errorf("%s does not support STARTTLS", smtpHost)
+	}
+	if smtpUsername != "" {
+		if err := c.Auth(smtp.PlainAuth("", smtpUsername, smtpPassword, smtpHost)); err != nil {
+			return fmt.Errorf("auth: %v", err)
+		}
+	}
+	if err := c.Mail(smtpFrom); err != nil {
+		return err
+	}
+	if err := c.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// buildEmail renders a multipart/alternative message with plain text and HTML versions
+// and RFC 8058 one-click unsubscribe headers.
+func buildEmail(n notification) ([]byte, error) {
+	unsubscribe := unsubscribeURL(n.Email, n.DeviceID)
+	history := publicURL + "/history?device=" + url.QueryEscape(n.DeviceID)
+	l := localeFor(n.Locale)
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+
+	plain := n.Text + "\n\n" + history + "\n\n" + l.text("email_unsubscribe_link", unsubscribe) + "\n"
+	if err := writeQuotedPart(mw, "text/plain; charset=utf-8", []byte(plain)); err != nil {
+		return nil, err
+	}
+	var html bytes.Buffer
+	err := emailTemplate.Execute(&html, map[string]interface{}{
+		"Lang":            localeName(n.Locale),
+		"Subject":         n.Subject,
+		"Lines":           strings.Split(n.Text, "\n"),
+		"History":         history,
+		"HistoryText":     l.text("email_history"),
+		"Unsubscribe":     unsubscribe,
+		"UnsubscribeText": l.text("email_unsubscribe"),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := writeQuotedPart(mw, "text/html; charset=utf-8", html.Bytes()); err != nil {
+		return nil, err
+	}
+	mw.Close()
+
+	var msg bytes.Buffer
+	header := func(k, v string) { fmt.Fprintf(&msg, "%s: %s\r\n", k, v) }
+	header("From", smtpFrom)
+	header("To", n.Email)
+	header("Subject", mime.QEncoding.Encode("utf-8", n.Subject))
+	header("Date", time.Now().Format(time.RFC1123Z))
+	header("Message-ID", fmt.Sprintf("<%d.%s@%s>", time.Now().UnixNano(), messageIDToken(), smtpHost))
+	header("MIME-Version", "1.0")
+	header("Content-Type", "multipart/alternative; boundary="+mw.Boundary())
+	header("List-Unsubscribe", "<"+unsubscribe+">")
+	header("List-Unsubscribe-Post", "List-Unsubscribe=One-Click")
+	msg.WriteString("\r\n")
+	msg.Write(body.Bytes())
+	return msg.Bytes(), nil
+}
+
+// messageIDToken makes Message-IDs unique without putting anything from the device in
+// the header.
+func messageIDToken() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func writeQuotedPart(mw *multipart.Writer, contentType string, content []byte) error {
+	part, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {contentType},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	if err != nil {
+		return err
+	}
+	qp := quotedprintable.NewWriter(part)
+	if _, err := qp.Write(content); err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
+var emailTemplate = template.Must(template.New("email").Parse(`<!DOCTYPE html>
+<html lang="{{.Lang}}">
+<head><meta charset="utf-8"><title>{{.Subject}}</title></head>
+<body style="font-family: -apple-system, BlinkMacSystemFont, sans-serif; background: #f4f4f5; padding: 24px;">
+    <div style="max-width: 480px; margin: 0 auto; background: #ffffff; border-radius: 12px; padding: 24px; color: #18181b;">
+        {{range .Lines}}<p style="margin: 0 0 8px; font-size: 16px;">{{.}}</p>{{end}}
+        <p style="margin: 20px 0 0;"><a href="{{.History}}" style="color: #2563eb;">{{.HistoryText}}</a></p>
+    </div>
+    <p style="text-align: center; font-size: 12px; color: #71717a; margin-top: 16px;">
+        <a href="{{.Unsubscribe}}" style="color: #71717a;">{{.UnsubscribeText}}</a>
+    </p>
+</body>
+</html>`))
+
+func unsubscribeSignature(email, deviceID string) string {
+	mac := hmac.New(sha256.New, unsubscribeSecret)
+	mac.Write([]byte(email + "\x00" + deviceID))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func unsubscribeURL(email, deviceID string) string {
+	q := url.Values{"email": {email}, "device": {deviceID}, "sig": {unsubscribeSignature(email, deviceID)}}
+	return publicURL + "/unsubscribe?" + q.Encode()
+}
+
+// emailUnsubscribeHandler serves the signed links from emails. GET asks for confirmation
+// (mail scanners follow links), POST unsubscribes; mail clients POST directly for
+// List-Unsubscribe-Post one-click.
+func emailUnsubscribeHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	email, deviceID := q.Get("email"), q.Get("device")
+	if !hmac.Equal([]byte(q.Get("sig")), []byte(unsubscribeSignature(email, deviceID))) {
+		http.Error(w, "invalid link", 400)
+		return
+	}
+
+	mu.Lock()
+	lang := defaultLocale
+	if d := devices[deviceID]; d != nil {
+		lang = localeName(d.Locale)
+	}
+	mu.Unlock()
+	l := localeFor(lang)
+	page := map[string]interface{}{
+		"Lang":    lang,
+		"Title":   l.text("unsubscribe_title"),
+		"Confirm": l.text("unsubscribe_confirm", deviceID),
+		"Button":  l.text("unsubscribe_button"),
+		"Done":    l.text("unsubscribe_done", deviceID),
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	switch r.Method {
+	case "GET":
+		unsubscribePageTemplate.Execute(w, page)
+	case "POST":
+		storage.Unsubscribe(email, deviceID)
+		if err := storage.DeletePrefs(email, deviceID, ""); err != nil {
+			requestLog(r).Error("Failed to remove delivery preferences", "device_id", deviceID, "email", email, "err", err)
+		}
+		requestLog(r).Info("Unsubscribed by email link", "device_id", deviceID, "email", email)
+		page["Confirm"] = ""
+		unsubscribePageTemplate.Execute(w, page)
+	default:
+		http.Error(w, "method not allowed", 405)
+	}
+}
+
+var unsubscribePageTemplate = template.Must(template.New("unsubscribe").Parse(`<!DOCTYPE html>
+<html lang="{{.Lang}}">
+<head><meta charset="utf-8"><meta name="viewport" content="width=device-width, initial-scale=1"><title>{{.Title}}</title></head>
+<body style="font-family: -apple-system, BlinkMacSystemFont, sans-serif; background: #0d0d14; color: #f4f4f5; text-align: center; padding: 48px 16px;">
+    {{if .Confirm}}
+    <p>{{.Confirm}}</p>
+    <form method="POST"><button type="submit" style="padding: 10px 24px; font-size: 16px; border-radius: 8px; border: none; background: #fbbf24; cursor: pointer;">{{.Button}}</button></form>
+    {{else}}
+    <p>{{.Done}}</p>
+    {{end}}
+</body>
+</html>`))
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"net/textproto"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// smtpSink is a minimal SMTP server that offers STARTTLS and AUTH PLAIN and keeps
+// every message it receives.
+type smtpSink struct {
+	ln   net.Listener
+	tls  *tls.Config
+	mu   sync.Mutex
+	msgs []sinkMessage
+}
+
+type sinkMessage struct {
+	from, to string
+	data     []byte
+	tls      bool
+	authed   bool
+}
+
+func startSMTPSink(t *testing.T) (*smtpSink, *x509.CertPool) {
+	t.Helper()
+	// Borrow httptest's certificate, valid for 127.0.0.1
+	certSrv := httptest.NewTLSServer(http.NotFoundHandler())
+	pool := x509.NewCertPool()
+	pool.AddCert(certSrv.Certificate())
+	tlsConfig := certSrv.TLS.Clone()
+	certSrv.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &smtpSink{ln: ln, tls: tlsConfig}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s, pool
+}
+
+func (s *smtpSink) serve(conn net.Conn) {
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+	tp.PrintfLine("220 sink ready")
+	var msg sinkMessage
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.Fields(line + " ")[0])
+		switch cmd {
+		case "EHLO", "HELO":
+			if msg.tls {
+				tp.PrintfLine("250-sink\r\n250 AUTH PLAIN")
+			} else {
+				tp.PrintfLine("250-sink\r\n250-STARTTLS\r\n250 AUTH PLAIN")
+			}
+		case "STARTTLS":
+			tp.PrintfLine("220 go ahead")
+			tlsConn := tls.Server(conn, s.tls)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn = tlsConn
+			tp = textproto.NewConn(conn)
+			msg.tls = true
+		case "AUTH":
+			msg.authed = true
+			tp.PrintfLine("235 ok")
+		case "MAIL":
+			msg.from = line
+			tp.PrintfLine("250 ok")
+		case "RCPT":
+			msg.to = line
+			tp.PrintfLine("250 ok")
+		case "DATA":
+			tp.PrintfLine("354 send it")
+			data, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			msg.data = data
+			s.mu.Lock()
+			s.msgs = append(s.msgs, msg)
+			s.mu.Unlock()
+			tp.PrintfLine("250 queued")
+		case "QUIT":
+			tp.PrintfLine("221 bye")
+			return
+		default:
+			tp.PrintfLine("250 ok")
+		}
+	}
+}
+
+func setupEmailTest(t *testing.T) *smtpSink {
+	t.Helper()
+	if err := initDB(filepath.Join(t.TempDir(), "test.db")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	sink, pool := startSMTPSink(t)
+	host, port, _ := net.SplitHostPort(sink.ln.Addr().String())
+	t.Setenv("SMTP_HOST", host)
+	t.Setenv("SMTP_PORT", port)
+	t.Setenv("SMTP_USERNAME", "monitor")
+	t.Setenv("SMTP_PASSWORD", "secret")
+	t.Setenv("SMTP_FROM", "alerts@example.com")
+	t.Setenv("PUBLIC_URL", "https://power.example.com")
+	t.Setenv("UNSUBSCRIBE_SECRET", "test-secret")
+	setupEmail()
+	t.Cleanup(func() { delete(deliverers, "email") })
+
+	orig := smtpTLSConfig
+	smtpTLSConfig = func(host string) *tls.Config { return &tls.Config{ServerName: host, RootCAs: pool} }
+	t.Cleanup(func() { smtpTLSConfig = orig })
+	return sink
+}
+
+func TestDeliverEmail(t *testing.T) {
+	sink := setupEmailTest(t)
+	if deliverers["email"] == nil {
+		t.Fatal("email deliverer not registered")
+	}
+
+	err := deliverers["email"](notification{
+		Email:    "neighbour@example.com",
+		DeviceID: "home",
+		Channel:  "email",
+		Subject:  "Дім: 🔴 18:05 Світло зникло",
+		Text:     "🏠 Дім\n🔴 18:05 Світло зникло\n🕓 Воно було 3 години",
+	})
+	if err != nil {
+		t.Fatalf("deliver: %v", err)
+	}
+
+	if len(sink.msgs) != 1 {
+		t.Fatalf("sink got %d messages, want 1", len(sink.msgs))
+	}
+	got := sink.msgs[0]
+	if !got.tls || !got.authed {
+		t.Errorf("tls = %v, authed = %v; want AUTH after STARTTLS", got.tls, got.authed)
+	}
+	if !strings.Contains(got.to, "neighbour@example.com") {
+		t.Errorf("RCPT = %q", got.to)
+	}
+
+	m, err := mail.ReadMessage(strings.NewReader(string(got.data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	subject, _ := new(mime.WordDecoder).DecodeHeader(m.Header.Get("Subject"))
+	if subject != "Дім: 🔴 18:05 Світло зникло" {
+		t.Errorf("Subject = %q", subject)
+	}
+	if m.Header.Get("List-Unsubscribe-Post") != "List-Unsubscribe=One-Click" {
+		t.Error("missing List-Unsubscribe-Post")
+	}
+	unsubscribe := strings.Trim(m.Header.Get("List-Unsubscribe"), "<>")
+	if !strings.HasPrefix(unsubscribe, "https://power.example.com/unsubscribe?") {
+		t.Errorf("List-Unsubscribe = %q", unsubscribe)
+	}
+
+	mediaType, params, _ := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	if mediaType != "multipart/alternative" {
+		t.Fatalf("Content-Type = %q, want multipart/alternative", mediaType)
+	}
+	parts := make(map[string]string)
+	mr := multipart.NewReader(m.Body, params["boundary"])
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(p) // NextPart already undoes quoted-printable
+		ct, _, _ := mime.ParseMediaType(p.Header.Get("Content-Type"))
+		parts[ct] = string(body)
+	}
+	if !strings.Contains(parts["text/plain"], "Світло зникло") || !strings.Contains(parts["text/plain"], unsubscribe) {
+		t.Errorf("plain part = %q", parts["text/plain"])
+	}
+	if !strings.Contains(parts["text/html"], "<p") || !strings.Contains(parts["text/html"], "Світло зникло") {
+		t.Errorf("html part = %q", parts["text/html"])
+	}
+}
+
+func TestEmailUnsubscribeLink(t *testing.T) {
+	setupEmailTest(t)
+	db.Exec("INSERT INTO subscriptions (email, device_id) VALUES ('a@example.com', 'home'), ('a@example.com', 'dacha'), ('b@example.com', 'home')")
+	db.Exec("INSERT INTO subscriber_prefs (email, device_id, channel, events) VALUES ('a@example.com', 'home', 'email', 'down,up')")
+
+	link, _ := url.Parse(unsubscribeURL("a@example.com", "home"))
+	target := link.RequestURI()
+
+	// Following the link only asks for confirmation
+	rec := httptest.NewRecorder()
+	emailUnsubscribeHandler(rec, httptest.NewRequest("GET", target, nil))
+	if rec.Code != 200 || countRows(t, "subscriptions") != 3 {
+		t.Fatalf("GET: code %d, %d subscriptions; want 200 and nothing removed", rec.Code, countRows(t, "subscriptions"))
+	}
+
+	// A tampered link is rejected
+	rec = httptest.NewRecorder()
+	emailUnsubscribeHandler(rec, httptest.NewRequest("POST", strings.Replace(target, "a%40example.com", "b%40example.com", 1), nil))
+	if rec.Code != 400 {
+		t.Errorf("tampered link: code %d, want 400", rec.Code)
+	}
+
+	// One-click POST removes exactly that subscription
+	rec = httptest.NewRecorder()
+	emailUnsubscribeHandler(rec, httptest.NewRequest("POST", target, strings.NewReader("List-Unsubscribe=One-Click")))
+	if rec.Code != 200 {
+		t.Fatalf("POST: code %d", rec.Code)
+	}
+	if n := countRows(t, "subscriptions"); n != 2 {
+		t.Errorf("%d subscriptions left, want 2", n)
+	}
+	var n int
+	db.QueryRow("SELECT COUNT(*) FROM subscriptions WHERE email = 'a@example.com' AND device_id = 'home'").Scan(&n)
+	if n != 0 {
+		t.Error("subscription still present")
+	}
+	if n := countRows(t, "subscriber_prefs"); n != 0 {
+		t.Errorf("%d prefs left, want 0", n)
+	}
+}
+
+func countRows(t *testing.T, table string) int {
+	t.Helper()
+	var n int
+	if err := db.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestUnsubscribeSecretKept(t *testing.T) {
+	setupEmailTest(t)
+	t.Setenv("UNSUBSCRIBE_SECRET", "")
+	setupEmail()
+	link := unsubscribeURL("a@example.com", "home")
+	if strings.Contains(link, unsubscribeSignature("a@example.com", "dacha")) {
+		t.Fatal("signature does not depend on the device")
+	}
+
+	// A restart signs with the same generated secret
+	unsubscribeSecret = nil
+	setupEmail()
+	if got := unsubscribeURL("a@example.com", "home"); got != link {
+		t.Errorf("link after restart = %s, want %s", got, link)
+	}
+	if deliverers["email"] == nil {
+		t.Error("email deliverer not registered with a generated secret")
+	}
+}
+
+func TestEmailHeadersFromDeviceID(t *testing.T) {
+	setupEmailTest(t)
+	msg, err := buildEmail(notification{Email: "a@example.com", DeviceID: "home\r\nBcc: victim@example.com", Subject: "s\r\nX-Injected: 1", Text: "t"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := mail.ReadMessage(strings.NewReader(string(msg)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Header.Get("Bcc") != "" || m.Header.Get("X-Injected") != "" {
+		t.Errorf("injected headers: %v", m.Header)
+	}
+	if id := m.Header.Get("Message-ID"); strings.Contains(id, "home") {
+		t.Errorf("Message-ID = %q, want no device ID in it", id)
+	}
+}
+
+func TestPingRejectsBadDeviceID(t *testing.T) {
+	if err := initDB(filepath.Join(t.TempDir(), "test.db")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	for _, id := range []string{"home%0D%0ABcc:%20x", "tab%09", strings.Repeat("a", 65), "%FF"} {
+		rec := httptest.NewRecorder()
+		pingHandler(rec, httptest.NewRequest("GET", "/ping?device="+id, nil))
+		if rec.Code != 400 {
+			t.Errorf("%q: %d, want 400", id, rec.Code)
+		}
+	}
+	if devices, _ := storage.ListDevices(); len(devices) != 0 {
+		t.Errorf("registered %+v", devices)
+	}
+	for _, id := range []string{"esp32-a1b2c3", "Дача_2"} {
+		if !validDeviceID(id) {
+			t.Errorf("%q rejected", id)
+		}
+	}
+}
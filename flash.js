@@ -877,27 +877,25 @@ async function findChats() {
     elements.tgChatList.innerHTML = '<div class="tg-chat-empty">Шукаємо чати...</div>';
 
     try {
-        const res = await fetch(`https://api.telegram.org/bot${currentBotToken}/getUpdates?timeout=1`);
-        const data = await res.json();
-
-        if (!data.ok) {
-            throw new Error(data.description || 'Помилка отримання чатів');
+        // The server asks Telegram, or answers itself for a bot it already polls
+        const res = await fetch('/api/telegram/chats', {
+            method: 'POST',
+            headers: {'Content-Type': 'application/json'},
+            body: JSON.stringify({token: currentBotToken})
+        });
+        if (!res.ok) {
+            throw new Error((await res.text()) || 'Помилка отримання чатів');
         }
+        const data = await res.json();
 
         const chats = new Map();
-        for (const update of data.result) {
-            const msg = update.message || update.channel_post || update.my_chat_member?.chat;
-            if (msg && msg.chat) {
-                const chat = msg.chat;
-                if (!chats.has(chat.id)) {
-                    chats.set(chat.id, {
-                        id: chat.id,
-                        title: chat.title || chat.first_name || chat.username || 'Chat',
-                        type: chat.type,
-                        username: chat.username
-                    });
-                }
-            }
+        for (const chat of data.chats) {
+            chats.set(chat.id, {
+                id: chat.id,
+                title: chat.title || chat.first_name || chat.username || 'Chat',
+                type: chat.type,
+                username: chat.username
+            });
         }
 
         if (chats.size === 0) {
@@ -2,9 +2,22 @@ module power-monitor
 
 go 1.21
 
-require github.com/mattn/go-sqlite3 v1.14.33
+require (
+	github.com/SherClockHolmes/webpush-go v1.4.0
+	github.com/eclipse/paho.mqtt.golang v1.4.3
+	github.com/fergusstrange/embedded-postgres v1.34.0
+	github.com/lib/pq v1.12.3
+	github.com/mattn/go-sqlite3 v1.14.33
+	golang.org/x/image v0.18.0
+)
 
 require (
 	cloud.google.com/go/compute/metadata v0.3.0 // indirect
+	github.com/golang-jwt/jwt/v5 v5.2.1 // indirect
+	github.com/gorilla/websocket v1.5.0 // indirect
+	github.com/xi2/xz v0.0.0-20171230120015-48954b6210f8 // indirect
+	golang.org/x/crypto v0.31.0 // indirect
+	golang.org/x/net v0.25.0 // indirect
 	golang.org/x/oauth2 v0.18.0
+	golang.org/x/sync v0.10.0 // indirect
 )
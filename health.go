@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Health checks for uptime monitors and load balancers, and a diagnostics page for
+// admins. /healthz only says the process answers; /readyz checks what serving needs.
+
+const (
+	trackerInterval = 10 * time.Second
+	readyTimeout    = 2 * time.Second
+)
+
+// requiredFiles are the pages, scripts and firmware images served from disk.
+var requiredFiles = []string{
+	dashboardPage,
+	landingPage,
+	"/opt/power-monitor/history.html",
+	"/opt/power-monitor/flash.html",
+	"/opt/power-monitor/flash.css",
+	"/opt/power-monitor/flash.js",
+	"/opt/power-monitor/dashboard.css",
+	"/opt/power-monitor/dashboard.js",
+	"/opt/power-monitor/improv.js",
+	"/opt/power-monitor/manifest.json",
+	"/opt/power-monitor/esptool-bundle.js",
+	"/opt/power-monitor/firmware.bin",
+	"/opt/power-monitor/firmware_improv.bin",
+}
+
+// trackerTick is when the tracker last checked timeouts, in Unix nanoseconds.
+var trackerTick atomic.Int64
+
+// subsystemError is the latest failure of a subsystem.
+type subsystemError struct {
+	Error string    `json:"error"`
+	At    time.Time `json:"at"`
+	Count int       `json:"count"` // failures since the start
+}
+
+var (
+	lastErrorsMu sync.Mutex
+	lastErrors   = make(map[string]subsystemError)
+)
+
+// noteError remembers err as the latest error of subsystem ("db", "telegram", "mqtt",
+// ...) for /api/diagnostics. The caller still logs it.
+func noteError(subsystem string, err error) {
+	if err == nil {
+		return
+	}
+	lastErrorsMu.Lock()
+	defer lastErrorsMu.Unlock()
+	e := lastErrors[subsystem]
+	lastErrors[subsystem] = subsystemError{Error: err.Error(), At: time.Now(), Count: e.Count + 1}
+}
+
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok"))
+}
+
+// readyChecks runs the readiness checks and returns the failed ones with the reason.
+func readyChecks(ctx context.Context, now time.Time) map[string]string {
+	failed := make(map[string]string)
+	if err := db.PingContext(ctx); err != nil {
+		failed["db"] = err.Error()
+	}
+
+	// The first check is due trackerInterval after the start
+	last := time.Unix(0, trackerTick.Load())
+	if trackerTick.Load() == 0 {
+		last = serverStartedAt
+	}
+	if age := now.Sub(last); age > 3*trackerInterval {
+		failed["tracker"] = fmt.Sprintf("last check %s ago", age.Round(time.Second))
+	}
+
+	var missing []string
+	for _, path := range requiredFiles {
+		if _, err := os.Stat(path); err != nil {
+			missing = append(missing, path)
+		}
+	}
+	if len(missing) > 0 {
+		failed["files"] = fmt.Sprintf("missing %v", missing)
+	}
+	return failed
+}
+
+// readyzHandler answers 200 when the server can do its job, 503 with the failed checks
+// otherwise.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+	defer cancel()
+	failed := readyChecks(ctx, time.Now())
+
+	w.Header().Set("Content-Type", "application/json")
+	status := "ok"
+	if len(failed) > 0 {
+		status = "unavailable"
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": status,
+		"failed": failed,
+	})
+}
+
+// diagnosticsHandler reports the server's internals to admins.
+func diagnosticsHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAdmin(w, r); !ok {
+		return
+	}
+	now := time.Now()
+
+	states := map[string]int{"up": 0, "down": 0, "unknown": 0, "paused": 0}
+	mu.Lock()
+	for id, d := range devices {
+		st, known := tracker.Status(id)
+		switch {
+		case d.Paused:
+			states["paused"]++
+		case !known:
+			states["unknown"]++
+		case st.Up:
+			states["up"]++
+		default:
+			states["down"]++
+		}
+	}
+	mu.Unlock()
+
+	result := map[string]interface{}{
+		"started_at":     serverStartedAt.Format(time.RFC3339),
+		"uptime_seconds": int64(now.Sub(serverStartedAt).Seconds()),
+		"goroutines":     runtime.NumGoroutine(),
+		"devices":        states,
+		"notification_queue": map[string]int{
+			"depth":    len(notificationQueue),
+			"capacity": cap(notificationQueue),
+		},
+	}
+	if tick := trackerTick.Load(); tick != 0 {
+		result["tracker_checked_at"] = time.Unix(0, tick).Format(time.RFC3339)
+	}
+	if size, err := db.Size(); err == nil {
+		result["db_size_bytes"] = size
+	} else {
+		noteError("db", err)
+	}
+	if version, err := db.SchemaVersion(); err == nil {
+		result["schema_version"] = version
+	} else {
+		noteError("db", err)
+	}
+	events := make(map[string]int)
+	for name, from := range map[string]time.Time{"total": {}, "last_24h": now.Add(-24 * time.Hour)} {
+		n, err := storage.CountEvents(from, now.Add(time.Second))
+		if err != nil {
+			noteError("db", err)
+			continue
+		}
+		events[name] = n
+	}
+	result["events"] = events
+
+	lastErrorsMu.Lock()
+	last := make(map[string]subsystemError, len(lastErrors))
+	for k, v := range lastErrors {
+		last[k] = v
+	}
+	lastErrorsMu.Unlock()
+	result["last_errors"] = last
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
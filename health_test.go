@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadyChecks(t *testing.T) {
+	dir := t.TempDir()
+	if err := initDB(filepath.Join(dir, "test.db")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	page := filepath.Join(dir, "page.html")
+	os.WriteFile(page, []byte("<html>"), 0644)
+	files := requiredFiles
+	requiredFiles = []string{page}
+	t.Cleanup(func() { requiredFiles = files })
+
+	now := time.Now()
+	serverStartedAt = now.Add(-5 * time.Second)
+	trackerTick.Store(0)
+	t.Cleanup(func() { serverStartedAt = time.Time{} })
+	if failed := readyChecks(context.Background(), now); len(failed) != 0 {
+		t.Errorf("fresh start: failed %v, want ready", failed)
+	}
+
+	trackerTick.Store(now.Add(-time.Minute).UnixNano())
+	requiredFiles = append(requiredFiles, filepath.Join(dir, "firmware.bin"))
+	failed := readyChecks(context.Background(), now)
+	if len(failed) != 2 || !strings.Contains(failed["tracker"], "1m0s ago") || !strings.Contains(failed["files"], "firmware.bin") {
+		t.Errorf("stalled tracker and missing firmware: failed %v", failed)
+	}
+	trackerTick.Store(0)
+
+	if size, err := db.Size(); err != nil || size == 0 {
+		t.Errorf("db size = %d, %v", size, err)
+	}
+
+	noteError("telegram", errors.New("first"))
+	noteError("telegram", errors.New("second"))
+	noteError("telegram", nil)
+	if e := lastErrors["telegram"]; e.Error != "second" || e.Count != 2 {
+		t.Errorf("telegram error = %+v, want the second of 2", e)
+	}
+	delete(lastErrors, "telegram")
+}
@@ -0,0 +1,482 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"power-monitor/store"
+)
+
+// Outage logs kept elsewhere (spreadsheets, other bots) are imported as down/up event
+// pairs. An import is all or nothing: one outage that can't be placed into the recorded
+// history rejects the file, and a dry run shows the events it would add and change.
+//
+// CSV has start, end and optionally channel columns, with or without a header row.
+// JSON is an array of {"start", "end", "channel"} objects. Times without a zone are in
+// the device timezone.
+
+const (
+	importUsage   = "usage: power-monitor import [-dry-run] [-format csv|json] <device> <file>"
+	maxImportSize = 10 << 20
+)
+
+var importTimeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04",
+	"02.01.2006 15:04:05",
+	"02.01.2006 15:04",
+}
+
+// importRecord is one outage of an import file.
+type importRecord struct {
+	Line    int       `json:"line"` // CSV line, or position in the JSON array
+	Channel string    `json:"channel,omitempty"`
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// importChange is one line of the dry-run diff.
+type importChange struct {
+	Op       string    `json:"op"` // "add" or "update"
+	Channel  string    `json:"channel,omitempty"`
+	Type     string    `json:"type"`
+	Time     time.Time `json:"time"`
+	Duration *int64    `json:"duration_seconds"` // seconds the previous state lasted
+	Previous *int64    `json:"previous_duration_seconds,omitempty"`
+}
+
+type importPlan struct {
+	Device   string         `json:"device"`
+	Outages  int            `json:"outages"`
+	Skipped  []importRecord `json:"skipped"` // already recorded
+	Rejected []importRecord `json:"rejected"`
+	Changes  []importChange `json:"changes"`
+	Applied  bool           `json:"applied"`
+
+	add, update []store.Event
+	since       map[string]time.Time // earliest change per channel, for the rollups
+}
+
+func parseImportTime(s string, loc *time.Location) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(n, 0), nil
+	}
+	for _, layout := range importTimeLayouts {
+		if t, err := time.ParseInLocation(layout, s, loc); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q", s)
+}
+
+func newImportRecord(line int, start, end, channel string, loc *time.Location) importRecord {
+	rec := importRecord{Line: line, Channel: strings.TrimSpace(channel)}
+	var err error
+	if rec.Start, err = parseImportTime(start, loc); err != nil {
+		rec.Error = err.Error()
+	} else if rec.End, err = parseImportTime(end, loc); err != nil {
+		rec.Error = err.Error()
+	}
+	return rec
+}
+
+// parseImport reads the outages of a CSV or JSON file. Rows that don't parse come back
+// with Error set; only an unreadable file is an error.
+func parseImport(r io.Reader, format string, loc *time.Location) ([]importRecord, error) {
+	var records []importRecord
+	switch format {
+	case "json":
+		var rows []struct {
+			Start   string `json:"start"`
+			End     string `json:"end"`
+			Channel string `json:"channel"`
+		}
+		if err := json.NewDecoder(r).Decode(&rows); err != nil {
+			return nil, err
+		}
+		for i, row := range rows {
+			records = append(records, newImportRecord(i+1, row.Start, row.End, row.Channel, loc))
+		}
+
+	case "csv":
+		cr := csv.NewReader(r)
+		cr.FieldsPerRecord = -1
+		cr.TrimLeadingSpace = true
+		cr.Comment = '#'
+		columns := map[string]int{"start": 0, "end": 1, "channel": 2}
+		first := true
+		for {
+			row, err := cr.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			line, _ := cr.FieldPos(0)
+			if first {
+				first = false
+				if _, err := parseImportTime(row[0], loc); err != nil {
+					columns = importColumns(row)
+					if columns == nil {
+						return nil, fmt.Errorf("line %d: expected a start,end[,channel] header", line)
+					}
+					continue
+				}
+			}
+			field := func(name string) string {
+				if i, ok := columns[name]; ok && i < len(row) {
+					return row[i]
+				}
+				return ""
+			}
+			records = append(records, newImportRecord(line, field("start"), field("end"), field("channel"), loc))
+		}
+
+	default:
+		return nil, fmt.Errorf("unknown format %q (csv, json)", format)
+	}
+	return records, nil
+}
+
+// importColumns maps a CSV header to column positions, nil without start and end.
+func importColumns(header []string) map[string]int {
+	names := map[string]string{
+		"start": "start", "from": "start", "down": "start",
+		"end": "end", "to": "end", "up": "end",
+		"channel": "channel",
+	}
+	columns := make(map[string]int)
+	for i, h := range header {
+		if name, ok := names[strings.ToLower(strings.TrimSpace(h))]; ok {
+			columns[name] = i
+		}
+	}
+	_, start := columns["start"]
+	_, end := columns["end"]
+	if !start || !end {
+		return nil
+	}
+	return columns
+}
+
+// planImport checks the outages against each other and the recorded events and works
+// out the events to add and the durations to correct.
+func planImport(deviceID string, records []importRecord, loc *time.Location, now time.Time) (*importPlan, error) {
+	plan := &importPlan{
+		Device:   deviceID,
+		Skipped:  []importRecord{},
+		Rejected: []importRecord{},
+		Changes:  []importChange{},
+		since:    make(map[string]time.Time),
+	}
+	var cutoff time.Time
+	if retentionDays > 0 {
+		// Older days are rolled up and their raw events pruned
+		cutoff = bucketStart(now.AddDate(0, 0, -retentionDays), "day", loc).AddDate(0, 0, 1)
+	}
+	reject := func(rec importRecord, format string, args ...interface{}) {
+		rec.Error = fmt.Sprintf(format, args...)
+		plan.Rejected = append(plan.Rejected, rec)
+	}
+
+	byChannel := make(map[string][]importRecord)
+	var channels []string
+	for _, rec := range records {
+		switch {
+		case rec.Error != "":
+			plan.Rejected = append(plan.Rejected, rec)
+		case !rec.End.After(rec.Start):
+			reject(rec, "end is not after start")
+		case rec.End.After(now):
+			reject(rec, "end is in the future")
+		case rec.Start.Before(cutoff):
+			reject(rec, "older than RETENTION_DAYS (%d days)", retentionDays)
+		default:
+			if _, ok := byChannel[rec.Channel]; !ok {
+				channels = append(channels, rec.Channel)
+			}
+			byChannel[rec.Channel] = append(byChannel[rec.Channel], rec)
+		}
+	}
+	sort.Strings(channels)
+
+	for _, channel := range channels {
+		recs := byChannel[channel]
+		sort.SliceStable(recs, func(i, j int) bool { return recs[i].Start.Before(recs[j].Start) })
+
+		var accepted []importRecord
+		var prevEnd []time.Time // when the state before each accepted outage began, zero if unknown
+		for _, rec := range recs {
+			if n := len(accepted); n > 0 && rec.Start.Before(accepted[n-1].End) {
+				reject(rec, "overlaps line %d", accepted[n-1].Line)
+				continue
+			}
+			before, err := storage.LastEventBefore(deviceID, channel, rec.Start)
+			if err != nil && err != store.ErrNotFound {
+				return nil, err
+			}
+			hasBefore := err == nil
+			inside, err := storage.Events(deviceID, channel, rec.Start, rec.End.Add(time.Second))
+			if err != nil {
+				return nil, err
+			}
+			for len(inside) > 0 && inside[len(inside)-1].Time.After(rec.End) {
+				inside = inside[:len(inside)-1]
+			}
+
+			switch {
+			case len(inside) == 2 && inside[0].Type == "down" && inside[0].Time.Equal(rec.Start) &&
+				inside[1].Type == "up" && inside[1].Time.Equal(rec.End):
+				plan.Skipped = append(plan.Skipped, rec)
+				continue
+			case hasBefore && before.Type == "down":
+				reject(rec, "overlaps the outage recorded since %s", before.Time.In(loc).Format("2006-01-02 15:04:05"))
+				continue
+			case len(inside) > 0:
+				reject(rec, "overlaps the %s event recorded at %s", inside[0].Type, inside[0].Time.In(loc).Format("2006-01-02 15:04:05"))
+				continue
+			}
+
+			var since time.Time
+			if hasBefore {
+				since = before.Time
+			}
+			if n := len(accepted); n > 0 && accepted[n-1].End.After(since) {
+				since = accepted[n-1].End
+			}
+			accepted = append(accepted, rec)
+			prevEnd = append(prevEnd, since)
+		}
+
+		for i, rec := range accepted {
+			down := store.Event{DeviceID: deviceID, Channel: channel, Type: "down", Time: rec.Start}
+			if !prevEnd[i].IsZero() {
+				down.Duration = sql.NullInt64{Int64: int64(rec.Start.Sub(prevEnd[i]).Seconds()), Valid: true}
+			}
+			up := store.Event{DeviceID: deviceID, Channel: channel, Type: "up", Time: rec.End,
+				Duration: sql.NullInt64{Int64: int64(rec.End.Sub(rec.Start).Seconds()), Valid: true}}
+			plan.add = append(plan.add, down, up)
+			plan.Changes = append(plan.Changes, importChange{Op: "add", Channel: channel, Type: "down", Time: down.Time.In(loc), Duration: nullSeconds(down.Duration)},
+				importChange{Op: "add", Channel: channel, Type: "up", Time: up.Time.In(loc), Duration: nullSeconds(up.Duration)})
+
+			// The recorded down after the outage now follows a shorter uptime
+			next, err := storage.EventAfter(deviceID, channel, rec.End)
+			if err == store.ErrNotFound {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			if next.Type != "down" || (i+1 < len(accepted) && accepted[i+1].Start.Before(next.Time)) {
+				continue
+			}
+			updated := next
+			updated.Duration = sql.NullInt64{Int64: int64(next.Time.Sub(rec.End).Seconds()), Valid: true}
+			plan.update = append(plan.update, updated)
+			plan.Changes = append(plan.Changes, importChange{Op: "update", Channel: channel, Type: next.Type, Time: next.Time.In(loc),
+				Duration: nullSeconds(updated.Duration), Previous: nullSeconds(next.Duration)})
+		}
+		if len(accepted) > 0 {
+			plan.Outages += len(accepted)
+			plan.since[channel] = accepted[0].Start
+		}
+	}
+	sort.SliceStable(plan.Rejected, func(i, j int) bool { return plan.Rejected[i].Line < plan.Rejected[j].Line })
+	return plan, nil
+}
+
+func nullSeconds(n sql.NullInt64) *int64 {
+	if !n.Valid {
+		return nil
+	}
+	return &n.Int64
+}
+
+// apply writes the planned events and refreshes the rollups of the days they fall in.
+func (p *importPlan) apply(loc *time.Location) error {
+	if len(p.Rejected) > 0 {
+		return fmt.Errorf("%d outage(s) rejected, nothing imported", len(p.Rejected))
+	}
+	if len(p.add) == 0 {
+		return nil
+	}
+	if err := storage.ImportEvents(p.add, p.update); err != nil {
+		return err
+	}
+	p.Applied = true
+	for channel, since := range p.since {
+		if err := rerollup(p.Device, channel, loc, since); err != nil {
+			return fmt.Errorf("events imported, but rollups failed: %v", err)
+		}
+	}
+	return nil
+}
+
+// importCommand runs "power-monitor import [-dry-run] [-format csv|json] <device> <file>".
+func importCommand(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "show the changes without writing them")
+	format := flags.String("format", "", "csv or json, by default from the file extension")
+	if err := flags.Parse(args); err != nil {
+		return errors.New(importUsage)
+	}
+	if flags.NArg() != 2 {
+		return errors.New(importUsage)
+	}
+	deviceID, file := flags.Arg(0), flags.Arg(1)
+	if *format == "" {
+		*format = "csv"
+		if strings.EqualFold(filepath.Ext(file), ".json") {
+			*format = "json"
+		}
+	}
+
+	if err := initDB(databaseURL()); err != nil {
+		return err
+	}
+	defer storage.Close()
+	setupRetention()
+	list, err := storage.ListDevices()
+	if err != nil {
+		return err
+	}
+	var device *DeviceConfig
+	for _, d := range list {
+		if d.ID == deviceID {
+			device = &DeviceConfig{Device: d}
+		}
+	}
+	if device == nil {
+		return fmt.Errorf("unknown device %q", deviceID)
+	}
+	loc := deviceLocation(device)
+
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	records, err := parseImport(f, *format, loc)
+	if err != nil {
+		return fmt.Errorf("%s: %v", file, err)
+	}
+	plan, err := planImport(deviceID, records, loc, time.Now())
+	if err != nil {
+		return err
+	}
+	printImportPlan(os.Stdout, plan, loc)
+	if *dryRun {
+		fmt.Println("dry run, nothing written")
+		return nil
+	}
+	return plan.apply(loc)
+}
+
+func printImportPlan(w io.Writer, p *importPlan, loc *time.Location) {
+	seconds := func(n *int64) string {
+		if n == nil {
+			return "-"
+		}
+		return (time.Duration(*n) * time.Second).String()
+	}
+	for _, c := range p.Changes {
+		sign := "+"
+		if c.Op == "update" {
+			sign = "~"
+		}
+		duration := seconds(c.Duration)
+		if c.Previous != nil {
+			duration = seconds(c.Previous) + " -> " + duration
+		}
+		fmt.Fprintf(w, "%s %-4s %s%s  after %s\n", sign, c.Type, c.Time.In(loc).Format("2006-01-02 15:04:05"), channelSuffix(c.Channel), duration)
+	}
+	for _, rec := range p.Skipped {
+		fmt.Fprintf(w, "= line %d: already recorded\n", rec.Line)
+	}
+	for _, rec := range p.Rejected {
+		fmt.Fprintf(w, "! line %d: %s\n", rec.Line, rec.Error)
+	}
+	fmt.Fprintf(w, "%d outage(s) to import, %d already recorded, %d rejected\n", p.Outages, len(p.Skipped), len(p.Rejected))
+}
+
+// importHandler imports outages for a device the caller owns (or any, for an admin):
+// POST /api/devices/{id}/import?format=csv|json&dry_run=1 with the file as the body.
+// The plan is returned either way; rejected outages make it 422 with nothing written.
+func importHandler(w http.ResponseWriter, r *http.Request, deviceID string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	email := getSessionEmail(r)
+	if email == "" {
+		http.Error(w, "Unauthorized", 401)
+		return
+	}
+	mu.Lock()
+	d, exists := devices[deviceID]
+	var loc *time.Location
+	if exists {
+		exists = d.OwnerEmail == email || isAdmin(email)
+		loc = deviceLocation(d)
+	}
+	mu.Unlock()
+	if !exists {
+		http.Error(w, "device not found", 404)
+		return
+	}
+
+	q := r.URL.Query()
+	format := q.Get("format")
+	if format == "" {
+		format = "csv"
+		if strings.Contains(r.Header.Get("Content-Type"), "json") {
+			format = "json"
+		}
+	}
+	dryRun := q.Get("dry_run") == "1" || q.Get("dry_run") == "true"
+
+	records, err := parseImport(http.MaxBytesReader(w, r.Body, maxImportSize), format, loc)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	plan, err := planImport(deviceID, records, loc, time.Now())
+	if err != nil {
+		requestLog(r).Error("Import failed", "device_id", deviceID, "err", err)
+		http.Error(w, "Database error", 500)
+		return
+	}
+	status := http.StatusOK
+	switch {
+	case len(plan.Rejected) > 0:
+		status = http.StatusUnprocessableEntity
+	case !dryRun:
+		if err := plan.apply(loc); err != nil {
+			requestLog(r).Error("Import failed", "device_id", deviceID, "err", err)
+			http.Error(w, "Database error", 500)
+			return
+		}
+		requestLog(r).Info("Imported outages", "device_id", deviceID, "outages", plan.Outages, "email", email)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(plan)
+}
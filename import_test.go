@@ -0,0 +1,84 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestImport(t *testing.T) {
+	if err := initDB(filepath.Join(t.TempDir(), "test.db")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	loc, _ := time.LoadLocation("Europe/Kyiv")
+	at := func(day, hour, min int) time.Time { return time.Date(2024, 3, day, hour, min, 0, 0, loc) }
+
+	saveEvent("home", "", "up", at(4, 8, 0), 0, false)
+	saveEvent("home", "", "down", at(5, 10, 0), 26*3600, false)
+	saveEvent("home", "", "up", at(5, 12, 0), 7200, false)
+	now := at(10, 12, 0)
+	if err := rollupChannel("home", "", loc, now); err != nil {
+		t.Fatal(err)
+	}
+
+	file := `# exported from the old bot
+start,end
+2024-03-04 18:00,2024-03-04 20:00
+05.03.2024 11:00,05.03.2024 11:30
+2024-03-05 09:00,2024-03-05 13:00
+yesterday,2024-03-05 13:00
+2024-03-04 19:00,2024-03-04 21:00
+2024-03-06 10:00,2024-03-06 09:00
+`
+	records, err := parseImport(strings.NewReader(file), "csv", loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err := planImport("home", records, loc, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.Outages != 1 || len(plan.Rejected) != 5 {
+		t.Fatalf("plan = %+v, want 1 outage and 5 rejected", plan)
+	}
+	for i, want := range []string{"outage recorded since", "event recorded at", "invalid time", "overlaps line 3", "not after start"} {
+		if !strings.Contains(plan.Rejected[i].Error, want) {
+			t.Errorf("line %d: %q, want %q", plan.Rejected[i].Line, plan.Rejected[i].Error, want)
+		}
+	}
+	if err := plan.apply(loc); err == nil {
+		t.Error("applied an import with rejected outages")
+	}
+
+	// The valid outage alone goes in, with the uptimes around it split
+	file = `[{"start": "2024-03-04T18:00:00+02:00", "end": "2024-03-04 20:00"}]`
+	records, _ = parseImport(strings.NewReader(file), "json", loc)
+	plan, err = planImport("home", records, loc, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Changes) != 3 || *plan.Changes[0].Duration != 10*3600 || *plan.Changes[1].Duration != 2*3600 ||
+		plan.Changes[2].Op != "update" || *plan.Changes[2].Previous != 26*3600 || *plan.Changes[2].Duration != 14*3600 {
+		t.Errorf("changes = %+v", plan.Changes)
+	}
+	if err := plan.apply(loc); err != nil || !plan.Applied {
+		t.Fatalf("apply: %v", err)
+	}
+	events, _ := storage.Events("home", "", at(4, 0, 0), at(6, 0, 0))
+	if len(events) != 5 || events[1].Type != "down" || events[3].Duration.Int64 != 14*3600 {
+		t.Errorf("events = %+v", events)
+	}
+	rollups, _ := storage.Rollups("home", "", "2024-03-04", "2024-03-05")
+	if len(rollups) != 1 || rollups[0].Outages != 1 || rollups[0].DownSeconds != 7200 {
+		t.Errorf("rollup of Mar 4 = %+v, want the imported outage", rollups)
+	}
+
+	// Importing the same file again changes nothing
+	records, _ = parseImport(strings.NewReader(file), "json", loc)
+	plan, _ = planImport("home", records, loc, now)
+	if plan.Outages != 0 || len(plan.Skipped) != 1 || len(plan.Rejected) != 0 {
+		t.Errorf("second import = %+v, want it skipped", plan)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"time"
+
+	"power-monitor/store"
+)
+
+// interval is a stretch of time with a single known power state.
+type interval struct {
+	Start time.Time
+	End   time.Time
+	State string // "up", "down" or "nodata"
+
+	Continued bool // the state resumed after the server was down; not a new outage
+}
+
+func (iv interval) Duration() time.Duration { return iv.End.Sub(iv.Start) }
+
+// loadIntervals rebuilds the on/off periods of a device channel between from and to
+// out of the events table. Time before the first recorded event and while the server
+// was down is reported as "nodata".
+func loadIntervals(deviceID, channel string, from, to time.Time) ([]interval, error) {
+	from, to = from.In(time.Local), to.In(time.Local)
+
+	state := "nodata"
+	last, err := storage.LastEventBefore(deviceID, channel, from)
+	if err == nil {
+		state = last.Type
+	} else if err != store.ErrNotFound {
+		return nil, err
+	}
+
+	events, err := storage.Events(deviceID, channel, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []interval
+	cursor := from
+	add := func(end time.Time) {
+		if !end.After(cursor) {
+			return
+		}
+		if n := len(result); n > 0 && result[n-1].State == state {
+			result[n-1].End = end
+		} else {
+			result = append(result, interval{Start: cursor, End: end, State: state})
+		}
+		cursor = end
+	}
+	for _, e := range events {
+		add(e.Time)
+		state = e.Type
+	}
+	add(to)
+
+	gaps, err := serverGaps(from, to)
+	if err != nil {
+		return nil, err
+	}
+	return maskServerGaps(result, gaps), nil
+}
+
+// maskServerGaps turns the parts of intervals that fall into gaps into "nodata". A
+// state going on on both sides of a gap is marked Continued after it.
+func maskServerGaps(intervals, gaps []interval) []interval {
+	if len(gaps) == 0 {
+		return intervals
+	}
+	var result []interval
+	add := func(iv interval) {
+		if !iv.End.After(iv.Start) {
+			return
+		}
+		if n := len(result); n > 0 && iv.State == "nodata" && result[n-1].State == "nodata" {
+			result[n-1].End = iv.End
+			return
+		}
+		result = append(result, iv)
+	}
+	for _, iv := range intervals {
+		piece := iv
+		for _, g := range gaps {
+			if !g.End.After(piece.Start) || !g.Start.Before(piece.End) {
+				continue
+			}
+			add(interval{Start: piece.Start, End: g.Start, State: piece.State, Continued: piece.Continued})
+			end := g.End
+			if end.After(piece.End) {
+				end = piece.End
+			}
+			start := g.Start
+			if start.Before(piece.Start) {
+				start = piece.Start
+			}
+			add(interval{Start: start, End: end, State: "nodata"})
+			piece.Start = end
+			piece.Continued = piece.State != "nodata"
+		}
+		add(piece)
+	}
+	return result
+}
+
+// outageSummary aggregates a list of intervals.
+type outageSummary struct {
+	Outages  []interval
+	Downtime time.Duration
+	Uptime   time.Duration
+	Longest  time.Duration
+}
+
+func summarize(intervals []interval) outageSummary {
+	var s outageSummary
+	for _, iv := range intervals {
+		switch iv.State {
+		case "down":
+			if !iv.Continued || len(s.Outages) == 0 {
+				s.Outages = append(s.Outages, iv)
+			}
+			s.Downtime += iv.Duration()
+			if iv.Duration() > s.Longest {
+				s.Longest = iv.Duration()
+			}
+		case "up":
+			s.Uptime += iv.Duration()
+		}
+	}
+	return s
+}
+
+// UptimePercent is the share of time with power among the time we have data for.
+func (s outageSummary) UptimePercent() float64 {
+	known := s.Uptime + s.Downtime
+	if known <= 0 {
+		return 0
+	}
+	return float64(s.Uptime) / float64(known) * 100
+}
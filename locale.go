@@ -0,0 +1,504 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const defaultLocale = "uk"
+
+// locale holds the plural rule, duration units, default message templates and the
+// other texts of a language.
+type locale struct {
+	// plural picks the form index for n: 0 = one, 1 = few, 2 = many. Languages without
+	// a "few" form repeat the "many" form in its place.
+	plural    func(n int) int
+	days      [3]string
+	hours     [3]string
+	minutes   [3]string
+	messages  [3]string
+	templates map[string]string
+	texts     map[string]string // fmt formats of digests, summaries, bot replies and emails
+}
+
+// slavicPlural is the one/few/many rule shared by Ukrainian and (for n != 1) Polish.
+func slavicPlural(n int) int {
+	switch {
+	case n%10 == 1 && n%100 != 11:
+		return 0
+	case n%10 >= 2 && n%10 <= 4 && (n%100 < 12 || n%100 > 14):
+		return 1
+	default:
+		return 2
+	}
+}
+
+func germanicPlural(n int) int {
+	if n == 1 {
+		return 0
+	}
+	return 2
+}
+
+var locales = map[string]*locale{
+	"uk": {
+		plural:   slavicPlural,
+		days:     [3]string{"день", "дні", "днів"},
+		hours:    [3]string{"година", "години", "годин"},
+		minutes:  [3]string{"хвилина", "хвилини", "хвилин"},
+		messages: [3]string{"повідомлення", "повідомлення", "повідомлень"},
+		templates: map[string]string{
+			"down":     "🔴 {{.Time}} Світло зникло{{with .Channel}} ({{.}}){{end}}\n🕓 Воно було {{.Duration}}{{with .ExpectedReturn}}\n⏳ Зазвичай повертається близько {{.}}{{end}}",
+			"up":       "🟢 {{.Time}} Світло з'явилось{{with .Channel}} ({{.}}){{end}}\n🕓 Його не було {{.Duration}}",
+			"unstable": "⚠️ {{.Time}} Нестабільне живлення{{with .Channel}} ({{.}}){{end}}\n⚡ Світло то зникає, то з'являється — повідомимо, коли стабілізується",
+			"stable":   "✅ {{.Time}} Живлення стабілізувалось{{with .Channel}} ({{.}}){{end}}\n{{if .PowerOn}}🟢 Зараз світло є{{else}}🔴 Зараз світла немає{{end}}\n📊 За {{.Period}}: {{.Outages}} {{plural .Outages \"відключення\" \"відключення\" \"відключень\"}}, без світла {{.Downtime}}",
+		},
+		texts: map[string]string{
+			"digest_daily":           "📊 %s — підсумок за вчора (%s)",
+			"digest_weekly":          "📊 %s — підсумок за тиждень (%s–%s)",
+			"digest_no_outages":      "✅ Відключень не було",
+			"digest_outages":         "🔌 Відключень: %d",
+			"digest_downtime":        "⏱ Без світла: %s",
+			"digest_longest":         "📏 Найдовше: %s",
+			"digest_more_week":       "📈 На %s більше, ніж тижнем раніше",
+			"digest_less_week":       "📉 На %s менше, ніж тижнем раніше",
+			"digest_same_week":       "➖ Стільки ж, скільки тижнем раніше",
+			"digest_more_day":        "📈 На %s більше, ніж у середньому за попередній тиждень",
+			"digest_less_day":        "📉 На %s менше, ніж у середньому за попередній тиждень",
+			"digest_same_day":        "➖ Стільки ж, скільки в середньому за попередній тиждень",
+			"held_title":             "🌙 Поки діяли тихі години:",
+			"held_skipped":           "…і ще %d %s раніше",
+			"chart_day":              "📊 %s — останні 24 години",
+			"chart_days":             "📊 %s — останні %d %s",
+			"bot_start":              "👋 Щоб отримувати сповіщення, відкрийте посилання з налаштувань підписки на power-monitor.club",
+			"bot_link_invalid":       "⚠️ Посилання недійсне або застаріло. Створіть нове в налаштуваннях підписки.",
+			"bot_linked":             "✅ Сповіщення підключено для %s\nВідключити: /stop",
+			"bot_stopped":            "🔕 Сповіщення в цей чат вимкнено",
+			"email_history":          "Історія відключень",
+			"email_unsubscribe":      "Відписатись від цього пристрою",
+			"email_unsubscribe_link": "Відписатись: %s",
+			"unsubscribe_title":      "Відписка",
+			"unsubscribe_confirm":    "Відписатись від сповіщень пристрою %s?",
+			"unsubscribe_button":     "Відписатись",
+			"unsubscribe_done":       "✅ Ви більше не отримуватимете сповіщень від %s",
+			"public_device":          "Пристрій %d",
+			"public_title":           "Статус світла",
+			"public_heading":         "Чи є світло?",
+			"public_up":              "💡 Світло є",
+			"public_down":            "🔌 Світла немає",
+			"public_for":             "Вже %s",
+			"public_since":           "(з %s)",
+			"public_uptime":          "зі світлом",
+			"public_outages":         "відключень",
+			"public_downtime":        "без світла",
+			"public_now":             "зараз",
+			"public_no_outages":      "Відключень за %d днів не було",
+			"public_days":            "Останні %d днів",
+		},
+	},
+	"en": {
+		plural:   germanicPlural,
+		days:     [3]string{"day", "days", "days"},
+		hours:    [3]string{"hour", "hours", "hours"},
+		minutes:  [3]string{"minute", "minutes", "minutes"},
+		messages: [3]string{"message", "messages", "messages"},
+		templates: map[string]string{
+			"down":     "🔴 {{.Time}} Power is off{{with .Channel}} ({{.}}){{end}}\n🕓 It was on for {{.Duration}}{{with .ExpectedReturn}}\n⏳ Usually back around {{.}}{{end}}",
+			"up":       "🟢 {{.Time}} Power is back{{with .Channel}} ({{.}}){{end}}\n🕓 It was off for {{.Duration}}",
+			"unstable": "⚠️ {{.Time}} Unstable power{{with .Channel}} ({{.}}){{end}}\n⚡ Power keeps going on and off — we'll tell you when it settles",
+			"stable":   "✅ {{.Time}} Power is stable again{{with .Channel}} ({{.}}){{end}}\n{{if .PowerOn}}🟢 Power is on now{{else}}🔴 Power is off now{{end}}\n📊 Over {{.Period}}: {{.Outages}} {{plural .Outages \"outage\" \"outages\" \"outages\"}}, {{.Downtime}} without power",
+		},
+		texts: map[string]string{
+			"digest_daily":           "📊 %s — yesterday's summary (%s)",
+			"digest_weekly":          "📊 %s — weekly summary (%s–%s)",
+			"digest_no_outages":      "✅ No outages",
+			"digest_outages":         "🔌 Outages: %d",
+			"digest_downtime":        "⏱ Without power: %s",
+			"digest_longest":         "📏 Longest: %s",
+			"digest_more_week":       "📈 %s more than the week before",
+			"digest_less_week":       "📉 %s less than the week before",
+			"digest_same_week":       "➖ The same as the week before",
+			"digest_more_day":        "📈 %s more than an average day of the week before",
+			"digest_less_day":        "📉 %s less than an average day of the week before",
+			"digest_same_day":        "➖ The same as an average day of the week before",
+			"held_title":             "🌙 While quiet hours were on:",
+			"held_skipped":           "…and %d earlier %s",
+			"chart_day":              "📊 %s — last 24 hours",
+			"chart_days":             "📊 %s — last %d %s",
+			"bot_start":              "👋 To get notifications, open the link from your subscription settings on power-monitor.club",
+			"bot_link_invalid":       "⚠️ The link is invalid or has expired. Create a new one in your subscription settings.",
+			"bot_linked":             "✅ Notifications are on for %s\nTurn them off: /stop",
+			"bot_stopped":            "🔕 Notifications to this chat are off",
+			"email_history":          "Outage history",
+			"email_unsubscribe":      "Unsubscribe from this device",
+			"email_unsubscribe_link": "Unsubscribe: %s",
+			"unsubscribe_title":      "Unsubscribe",
+			"unsubscribe_confirm":    "Unsubscribe from the notifications of %s?",
+			"unsubscribe_button":     "Unsubscribe",
+			"unsubscribe_done":       "✅ You won't get notifications from %s any more",
+			"public_device":          "Device %d",
+			"public_title":           "Power status",
+			"public_heading":         "Is the power on?",
+			"public_up":              "💡 Power is on",
+			"public_down":            "🔌 Power is off",
+			"public_for":             "For %s",
+			"public_since":           "(since %s)",
+			"public_uptime":          "with power",
+			"public_outages":         "outages",
+			"public_downtime":        "without power",
+			"public_now":             "now",
+			"public_no_outages":      "No outages in %d days",
+			"public_days":            "Last %d days",
+		},
+	},
+	"pl": {
+		plural: func(n int) int {
+			if n == 1 {
+				return 0
+			}
+			if p := slavicPlural(n); p == 1 {
+				return 1
+			}
+			return 2
+		},
+		days:     [3]string{"dzień", "dni", "dni"},
+		hours:    [3]string{"godzina", "godziny", "godzin"},
+		minutes:  [3]string{"minuta", "minuty", "minut"},
+		messages: [3]string{"wiadomość", "wiadomości", "wiadomości"},
+		templates: map[string]string{
+			"down":     "🔴 {{.Time}} Brak prądu{{with .Channel}} ({{.}}){{end}}\n🕓 Prąd był przez {{.Duration}}{{with .ExpectedReturn}}\n⏳ Zwykle wraca około {{.}}{{end}}",
+			"up":       "🟢 {{.Time}} Prąd wrócił{{with .Channel}} ({{.}}){{end}}\n🕓 Nie było go przez {{.Duration}}",
+			"unstable": "⚠️ {{.Time}} Niestabilne zasilanie{{with .Channel}} ({{.}}){{end}}\n⚡ Prąd znika i wraca — damy znać, gdy się ustabilizuje",
+			"stable":   "✅ {{.Time}} Zasilanie ustabilizowane{{with .Channel}} ({{.}}){{end}}\n{{if .PowerOn}}🟢 Prąd teraz jest{{else}}🔴 Prądu teraz nie ma{{end}}\n📊 W ciągu {{.Period}}: {{.Outages}} {{plural .Outages \"przerwa\" \"przerwy\" \"przerw\"}}, bez prądu {{.Downtime}}",
+		},
+		texts: map[string]string{
+			"digest_daily":           "📊 %s — podsumowanie wczorajszego dnia (%s)",
+			"digest_weekly":          "📊 %s — podsumowanie tygodnia (%s–%s)",
+			"digest_no_outages":      "✅ Nie było przerw w dostawie prądu",
+			"digest_outages":         "🔌 Przerwy: %d",
+			"digest_downtime":        "⏱ Bez prądu: %s",
+			"digest_longest":         "📏 Najdłuższa: %s",
+			"digest_more_week":       "📈 O %s dłużej niż tydzień wcześniej",
+			"digest_less_week":       "📉 O %s krócej niż tydzień wcześniej",
+			"digest_same_week":       "➖ Tyle samo co tydzień wcześniej",
+			"digest_more_day":        "📈 O %s dłużej niż średnio w poprzednim tygodniu",
+			"digest_less_day":        "📉 O %s krócej niż średnio w poprzednim tygodniu",
+			"digest_same_day":        "➖ Tyle samo co średnio w poprzednim tygodniu",
+			"held_title":             "🌙 W czasie godzin ciszy:",
+			"held_skipped":           "…i jeszcze %d %s wcześniej",
+			"chart_day":              "📊 %s — ostatnie 24 godziny",
+			"chart_days":             "📊 %s — ostatnie %d %s",
+			"bot_start":              "👋 Aby otrzymywać powiadomienia, otwórz link z ustawień subskrypcji na power-monitor.club",
+			"bot_link_invalid":       "⚠️ Link jest nieprawidłowy lub wygasł. Utwórz nowy w ustawieniach subskrypcji.",
+			"bot_linked":             "✅ Powiadomienia włączone dla %s\nWyłącz: /stop",
+			"bot_stopped":            "🔕 Powiadomienia na tym czacie są wyłączone",
+			"email_history":          "Historia przerw",
+			"email_unsubscribe":      "Wypisz się z tego urządzenia",
+			"email_unsubscribe_link": "Wypisz się: %s",
+			"unsubscribe_title":      "Wypisanie",
+			"unsubscribe_confirm":    "Wypisać się z powiadomień urządzenia %s?",
+			"unsubscribe_button":     "Wypisz się",
+			"unsubscribe_done":       "✅ Nie będziesz już otrzymywać powiadomień od %s",
+			"public_device":          "Urządzenie %d",
+			"public_title":           "Status zasilania",
+			"public_heading":         "Czy jest prąd?",
+			"public_up":              "💡 Prąd jest",
+			"public_down":            "🔌 Brak prądu",
+			"public_for":             "Od %s",
+			"public_since":           "(od %s)",
+			"public_uptime":          "z prądem",
+			"public_outages":         "wyłączeń",
+			"public_downtime":        "bez prądu",
+			"public_now":             "teraz",
+			"public_no_outages":      "Brak wyłączeń przez %d dni",
+			"public_days":            "Ostatnie %d dni",
+		},
+	},
+	"de": {
+		plural:   germanicPlural,
+		days:     [3]string{"Tag", "Tage", "Tage"},
+		hours:    [3]string{"Stunde", "Stunden", "Stunden"},
+		minutes:  [3]string{"Minute", "Minuten", "Minuten"},
+		messages: [3]string{"Nachricht", "Nachrichten", "Nachrichten"},
+		templates: map[string]string{
+			"down":     "🔴 {{.Time}} Stromausfall{{with .Channel}} ({{.}}){{end}}\n🕓 Strom war {{.Duration}} da{{with .ExpectedReturn}}\n⏳ Kommt meist gegen {{.}} zurück{{end}}",
+			"up":       "🟢 {{.Time}} Strom ist zurück{{with .Channel}} ({{.}}){{end}}\n🕓 Ausfall dauerte {{.Duration}}",
+			"unstable": "⚠️ {{.Time}} Instabile Stromversorgung{{with .Channel}} ({{.}}){{end}}\n⚡ Der Strom fällt immer wieder aus — wir melden uns, wenn er stabil ist",
+			"stable":   "✅ {{.Time}} Stromversorgung wieder stabil{{with .Channel}} ({{.}}){{end}}\n{{if .PowerOn}}🟢 Strom ist jetzt da{{else}}🔴 Jetzt kein Strom{{end}}\n📊 In {{.Period}}: {{.Outages}} {{plural .Outages \"Ausfall\" \"Ausfälle\" \"Ausfälle\"}}, {{.Downtime}} ohne Strom",
+		},
+		texts: map[string]string{
+			"digest_daily":           "📊 %s — Zusammenfassung von gestern (%s)",
+			"digest_weekly":          "📊 %s — Wochenzusammenfassung (%s–%s)",
+			"digest_no_outages":      "✅ Keine Stromausfälle",
+			"digest_outages":         "🔌 Ausfälle: %d",
+			"digest_downtime":        "⏱ Ohne Strom: %s",
+			"digest_longest":         "📏 Längster: %s",
+			"digest_more_week":       "📈 %s mehr als in der Woche davor",
+			"digest_less_week":       "📉 %s weniger als in der Woche davor",
+			"digest_same_week":       "➖ Genauso viel wie in der Woche davor",
+			"digest_more_day":        "📈 %s mehr als an einem durchschnittlichen Tag der Vorwoche",
+			"digest_less_day":        "📉 %s weniger als an einem durchschnittlichen Tag der Vorwoche",
+			"digest_same_day":        "➖ Genauso viel wie an einem durchschnittlichen Tag der Vorwoche",
+			"held_title":             "🌙 Während der Ruhezeit:",
+			"held_skipped":           "…und %d frühere %s",
+			"chart_day":              "📊 %s — letzte 24 Stunden",
+			"chart_days":             "📊 %s — letzte %d %s",
+			"bot_start":              "👋 Um Benachrichtigungen zu erhalten, öffne den Link aus deinen Abo-Einstellungen auf power-monitor.club",
+			"bot_link_invalid":       "⚠️ Der Link ist ungültig oder abgelaufen. Erstelle einen neuen in den Abo-Einstellungen.",
+			"bot_linked":             "✅ Benachrichtigungen für %s sind aktiviert\nAbschalten: /stop",
+			"bot_stopped":            "🔕 Benachrichtigungen in diesem Chat sind deaktiviert",
+			"email_history":          "Ausfallverlauf",
+			"email_unsubscribe":      "Von diesem Gerät abmelden",
+			"email_unsubscribe_link": "Abmelden: %s",
+			"unsubscribe_title":      "Abmeldung",
+			"unsubscribe_confirm":    "Benachrichtigungen von %s abbestellen?",
+			"unsubscribe_button":     "Abmelden",
+			"unsubscribe_done":       "✅ Du erhältst keine Benachrichtigungen mehr von %s",
+			"public_device":          "Gerät %d",
+			"public_title":           "Stromstatus",
+			"public_heading":         "Gibt es Strom?",
+			"public_up":              "💡 Strom ist da",
+			"public_down":            "🔌 Kein Strom",
+			"public_for":             "Seit %s",
+			"public_since":           "(seit %s)",
+			"public_uptime":          "mit Strom",
+			"public_outages":         "Ausfälle",
+			"public_downtime":        "ohne Strom",
+			"public_now":             "jetzt",
+			"public_no_outages":      "Keine Ausfälle in %d Tagen",
+			"public_days":            "Letzte %d Tage",
+		},
+	},
+}
+
+func localeFor(name string) *locale {
+	return locales[localeName(name)]
+}
+
+// localeName is name if there is such a locale, the default one otherwise.
+func localeName(name string) string {
+	if _, ok := locales[name]; ok {
+		return name
+	}
+	return defaultLocale
+}
+
+func (l *locale) plural3(n int, forms [3]string) string {
+	return forms[l.plural(n)]
+}
+
+// text formats the text key, taken from the default locale if this one lacks it.
+func (l *locale) text(key string, args ...interface{}) string {
+	format, ok := l.texts[key]
+	if !ok {
+		format = locales[defaultLocale].texts[key]
+	}
+	return fmt.Sprintf(format, args...)
+}
+
+// duration renders d with its two largest units: "2 дні 3 години", "1 hour 5 minutes", "0 хвилин".
+func (l *locale) duration(d time.Duration) string {
+	if d < 0 {
+		d = 0
+	}
+	days := int(d.Hours()) / 24
+	h := int(d.Hours()) % 24
+	m := int(d.Minutes()) % 60
+	unit := func(n int, forms [3]string) string {
+		return fmt.Sprintf("%d %s", n, l.plural3(n, forms))
+	}
+	switch {
+	case days > 0 && h > 0:
+		return unit(days, l.days) + " " + unit(h, l.hours)
+	case days > 0:
+		return unit(days, l.days)
+	case h > 0 && m > 0:
+		return unit(h, l.hours) + " " + unit(m, l.minutes)
+	case h > 0:
+		return unit(h, l.hours)
+	default:
+		return unit(m, l.minutes)
+	}
+}
+
+// messageData is what message templates see. Times and durations are already formatted
+// for the device's locale and timezone.
+type messageData struct {
+	Kind           string // "down", "up", "unstable" or "stable"
+	Device         string
+	Channel        string
+	Time           string // "15:04"
+	Date           string // "02.01.2006"
+	Duration       string // how long the previous state lasted
+	ExpectedReturn string // "18:30" estimated from past outages, empty if unknown
+
+	// "stable" only
+	PowerOn  bool
+	Period   string
+	Outages  int
+	Downtime string
+}
+
+func newMessageData(d *DeviceConfig, kind, channel string, at time.Time) messageData {
+	local := at.In(deviceLocation(d))
+	return messageData{
+		Kind:    kind,
+		Device:  d.Name,
+		Channel: channel,
+		Time:    local.Format("15:04"),
+		Date:    local.Format("02.01.2006"),
+	}
+}
+
+func parseMessageTemplate(l *locale, text string) (*template.Template, error) {
+	funcs := template.FuncMap{
+		"plural": func(n int, one, few, many string) string {
+			return [3]string{one, few, many}[l.plural(n)]
+		},
+	}
+	return template.New("message").Funcs(funcs).Option("missingkey=error").Parse(text)
+}
+
+func executeMessageTemplate(l *locale, text string, data messageData) (string, error) {
+	t, err := parseMessageTemplate(l, text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(buf.String()), nil
+}
+
+// renderMessage renders the device's own template for kind, falling back to the
+// locale default if the device has none or it fails.
+func renderMessage(d *DeviceConfig, data messageData) string {
+	l := localeFor(d.Locale)
+	if custom := d.Templates[data.Kind]; custom != "" {
+		text, err := executeMessageTemplate(l, custom, data)
+		if err == nil && text != "" {
+			return text
+		}
+		slog.Warn("Template failed", "device_id", d.ID, "kind", data.Kind, "err", err)
+	}
+	text, err := executeMessageTemplate(l, l.templates[data.Kind], data)
+	if err != nil {
+		slog.Error("Default template failed", "device_id", d.ID, "kind", data.Kind, "err", err)
+	}
+	return text
+}
+
+// expectedReturn estimates when power comes back as the start of this outage plus the
+// median length of the device's outages over the last 30 days. Zero if there is too
+// little history.
+func expectedReturn(d *DeviceConfig, channel string, downSince time.Time) time.Time {
+	events, err := storage.Events(d.ID, channel, downSince.AddDate(0, 0, -30), time.Now())
+	if err != nil {
+		return time.Time{}
+	}
+	var durations []int64
+	for _, e := range events {
+		if e.Type == "up" && !e.Suppressed && e.Duration.Int64 > 0 {
+			durations = append(durations, e.Duration.Int64)
+		}
+	}
+	if len(durations) < 3 {
+		return time.Time{}
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	median := durations[len(durations)/2]
+	return downSince.Add(time.Duration(median) * time.Second)
+}
+
+// formatExpected shows the time only, or the date too if it is not on the day of from.
+func formatExpected(t, from time.Time, loc *time.Location) string {
+	if t.IsZero() {
+		return ""
+	}
+	t, from = t.In(loc), from.In(loc)
+	if t.YearDay() != from.YearDay() || t.Year() != from.Year() {
+		return t.Format("02.01 15:04")
+	}
+	return t.Format("15:04")
+}
+
+// validateTemplates checks that every custom template parses and renders on sample data.
+func validateTemplates(localeName string, templates map[string]string) error {
+	l := localeFor(localeName)
+	for kind, text := range templates {
+		if l.templates[kind] == "" {
+			return fmt.Errorf("unknown message kind %q", kind)
+		}
+		if text == "" {
+			continue
+		}
+		if _, err := executeMessageTemplate(l, text, sampleMessageData(l, kind)); err != nil {
+			return fmt.Errorf("%s: %v", kind, err)
+		}
+	}
+	return nil
+}
+
+func sampleMessageData(l *locale, kind string) messageData {
+	return messageData{
+		Kind:           kind,
+		Device:         "Дім",
+		Time:           "18:05",
+		Date:           time.Now().Format("02.01.2006"),
+		Duration:       l.duration(3*time.Hour + 25*time.Minute),
+		ExpectedReturn: "21:30",
+		PowerOn:        true,
+		Period:         l.duration(40 * time.Minute),
+		Outages:        4,
+		Downtime:       l.duration(12 * time.Minute),
+	}
+}
+
+// templatePreviewHandler renders a template on sample data so it can be checked before saving:
+// POST /api/templates/preview {"locale": "en", "kind": "down", "template": "..."}
+// An empty template previews the locale default.
+func templatePreviewHandler(w http.ResponseWriter, r *http.Request) {
+	if getSessionEmail(r) == "" {
+		http.Error(w, "unauthorized", 401)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+	var req struct {
+		Locale   string `json:"locale"`
+		Kind     string `json:"kind"`
+		Template string `json:"template"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid json", 400)
+		return
+	}
+	l := localeFor(req.Locale)
+	if l.templates[req.Kind] == "" {
+		http.Error(w, "unknown kind", 400)
+		return
+	}
+	text := req.Template
+	if text == "" {
+		text = l.templates[req.Kind]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	out, err := executeMessageTemplate(l, text, sampleMessageData(l, req.Kind))
+	if err != nil {
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"text": out, "default": l.templates[req.Kind]})
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"power-monitor/store"
+)
+
+func TestPlural(t *testing.T) {
+	tests := []struct {
+		locale string
+		n      int
+		forms  func(l *locale) [3]string
+		want   string
+	}{
+		{"uk", 1, func(l *locale) [3]string { return l.days }, "день"},
+		{"uk", 2, func(l *locale) [3]string { return l.days }, "дні"},
+		{"uk", 5, func(l *locale) [3]string { return l.days }, "днів"},
+		{"uk", 11, func(l *locale) [3]string { return l.days }, "днів"},
+		{"uk", 12, func(l *locale) [3]string { return l.days }, "днів"},
+		{"uk", 21, func(l *locale) [3]string { return l.days }, "день"},
+		{"uk", 22, func(l *locale) [3]string { return l.days }, "дні"},
+		{"uk", 112, func(l *locale) [3]string { return l.days }, "днів"},
+		{"pl", 1, func(l *locale) [3]string { return l.hours }, "godzina"},
+		{"pl", 3, func(l *locale) [3]string { return l.hours }, "godziny"},
+		{"pl", 13, func(l *locale) [3]string { return l.hours }, "godzin"},
+		{"pl", 21, func(l *locale) [3]string { return l.hours }, "godzin"},
+		{"pl", 24, func(l *locale) [3]string { return l.hours }, "godziny"},
+		{"en", 0, func(l *locale) [3]string { return l.minutes }, "minutes"},
+		{"en", 1, func(l *locale) [3]string { return l.minutes }, "minute"},
+		{"en", 2, func(l *locale) [3]string { return l.minutes }, "minutes"},
+		{"de", 1, func(l *locale) [3]string { return l.messages }, "Nachricht"},
+		{"de", 4, func(l *locale) [3]string { return l.messages }, "Nachrichten"},
+	}
+	for _, tt := range tests {
+		l := localeFor(tt.locale)
+		if got := l.plural3(tt.n, tt.forms(l)); got != tt.want {
+			t.Errorf("%s %d: %q, want %q", tt.locale, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestLocaleDuration(t *testing.T) {
+	tests := []struct {
+		locale string
+		d      time.Duration
+		want   string
+	}{
+		{"uk", 2*24*time.Hour + 3*time.Hour, "2 дні 3 години"},
+		{"uk", 21 * time.Minute, "21 хвилина"},
+		{"uk", 0, "0 хвилин"},
+		{"en", time.Hour + 5*time.Minute, "1 hour 5 minutes"},
+		{"pl", 5 * 24 * time.Hour, "5 dni"},
+		{"de", 2 * time.Hour, "2 Stunden"},
+		{"xx", time.Hour, "1 година"}, // unknown locales fall back to the default
+	}
+	for _, tt := range tests {
+		if got := localeFor(tt.locale).duration(tt.d); got != tt.want {
+			t.Errorf("%s %v: %q, want %q", tt.locale, tt.d, got, tt.want)
+		}
+	}
+}
+
+// Every locale has every text of the default one, with the same arguments.
+func TestLocaleTexts(t *testing.T) {
+	verbs := regexp.MustCompile(`%[a-z]`)
+	for name, l := range locales {
+		for key, format := range locales[defaultLocale].texts {
+			own, ok := l.texts[key]
+			if !ok {
+				t.Errorf("%s: no text %q", name, key)
+				continue
+			}
+			if got, want := verbs.FindAllString(own, -1), verbs.FindAllString(format, -1); fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Errorf("%s %s: arguments %v, want %v", name, key, got, want)
+			}
+		}
+		if len(l.texts) != len(locales[defaultLocale].texts) {
+			t.Errorf("%s has %d texts, the default locale %d", name, len(l.texts), len(locales[defaultLocale].texts))
+		}
+	}
+}
+
+func TestLocalizedMessages(t *testing.T) {
+	if err := initDB(filepath.Join(t.TempDir(), "test.db")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	d := &DeviceConfig{Device: store.Device{ID: "home", Name: "Home", Timezone: "Europe/Berlin", DigestFrequency: "daily", Locale: "en"}}
+	text, err := buildDigest(d, time.Date(2024, 6, 5, 8, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text != "📊 Home — yesterday's summary (04.06)\n✅ No outages" {
+		t.Errorf("English digest %q", text)
+	}
+
+	held := make([]store.HeldMessage, maxHeldInSummary+3)
+	for i := range held {
+		held[i].Text = fmt.Sprint("message ", i)
+	}
+	summary := heldSummary(localeFor("en"), held)
+	if !strings.HasPrefix(summary, "🌙 While quiet hours were on:\n\n…and 3 earlier messages\n") || strings.Contains(summary, "message 2\n") {
+		t.Errorf("English summary %q", summary)
+	}
+	if summary := heldSummary(localeFor("uk"), held[:maxHeldInSummary+1]); !strings.Contains(summary, "…і ще 1 повідомлення раніше") {
+		t.Errorf("Ukrainian summary %q", summary)
+	}
+
+	for code, want := range map[string]string{"en": "en", "de-AT": "de", "PL": "pl", "": ""} {
+		msg := &telegramMessage{From: &telegramUser{LanguageCode: code}}
+		if got := msg.language(); got != want {
+			t.Errorf("language of %q = %q, want %q", code, got, want)
+		}
+	}
+	if got := (&telegramMessage{}).language(); got != "" {
+		t.Errorf("language without a sender = %q", got)
+	}
+}
+
+func TestValidateTemplates(t *testing.T) {
+	tests := []struct {
+		name      string
+		templates map[string]string
+		wantErr   string
+	}{
+		{"valid", map[string]string{"down": "{{.Device}} {{.Time}} {{plural .Outages \"a\" \"b\" \"c\"}}", "up": ""}, ""},
+		{"unknown kind", map[string]string{"sideways": "{{.Time}}"}, "unknown message kind"},
+		{"syntax error", map[string]string{"down": "{{.Time"}, "down:"},
+		{"unknown field", map[string]string{"up": "{{.Voltage}}"}, "up:"},
+	}
+	for _, tt := range tests {
+		err := validateTemplates("en", tt.templates)
+		if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("%s: err = %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestTemplatePreview(t *testing.T) {
+	if err := initDB(filepath.Join(t.TempDir(), "test.db")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	preview := func(body string, signedIn bool) (int, map[string]string) {
+		r := httptest.NewRequest("POST", "/api/templates/preview", strings.NewReader(body))
+		if signedIn {
+			signIn(t, r, "owner@example.com")
+		}
+		rec := httptest.NewRecorder()
+		templatePreviewHandler(rec, r)
+		var resp map[string]string
+		json.NewDecoder(rec.Body).Decode(&resp)
+		return rec.Code, resp
+	}
+
+	if code, _ := preview(`{"locale":"en","kind":"down"}`, false); code != 401 {
+		t.Errorf("signed out: %d, want 401", code)
+	}
+	code, resp := preview(`{"locale":"en","kind":"down"}`, true)
+	if code != 200 || !strings.Contains(resp["text"], "Power is off") || !strings.Contains(resp["text"], "3 hours 25 minutes") ||
+		resp["default"] != locales["en"].templates["down"] {
+		t.Errorf("English default: %d %v", code, resp)
+	}
+	code, resp = preview(`{"locale":"uk","kind":"stable","template":"{{.Outages}} {{plural .Outages \"раз\" \"рази\" \"разів\"}}"}`, true)
+	if code != 200 || resp["text"] != "4 рази" {
+		t.Errorf("custom template: %d %v", code, resp)
+	}
+	if code, resp := preview(`{"locale":"en","kind":"down","template":"{{.Nope}}"}`, true); code != 400 || resp["error"] == "" {
+		t.Errorf("broken template: %d %v", code, resp)
+	}
+	if code, _ := preview(`{"locale":"en","kind":"sideways"}`, true); code != 400 {
+		t.Errorf("unknown kind: %d, want 400", code)
+	}
+}
+
+func TestLocalizedPublicPage(t *testing.T) {
+	if err := initDB(filepath.Join(t.TempDir(), "test.db")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	devices["home"] = &DeviceConfig{Device: store.Device{ID: "home", Name: "Home", Timezone: "Europe/Kyiv", Locale: "en"}}
+	t.Cleanup(func() { delete(devices, "home") })
+	publicPages["street"] = &PublicPage{Slug: "street", DeviceIDs: []string{"gone", "home"}, HideName: true}
+	t.Cleanup(func() { delete(publicPages, "street") })
+
+	rec := httptest.NewRecorder()
+	publicPageHandler(rec, httptest.NewRequest("GET", "/s/street", nil))
+	page := rec.Body.String()
+	for _, want := range []string{`<html lang="en">`, "Device 2", "Is the power on?", "No outages in 7 days", "Last 7 days"} {
+		if !strings.Contains(page, want) {
+			t.Errorf("English page has no %q", want)
+		}
+	}
+	if strings.Contains(page, "Пристрій") || strings.Contains(page, "світл") {
+		t.Error("English page has Ukrainian text")
+	}
+
+	devices["home"].Locale = ""
+	rec = httptest.NewRecorder()
+	publicPageHandler(rec, httptest.NewRequest("GET", "/s/street.json", nil))
+	var status publicStatus
+	json.NewDecoder(rec.Body).Decode(&status)
+	if status.Locale != "uk" || len(status.Devices) != 1 || status.Devices[0].Name != "Пристрій 2" {
+		t.Errorf("default locale status = %+v", status)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequestID(t *testing.T) {
+	var buf bytes.Buffer
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: logLevel})))
+	t.Cleanup(func() { slog.SetDefault(prev); logLevel.Set(slog.LevelInfo) })
+	logLevel.Set(slog.LevelDebug)
+
+	h := withRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestLog(r).Info("Handled", "device_id", "dev1")
+		http.Error(w, "Database error", 500)
+	}))
+	lines := func() []map[string]interface{} {
+		var out []map[string]interface{}
+		for _, line := range bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n")) {
+			var m map[string]interface{}
+			if err := json.Unmarshal(line, &m); err != nil {
+				t.Fatalf("log line %q: %v", line, err)
+			}
+			out = append(out, m)
+		}
+		buf.Reset()
+		return out
+	}
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/ping?device=dev1", nil)
+	req.Header.Set(requestIDHeader, "proxy-42")
+	h.ServeHTTP(rec, req)
+	if got := rec.Header().Get(requestIDHeader); got != "proxy-42" {
+		t.Errorf("X-Request-ID = %q, want the proxy's", got)
+	}
+	logged := lines()
+	if len(logged) != 2 {
+		t.Fatalf("logged %v, want the handler's line and the request", logged)
+	}
+	if logged[0]["request_id"] != "proxy-42" || logged[0]["device_id"] != "dev1" {
+		t.Errorf("handler line %v", logged[0])
+	}
+	if logged[1]["msg"] != "Request" || logged[1]["level"] != "WARN" || logged[1]["status"] != 500.0 || logged[1]["path"] != "/ping" {
+		t.Errorf("request line %v", logged[1])
+	}
+
+	// Unsafe IDs are replaced, and successful requests only show at debug level
+	h = withRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	logLevel.Set(slog.LevelInfo)
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set(requestIDHeader, "bad id\nlevel=ERROR")
+	h.ServeHTTP(rec, req)
+	if id := rec.Header().Get(requestIDHeader); !validRequestID(id) || len(id) != 16 {
+		t.Errorf("X-Request-ID = %q, want a new one", id)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("logged %q at info level", buf.String())
+	}
+}
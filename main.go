@@ -6,20 +6,28 @@ import (
 	"crypto/rand"
 	"database/sql"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"mime/multipart"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"power-monitor/monitor"
+	"power-monitor/store"
 
-	_ "github.com/mattn/go-sqlite3"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 )
@@ -43,165 +51,134 @@ const (
 	redAvatar   = "/opt/power-monitor/red.png"
 )
 
+// DeviceConfig is a device's stored settings plus what is derived from them.
 type DeviceConfig struct {
-	ID         string
-	Name       string
-	ChatID     string
-	BotToken   string
+	store.Device
 	Configured bool
-	OwnerEmail string
-	WifiSSID   string
-	Paused     bool
-	Timeout    int // seconds, 0 = default (90)
-}
-
-type DeviceState struct {
-	LastPing  time.Time
-	IsDown    bool
-	DownSince time.Time
-	UpSince   time.Time
-}
-
-type Session struct {
-	Email     string
-	ExpiresAt time.Time
 }
 
 var (
-	devices  = make(map[string]*DeviceConfig)
-	states   = make(map[string]*DeviceState)
-	sessions = make(map[string]*Session)
-	mu       sync.Mutex
-	kyivLoc  *time.Location
-	db       *sql.DB
+	devices     = make(map[string]*DeviceConfig)
+	tracker     = monitor.New(monitor.SystemClock)
+	telemetry   = make(map[string]map[string]int) // last UDP heartbeat values (battery_mv, rssi, uptime)
+	publicPages = make(map[string]*PublicPage)
+	mu          sync.Mutex
+	defaultLoc  *time.Location
+	storage     store.Store
+	db          *store.DB // for the tables outside the store interfaces
 )
 
-func initDB() error {
+// initDB opens a PostgreSQL URL or an SQLite file, see store.Open, and applies pending
+// migrations.
+func initDB(dsn string) error {
 	var err error
-	db, err = sql.Open("sqlite3", dbPath)
+	storage, err = store.Open(dsn)
 	if err != nil {
 		return err
 	}
-
-	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS events (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			device_id TEXT NOT NULL,
-			event_type TEXT NOT NULL,
-			timestamp DATETIME NOT NULL,
-			duration_seconds INTEGER
-		);
-		CREATE INDEX IF NOT EXISTS idx_device_time ON events(device_id, timestamp DESC);
-
-		CREATE TABLE IF NOT EXISTS devices (
-			id TEXT PRIMARY KEY,
-			name TEXT NOT NULL,
-			chat_id TEXT,
-			bot_token TEXT,
-			owner_email TEXT,
-			wifi_ssid TEXT,
-			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
-		);
-	`)
-	
-	// Migration: add columns if not exists (for existing DBs)
-	db.Exec("ALTER TABLE devices ADD COLUMN owner_email TEXT")
-	db.Exec("ALTER TABLE devices ADD COLUMN wifi_ssid TEXT")
-	db.Exec("ALTER TABLE devices ADD COLUMN paused INTEGER DEFAULT 0")
-	db.Exec("ALTER TABLE devices ADD COLUMN timeout INTEGER DEFAULT 0")
-
-	// Create subscriptions table
-	db.Exec(`CREATE TABLE IF NOT EXISTS subscriptions (
-		email TEXT NOT NULL,
-		device_id TEXT NOT NULL,
-		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-		PRIMARY KEY (email, device_id)
-	)`)
-	
+	db = storage.DB()
+	applied, err := db.MigrateUp()
+	for _, m := range applied {
+		slog.Info("Applied migration", "version", m.Version, "name", m.Name)
+	}
 	return err
 }
 
 func loadDevices() {
-	rows, err := db.Query("SELECT id, name, chat_id, bot_token, owner_email, wifi_ssid, paused, COALESCE(timeout, 0) FROM devices")
+	list, err := storage.ListDevices()
 	if err != nil {
-		log.Printf("Failed to load devices: %v", err)
-	}
-	defer rows.Close()
-
-	for rows.Next() {
-		var d DeviceConfig
-		var chatID, botToken, ownerEmail, wifiSSID sql.NullString
-		var paused sql.NullBool
-		var timeoutVal int
-		rows.Scan(&d.ID, &d.Name, &chatID, &botToken, &ownerEmail, &wifiSSID, &paused, &timeoutVal)
-		d.ChatID = chatID.String
-		d.BotToken = botToken.String
-		d.OwnerEmail = ownerEmail.String
-		d.WifiSSID = wifiSSID.String
-		d.Paused = paused.Bool
-		d.Timeout = timeoutVal
+		slog.Error("Failed to load devices", "err", err)
+	}
+	for _, sd := range list {
+		d := &DeviceConfig{Device: sd}
 		d.Configured = d.ChatID != "" && d.BotToken != ""
-		devices[d.ID] = &d
-		log.Printf("Loaded device: %s (%s) owner=%s paused=%v", d.ID, d.Name, d.OwnerEmail, d.Paused)
+		devices[d.ID] = d
+		slog.Info("Loaded device", "device_id", d.ID, "name", d.Name, "owner", d.OwnerEmail, "paused", d.Paused)
+	}
+
+	// Devices registered before device keys existed
+	for _, d := range devices {
+		if d.DeviceKey == "" {
+			d.DeviceKey = generateDeviceKey()
+			saveDevice(d)
+		}
 	}
 }
 
 func saveDevice(d *DeviceConfig) error {
-	_, err := db.Exec(`
-		INSERT OR REPLACE INTO devices (id, name, chat_id, bot_token, owner_email, wifi_ssid, paused, timeout)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
-	`, d.ID, d.Name, d.ChatID, d.BotToken, d.OwnerEmail, d.WifiSSID, d.Paused, d.Timeout)
+	err := storage.SaveDevice(&d.Device)
+	if err != nil {
+		slog.Error("Failed to save device", "device_id", d.ID, "err", err)
+		noteError("db", err)
+	}
 	return err
 }
 
-func saveEvent(deviceID, eventType string, ts time.Time, durationSec int64) {
+func saveEvent(deviceID, channel, eventType string, ts time.Time, durationSec int64, suppressed bool) {
 	// Check if last event is same type - skip duplicate
-	var lastType string
-	db.QueryRow("SELECT event_type FROM events WHERE device_id = ? ORDER BY timestamp DESC LIMIT 1", deviceID).Scan(&lastType)
-	if lastType == eventType {
-		log.Printf("[%s] Skipping duplicate %s event", deviceID, eventType)
+	if last, err := storage.LastEvent(deviceID, channel); err == nil && last.Type == eventType {
+		slog.Debug("Skipping duplicate event", "device_id", deviceID, "channel", channel, "type", eventType)
 		return
 	}
 
-	_, err := db.Exec(
-		"INSERT INTO events (device_id, event_type, timestamp, duration_seconds) VALUES (?, ?, ?, ?)",
-		deviceID, eventType, ts, durationSec,
-	)
+	err := storage.AddEvent(store.Event{
+		DeviceID:   deviceID,
+		Channel:    channel,
+		Type:       eventType,
+		Time:       ts,
+		Duration:   sql.NullInt64{Int64: durationSec, Valid: true},
+		Suppressed: suppressed,
+	})
 	if err != nil {
-		log.Printf("DB error: %v", err)
+		slog.Error("Failed to save event", "device_id", deviceID, "channel", channel, "type", eventType, "err", err)
+		noteError("db", err)
 	}
 }
 
-func loadLastState(deviceID string) (*DeviceState, error) {
+func loadLastState(deviceID, channel string) (monitor.State, error) {
 	now := time.Now()
-	state := &DeviceState{IsDown: true, DownSince: now, LastPing: now}
-
-	var eventType string
-	var ts time.Time
-	err := db.QueryRow(
-		"SELECT event_type, timestamp FROM events WHERE device_id = ? ORDER BY timestamp DESC LIMIT 1",
-		deviceID,
-	).Scan(&eventType, &ts)
+	state := monitor.State{IsDown: true, DownSince: now, LastPing: now}
 
-	if err == sql.ErrNoRows {
+	last, err := storage.LastEvent(deviceID, channel)
+	if err == store.ErrNotFound {
 		return state, nil
 	}
 	if err != nil {
 		return state, err
 	}
 
-	if eventType == "down" {
+	if last.Type == "down" {
 		state.IsDown = true
-		state.DownSince = ts
-		state.LastPing = ts
+		state.DownSince = last.Time
+		state.LastPing = last.Time
 	} else {
 		state.IsDown = false
-		state.UpSince = ts
+		state.UpSince = last.Time
 		state.LastPing = now
 	}
+	resumeAfterGap(&state)
 	return state, nil
 }
 
+// loadChannelStates restores the state of every named channel the device has reported before.
+func loadChannelStates(deviceID string) map[string]monitor.State {
+	channels := make(map[string]monitor.State)
+	names, err := storage.EventChannels(deviceID)
+	if err != nil {
+		slog.Error("Failed to load channels", "device_id", deviceID, "err", err)
+		return channels
+	}
+	for _, name := range names {
+		state, err := loadLastState(deviceID, name)
+		if err != nil {
+			slog.Error("Failed to load channel state", "device_id", deviceID, "channel", name, "err", err)
+			continue
+		}
+		channels[name] = state
+	}
+	return channels
+}
+
 // Session helpers
 func generateSessionID() string {
 	b := make([]byte, 32)
@@ -209,27 +186,35 @@ func generateSessionID() string {
 	return base64.URLEncoding.EncodeToString(b)
 }
 
+// generateDeviceKey returns a random hex secret for a device to authenticate its pings.
+func generateDeviceKey() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
 func getSessionEmail(r *http.Request) string {
 	cookie, err := r.Cookie("session")
 	if err != nil {
 		return ""
 	}
-	mu.Lock()
-	defer mu.Unlock()
-	if s, ok := sessions[cookie.Value]; ok && time.Now().Before(s.ExpiresAt) {
-		return s.Email
+	s, err := storage.Session(cookie.Value)
+	if err != nil {
+		return ""
 	}
-	return ""
+	return s.Email
 }
 
 func setSession(w http.ResponseWriter, email string) {
 	sessionID := generateSessionID()
-	mu.Lock()
-	sessions[sessionID] = &Session{
+	err := storage.CreateSession(store.Session{
+		ID:        sessionID,
 		Email:     email,
 		ExpiresAt: time.Now().Add(30 * 24 * time.Hour),
+	})
+	if err != nil {
+		slog.Error("Failed to save session", "email", email, "err", err)
 	}
-	mu.Unlock()
 	http.SetCookie(w, &http.Cookie{
 		Name:     "session",
 		Value:    sessionID,
@@ -243,9 +228,12 @@ func setSession(w http.ResponseWriter, email string) {
 // OAuth handlers
 func authLoginHandler(w http.ResponseWriter, r *http.Request) {
 	state := generateSessionID()
-	mu.Lock()
-	sessions["oauth_"+state] = &Session{ExpiresAt: time.Now().Add(10 * time.Minute)}
-	mu.Unlock()
+	// Pending logins are sessions without an email
+	if err := storage.CreateSession(store.Session{ID: "oauth_" + state, ExpiresAt: time.Now().Add(10 * time.Minute)}); err != nil {
+		requestLog(r).Error("Failed to save OAuth state", "err", err)
+		http.Error(w, "Internal error", 500)
+		return
+	}
 	
 	url := googleOAuthConfig.AuthCodeURL(state, oauth2.AccessTypeOffline)
 	http.Redirect(w, r, url, http.StatusTemporaryRedirect)
@@ -253,13 +241,13 @@ func authLoginHandler(w http.ResponseWriter, r *http.Request) {
 
 func authCallbackHandler(w http.ResponseWriter, r *http.Request) {
 	state := r.URL.Query().Get("state")
-	mu.Lock()
-	_, valid := sessions["oauth_"+state]
-	delete(sessions, "oauth_"+state)
-	mu.Unlock()
+	_, err := storage.Session("oauth_" + state)
+	valid := err == nil
+	storage.DeleteSession("oauth_" + state)
 	
 	if !valid {
 		http.Error(w, "Invalid state", 400)
+		return
 	}
 
 	code := r.URL.Query().Get("code")
@@ -281,16 +269,14 @@ func authCallbackHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewDecoder(resp.Body).Decode(&userInfo)
 
 	setSession(w, userInfo.Email)
-	log.Printf("User logged in: %s", userInfo.Email)
+	requestLog(r).Info("User logged in", "email", userInfo.Email)
 	http.Redirect(w, r, "/dashboard", http.StatusTemporaryRedirect)
 }
 
 func authLogoutHandler(w http.ResponseWriter, r *http.Request) {
 	cookie, err := r.Cookie("session")
 	if err == nil {
-		mu.Lock()
-		delete(sessions, cookie.Value)
-		mu.Unlock()
+		storage.DeleteSession(cookie.Value)
 	}
 	http.SetCookie(w, &http.Cookie{
 		Name:   "session",
@@ -485,27 +471,78 @@ func testFlashHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write(content)
 }
 
+// databaseURL is DATABASE_URL, a postgres:// URL or an SQLite file, or the default file.
+func databaseURL() string {
+	if dsn := os.Getenv("DATABASE_URL"); dsn != "" {
+		return dsn
+	}
+	return dbPath
+}
+
 func main() {
-	kyivLoc, _ = time.LoadLocation("Europe/Kyiv")
+	setupLogging()
+	defaultTZ := os.Getenv("DEFAULT_TIMEZONE")
+	if defaultTZ == "" { defaultTZ = "Europe/Kyiv" }
+	var err error
+	if defaultLoc, err = time.LoadLocation(defaultTZ); err != nil {
+		fatal("Invalid DEFAULT_TIMEZONE", "value", defaultTZ, "err", err)
+	}
+
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "migrate":
+			err = migrateCommand(os.Args[2:])
+		case "backup":
+			err = backupCommand(os.Args[2:])
+		case "restore":
+			err = restoreCommand(os.Args[2:])
+		case "import":
+			err = importCommand(os.Args[2:])
+		default:
+			err = fmt.Errorf("unknown command %q (migrate, backup, restore, import)", os.Args[1])
+		}
+		if err != nil {
+			fatal(err.Error())
+		}
+		return
+	}
 
-	if err := initDB(); err != nil {
-		log.Fatalf("Failed to init DB: %v", err)
+	if err := initDB(databaseURL()); err != nil {
+		fatal("Failed to init DB", "err", err)
 	}
-	defer db.Close()
+	defer storage.Close()
+	storage.DeleteExpiredSessions(time.Now())
+	setupSubscriberDelivery()
+	setupWebPush()
+	setupEmail()
+	setupRetention()
+	setupBackups()
+	setupAdmins()
 
-	loadDevices()
+	setupServerRun()
 
-	for deviceID := range devices {
-		state, _ := loadLastState(deviceID)
-		// state.LastPing loaded from DB
-		states[deviceID] = state
+	loadDevices()
+	loadPublicPages()
+
+	for deviceID, d := range devices {
+		track(d)
+		state, _ := loadLastState(deviceID, "")
+		tracker.Restore(deviceID, "", state)
+		for name, ch := range loadChannelStates(deviceID) {
+			tracker.Restore(deviceID, name, ch)
+		}
 	}
 
+	// Device transports besides /ping, started once devices and states are loaded
+	setupMQTT()
+	setupUDP()
+
 	http.HandleFunc("/", landingHandler)
 	http.HandleFunc("/dashboard", dashboardHandler)
 	http.HandleFunc("/ping", pingHandler)
 	http.HandleFunc("/api/status", apiStatusHandler)
 	http.HandleFunc("/api/history", historyHandler)
+	http.HandleFunc("/api/devices/", devicesAPIHandler)
 	http.HandleFunc("/history", historyPageHandler)
 	http.HandleFunc("/flash", flashPageHandler)
 	http.HandleFunc("/test-flash", testFlashHandler)
@@ -528,22 +565,65 @@ func main() {
 	http.HandleFunc("/api/subscribe", subscribeHandler)
 	http.HandleFunc("/api/unsubscribe/", unsubscribeHandler)
 	http.HandleFunc("/api/stats", apiStatsHandler)
+	http.HandleFunc("/api/admin/backup", adminBackupHandler)
+	http.HandleFunc("/api/admin/log-level", logLevelHandler)
+	http.HandleFunc("/api/diagnostics", diagnosticsHandler)
+	http.HandleFunc("/healthz", healthzHandler)
+	http.HandleFunc("/readyz", readyzHandler)
 	http.HandleFunc("/auth/logout", authLogoutHandler)
+	http.HandleFunc("/s/", publicPageHandler)
+	http.HandleFunc("/api/public-pages", publicPagesHandler)
+	http.HandleFunc("/api/public-pages/", publicPageDeleteHandler)
+	http.HandleFunc("/api/templates/preview", templatePreviewHandler)
+	http.HandleFunc("/api/notification-prefs", notificationPrefsHandler)
+	http.HandleFunc("/api/telegram/link", telegramLinkHandler)
+	http.HandleFunc("/api/telegram/chats", telegramChatsHandler)
+	http.HandleFunc("/api/push/key", pushKeyHandler)
+	http.HandleFunc("/api/push/subscribe", pushSubscribeHandler)
+	http.HandleFunc("/sw.js", serviceWorkerHandler)
+	http.HandleFunc("/unsubscribe", emailUnsubscribeHandler)
+	http.HandleFunc("/badge/", badgeHandler)
+	http.HandleFunc("/widget/", widgetHandler)
 	http.HandleFunc("/esptool-js/", esptoolJsHandler)
 	http.HandleFunc("/improv-wifi-sdk/", improvSdkHandler)
 
-	go monitor()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	trackerDone := runTracker(ctx)
+	go botPoller()
+	go digestScheduler()
+	go rollupScheduler()
+	go backupScheduler()
+	go serverHeartbeat()
+	go quietHoursScheduler()
+	go notificationWorker()
+
+	srv := &http.Server{Addr: port, Handler: withRequestID(http.DefaultServeMux)}
+	go func() {
+		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+			fatal("HTTP server failed", "err", err)
+		}
+	}()
+	slog.Info("Power monitor started", "addr", port)
 
-	log.Printf("Power monitor started on %s", port)
-	log.Fatal(http.ListenAndServe(port, nil))
+	<-ctx.Done()
+	stop()
+	slog.Info("Shutting down")
+	shutdown(srv, trackerDone)
 }
 
+// Pages served relative to the working directory; /readyz checks the same paths.
+const (
+	dashboardPage = "dashboard.html"
+	landingPage   = "landing.html"
+)
+
 func dashboardHandler(w http.ResponseWriter, r *http.Request) {
 	email := getSessionEmail(r)
 	if email == "" {
 		http.Redirect(w, r, "/auth/login", http.StatusTemporaryRedirect)
 	}
-	http.ServeFile(w, r, "dashboard.html")
+	http.ServeFile(w, r, dashboardPage)
 }
 
 func oldDashboardHandler(w http.ResponseWriter, r *http.Request) {
@@ -576,9 +656,10 @@ func myDevicesHandler(w http.ResponseWriter, r *http.Request) {
 		if d.OwnerEmail == email {
 			status := "offline"
 			lastPing := time.Time{}
-			if state, ok := states[id]; ok {
-				lastPing = state.LastPing
-				if time.Since(state.LastPing) < getDeviceTimeout(d) {
+			st, known := tracker.Status(id)
+			if known {
+				lastPing = st.LastPing
+				if time.Since(st.LastPing) < getDeviceTimeout(d) {
 					status = "online"
 				}
 			}
@@ -592,35 +673,54 @@ func myDevicesHandler(w http.ResponseWriter, r *http.Request) {
 				"wifi_ssid": d.WifiSSID,
 				"paused":    d.Paused,
 				"timeout":   d.Timeout,
+				"channels":  channelStatus(st),
+				"timezone":  deviceLocation(d).String(),
+
+				"digest_frequency": d.DigestFrequency,
+				"digest_time":      d.DigestTime,
+
+				"min_outage":     d.MinOutage,
+				"min_stable_up":  d.MinStableUp,
+				"flap_threshold": d.FlapThreshold,
+				"flap_window":    d.flapWindow() / time.Second,
+
+				"quiet_start": d.QuietStart,
+				"quiet_end":   d.QuietEnd,
+				"quiet_mode":  d.QuietMode,
+
+				"locale":    d.Locale,
+				"templates": d.Templates,
+
+				"device_key":   d.DeviceKey,
+				"bot_commands": d.BotCommands,
 			})
 		}
 	}
 	
 	// Get subscribed devices from database
 	var subscribed []map[string]interface{}
-	rows, err := db.Query("SELECT device_id FROM subscriptions WHERE email = ?", email)
-	if err == nil {
-		defer rows.Close()
-		for rows.Next() {
-			var deviceID string
-			rows.Scan(&deviceID)
-			
-			if d, ok := devices[deviceID]; ok {
-				status := "offline"
-				lastPing := time.Time{}
-				if state, ok := states[deviceID]; ok {
-					lastPing = state.LastPing
-					if time.Since(state.LastPing) < getDeviceTimeout(d) {
-						status = "online"
-					}
+	ids, err := storage.Subscriptions(email)
+	if err != nil {
+		requestLog(r).Error("Failed to load subscriptions", "email", email, "err", err)
+	}
+	for _, deviceID := range ids {
+		if d, ok := devices[deviceID]; ok {
+			status := "offline"
+			lastPing := time.Time{}
+			st, known := tracker.Status(deviceID)
+			if known {
+				lastPing = st.LastPing
+				if time.Since(st.LastPing) < getDeviceTimeout(d) {
+					status = "online"
 				}
-				subscribed = append(subscribed, map[string]interface{}{
-					"id":        deviceID,
-					"name":      d.Name,
-					"status":    status,
-					"last_ping": lastPing.Format(time.RFC3339),
-				})
 			}
+			subscribed = append(subscribed, map[string]interface{}{
+				"id":        deviceID,
+				"name":      d.Name,
+				"status":    status,
+				"last_ping": lastPing.Format(time.RFC3339),
+				"channels":  channelStatus(st),
+			})
 		}
 	}
 
@@ -659,6 +759,25 @@ func myDeviceHandler(w http.ResponseWriter, r *http.Request) {
 			WifiSSID string `json:"wifi_ssid"`
 			Paused   *bool  `json:"paused"`
 			Timeout  *int   `json:"timeout"`
+			Timezone *string `json:"timezone"`
+
+			DigestFrequency *string `json:"digest_frequency"`
+			DigestTime      *string `json:"digest_time"`
+
+			MinOutage     *int `json:"min_outage"`
+			MinStableUp   *int `json:"min_stable_up"`
+			FlapThreshold *int `json:"flap_threshold"`
+			FlapWindow    *int `json:"flap_window"`
+
+			QuietStart *string `json:"quiet_start"`
+			QuietEnd   *string `json:"quiet_end"`
+			QuietMode  *string `json:"quiet_mode"`
+
+			Locale    *string           `json:"locale"`
+			Templates map[string]string `json:"templates"`
+
+			RegenerateKey bool  `json:"regenerate_key"`
+			BotCommands   *bool `json:"bot_commands"`
 		}
 		json.NewDecoder(r.Body).Decode(&data)
 		if data.Name != "" {
@@ -681,15 +800,102 @@ func myDeviceHandler(w http.ResponseWriter, r *http.Request) {
 			if t > 300 { t = 300 }
 			d.Timeout = t
 		}
+		if data.Timezone != nil {
+			if _, err := time.LoadLocation(*data.Timezone); err != nil {
+				http.Error(w, "invalid timezone", 400)
+				return
+			}
+			d.Timezone = *data.Timezone
+		}
+		if data.DigestFrequency != nil {
+			switch *data.DigestFrequency {
+			case "", "daily", "weekly":
+				d.DigestFrequency = *data.DigestFrequency
+			default:
+				http.Error(w, "invalid digest_frequency", 400)
+				return
+			}
+		}
+		if data.DigestTime != nil {
+			if _, err := time.Parse("15:04", *data.DigestTime); err != nil {
+				http.Error(w, "invalid digest_time", 400)
+				return
+			}
+			d.DigestTime = *data.DigestTime
+		}
+		if data.MinOutage != nil {
+			d.MinOutage = clampSeconds(*data.MinOutage, 0, 3600)
+		}
+		if data.MinStableUp != nil {
+			d.MinStableUp = clampSeconds(*data.MinStableUp, 0, 3600)
+		}
+		if data.FlapThreshold != nil {
+			d.FlapThreshold = clampSeconds(*data.FlapThreshold, 0, 50)
+		}
+		if data.FlapWindow != nil {
+			d.FlapWindow = clampSeconds(*data.FlapWindow, 60, 3600)
+		}
+		for _, t := range []*string{data.QuietStart, data.QuietEnd} {
+			if t == nil || *t == "" { continue }
+			if _, err := time.Parse("15:04", *t); err != nil {
+				http.Error(w, "invalid quiet hours", 400)
+				return
+			}
+		}
+		if data.QuietStart != nil {
+			d.QuietStart = *data.QuietStart
+		}
+		if data.QuietEnd != nil {
+			d.QuietEnd = *data.QuietEnd
+		}
+		if data.QuietMode != nil {
+			switch *data.QuietMode {
+			case "", "silent", "hold":
+				d.QuietMode = *data.QuietMode
+			default:
+				http.Error(w, "invalid quiet_mode", 400)
+				return
+			}
+		}
+		if data.Locale != nil {
+			if _, ok := locales[*data.Locale]; !ok && *data.Locale != "" {
+				http.Error(w, "unknown locale", 400)
+				return
+			}
+			d.Locale = *data.Locale
+		}
+		if data.Templates != nil {
+			if err := validateTemplates(d.Locale, data.Templates); err != nil {
+				http.Error(w, "invalid template: "+err.Error(), 400)
+				return
+			}
+			for kind, text := range data.Templates {
+				if text == "" { delete(data.Templates, kind) }
+			}
+			d.Templates = data.Templates
+		}
+		if data.BotCommands != nil {
+			d.BotCommands = *data.BotCommands
+		}
+		if data.RegenerateKey {
+			d.DeviceKey = generateDeviceKey()
+			d.UDPSeq = 0
+			delete(mqttWills, id)
+			requestLog(r).Info("Device key regenerated", "device_id", id)
+		}
 		saveDevice(d)
+		track(d)
 		w.Write([]byte("ok"))
 
 	case "DELETE":
 		delete(devices, id)
-		delete(states, id)
-		db.Exec("DELETE FROM devices WHERE id = ?", id)
-		db.Exec("DELETE FROM events WHERE device_id = ?", id)
-		db.Exec("DELETE FROM subscriptions WHERE device_id = ?", id)
+		delete(telemetry, id)
+		delete(mqttWills, id)
+		tracker.Remove(id)
+		if err := storage.DeleteDevice(id); err != nil {
+			requestLog(r).Error("Failed to delete device", "device_id", id, "err", err)
+		}
+		removeFromPublicPages(id)
 		w.Write([]byte("ok"))
 
 	default:
@@ -703,51 +909,118 @@ func apiStatusHandler(w http.ResponseWriter, r *http.Request) {
 
 	result := make(map[string]interface{})
 	for id, d := range devices {
-		state := states[id]
-		if state == nil {
-			state = &DeviceState{IsDown: true, LastPing: time.Now(), DownSince: time.Now()}
+		st, known := tracker.Status(id)
+		if !known {
+			st = monitor.Status{LastPing: time.Now(), Since: time.Now()}
 		}
-		status := "up"
-		since := state.UpSince
-		if state.IsDown {
-			status = "down"
-			since = state.DownSince
+		status := "down"
+		if st.Up {
+			status = "up"
 		}
 		result[id] = map[string]interface{}{
 			"name":       d.Name,
 			"status":     status,
-			"last_ping":  state.LastPing.Format(time.RFC3339),
-			"since":      since.Format(time.RFC3339),
+			"last_ping":  st.LastPing.Format(time.RFC3339),
+			"since":      st.Since.Format(time.RFC3339),
 			"configured": d.Configured,
+			"channels":   channelStatus(st),
+			"telemetry":  telemetry[id],
 		}
 	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(result)
 }
 
+// channelStatus summarizes the named channels of a device for the JSON APIs.
+func channelStatus(st monitor.Status) map[string]interface{} {
+	if len(st.Channels) == 0 {
+		return nil
+	}
+	result := make(map[string]interface{})
+	for name, ch := range st.Channels {
+		status := "down"
+		if ch.Up {
+			status = "up"
+		}
+		result[name] = map[string]interface{}{
+			"status":    status,
+			"last_ping": ch.LastPing.Format(time.RFC3339),
+			"since":     ch.Since.Format(time.RFC3339),
+		}
+	}
+	return result
+}
+
+// apiStatsHandler serves overall counters; ?days=N adds the outages of all devices over
+// the last N days in each device's timezone.
 func apiStatsHandler(w http.ResponseWriter, r *http.Request) {
+	days := 0
+	if s := r.URL.Query().Get("days"); s != "" {
+		fmt.Sscanf(s, "%d", &days)
+	}
+	if days > 366 { days = 366 }
+
 	mu.Lock()
 	online := 0
-	for _, state := range states {
-		if state != nil && !state.IsDown {
+	locs := make(map[string]*time.Location)
+	for id, d := range devices {
+		if st, known := tracker.Status(id); known && st.Up {
 			online++
 		}
+		locs[id] = deviceLocation(d)
 	}
 	mu.Unlock()
 
-	today := time.Now().Format("2006-01-02")
-	var eventsToday int
-	db.QueryRow("SELECT COUNT(*) FROM events WHERE date(timestamp) = ?", today).Scan(&eventsToday)
+	now := time.Now()
+	y, m, d := now.Date()
+	today := time.Date(y, m, d, 0, 0, 0, 0, time.Local)
+	eventsToday, _ := storage.CountEvents(today, today.AddDate(0, 0, 1))
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
+	result := map[string]interface{}{
 		"devices_online": online,
 		"events_today":   eventsToday,
-	})
+	}
+	if days > 0 {
+		outages, downtime := 0, int64(0)
+		nodata := int64(0)
+		for id, loc := range locs {
+			from := bucketStart(now, "day", loc).AddDate(0, 0, -(days - 1))
+			buckets, _, err := dayBuckets(id, "", from, now, loc)
+			if err != nil {
+				requestLog(r).Error("Stats failed", "device_id", id, "err", err)
+				continue
+			}
+			for _, b := range buckets {
+				outages += b.Outages
+				downtime += b.DownSeconds
+				nodata += b.NoDataSeconds
+			}
+		}
+		result["days"] = days
+		result["outages"] = outages
+		result["downtime_seconds"] = downtime
+		result["nodata_seconds"] = nodata
+
+		// The server's own downtime, counted as no data rather than outages
+		gaps, err := serverGaps(bucketStart(now, "day", defaultLoc).AddDate(0, 0, -(days - 1)), now)
+		if err != nil {
+			requestLog(r).Error("Stats failed", "err", err)
+		}
+		serverDown := int64(0)
+		for _, g := range gaps {
+			serverDown += int64(g.Duration().Seconds())
+		}
+		result["server_gaps"] = len(gaps)
+		result["server_downtime_seconds"] = serverDown
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
 }
 
 func historyHandler(w http.ResponseWriter, r *http.Request) {
 	deviceID := r.URL.Query().Get("device")
+	channel := r.URL.Query().Get("channel")
 	limit := 10
 	if l := r.URL.Query().Get("limit"); l != "" {
 		fmt.Sscanf(l, "%d", &limit)
@@ -762,20 +1035,30 @@ func historyHandler(w http.ResponseWriter, r *http.Request) {
 		for id := range devices { deviceList = append(deviceList, id) }
 	}
 
+	// ?gaps=1 lists the times the server was down among the events, as type "server"
+	withGaps := r.URL.Query().Get("gaps") == "1"
+
 	for _, id := range deviceList {
-		rows, err := db.Query("SELECT event_type, timestamp, duration_seconds FROM events WHERE device_id = ? ORDER BY timestamp DESC LIMIT ?", id, limit)
+		recent, err := storage.RecentEvents(id, channel, limit)
 		if err != nil { continue }
+		var gaps []interval
+		if withGaps && len(recent) > 0 {
+			gaps, _ = serverGaps(recent[len(recent)-1].Time, time.Now())
+		}
 		var events []map[string]interface{}
-		for rows.Next() {
-			var eventType string
-			var ts time.Time
-			var duration sql.NullInt64
-			rows.Scan(&eventType, &ts, &duration)
-			ev := map[string]interface{}{"type": eventType, "time": ts.Format(time.RFC3339)}
-			if duration.Valid { ev["duration"] = duration.Int64 }
+		for _, e := range recent {
+			for len(gaps) > 0 && !gaps[len(gaps)-1].Start.Before(e.Time) {
+				g := gaps[len(gaps)-1]
+				gaps = gaps[:len(gaps)-1]
+				events = append(events, map[string]interface{}{
+					"type": "server", "time": g.Start.Format(time.RFC3339), "end": g.End.Format(time.RFC3339),
+					"duration": int64(g.Duration().Seconds()),
+				})
+			}
+			ev := map[string]interface{}{"type": e.Type, "time": e.Time.Format(time.RFC3339), "suppressed": e.Suppressed}
+			if e.Duration.Valid { ev["duration"] = e.Duration.Int64 }
 			events = append(events, ev)
 		}
-		rows.Close()
 		result[id] = events
 	}
 
@@ -783,45 +1066,125 @@ func historyHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(result)
 }
 
+// pingHandler accepts heartbeats from devices. Besides the device heartbeat itself,
+// a device watching several inputs reports them as ?channels=L1:1,L2:0,L3:1 where
+// 1 means the input is powered; each channel gets its own up/down events.
 func pingHandler(w http.ResponseWriter, r *http.Request) {
 	deviceID := r.URL.Query().Get("device")
 	if deviceID == "" { deviceID = "default" }
+	if !validDeviceID(deviceID) {
+		http.Error(w, "invalid device", 400)
+		return
+	}
+	channels := parseChannels(r.URL.Query().Get("channels"))
+	requestLog(r).Debug("Ping", "device_id", deviceID, "channels", len(channels))
+	recordPing(deviceID, channels)
+	w.Write([]byte("ok"))
+}
 
+// recordPing marks the device and its reported channels alive, whichever transport the
+// ping came by. Unknown devices are registered.
+func recordPing(deviceID string, reported map[string]bool) {
 	mu.Lock()
-	config, exists := devices[deviceID]
-	if !exists {
-		config = &DeviceConfig{ID: deviceID, Name: deviceID}
+	if _, exists := devices[deviceID]; !exists {
+		config := &DeviceConfig{Device: store.Device{ID: deviceID, Name: deviceID, DeviceKey: generateDeviceKey()}}
 		devices[deviceID] = config
 		saveDevice(config)
-		log.Printf("Auto-registered device: %s", deviceID)
+		track(config)
+		slog.Info("Auto-registered device", "device_id", deviceID)
 	}
+	mu.Unlock()
 
-	state, exists := states[deviceID]
-	if !exists {
-		state = &DeviceState{UpSince: time.Now(), LastPing: time.Now()}
-		states[deviceID] = state
+	queueEvents(func() monitor.Events { return tracker.Ping(deviceID, reported) })
+}
+
+// recordOffline takes the device and its channels down at their last ping without
+// waiting for the timeout, for transports that report a lost connection.
+func recordOffline(deviceID string) {
+	queueEvents(func() monitor.Events { return tracker.Offline(deviceID) })
+}
+
+// parseChannels parses "L1:1,L2:0,grid:on" into channel name -> powered.
+// Malformed entries are ignored.
+func parseChannels(s string) map[string]bool {
+	result := make(map[string]bool)
+	if s == "" { return result }
+	for _, part := range strings.Split(s, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(part), ":")
+		if !ok || !validChannelName(name) { continue }
+		switch value {
+		case "1", "on", "up":
+			result[name] = true
+		case "0", "off", "down":
+			result[name] = false
+		}
 	}
+	return result
+}
 
-	wasDown := state.IsDown
-	downTime := state.DownSince
-	state.LastPing = time.Now()
-	state.IsDown = false
-	if wasDown { state.UpSince = time.Now() }
-	mu.Unlock()
+// validDeviceID accepts the IDs devices may register with. They end up in mail
+// headers, chat messages and MQTT topics, so control characters are out.
+func validDeviceID(id string) bool {
+	if id == "" || len(id) > 64 || !utf8.ValidString(id) { return false }
+	for _, c := range id {
+		if unicode.IsControl(c) { return false }
+	}
+	return true
+}
 
-	if wasDown {
-		duration := time.Since(downTime)
-		log.Printf("[%s] Light ON after %s", deviceID, formatDuration(duration))
-		saveEvent(deviceID, "up", time.Now(), int64(duration.Seconds()))
-		if config.Configured && !config.Paused {
-			now := time.Now().In(kyivLoc)
-			msg := fmt.Sprintf("🟢 %s Світло з'явилось\n🕓 Його не було %s", now.Format("15:04"), formatDuration(duration))
-			msgID := sendTelegram(config.BotToken, config.ChatID, msg)
-			setChatPhoto(config.BotToken, config.ChatID, greenAvatar, msgID)
+func validChannelName(name string) bool {
+	if name == "" || len(name) > 32 { return false }
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
 		}
 	}
+	return true
+}
 
-	w.Write([]byte("ok"))
+// channelSuffix renders the channel name for command output, empty for the device itself.
+func channelSuffix(channel string) string {
+	if channel == "" { return "" }
+	return " (" + channel + ")"
+}
+
+func notifyUp(config *DeviceConfig, channel string, at time.Time, duration time.Duration) {
+	if config.Paused { return }
+	data := newMessageData(config, "up", channel, at)
+	data.Duration = localeFor(config.Locale).duration(duration)
+	msg := renderMessage(config, data)
+	// Attach the last 24h so the chat sees the whole outage at a glance
+	chart := func() ([]byte, error) { return renderOutageChart(config, channel, 1) }
+	if config.Configured {
+		deliverAlert(config, msg, chart, deviceAvatar(channel, greenAvatar))
+	}
+	notifySubscribers(config, "up", msg)
+}
+
+func notifyDown(config *DeviceConfig, channel string, at time.Time, upDuration time.Duration) {
+	if config.Paused { return }
+	data := newMessageData(config, "down", channel, at)
+	data.Duration = localeFor(config.Locale).duration(upDuration)
+	data.ExpectedReturn = formatExpected(expectedReturn(config, channel, at), at, deviceLocation(config))
+	msg := renderMessage(config, data)
+	if config.Configured {
+		deliverAlert(config, msg, nil, deviceAvatar(channel, redAvatar))
+	}
+	notifySubscribers(config, "down", msg)
+}
+
+// deviceAvatar returns the chat photo for a state change; only the device itself, not
+// its channels, changes the photo.
+func deviceAvatar(channel, avatar string) string {
+	if channel != "" { return "" }
+	return avatar
+}
+
+// clampSeconds bounds a user-supplied setting.
+func clampSeconds(v, min, max int) int {
+	if v < min { return min }
+	if v > max { return max }
+	return v
 }
 
 func getDeviceTimeout(d *DeviceConfig) time.Duration {
@@ -831,46 +1194,66 @@ func getDeviceTimeout(d *DeviceConfig) time.Duration {
 	return timeout
 }
 
-func monitor() {
-	for {
-		time.Sleep(10 * time.Second)
-		mu.Lock()
-		for deviceID, state := range states {
-			config := devices[deviceID]
-			if config == nil { continue }
-			if !state.IsDown && time.Since(state.LastPing) > getDeviceTimeout(config) {
-				state.IsDown = true
-				state.DownSince = state.LastPing
-				upDuration := state.DownSince.Sub(state.UpSince)
-				log.Printf("[%s] Light OFF after %s up", deviceID, formatDuration(upDuration))
-				go saveEvent(deviceID, "down", time.Now(), int64(upDuration.Seconds()))
-				if config.Configured && !config.Paused {
-					now := time.Now().In(kyivLoc)
-					msg := fmt.Sprintf("🔴 %s Світло зникло\n🕓 Воно було %s", now.Format("15:04"), formatDuration(upDuration))
-					go func(bt, ci, m, pp string) {
-						msgID := sendTelegram(bt, ci, m)
-						setChatPhoto(bt, ci, pp, msgID)
-					}(config.BotToken, config.ChatID, msg, redAvatar)
-				}
-			}
-		}
-		mu.Unlock()
-	}
+func sendTelegram(botToken, chatID, text string) int {
+	return sendTelegramMessage(botToken, chatID, text, false)
 }
 
-func sendTelegram(botToken, chatID, text string) int {
+// sendTelegramMessage sends text and returns the message ID (0 on failure); silent
+// messages arrive without a notification sound.
+func sendTelegramMessage(botToken, chatID, text string, silent bool) int {
 	if botToken == "" || chatID == "" { return 0 }
 	apiURL := fmt.Sprintf("https://api.telegram.org/bot%s/sendMessage", botToken)
-	resp, err := http.PostForm(apiURL, url.Values{"chat_id": {chatID}, "text": {text}})
-	if err != nil { return 0 }
+	form := url.Values{"chat_id": {chatID}, "text": {text}}
+	if silent { form.Set("disable_notification", "true") }
+	resp, err := http.PostForm(apiURL, form)
+	if err != nil {
+		noteError("telegram", err)
+		return 0
+	}
 	defer resp.Body.Close()
 	var result struct {
-		OK     bool `json:"ok"`
-		Result struct {
+		OK          bool   `json:"ok"`
+		Description string `json:"description"`
+		Result      struct {
 			MessageID int `json:"message_id"`
 		} `json:"result"`
 	}
 	json.NewDecoder(resp.Body).Decode(&result)
+	if !result.OK {
+		noteError("telegram", fmt.Errorf("sendMessage: %s %s", resp.Status, result.Description))
+	}
+	return result.Result.MessageID
+}
+
+// sendTelegramPhoto sends a PNG with a caption and returns the message ID (0 on failure).
+func sendTelegramPhoto(botToken, chatID, caption string, photo []byte, silent bool) int {
+	if botToken == "" || chatID == "" { return 0 }
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	writer.WriteField("chat_id", chatID)
+	writer.WriteField("caption", caption)
+	if silent { writer.WriteField("disable_notification", "true") }
+	part, _ := writer.CreateFormFile("photo", "chart.png")
+	part.Write(photo)
+	writer.Close()
+	apiURL := fmt.Sprintf("https://api.telegram.org/bot%s/sendPhoto", botToken)
+	resp, err := http.Post(apiURL, writer.FormDataContentType(), body)
+	if err != nil {
+		noteError("telegram", err)
+		return 0
+	}
+	defer resp.Body.Close()
+	var result struct {
+		OK          bool   `json:"ok"`
+		Description string `json:"description"`
+		Result      struct {
+			MessageID int `json:"message_id"`
+		} `json:"result"`
+	}
+	json.NewDecoder(resp.Body).Decode(&result)
+	if !result.OK {
+		noteError("telegram", fmt.Errorf("sendPhoto: %s %s", resp.Status, result.Description))
+	}
 	return result.Result.MessageID
 }
 
@@ -906,10 +1289,7 @@ func setChatPhoto(botToken, chatID, photoPath string, afterMsgID int) {
 func formatDuration(d time.Duration) string {
 	if d < 0 { d = 0 }
 	if d > 365*24*time.Hour { d = 0 } // overflow protection
-	h := int(d.Hours())
-	m := int(d.Minutes()) % 60
-	if h > 0 { return fmt.Sprintf("%dгод %dхв", h, m) }
-	return fmt.Sprintf("%dхв", m)
+	return localeFor(defaultLocale).duration(d)
 }
 
 func flashPageHandler(w http.ResponseWriter, r *http.Request) {
@@ -966,15 +1346,19 @@ func manifestHandler(w http.ResponseWriter, r *http.Request) {
 		mu.Lock()
 		if _, exists := devices[device]; !exists {
 			d := &DeviceConfig{
-				ID: device, Name: name,
-				BotToken: botToken, ChatID: chatID,
+				Device: store.Device{
+					ID: device, Name: name,
+					BotToken: botToken, ChatID: chatID,
+					OwnerEmail: ownerEmail,
+					DeviceKey:  generateDeviceKey(),
+				},
 				Configured: botToken != "" && chatID != "",
-				OwnerEmail: ownerEmail,
 			}
 			devices[device] = d
-			states[device] = &DeviceState{LastPing: time.Now(), UpSince: time.Now()}
 			saveDevice(d)
-			log.Printf("Pre-registered device: %s (%s) owner=%s", device, name, ownerEmail)
+			track(d)
+			tracker.Restore(device, "", monitor.State{LastPing: time.Now(), UpSince: time.Now()})
+			requestLog(r).Info("Pre-registered device", "device_id", device, "name", name, "owner", ownerEmail)
 		}
 		mu.Unlock()
 	}
@@ -1065,7 +1449,7 @@ func landingHandler(w http.ResponseWriter, r *http.Request) {
 	if r.URL.Path != "/" {
 		http.NotFound(w, r)
 	}
-	http.ServeFile(w, r, "landing.html")
+	http.ServeFile(w, r, landingPage)
 }
 
 func subscribeHandler(w http.ResponseWriter, r *http.Request) {
@@ -1095,8 +1479,7 @@ func subscribeHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Пристрій не знайдено", 404)
 	}
 	
-	_, err := db.Exec("INSERT OR IGNORE INTO subscriptions (email, device_id) VALUES (?, ?)", email, req.DeviceID)
-	if err != nil {
+	if err := storage.Subscribe(email, req.DeviceID); err != nil {
 		http.Error(w, "Database error", 500)
 	}
 	
@@ -1119,7 +1502,8 @@ func unsubscribeHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Device ID required", 400)
 	}
 	
-	db.Exec("DELETE FROM subscriptions WHERE email = ? AND device_id = ?", email, deviceID)
+	storage.Unsubscribe(email, deviceID)
+	storage.DeletePrefs(email, deviceID, "")
 	w.WriteHeader(200)
 }
 
@@ -1167,6 +1551,10 @@ func claimDeviceHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "device required", 400)
 		return
 	}
+	if !validDeviceID(deviceID) {
+		http.Error(w, "invalid device", 400)
+		return
+	}
 	deviceName := r.URL.Query().Get("name")
 
 	mu.Lock()
@@ -1175,19 +1563,21 @@ func claimDeviceHandler(w http.ResponseWriter, r *http.Request) {
 	d, exists := devices[deviceID]
 	if !exists {
 		// Create new device if it doesn't exist yet
-		d = &DeviceConfig{
-			ID:   deviceID,
-			Name: deviceName,
-		}
+		d = &DeviceConfig{Device: store.Device{
+			ID:        deviceID,
+			Name:      deviceName,
+			DeviceKey: generateDeviceKey(),
+		}}
 		devices[deviceID] = d
-		states[deviceID] = &DeviceState{LastPing: time.Now(), DownSince: time.Now(), IsDown: true}
-		log.Printf("Device %s created during claim", deviceID)
+		track(d)
+		tracker.Restore(deviceID, "", monitor.State{LastPing: time.Now(), DownSince: time.Now(), IsDown: true})
+		requestLog(r).Info("Device created during claim", "device_id", deviceID)
 	}
 
 	// If device has different owner, add them as subscriber before transferring
 	if d.OwnerEmail != "" && d.OwnerEmail != email {
-		db.Exec("INSERT OR IGNORE INTO subscriptions (email, device_id) VALUES (?, ?)", d.OwnerEmail, deviceID)
-		log.Printf("Device %s: old owner %s added to subscribers", deviceID, d.OwnerEmail)
+		storage.Subscribe(d.OwnerEmail, deviceID)
+		requestLog(r).Info("Old owner added to subscribers", "device_id", deviceID, "email", d.OwnerEmail)
 	}
 
 	d.OwnerEmail = email
@@ -1197,7 +1587,7 @@ func claimDeviceHandler(w http.ResponseWriter, r *http.Request) {
 	// Clear WiFi on re-flash (NVS is erased on ESP32)
 	d.WifiSSID = ""
 	saveDevice(d)
-	log.Printf("Device %s claimed by %s", deviceID, email)
+	requestLog(r).Info("Device claimed", "device_id", deviceID, "email", email)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{"status": "ok", "device": deviceID})
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"power-monitor/store"
+)
+
+const migrateUsage = "usage: power-monitor migrate status|up|down"
+
+// migrateCommand runs "power-monitor migrate status|up|down" against DATABASE_URL.
+// The server applies pending migrations itself on start; down reverts one at a time.
+func migrateCommand(args []string) error {
+	if len(args) != 1 {
+		return errors.New(migrateUsage)
+	}
+	s, err := store.Open(databaseURL())
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	db := s.DB()
+
+	switch args[0] {
+	case "status":
+		list, err := db.MigrationStatus()
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED")
+		for _, m := range list {
+			applied := "pending"
+			if !m.AppliedAt.IsZero() {
+				applied = m.AppliedAt.Local().Format("2006-01-02 15:04:05")
+			}
+			fmt.Fprintf(w, "%04d\t%s\t%s\n", m.Version, m.Name, applied)
+		}
+		return w.Flush()
+
+	case "up":
+		applied, err := db.MigrateUp()
+		for _, m := range applied {
+			fmt.Printf("applied %04d_%s\n", m.Version, m.Name)
+		}
+		if err == nil && len(applied) == 0 {
+			fmt.Println("schema is up to date")
+		}
+		return err
+
+	case "down":
+		m, reverted, err := db.MigrateDown()
+		if err != nil {
+			return err
+		}
+		if !reverted {
+			fmt.Println("no migrations applied")
+			return nil
+		}
+		fmt.Printf("reverted %04d_%s\n", m.Version, m.Name)
+		return nil
+	}
+	return errors.New(migrateUsage)
+}
@@ -0,0 +1,109 @@
+package monitor
+
+import (
+	"log/slog"
+	"time"
+)
+
+func stateName(up bool) string {
+	if up {
+		return "up"
+	}
+	return "down"
+}
+
+// applyHysteresis decides what a transition means for the chat. It reports true when
+// the transition will never be announced on its own: during flapping, or when it
+// undoes a change that was still waiting out its debounce delay.
+func (t *Tracker) applyHysteresis(ev *Events, d *device, st *State, up bool, at time.Time, duration time.Duration, ref Ref) bool {
+	if st.announced == "" {
+		st.announced = stateName(!up)
+		st.announcedSince = at.Add(-duration)
+	}
+
+	s := d.settings
+	if s.FlapThreshold > 0 {
+		cutoff := at.Add(-s.flapWindow())
+		recent := st.transitions[:0]
+		for _, tr := range st.transitions {
+			if tr.After(cutoff) {
+				recent = append(recent, tr)
+			}
+		}
+		st.transitions = append(recent, at)
+		if !st.flapping && len(st.transitions) >= s.FlapThreshold {
+			slog.Warn("Power is flapping", "device_id", ref.DeviceID, "channel", ref.Channel, "changes", len(st.transitions), "window", s.flapWindow().String())
+			st.flapping = true
+			st.flapSince = st.transitions[0]
+			st.flapOutages = 0
+			st.flapDowntime = 0
+			if st.pending != nil {
+				ev.Suppressed = append(ev.Suppressed, *st.pending)
+				st.pending = nil
+			}
+			t.alert(ev, d, Alert{DeviceID: ref.DeviceID, Channel: ref.Channel, Kind: "unstable", At: at})
+		}
+	}
+	if st.flapping {
+		if up {
+			st.flapDowntime += duration
+		} else {
+			st.flapOutages++
+		}
+		return true
+	}
+
+	if st.pending != nil {
+		// Back to the announced state before the delay ran out: a blip, say nothing
+		ev.Suppressed = append(ev.Suppressed, *st.pending)
+		st.pending = nil
+		return true
+	}
+	if stateName(up) == st.announced {
+		return true
+	}
+	st.pending = &ref
+	st.pendingAt = at
+	return false
+}
+
+// checkPending announces changes that outlived their debounce delay and ends flapping
+// once a full flap window passes without transitions. Callers must hold t.mu.
+func (t *Tracker) checkPending(ev *Events, deviceID, channel string, d *device, st *State, now time.Time) {
+	s := d.settings
+	if st.flapping {
+		last := st.flapSince
+		if n := len(st.transitions); n > 0 {
+			last = st.transitions[n-1]
+		}
+		if now.Sub(last) < s.flapWindow() {
+			return
+		}
+		slog.Info("Power stable again", "device_id", deviceID, "channel", channel)
+		t.alert(ev, d, Alert{
+			DeviceID: deviceID, Channel: channel, Kind: "stable", At: now, Up: !st.IsDown,
+			FlapSince: st.flapSince, FlapOutages: st.flapOutages, FlapDowntime: st.flapDowntime,
+		})
+		st.flapping = false
+		st.transitions = nil
+		st.announced = stateName(!st.IsDown)
+		st.announcedSince = last
+		return
+	}
+
+	if st.pending == nil {
+		return
+	}
+	delay := s.MinStableUp
+	if st.IsDown {
+		delay = s.MinOutage
+	}
+	if now.Sub(st.pendingAt) < delay {
+		return
+	}
+	kind := stateName(!st.IsDown)
+	t.alert(ev, d, Alert{DeviceID: deviceID, Channel: channel, Kind: kind, At: st.pendingAt, Duration: st.pendingAt.Sub(st.announcedSince)})
+	st.announced = kind
+	st.announcedSince = st.pendingAt
+	st.pending = nil
+}
@@ -0,0 +1,318 @@
+// Package monitor tracks whether devices and their channels have power, from pings and
+// timeouts, and decides which changes are worth announcing. It keeps no storage and
+// sends nothing: every call returns Events for the caller to write and deliver.
+package monitor
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultTimeout    = 90 * time.Second
+	DefaultFlapWindow = 10 * time.Minute
+)
+
+// Settings are the per-device options that affect tracking.
+type Settings struct {
+	Timeout       time.Duration // silence before the device counts as down, 0 = DefaultTimeout
+	MinOutage     time.Duration // an outage must last this long to be announced
+	MinStableUp   time.Duration // power must stay back this long to be announced
+	FlapThreshold int           // transitions within FlapWindow that count as flapping, 0 = off
+	FlapWindow    time.Duration // 0 = DefaultFlapWindow
+	Paused        bool          // record transitions but announce nothing
+}
+
+func (s Settings) timeout() time.Duration {
+	if s.Timeout > 0 {
+		return s.Timeout
+	}
+	return DefaultTimeout
+}
+
+func (s Settings) flapWindow() time.Duration {
+	if s.FlapWindow > 0 {
+		return s.FlapWindow
+	}
+	return DefaultFlapWindow
+}
+
+// State is the power state of a device or one of its channels.
+type State struct {
+	LastPing  time.Time
+	IsDown    bool
+	DownSince time.Time
+	UpSince   time.Time
+
+	// Notification hysteresis, see hysteresis.go
+	announced      string // last state announced: "up", "down" or "" before the first change
+	announcedSince time.Time
+	pending        *Ref // change waiting out MinOutage/MinStableUp
+	pendingAt      time.Time
+	transitions    []time.Time // recent changes for flap detection
+	flapping       bool
+	flapSince      time.Time
+	flapOutages    int
+	flapDowntime   time.Duration
+}
+
+// Status is a read-only snapshot of a device or channel.
+type Status struct {
+	Up       bool
+	LastPing time.Time
+	Since    time.Time         // start of the current state
+	Channels map[string]Status // named inputs (phases, grid/generator), nil for channels themselves
+}
+
+// Ref identifies a recorded transition by device, channel and the time it was detected,
+// the key of a row in the events table.
+type Ref struct {
+	DeviceID string
+	Channel  string
+	Time     time.Time
+}
+
+// Transition is a change of state to record.
+type Transition struct {
+	Ref
+	Up         bool
+	At         time.Time     // when the change happened; Ref.Time is when it was noticed
+	Duration   time.Duration // how long the previous state lasted
+	Suppressed bool          // it will never be announced on its own
+}
+
+// Alert is a change worth telling people about.
+type Alert struct {
+	DeviceID string
+	Channel  string
+	Kind     string // "up", "down", "unstable" or "stable"
+	At       time.Time
+	Duration time.Duration // how long the previous announced state lasted
+
+	// Flap summary for "stable"
+	Up           bool
+	FlapSince    time.Time
+	FlapOutages  int
+	FlapDowntime time.Duration
+}
+
+// Events are the results of one tracker call, to be applied in order: transitions
+// first, then the earlier transitions that turned out silent, then alerts.
+type Events struct {
+	Transitions []Transition
+	Suppressed  []Ref
+	Alerts      []Alert
+}
+
+type device struct {
+	settings Settings
+	state    *State // nil until the first ping or restore
+	channels map[string]*State
+}
+
+// Tracker owns the state of every device. It is safe for concurrent use.
+type Tracker struct {
+	clock      Clock
+	mu         sync.Mutex
+	devices    map[string]*device
+	graceUntil time.Time // no timeouts before this
+}
+
+func New(clock Clock) *Tracker {
+	return &Tracker{clock: clock, devices: make(map[string]*device)}
+}
+
+func (t *Tracker) device(id string) *device {
+	d := t.devices[id]
+	if d == nil {
+		d = &device{channels: make(map[string]*State)}
+		t.devices[id] = d
+	}
+	return d
+}
+
+// Configure sets a device's settings; call it whenever they change.
+func (t *Tracker) Configure(deviceID string, s Settings) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.device(deviceID).settings = s
+}
+
+// Restore sets the state of a device, or of a channel when channel isn't empty, as
+// known from storage or registration. Hysteresis starts over.
+func (t *Tracker) Restore(deviceID, channel string, st State) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	restored := &State{LastPing: st.LastPing, IsDown: st.IsDown, DownSince: st.DownSince, UpSince: st.UpSince}
+	d := t.device(deviceID)
+	if channel == "" {
+		d.state = restored
+	} else {
+		d.channels[channel] = restored
+	}
+}
+
+// Grace holds off timeouts until the given time, while devices reconnect after a server
+// restart. Pings are tracked as usual in the meantime.
+func (t *Tracker) Grace(until time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.graceUntil = until
+}
+
+// Remove forgets a device.
+func (t *Tracker) Remove(deviceID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.devices, deviceID)
+}
+
+// Ping marks the device alive along with the state of each reported channel. Channels
+// seen for the first time start in the reported state with a suppressed transition, so
+// their history begins at the first report.
+func (t *Tracker) Ping(deviceID string, channels map[string]bool) Events {
+	now := t.clock.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var ev Events
+	d := t.device(deviceID)
+	if d.state == nil {
+		d.state = &State{UpSince: now, LastPing: now}
+	}
+	d.state.LastPing = now
+	if d.state.IsDown {
+		t.transition(&ev, deviceID, "", d, d.state, true, now, now)
+	}
+
+	for name, on := range channels {
+		ch, known := d.channels[name]
+		if !known {
+			d.channels[name] = &State{LastPing: now, IsDown: !on, UpSince: now, DownSince: now, announced: stateName(on), announcedSince: now}
+			ev.Transitions = append(ev.Transitions, Transition{Ref: Ref{DeviceID: deviceID, Channel: name, Time: now}, Up: on, At: now, Suppressed: true})
+			continue
+		}
+		ch.LastPing = now
+		if on == ch.IsDown {
+			t.transition(&ev, deviceID, name, d, ch, on, now, now)
+		}
+	}
+	return ev
+}
+
+// Offline takes the device and its channels down at their last ping without waiting
+// for the timeout, for transports that report a lost connection.
+func (t *Tracker) Offline(deviceID string) Events {
+	now := t.clock.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var ev Events
+	d := t.devices[deviceID]
+	if d == nil || d.state == nil {
+		return ev
+	}
+	if !d.state.IsDown {
+		t.transition(&ev, deviceID, "", d, d.state, false, d.state.LastPing, now)
+	}
+	for name, ch := range d.channels {
+		if !ch.IsDown {
+			t.transition(&ev, deviceID, name, d, ch, false, ch.LastPing, now)
+		}
+	}
+	return ev
+}
+
+// Check takes down devices and channels that stopped pinging, announces changes that
+// outlived their debounce delay and ends flapping that calmed down.
+func (t *Tracker) Check() Events {
+	now := t.clock.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var ev Events
+	timeouts := !now.Before(t.graceUntil)
+	for id, d := range t.devices {
+		if d.state == nil {
+			continue
+		}
+		if timeouts && !d.state.IsDown && now.Sub(d.state.LastPing) > d.settings.timeout() {
+			t.transition(&ev, id, "", d, d.state, false, d.state.LastPing, now)
+		}
+		t.checkPending(&ev, id, "", d, d.state, now)
+		// Channels that stop being reported go down the same way as the device
+		for name, ch := range d.channels {
+			if timeouts && !ch.IsDown && now.Sub(ch.LastPing) > d.settings.timeout() {
+				t.transition(&ev, id, name, d, ch, false, ch.LastPing, now)
+			}
+			t.checkPending(&ev, id, name, d, ch, now)
+		}
+	}
+	return ev
+}
+
+// Run calls check every interval until ctx is done. check calls Check, so the caller
+// can order its events with those of Ping and Offline.
+func (t *Tracker) Run(ctx context.Context, interval time.Duration, check func()) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.clock.After(interval):
+		}
+		check()
+	}
+}
+
+// Status returns a snapshot of the device, false if it has never been seen.
+func (t *Tracker) Status(deviceID string) (Status, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	d := t.devices[deviceID]
+	if d == nil || d.state == nil {
+		return Status{}, false
+	}
+	s := d.state.status()
+	if len(d.channels) > 0 {
+		s.Channels = make(map[string]Status, len(d.channels))
+		for name, ch := range d.channels {
+			s.Channels[name] = ch.status()
+		}
+	}
+	return s, true
+}
+
+func (st *State) status() Status {
+	if st.IsDown {
+		return Status{Up: false, LastPing: st.LastPing, Since: st.DownSince}
+	}
+	return Status{Up: true, LastPing: st.LastPing, Since: st.UpSince}
+}
+
+// transition flips a device or channel state at time at, records the event stamped ts
+// and runs the notification hysteresis. Callers must hold t.mu.
+func (t *Tracker) transition(ev *Events, deviceID, channel string, d *device, st *State, up bool, at, ts time.Time) {
+	var duration time.Duration
+	if up {
+		duration = at.Sub(st.DownSince)
+		st.IsDown = false
+		st.UpSince = at
+	} else {
+		duration = at.Sub(st.UpSince)
+		st.IsDown = true
+		st.DownSince = at
+	}
+
+	ref := Ref{DeviceID: deviceID, Channel: channel, Time: ts}
+	suppressed := t.applyHysteresis(ev, d, st, up, at, duration, ref)
+	ev.Transitions = append(ev.Transitions, Transition{Ref: ref, Up: up, At: at, Duration: duration, Suppressed: suppressed})
+	t.checkPending(ev, deviceID, channel, d, st, ts)
+}
+
+func (t *Tracker) alert(ev *Events, d *device, a Alert) {
+	if d.settings.Paused {
+		return
+	}
+	ev.Alerts = append(ev.Alerts, a)
+}
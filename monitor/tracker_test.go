@@ -0,0 +1,346 @@
+package monitor
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock only moves when told to. After channels fire once Advance passes them.
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []fakeWaiter
+}
+
+type fakeWaiter struct {
+	at time.Time
+	ch chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	c.waiters = append(c.waiters, fakeWaiter{at: c.now.Add(d), ch: ch})
+	return ch
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	waiting := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.at.After(c.now) {
+			waiting = append(waiting, w)
+		} else {
+			w.ch <- c.now
+		}
+	}
+	c.waiters = waiting
+}
+
+func (c *fakeClock) pending() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.waiters)
+}
+
+func newTestTracker(s Settings) (*Tracker, *fakeClock) {
+	clock := newFakeClock()
+	t := New(clock)
+	t.Configure("home", s)
+	return t, clock
+}
+
+func alertKinds(ev Events) []string {
+	var kinds []string
+	for _, a := range ev.Alerts {
+		kinds = append(kinds, a.Kind)
+	}
+	return kinds
+}
+
+func TestTimeout(t *testing.T) {
+	tr, clock := newTestTracker(Settings{Timeout: time.Minute})
+	first := clock.Now()
+	if ev := tr.Ping("home", nil); len(ev.Transitions) != 0 {
+		t.Fatalf("first ping: %+v, want no transition", ev)
+	}
+
+	clock.Advance(time.Minute)
+	if ev := tr.Check(); len(ev.Transitions) != 0 {
+		t.Fatalf("at exactly the timeout: %+v, want still up", ev)
+	}
+
+	clock.Advance(10 * time.Second)
+	ev := tr.Check()
+	if len(ev.Transitions) != 1 || ev.Transitions[0].Up {
+		t.Fatalf("after the timeout: %+v, want one down transition", ev)
+	}
+	down := ev.Transitions[0]
+	if !down.At.Equal(first) || !down.Time.Equal(clock.Now()) {
+		t.Errorf("down at %v noticed %v; want at the last ping, noticed now", down.At, down.Time)
+	}
+	if got := alertKinds(ev); len(got) != 1 || got[0] != "down" {
+		t.Errorf("alerts = %v, want [down]", got)
+	}
+
+	clock.Advance(time.Hour)
+	ev = tr.Ping("home", nil)
+	if len(ev.Transitions) != 1 || !ev.Transitions[0].Up {
+		t.Fatalf("ping after outage: %+v, want one up transition", ev)
+	}
+	if want := time.Hour + 70*time.Second; ev.Transitions[0].Duration != want {
+		t.Errorf("outage lasted %v, want %v", ev.Transitions[0].Duration, want)
+	}
+	if st, _ := tr.Status("home"); !st.Up || !st.Since.Equal(clock.Now()) {
+		t.Errorf("status = %+v", st)
+	}
+}
+
+func TestNoDuplicateEvents(t *testing.T) {
+	tr, clock := newTestTracker(Settings{Timeout: time.Minute})
+	tr.Ping("home", nil)
+	clock.Advance(2 * time.Minute)
+	if ev := tr.Check(); len(ev.Transitions) != 1 {
+		t.Fatalf("first check: %d transitions, want 1", len(ev.Transitions))
+	}
+	for i := 0; i < 3; i++ {
+		clock.Advance(time.Minute)
+		if ev := tr.Check(); len(ev.Transitions)+len(ev.Alerts) != 0 {
+			t.Fatalf("check %d while down: %+v, want nothing", i, ev)
+		}
+	}
+
+	tr.Ping("home", nil)
+	for i := 0; i < 3; i++ {
+		clock.Advance(10 * time.Second)
+		if ev := tr.Ping("home", nil); len(ev.Transitions)+len(ev.Alerts) != 0 {
+			t.Fatalf("ping %d while up: %+v, want nothing", i, ev)
+		}
+	}
+}
+
+func TestRestart(t *testing.T) {
+	// Stored state says down since an hour ago: the next ping ends that outage
+	tr, clock := newTestTracker(Settings{Timeout: time.Minute})
+	since := clock.Now().Add(-time.Hour)
+	tr.Restore("home", "", State{IsDown: true, DownSince: since, LastPing: since})
+	tr.Restore("home", "L1", State{IsDown: true, DownSince: since, LastPing: since})
+	if ev := tr.Check(); len(ev.Transitions) != 0 {
+		t.Fatalf("check after restore: %+v, want nothing", ev)
+	}
+	ev := tr.Ping("home", map[string]bool{"L1": true})
+	if len(ev.Transitions) != 2 {
+		t.Fatalf("ping after restart: %+v, want device and channel up", ev)
+	}
+	for _, tr := range ev.Transitions {
+		if !tr.Up || tr.Duration != time.Hour {
+			t.Errorf("transition %+v, want up after 1h", tr)
+		}
+	}
+
+	// Stored state says up: without pings the device goes down after the timeout
+	tr, clock = newTestTracker(Settings{Timeout: time.Minute})
+	tr.Restore("home", "", State{UpSince: clock.Now().Add(-time.Hour), LastPing: clock.Now()})
+	clock.Advance(2 * time.Minute)
+	ev = tr.Check()
+	if len(ev.Transitions) != 1 || ev.Transitions[0].Up || ev.Transitions[0].Duration != time.Hour {
+		t.Fatalf("check after silent restart: %+v, want down after 1h up", ev)
+	}
+
+	// A grace period holds the timeout off while devices reconnect
+	tr, clock = newTestTracker(Settings{Timeout: time.Minute})
+	start := clock.Now()
+	tr.Restore("home", "", State{UpSince: start, LastPing: start})
+	tr.Restore("home", "L1", State{UpSince: start, LastPing: start})
+	tr.Grace(start.Add(5 * time.Minute))
+	clock.Advance(4 * time.Minute)
+	if ev := tr.Check(); len(ev.Transitions) != 0 {
+		t.Fatalf("check within the grace period: %+v, want nothing", ev)
+	}
+	clock.Advance(time.Minute)
+	ev = tr.Check()
+	if len(ev.Transitions) != 2 || ev.Transitions[0].Up || !ev.Transitions[0].At.Equal(start) {
+		t.Fatalf("check after the grace period: %+v, want both down at the restart", ev)
+	}
+}
+
+func TestPaused(t *testing.T) {
+	tr, clock := newTestTracker(Settings{Timeout: time.Minute, Paused: true})
+	tr.Ping("home", nil)
+	clock.Advance(2 * time.Minute)
+	ev := tr.Check()
+	if len(ev.Transitions) != 1 || len(ev.Alerts) != 0 {
+		t.Fatalf("paused outage: %+v, want recorded but not announced", ev)
+	}
+
+	// Unpausing announces the next change as usual
+	tr.Configure("home", Settings{Timeout: time.Minute})
+	ev = tr.Ping("home", nil)
+	if got := alertKinds(ev); len(got) != 1 || got[0] != "up" {
+		t.Errorf("alerts after unpause = %v, want [up]", got)
+	}
+}
+
+func TestMinOutage(t *testing.T) {
+	tr, clock := newTestTracker(Settings{Timeout: time.Minute, MinOutage: 5 * time.Minute})
+	tr.Ping("home", nil)
+
+	// A short outage is recorded, then marked suppressed once power returns
+	clock.Advance(2 * time.Minute)
+	ev := tr.Check()
+	if len(ev.Transitions) != 1 || len(ev.Alerts) != 0 {
+		t.Fatalf("outage start: %+v, want a transition and no alert yet", ev)
+	}
+	blip := ev.Transitions[0].Ref
+	clock.Advance(time.Minute)
+	ev = tr.Ping("home", nil)
+	if len(ev.Alerts) != 0 || len(ev.Suppressed) != 1 || ev.Suppressed[0] != blip || !ev.Transitions[0].Suppressed {
+		t.Fatalf("power back early: %+v, want both transitions silent", ev)
+	}
+
+	// A long one is announced once it has lasted the delay, stamped when it began
+	clock.Advance(2 * time.Minute)
+	start := tr.Check().Transitions[0].At
+	clock.Advance(2 * time.Minute)
+	if ev := tr.Check(); len(ev.Alerts) != 0 {
+		t.Fatalf("before the delay: %+v", ev)
+	}
+	clock.Advance(2 * time.Minute)
+	ev = tr.Check()
+	if len(ev.Alerts) != 1 || ev.Alerts[0].Kind != "down" || !ev.Alerts[0].At.Equal(start) {
+		t.Fatalf("after the delay: %+v, want down at %v", ev.Alerts, start)
+	}
+}
+
+func TestFlapping(t *testing.T) {
+	tr, clock := newTestTracker(Settings{Timeout: time.Minute, FlapThreshold: 4, FlapWindow: 10 * time.Minute})
+	tr.Ping("home", map[string]bool{})
+
+	var kinds []string
+	for i := 0; i < 3; i++ {
+		clock.Advance(90 * time.Second)
+		kinds = append(kinds, alertKinds(tr.Check())...)
+		clock.Advance(10 * time.Second)
+		kinds = append(kinds, alertKinds(tr.Ping("home", nil))...)
+	}
+	want := []string{"down", "up", "down", "unstable"}
+	if len(kinds) != len(want) {
+		t.Fatalf("alerts = %v, want %v", kinds, want)
+	}
+	for i := range want {
+		if kinds[i] != want[i] {
+			t.Fatalf("alerts = %v, want %v", kinds, want)
+		}
+	}
+
+	// Quiet for a whole window: one summary, then back to normal
+	for i := 0; i < 20; i++ {
+		clock.Advance(30 * time.Second)
+		tr.Ping("home", nil)
+	}
+	clock.Advance(30 * time.Second)
+	ev := tr.Check()
+	// The third outage came after flapping was announced
+	if len(ev.Alerts) != 1 || ev.Alerts[0].Kind != "stable" || !ev.Alerts[0].Up || ev.Alerts[0].FlapOutages != 1 {
+		t.Fatalf("stable summary: %+v", ev.Alerts)
+	}
+}
+
+func TestChannels(t *testing.T) {
+	tr, clock := newTestTracker(Settings{Timeout: time.Minute})
+	ev := tr.Ping("home", map[string]bool{"L1": true, "L2": false})
+	initial := map[string]bool{}
+	for _, tr := range ev.Transitions {
+		if !tr.Suppressed || tr.Duration != 0 {
+			t.Errorf("first report: %+v, want a silent initial event", tr)
+		}
+		initial[tr.Channel] = tr.Up
+	}
+	if len(initial) != 2 || !initial["L1"] || initial["L2"] || len(ev.Alerts) != 0 {
+		t.Fatalf("first report: %+v, want an initial event per channel", ev)
+	}
+	clock.Advance(30 * time.Second)
+	ev = tr.Ping("home", map[string]bool{"L1": false, "L2": false})
+	if len(ev.Transitions) != 1 || ev.Transitions[0].Channel != "L1" || ev.Transitions[0].Up || ev.Transitions[0].Suppressed {
+		t.Fatalf("L1 off: %+v", ev)
+	}
+
+	// A channel that is no longer reported times out on its own
+	clock.Advance(30 * time.Second)
+	tr.Ping("home", map[string]bool{"L1": true})
+	clock.Advance(45 * time.Second)
+	tr.Ping("home", map[string]bool{"L1": true})
+	st, _ := tr.Status("home")
+	if !st.Up || !st.Channels["L1"].Up || st.Channels["L2"].Up {
+		t.Fatalf("status = %+v", st)
+	}
+	clock.Advance(45 * time.Second)
+	if ev := tr.Check(); len(ev.Transitions) != 0 {
+		t.Fatalf("L2 was already down: %+v", ev)
+	}
+}
+
+func TestOffline(t *testing.T) {
+	tr, clock := newTestTracker(Settings{Timeout: 5 * time.Minute})
+	tr.Ping("home", map[string]bool{"L1": true})
+	last := clock.Now()
+	clock.Advance(20 * time.Second)
+	ev := tr.Offline("home")
+	if len(ev.Transitions) != 2 {
+		t.Fatalf("offline: %+v, want device and channel down", ev)
+	}
+	for _, tr := range ev.Transitions {
+		if tr.Up || !tr.At.Equal(last) {
+			t.Errorf("transition %+v, want down at the last ping", tr)
+		}
+	}
+	if ev := tr.Offline("home"); len(ev.Transitions) != 0 {
+		t.Errorf("second offline: %+v, want nothing", ev)
+	}
+	if ev := tr.Offline("unknown"); len(ev.Transitions) != 0 {
+		t.Errorf("unknown device: %+v", ev)
+	}
+}
+
+func TestRun(t *testing.T) {
+	tr, clock := newTestTracker(Settings{Timeout: time.Minute})
+	tr.Ping("home", nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	applied := make(chan Events)
+	done := make(chan struct{})
+	go func() {
+		tr.Run(ctx, 10*time.Second, func() { applied <- tr.Check() })
+		close(done)
+	}()
+
+	var transitions int
+	for i := 0; i < 7; i++ {
+		for clock.pending() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		clock.Advance(10 * time.Second)
+		transitions += len((<-applied).Transitions)
+	}
+	if transitions != 1 {
+		t.Errorf("%d transitions over 70s, want the timeout once", transitions)
+	}
+
+	cancel()
+	<-done
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// MQTT publishing for Home Assistant and other consumers, and MQTT as an alternative
+// to HTTP /ping for devices. Configured with MQTT_URL
+// (tcp://host:1883), MQTT_USERNAME, MQTT_PASSWORD, MQTT_PREFIX (default
+// "power-monitor") and HA_DISCOVERY_PREFIX (default "homeassistant").
+//
+// Retained topics:
+//
+//	{prefix}/status            online/offline, the server's availability (LWT)
+//	{prefix}/{id}/state        ON/OFF
+//	{prefix}/{id}/last_ping    RFC3339
+//	{prefix}/{id}/duration     seconds in the current state
+//
+// Devices publish signed mqttPingMessages to {prefix}/{id}/ping and set one as their
+// will on {prefix}/{id}/lwt, so the broker reports a lost connection right away.
+var (
+	mqttClient mqtt.Client
+	mqttPrefix string
+	haPrefix   string
+
+	mqttKick   = make(chan struct{}, 1) // a device changed state
+	mqttResync = make(chan struct{}, 1) // (re)connected, publish everything
+)
+
+func setupMQTT() {
+	broker := os.Getenv("MQTT_URL")
+	if broker == "" {
+		return
+	}
+	mqttPrefix = os.Getenv("MQTT_PREFIX")
+	if mqttPrefix == "" {
+		mqttPrefix = "power-monitor"
+	}
+	haPrefix = os.Getenv("HA_DISCOVERY_PREFIX")
+	if haPrefix == "" {
+		haPrefix = "homeassistant"
+	}
+
+	hostname, _ := os.Hostname()
+	opts := mqtt.NewClientOptions().
+		AddBroker(broker).
+		SetClientID("power-monitor-"+hostname).
+		SetUsername(os.Getenv("MQTT_USERNAME")).
+		SetPassword(os.Getenv("MQTT_PASSWORD")).
+		SetWill(mqttStatusTopic(), "offline", 1, true).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(30 * time.Second).
+		SetOrderMatters(false). // handlers send alerts, don't block the client on them
+		SetOnConnectHandler(func(c mqtt.Client) {
+			slog.Info("MQTT connected", "broker", broker)
+			c.Publish(mqttStatusTopic(), 1, true, "online")
+			for _, topic := range []string{mqttPrefix + "/+/ping", mqttPrefix + "/+/lwt"} {
+				token := c.Subscribe(topic, 1, handleDeviceMessage)
+				go func(topic string) {
+					if token.Wait() && token.Error() != nil {
+						slog.Error("MQTT subscribe failed", "topic", topic, "err", token.Error())
+					}
+				}(topic)
+			}
+			select {
+			case mqttResync <- struct{}{}:
+			default:
+			}
+		}).
+		SetConnectionLostHandler(func(c mqtt.Client, err error) {
+			slog.Warn("MQTT connection lost", "err", err)
+			noteError("mqtt", err)
+		})
+	mqttClient = mqtt.NewClient(opts)
+	mqttClient.Connect() // keeps retrying in the background
+	go mqttPublisher()
+}
+
+// stopMQTT marks the server offline, which the will only does for a lost connection,
+// and disconnects.
+func stopMQTT() {
+	if mqttClient == nil {
+		return
+	}
+	if mqttClient.IsConnectionOpen() {
+		mqttClient.Publish(mqttStatusTopic(), 1, true, "offline").WaitTimeout(2 * time.Second)
+	}
+	mqttClient.Disconnect(250)
+}
+
+func mqttStatusTopic() string {
+	return mqttPrefix + "/status"
+}
+
+// mqttNotify asks the publisher to push state now rather than on its next tick.
+func mqttNotify() {
+	if mqttClient == nil {
+		return
+	}
+	select {
+	case mqttKick <- struct{}{}:
+	default:
+	}
+}
+
+type mqttDeviceState struct {
+	Name     string
+	Up       bool
+	LastPing time.Time
+	Since    time.Time
+}
+
+func mqttSnapshot() map[string]mqttDeviceState {
+	mu.Lock()
+	defer mu.Unlock()
+	snapshot := make(map[string]mqttDeviceState)
+	for id, d := range devices {
+		s := mqttDeviceState{Name: d.Name}
+		if st, known := tracker.Status(id); known {
+			s.Up = st.Up
+			s.LastPing = st.LastPing
+			s.Since = st.Since
+		}
+		snapshot[id] = s
+	}
+	return snapshot
+}
+
+// mqttPublisher publishes what changed since the last round, and durations every minute.
+func mqttPublisher() {
+	published := make(map[string]mqttDeviceState)
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-mqttKick:
+		case <-mqttResync:
+			published = make(map[string]mqttDeviceState)
+		}
+		if !mqttClient.IsConnectionOpen() {
+			continue
+		}
+		publishChanges(published, mqttSnapshot(), time.Now())
+	}
+}
+
+// publishChanges publishes the difference between published, what the broker has, and
+// snapshot, and updates published to match.
+func publishChanges(published, snapshot map[string]mqttDeviceState, now time.Time) {
+	for id, s := range snapshot {
+		prev, seen := published[id]
+		if !seen || prev.Name != s.Name {
+			publishDiscovery(id, s.Name)
+		}
+		if !seen || prev.Up != s.Up {
+			state := "OFF"
+			if s.Up {
+				state = "ON"
+			}
+			mqttPublish(id, "state", state)
+		}
+		if !s.LastPing.IsZero() && (!seen || !prev.LastPing.Equal(s.LastPing)) {
+			mqttPublish(id, "last_ping", s.LastPing.Format(time.RFC3339))
+		}
+		if !s.Since.IsZero() {
+			mqttPublish(id, "duration", strconv.Itoa(int(now.Sub(s.Since).Seconds())))
+		}
+		published[id] = s
+	}
+	for id := range published {
+		if _, ok := snapshot[id]; !ok {
+			clearDevice(id)
+			delete(published, id)
+		}
+	}
+}
+
+func mqttPublish(deviceID, name, payload string) {
+	mqttClient.Publish(mqttPrefix+"/"+deviceID+"/"+name, 1, true, payload)
+}
+
+// haNodeID makes a device ID safe for discovery topics and unique IDs.
+func haNodeID(deviceID string) string {
+	return "power_monitor_" + strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-' {
+			return r
+		}
+		return '_'
+	}, deviceID)
+}
+
+// haEntities lists the discovery topics of a device and their configs.
+func haEntities(deviceID, name string) map[string]map[string]interface{} {
+	node := haNodeID(deviceID)
+	base := func(entity, title string) map[string]interface{} {
+		return map[string]interface{}{
+			"name":                  title,
+			"unique_id":             node + "_" + entity,
+			"availability_topic":    mqttStatusTopic(),
+			"payload_available":     "online",
+			"payload_not_available": "offline",
+			"device": map[string]interface{}{
+				"identifiers":  []string{node},
+				"name":         name,
+				"manufacturer": "power-monitor",
+				"model":        "Power monitor",
+			},
+		}
+	}
+
+	power := base("power", "Power")
+	power["state_topic"] = mqttPrefix + "/" + deviceID + "/state"
+	power["payload_on"] = "ON"
+	power["payload_off"] = "OFF"
+	power["device_class"] = "power"
+
+	duration := base("duration", "State duration")
+	duration["state_topic"] = mqttPrefix + "/" + deviceID + "/duration"
+	duration["unit_of_measurement"] = "s"
+	duration["device_class"] = "duration"
+	duration["state_class"] = "measurement"
+
+	lastPing := base("last_ping", "Last ping")
+	lastPing["state_topic"] = mqttPrefix + "/" + deviceID + "/last_ping"
+	lastPing["device_class"] = "timestamp"
+	lastPing["entity_category"] = "diagnostic"
+
+	return map[string]map[string]interface{}{
+		fmt.Sprintf("%s/binary_sensor/%s/power/config", haPrefix, node): power,
+		fmt.Sprintf("%s/sensor/%s/duration/config", haPrefix, node):     duration,
+		fmt.Sprintf("%s/sensor/%s/last_ping/config", haPrefix, node):    lastPing,
+	}
+}
+
+func publishDiscovery(deviceID, name string) {
+	for topic, config := range haEntities(deviceID, name) {
+		payload, _ := json.Marshal(config)
+		mqttClient.Publish(topic, 1, true, payload)
+	}
+}
+
+// clearDevice removes a deleted device from Home Assistant and the broker's retained state.
+func clearDevice(deviceID string) {
+	for topic := range haEntities(deviceID, "") {
+		mqttClient.Publish(topic, 1, true, "")
+	}
+	for _, name := range []string{"state", "last_ping", "duration"} {
+		mqttPublish(deviceID, name, "")
+	}
+}
+
+// mqttPingMessage is the payload of device pings and wills:
+//
+//	{"seq": 42, "will": 40, "channels": "L1:1,L2:0", "mac": "..."}
+//
+// Seq comes from the same strictly increasing counter as UDP heartbeats. Will is the
+// seq of the will the device set when it connected; only that will is accepted, once.
+// Channels is the same list as /ping takes. Mac is the hex HMAC-SHA256 of mqttSigned
+// with the device key, so reading the topics doesn't give away the key.
+type mqttPingMessage struct {
+	Seq      uint32 `json:"seq"`
+	Will     uint32 `json:"will,omitempty"`
+	Channels string `json:"channels,omitempty"`
+	MAC      string `json:"mac"`
+}
+
+// mqttSigned is what the MAC covers. The topic is part of it, so a ping can't be
+// replayed as a will or for another device.
+func mqttSigned(deviceID, kind string, msg mqttPingMessage) string {
+	return fmt.Sprintf("%s\n%s\n%d\n%d\n%s", deviceID, kind, msg.Seq, msg.Will, msg.Channels)
+}
+
+func mqttMAC(key, deviceID, kind string, msg mqttPingMessage) []byte {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(mqttSigned(deviceID, kind, msg)))
+	return mac.Sum(nil)
+}
+
+// mqttWills holds the seq of the will each device's last ping announced, under mu.
+var mqttWills = make(map[string]uint32)
+
+// handleDeviceMessage feeds {prefix}/{id}/ping and {prefix}/{id}/lwt into the same
+// state machine as HTTP pings and the monitor.
+func handleDeviceMessage(c mqtt.Client, m mqtt.Message) {
+	// Retained pings and wills describe the past; the monitor timeout covers whatever
+	// happened while we were away
+	if m.Retained() {
+		return
+	}
+	deviceID, kind, ok := strings.Cut(strings.TrimPrefix(m.Topic(), mqttPrefix+"/"), "/")
+	if !ok || deviceID == "" {
+		return
+	}
+	var msg mqttPingMessage
+	if err := json.Unmarshal(m.Payload(), &msg); err != nil {
+		slog.Warn("MQTT bad payload", "device_id", deviceID, "kind", kind, "err", err)
+		return
+	}
+	if err := acceptDeviceMessage(deviceID, kind, msg); err != nil {
+		slog.Warn("MQTT message rejected", "device_id", deviceID, "kind", kind, "err", err)
+		return
+	}
+
+	switch kind {
+	case "ping":
+		recordPing(deviceID, parseChannels(msg.Channels))
+	case "lwt":
+		slog.Info("Device MQTT connection lost", "device_id", deviceID)
+		recordOffline(deviceID)
+	}
+}
+
+// acceptDeviceMessage checks the MAC against the device key, rejects ping sequence
+// numbers that were already seen and wills other than the announced one. Devices are
+// not registered over MQTT: the key comes from the dashboard.
+func acceptDeviceMessage(deviceID, kind string, msg mqttPingMessage) error {
+	mu.Lock()
+	defer mu.Unlock()
+	d := devices[deviceID]
+	if d == nil || d.DeviceKey == "" {
+		return errors.New("unknown device")
+	}
+	mac, err := hex.DecodeString(msg.MAC)
+	if err != nil || !hmac.Equal(mac, mqttMAC(d.DeviceKey, deviceID, kind, msg)) {
+		return errors.New("bad signature")
+	}
+	switch kind {
+	case "ping":
+		if msg.Seq <= d.UDPSeq {
+			return errors.New("replayed sequence number")
+		}
+		d.UDPSeq = msg.Seq
+		saveSeq(d)
+		if msg.Will != 0 {
+			mqttWills[deviceID] = msg.Will
+		}
+	case "lwt":
+		if will, ok := mqttWills[deviceID]; !ok || msg.Seq != will {
+			return errors.New("not the will of the current connection")
+		}
+		delete(mqttWills, deviceID)
+	default:
+		return errors.New("unknown topic")
+	}
+	return nil
+}
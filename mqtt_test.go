@@ -0,0 +1,316 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+
+	"power-monitor/store"
+)
+
+// fakeMessage is an incoming MQTT message.
+type fakeMessage struct {
+	topic    string
+	payload  []byte
+	retained bool
+}
+
+func (m *fakeMessage) Duplicate() bool   { return false }
+func (m *fakeMessage) Qos() byte         { return 1 }
+func (m *fakeMessage) Retained() bool    { return m.retained }
+func (m *fakeMessage) Topic() string     { return m.topic }
+func (m *fakeMessage) MessageID() uint16 { return 0 }
+func (m *fakeMessage) Payload() []byte   { return m.payload }
+func (m *fakeMessage) Ack()              {}
+
+// signed adds the MAC device firmware computes.
+func signed(key, deviceID, kind string, msg mqttPingMessage) mqttPingMessage {
+	msg.MAC = hex.EncodeToString(mqttMAC(key, deviceID, kind, msg))
+	return msg
+}
+
+// deviceMessage is msg as a device publishes it.
+func deviceMessage(key, deviceID, kind string, msg mqttPingMessage) *fakeMessage {
+	payload, _ := json.Marshal(signed(key, deviceID, kind, msg))
+	return &fakeMessage{topic: mqttPrefix + "/" + deviceID + "/" + kind, payload: payload}
+}
+
+func setupMQTTDevice(t *testing.T) *DeviceConfig {
+	t.Helper()
+	if err := initDB(filepath.Join(t.TempDir(), "test.db")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	prefix := mqttPrefix
+	mqttPrefix = "pm"
+	t.Cleanup(func() { mqttPrefix = prefix })
+
+	d := &DeviceConfig{Device: store.Device{ID: "home", Name: "home", DeviceKey: "secret", Paused: true}}
+	devices["home"] = d
+	saveDevice(d)
+	track(d)
+	t.Cleanup(func() {
+		delete(devices, "home")
+		delete(mqttWills, "home")
+		tracker.Remove("home")
+	})
+	return d
+}
+
+func deviceUp(t *testing.T) bool {
+	t.Helper()
+	st, known := tracker.Status("home")
+	return known && st.Up
+}
+
+func TestMQTTPing(t *testing.T) {
+	d := setupMQTTDevice(t)
+
+	handleDeviceMessage(nil, deviceMessage("secret", "home", "ping", mqttPingMessage{Seq: 2, Will: 1, Channels: "L1:1"}))
+	if !deviceUp(t) {
+		t.Fatal("valid ping not recorded")
+	}
+	var stored uint32
+	db.QueryRow("SELECT udp_seq FROM devices WHERE id = 'home'").Scan(&stored)
+	if d.UDPSeq != 2 || stored != 2 {
+		t.Errorf("sequence = %d, stored %d; want 2", d.UDPSeq, stored)
+	}
+	if st, _ := tracker.Status("home"); !st.Channels["L1"].Up {
+		t.Errorf("channels = %+v", st.Channels)
+	}
+
+	// The will the device announced marks it offline, once
+	handleDeviceMessage(nil, deviceMessage("secret", "home", "lwt", mqttPingMessage{Seq: 1}))
+	if deviceUp(t) {
+		t.Fatal("will did not mark the device offline")
+	}
+	if _, ok := mqttWills["home"]; ok {
+		t.Error("will still accepted after use")
+	}
+}
+
+// Concurrent pings, as the MQTT client delivers them, never leave an older sequence
+// number in the database than the one accepted last.
+func TestMQTTSequenceSaved(t *testing.T) {
+	d := setupMQTTDevice(t)
+	var wg sync.WaitGroup
+	for seq := uint32(1); seq <= 50; seq++ {
+		wg.Add(1)
+		go func(seq uint32) {
+			defer wg.Done()
+			acceptDeviceMessage("home", "ping", signed("secret", "home", "ping", mqttPingMessage{Seq: seq}))
+		}(seq)
+	}
+	wg.Wait()
+
+	var stored uint32
+	db.QueryRow("SELECT udp_seq FROM devices WHERE id = 'home'").Scan(&stored)
+	if d.UDPSeq != 50 || stored != 50 {
+		t.Errorf("sequence = %d, stored %d; want 50", d.UDPSeq, stored)
+	}
+}
+
+func TestMQTTRejectedMessages(t *testing.T) {
+	setupMQTTDevice(t)
+	handleDeviceMessage(nil, deviceMessage("secret", "home", "ping", mqttPingMessage{Seq: 5, Will: 4}))
+
+	tests := []struct {
+		name string
+		msg  *fakeMessage
+	}{
+		{"wrong key", deviceMessage("guess", "home", "lwt", mqttPingMessage{Seq: 4})},
+		{"other will", deviceMessage("secret", "home", "lwt", mqttPingMessage{Seq: 3})},
+		{"ping as will", func() *fakeMessage {
+			m := deviceMessage("secret", "home", "ping", mqttPingMessage{Seq: 4})
+			m.topic = "pm/home/lwt"
+			return m
+		}()},
+		{"unsigned", &fakeMessage{topic: "pm/home/lwt", payload: []byte(`{"seq": 4, "key": "secret"}`)}},
+		{"retained", func() *fakeMessage {
+			m := deviceMessage("secret", "home", "lwt", mqttPingMessage{Seq: 4})
+			m.retained = true
+			return m
+		}()},
+		{"not json", &fakeMessage{topic: "pm/home/lwt", payload: []byte("offline")}},
+	}
+	for _, tt := range tests {
+		handleDeviceMessage(nil, tt.msg)
+		if !deviceUp(t) {
+			t.Fatalf("%s: marked the device offline", tt.name)
+		}
+	}
+
+	// Once the will is in, pings with a wrong key, a replayed sequence number, a retained
+	// ping or one for an unknown device don't bring it back
+	handleDeviceMessage(nil, deviceMessage("secret", "home", "lwt", mqttPingMessage{Seq: 4}))
+	for name, msg := range map[string]mqtt.Message{
+		"wrong key": deviceMessage("guess", "home", "ping", mqttPingMessage{Seq: 9}),
+		"replayed":  deviceMessage("secret", "home", "ping", mqttPingMessage{Seq: 5}),
+		"retained": func() *fakeMessage {
+			m := deviceMessage("secret", "home", "ping", mqttPingMessage{Seq: 10})
+			m.retained = true
+			return m
+		}(),
+		"unknown device": deviceMessage("secret", "cottage", "ping", mqttPingMessage{Seq: 11}),
+	} {
+		handleDeviceMessage(nil, msg)
+		if deviceUp(t) {
+			t.Errorf("%s: ping recorded", name)
+		}
+	}
+	if _, ok := devices["cottage"]; ok {
+		t.Error("device registered over MQTT")
+	}
+}
+
+// fakeClient records what is published, in order.
+type fakeClient struct {
+	mqtt.Client
+	published []string // "topic payload"
+}
+
+func (c *fakeClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	if !retained {
+		panic("not retained: " + topic)
+	}
+	switch p := payload.(type) {
+	case []byte:
+		c.published = append(c.published, topic+" "+string(p))
+	default:
+		c.published = append(c.published, topic+" "+p.(string))
+	}
+	return &mqtt.DummyToken{}
+}
+
+// round returns the topics published since the last round, sorted, with payloads of
+// the state topics.
+func (c *fakeClient) round() []string {
+	var got []string
+	for _, p := range c.published {
+		topic, payload, _ := strings.Cut(p, " ")
+		if strings.HasPrefix(topic, "homeassistant/") && payload != "" {
+			payload = "{...}"
+		}
+		got = append(got, strings.TrimSpace(topic+" "+payload))
+	}
+	sort.Strings(got)
+	c.published = nil
+	return got
+}
+
+func setupMQTTPublisher(t *testing.T) *fakeClient {
+	t.Helper()
+	client := &fakeClient{}
+	orig, prefix, ha := mqttClient, mqttPrefix, haPrefix
+	mqttClient, mqttPrefix, haPrefix = client, "pm", "homeassistant"
+	t.Cleanup(func() { mqttClient, mqttPrefix, haPrefix = orig, prefix, ha })
+	return client
+}
+
+func TestHANodeID(t *testing.T) {
+	for id, want := range map[string]string{
+		"home-1_A": "power_monitor_home-1_A",
+		"my/dev+#": "power_monitor_my_dev__",
+		"дім 2":    "power_monitor_____2",
+		"a.b c":    "power_monitor_a_b_c",
+	} {
+		if got := haNodeID(id); got != want {
+			t.Errorf("haNodeID(%q) = %q, want %q", id, got, want)
+		}
+	}
+}
+
+func TestHAEntities(t *testing.T) {
+	client := setupMQTTPublisher(t)
+	publishDiscovery("my/home", "Дім")
+
+	configs := make(map[string]map[string]interface{})
+	for _, p := range client.published {
+		topic, payload, _ := strings.Cut(p, " ")
+		var config map[string]interface{}
+		if err := json.Unmarshal([]byte(payload), &config); err != nil {
+			t.Fatalf("%s: %v", topic, err)
+		}
+		configs[topic] = config
+	}
+	power := configs["homeassistant/binary_sensor/power_monitor_my_home/power/config"]
+	duration := configs["homeassistant/sensor/power_monitor_my_home/duration/config"]
+	lastPing := configs["homeassistant/sensor/power_monitor_my_home/last_ping/config"]
+	if len(configs) != 3 || power == nil || duration == nil || lastPing == nil {
+		t.Fatalf("discovery topics = %v", client.round())
+	}
+
+	if power["state_topic"] != "pm/my/home/state" || power["payload_on"] != "ON" || power["payload_off"] != "OFF" ||
+		power["device_class"] != "power" || power["unique_id"] != "power_monitor_my_home_power" {
+		t.Errorf("power = %v", power)
+	}
+	if duration["state_topic"] != "pm/my/home/duration" || duration["unit_of_measurement"] != "s" || duration["device_class"] != "duration" {
+		t.Errorf("duration = %v", duration)
+	}
+	if lastPing["state_topic"] != "pm/my/home/last_ping" || lastPing["device_class"] != "timestamp" {
+		t.Errorf("last ping = %v", lastPing)
+	}
+	for topic, config := range configs {
+		device, _ := config["device"].(map[string]interface{})
+		if config["availability_topic"] != "pm/status" || config["payload_available"] != "online" ||
+			device["name"] != "Дім" || device["identifiers"].([]interface{})[0] != "power_monitor_my_home" {
+			t.Errorf("%s = %v", topic, config)
+		}
+	}
+}
+
+func TestMQTTPublishChanges(t *testing.T) {
+	client := setupMQTTPublisher(t)
+	discovery := []string{
+		"homeassistant/binary_sensor/power_monitor_home/power/config {...}",
+		"homeassistant/sensor/power_monitor_home/duration/config {...}",
+		"homeassistant/sensor/power_monitor_home/last_ping/config {...}",
+	}
+	check := func(step string, want ...string) {
+		t.Helper()
+		sort.Strings(want)
+		if got := client.round(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+			t.Errorf("%s: published\n%s\nwant\n%s", step, strings.Join(got, "\n"), strings.Join(want, "\n"))
+		}
+	}
+
+	// A device the tracker hasn't seen yet is off
+	devices["home"] = &DeviceConfig{Device: store.Device{ID: "home", Name: "Дім"}}
+	t.Cleanup(func() { delete(devices, "home") })
+	published := make(map[string]mqttDeviceState)
+	now := time.Date(2024, 6, 5, 12, 0, 0, 0, time.UTC)
+	publishChanges(published, mqttSnapshot(), now)
+	check("first round", append(discovery, "pm/home/state OFF")...)
+
+	publishChanges(published, mqttSnapshot(), now)
+	check("nothing changed")
+
+	up := map[string]mqttDeviceState{"home": {Name: "Дім", Up: true, LastPing: now, Since: now.Add(-time.Minute)}}
+	publishChanges(published, up, now)
+	check("power back", "pm/home/state ON", "pm/home/last_ping 2024-06-05T12:00:00Z", "pm/home/duration 60")
+
+	publishChanges(published, up, now.Add(time.Minute))
+	check("a minute later", "pm/home/duration 120")
+
+	renamed := map[string]mqttDeviceState{"home": {Name: "Дача", Up: true, LastPing: now, Since: now.Add(-time.Minute)}}
+	publishChanges(published, renamed, now)
+	check("renamed", append(discovery, "pm/home/duration 60")...)
+
+	// A deleted device's retained topics are cleared
+	publishChanges(published, map[string]mqttDeviceState{}, now)
+	check("deleted",
+		"homeassistant/binary_sensor/power_monitor_home/power/config",
+		"homeassistant/sensor/power_monitor_home/duration/config",
+		"homeassistant/sensor/power_monitor_home/last_ping/config",
+		"pm/home/state", "pm/home/last_ping", "pm/home/duration")
+	if len(published) != 0 {
+		t.Errorf("still published: %v", published)
+	}
+}
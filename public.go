@@ -0,0 +1,377 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"power-monitor/store"
+)
+
+// PublicPage is an opt-in status page at /s/{slug} for one device or a group of them.
+type PublicPage struct {
+	Slug       string   `json:"slug"`
+	OwnerEmail string   `json:"-"`
+	Title      string   `json:"title"`
+	DeviceIDs  []string `json:"device_ids"`
+	HideTimes  bool     `json:"hide_times"` // show durations and days only
+	HideName   bool     `json:"hide_name"`  // don't reveal device names
+}
+
+const publicHistoryDays = 7
+
+func loadPublicPages() {
+	pages, err := storage.PublicPages()
+	if err != nil {
+		slog.Error("Failed to load public pages", "err", err)
+		return
+	}
+	for _, p := range pages {
+		page := PublicPage(p)
+		publicPages[p.Slug] = &page
+	}
+}
+
+func savePublicPage(p *PublicPage) error {
+	return storage.SavePublicPage(store.PublicPage(*p))
+}
+
+// removeFromPublicPages drops a deleted device from every page, removing pages left empty.
+// Callers must hold mu.
+func removeFromPublicPages(deviceID string) {
+	for slug, p := range publicPages {
+		kept := p.DeviceIDs[:0]
+		for _, id := range p.DeviceIDs {
+			if id != deviceID {
+				kept = append(kept, id)
+			}
+		}
+		if len(kept) == len(p.DeviceIDs) {
+			continue
+		}
+		p.DeviceIDs = kept
+		if len(kept) == 0 {
+			delete(publicPages, slug)
+			if err := storage.DeletePublicPage(slug); err != nil {
+				slog.Error("Failed to delete public page", "slug", slug, "err", err)
+			}
+		} else {
+			savePublicPage(p)
+		}
+	}
+}
+
+func validSlug(slug string) bool {
+	if len(slug) < 3 || len(slug) > 40 {
+		return false
+	}
+	for _, c := range slug {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+type publicOutage struct {
+	Start           string `json:"start,omitempty"`
+	End             string `json:"end,omitempty"`
+	Day             string `json:"day"`
+	DurationSeconds int64  `json:"duration_seconds"`
+	Ongoing         bool   `json:"ongoing,omitempty"`
+}
+
+type publicDevice struct {
+	Name            string         `json:"name"`
+	Status          string         `json:"status"`
+	Since           string         `json:"since,omitempty"`
+	DurationSeconds int64          `json:"duration_seconds"`
+	UptimePercent   float64        `json:"uptime_percent"`
+	OutageCount     int            `json:"outage_count"`
+	DowntimeSeconds int64          `json:"downtime_seconds"`
+	Outages         []publicOutage `json:"outages"`
+}
+
+type publicStatus struct {
+	Title     string         `json:"title"`
+	Days      int            `json:"days"`
+	Locale    string         `json:"locale"` // of the first device, for the page text
+	Devices   []publicDevice `json:"devices"`
+	UpdatedAt string         `json:"updated_at"`
+}
+
+// buildPublicStatus collects current state and the last week of outages for a page.
+func buildPublicStatus(p *PublicPage) publicStatus {
+	now := time.Now()
+	from := now.Add(-publicHistoryDays * 24 * time.Hour)
+	result := publicStatus{Title: p.Title, Days: publicHistoryDays, Locale: defaultLocale, UpdatedAt: now.Format(time.RFC3339)}
+	mu.Lock()
+	for _, id := range p.DeviceIDs {
+		if d := devices[id]; d != nil {
+			result.Locale = localeName(d.Locale)
+			break
+		}
+	}
+	mu.Unlock()
+	l := localeFor(result.Locale)
+
+	for i, id := range p.DeviceIDs {
+		mu.Lock()
+		d, exists := devices[id]
+		loc := deviceLocation(d)
+		var name string
+		var isDown bool
+		var since time.Time
+		if exists {
+			name = d.Name
+			if st, known := tracker.Status(id); known {
+				isDown = !st.Up
+				since = st.Since
+			}
+		}
+		mu.Unlock()
+		if !exists {
+			continue
+		}
+
+		if p.HideName {
+			name = l.text("public_device", i+1)
+			if len(p.DeviceIDs) == 1 && p.Title != "" {
+				name = p.Title
+			}
+		}
+		pd := publicDevice{Name: name, Status: "up", DurationSeconds: int64(now.Sub(since).Seconds()), Outages: []publicOutage{}}
+		if isDown {
+			pd.Status = "down"
+		}
+		if !p.HideTimes {
+			pd.Since = since.In(loc).Format(time.RFC3339)
+		}
+
+		intervals, err := loadIntervals(id, "", from, now)
+		if err != nil {
+			slog.Error("Public page status failed", "device_id", id, "slug", p.Slug, "err", err)
+		}
+		summary := summarize(intervals)
+		pd.UptimePercent = float64(int(summary.UptimePercent()*10)) / 10
+		pd.OutageCount = len(summary.Outages)
+		pd.DowntimeSeconds = int64(summary.Downtime.Seconds())
+		for j := len(summary.Outages) - 1; j >= 0; j-- {
+			o := summary.Outages[j]
+			po := publicOutage{
+				Day:             o.Start.In(loc).Format("2006-01-02"),
+				DurationSeconds: int64(o.Duration().Seconds()),
+				Ongoing:         !o.End.Before(now),
+			}
+			if !p.HideTimes {
+				po.Start = o.Start.In(loc).Format(time.RFC3339)
+				po.End = o.End.In(loc).Format(time.RFC3339)
+			}
+			pd.Outages = append(pd.Outages, po)
+		}
+		result.Devices = append(result.Devices, pd)
+	}
+	return result
+}
+
+// publicPageHandler serves /s/{slug} (HTML) and /s/{slug}.json without authentication.
+func publicPageHandler(w http.ResponseWriter, r *http.Request) {
+	slug := r.URL.Path[len("/s/"):]
+	asJSON := strings.HasSuffix(slug, ".json")
+	slug = strings.TrimSuffix(slug, ".json")
+
+	mu.Lock()
+	page, exists := publicPages[slug]
+	mu.Unlock()
+	if !exists {
+		http.NotFound(w, r)
+		return
+	}
+
+	status := buildPublicStatus(page)
+	w.Header().Set("Cache-Control", "public, max-age=60")
+	if asJSON {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		json.NewEncoder(w).Encode(status)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := publicPageTemplate.Execute(w, map[string]interface{}{"Page": page, "Status": status, "Lang": status.Locale}); err != nil {
+		requestLog(r).Error("Public page failed", "slug", slug, "err", err)
+	}
+}
+
+// publicPagesHandler lists (GET) and creates or updates (POST) the pages owned by the user.
+func publicPagesHandler(w http.ResponseWriter, r *http.Request) {
+	email := getSessionEmail(r)
+	if email == "" {
+		http.Error(w, "Unauthorized", 401)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		mu.Lock()
+		pages := []*PublicPage{}
+		for _, p := range publicPages {
+			if p.OwnerEmail == email {
+				pages = append(pages, p)
+			}
+		}
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(pages)
+
+	case "POST":
+		var req PublicPage
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", 400)
+			return
+		}
+		req.Slug = strings.ToLower(strings.TrimSpace(req.Slug))
+		if !validSlug(req.Slug) {
+			http.Error(w, "Адреса має містити 3-40 символів: a-z, 0-9, -", 400)
+			return
+		}
+		if len(req.DeviceIDs) == 0 {
+			http.Error(w, "Оберіть хоча б один пристрій", 400)
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if existing, ok := publicPages[req.Slug]; ok && existing.OwnerEmail != email {
+			http.Error(w, "Ця адреса вже зайнята", 409)
+			return
+		}
+		for _, id := range req.DeviceIDs {
+			if d, ok := devices[id]; !ok || d.OwnerEmail != email {
+				http.Error(w, "Пристрій не знайдено: "+id, 404)
+				return
+			}
+		}
+		req.OwnerEmail = email
+		if err := savePublicPage(&req); err != nil {
+			http.Error(w, "Database error", 500)
+			return
+		}
+		publicPages[req.Slug] = &req
+		requestLog(r).Info("Public page saved", "slug", req.Slug, "email", email, "devices", len(req.DeviceIDs))
+		w.Write([]byte("ok"))
+
+	default:
+		http.Error(w, "method not allowed", 405)
+	}
+}
+
+func publicPageDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	email := getSessionEmail(r)
+	if email == "" {
+		http.Error(w, "Unauthorized", 401)
+		return
+	}
+	if r.Method != "DELETE" {
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+
+	slug := r.URL.Path[len("/api/public-pages/"):]
+	mu.Lock()
+	defer mu.Unlock()
+	if p, ok := publicPages[slug]; !ok || p.OwnerEmail != email {
+		http.Error(w, "not found", 404)
+		return
+	}
+	if err := storage.DeletePublicPage(slug); err != nil {
+		http.Error(w, "Database error", 500)
+		return
+	}
+	delete(publicPages, slug)
+	w.Write([]byte("ok"))
+}
+
+var publicPageTemplate = template.Must(template.New("public").Funcs(template.FuncMap{
+	"text": func(lang, key string, args ...interface{}) string { return localeFor(lang).text(key, args...) },
+	"duration": func(lang string, sec int64) string {
+		d := time.Duration(sec) * time.Second
+		if d > 365*24*time.Hour {
+			d = 0 // never seen
+		}
+		return localeFor(lang).duration(d)
+	},
+	"clock": func(ts string) string {
+		t, err := time.Parse(time.RFC3339, ts)
+		if err != nil {
+			return ""
+		}
+		return t.Format("02.01 15:04") // already in the device timezone
+	},
+	"day": func(day string) string {
+		t, err := time.Parse("2006-01-02", day)
+		if err != nil {
+			return day
+		}
+		return t.Format("02.01")
+	},
+}).Parse(publicPageHTML))
+
+var publicPageHTML = `<!DOCTYPE html>
+<html lang="{{.Lang}}">
+<head>
+    <meta charset="utf-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1">
+    <meta http-equiv="refresh" content="60">
+    <title>{{if .Status.Title}}{{.Status.Title}}{{else}}{{text .Lang "public_title"}}{{end}} — Power Monitor</title>
+    <style>
+        * { box-sizing: border-box; margin: 0; padding: 0; }
+        body { font-family: -apple-system, BlinkMacSystemFont, sans-serif; background: #06060a; color: #f4f4f5; padding: 32px 20px; }
+        .container { max-width: 640px; margin: 0 auto; }
+        h1 { font-size: 22px; margin-bottom: 24px; text-align: center; }
+        .device { background: #0d0d14; border: 1px solid rgba(255,255,255,0.08); border-radius: 16px; padding: 24px; margin-bottom: 20px; }
+        .device.up { border-left: 4px solid #22c55e; }
+        .device.down { border-left: 4px solid #ef4444; }
+        .name { font-size: 16px; color: #71717a; margin-bottom: 8px; }
+        .status { font-size: 26px; font-weight: 800; }
+        .up .status { color: #22c55e; }
+        .down .status { color: #ef4444; }
+        .since { color: #71717a; font-size: 14px; margin-top: 4px; }
+        .stats { display: flex; gap: 24px; margin: 20px 0 12px; font-size: 14px; color: #71717a; }
+        .stats b { display: block; font-size: 20px; color: #f4f4f5; }
+        .outage { display: flex; justify-content: space-between; padding: 8px 0; border-top: 1px solid rgba(255,255,255,0.04); font-size: 14px; }
+        .outage .dur { color: #fbbf24; }
+        .none { color: #71717a; font-size: 14px; padding-top: 8px; }
+        .footer { text-align: center; color: #3f3f46; font-size: 12px; margin-top: 24px; }
+        .footer a { color: #71717a; }
+    </style>
+</head>
+<body>
+    <div class="container">
+        <h1>⚡ {{if .Status.Title}}{{.Status.Title}}{{else}}{{text .Lang "public_heading"}}{{end}}</h1>
+        {{range .Status.Devices}}
+        <div class="device {{.Status}}">
+            <div class="name">{{.Name}}</div>
+            <div class="status">{{if eq .Status "up"}}{{text $.Lang "public_up"}}{{else}}{{text $.Lang "public_down"}}{{end}}</div>
+            <div class="since">{{text $.Lang "public_for" (duration $.Lang .DurationSeconds)}}{{if .Since}} {{text $.Lang "public_since" (clock .Since)}}{{end}}</div>
+            <div class="stats">
+                <div><b>{{printf "%.1f" .UptimePercent}}%</b>{{text $.Lang "public_uptime"}}</div>
+                <div><b>{{.OutageCount}}</b>{{text $.Lang "public_outages"}}</div>
+                <div><b>{{duration $.Lang .DowntimeSeconds}}</b>{{text $.Lang "public_downtime"}}</div>
+            </div>
+            {{range .Outages}}
+            <div class="outage">
+                <span>{{if .Start}}{{clock .Start}} — {{if .Ongoing}}{{text $.Lang "public_now"}}{{else}}{{clock .End}}{{end}}{{else}}{{day .Day}}{{end}}</span>
+                <span class="dur">{{duration $.Lang .DurationSeconds}}</span>
+            </div>
+            {{else}}
+            <div class="none">{{text $.Lang "public_no_outages" $.Status.Days}}</div>
+            {{end}}
+        </div>
+        {{end}}
+        <div class="footer">{{text .Lang "public_days" .Status.Days}} • <a href="/s/{{.Page.Slug}}.json">JSON</a> • <a href="/">Power Monitor</a></div>
+    </div>
+</body>
+</html>`
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	webpush "github.com/SherClockHolmes/webpush-go"
+
+	"power-monitor/store"
+)
+
+const pushTTL = 6 * 60 * 60 // seconds a push service keeps an undelivered message
+
+// VAPID keys identify this server to browser push services. Generate a pair once with
+// webpush.GenerateVAPIDKeys and keep it: changing keys invalidates every subscription.
+var (
+	vapidPublicKey  string
+	vapidPrivateKey string
+	vapidSubject    string
+)
+
+func setupWebPush() {
+	vapidPublicKey = os.Getenv("VAPID_PUBLIC_KEY")
+	vapidPrivateKey = os.Getenv("VAPID_PRIVATE_KEY")
+	vapidSubject = os.Getenv("VAPID_SUBJECT")
+	if vapidSubject == "" {
+		vapidSubject = "mailto:admin@power-monitor.club"
+	}
+	if vapidPublicKey != "" && vapidPrivateKey != "" {
+		deliverers["webpush"] = deliverWebPush
+	}
+}
+
+type pushPayload struct {
+	Title  string `json:"title"`
+	Body   string `json:"body"`
+	URL    string `json:"url"`
+	Silent bool   `json:"silent"`
+}
+
+// deliverWebPush sends n to every browser the user subscribed. Subscriptions the push
+// service reports as gone are removed.
+func deliverWebPush(n notification) error {
+	stored, err := storage.PushSubscriptions(n.Email)
+	if err != nil {
+		return err
+	}
+	subs := make([]webpush.Subscription, len(stored))
+	for i, s := range stored {
+		subs[i].Endpoint = s.Endpoint
+		subs[i].Keys.P256dh = s.P256dh
+		subs[i].Keys.Auth = s.Auth
+	}
+
+	payload, _ := json.Marshal(pushPayload{
+		Title:  n.Subject,
+		Body:   n.Text,
+		URL:    "/history?device=" + n.DeviceID,
+		Silent: n.Silent,
+	})
+	urgency := webpush.UrgencyHigh
+	if n.Silent {
+		urgency = webpush.UrgencyLow
+	}
+
+	var lastErr error
+	for i := range subs {
+		resp, err := webpush.SendNotification(payload, &subs[i], &webpush.Options{
+			HTTPClient:      pushHTTPClient,
+			Subscriber:      vapidSubject,
+			VAPIDPublicKey:  vapidPublicKey,
+			VAPIDPrivateKey: vapidPrivateKey,
+			TTL:             pushTTL,
+			Urgency:         urgency,
+			Topic:           n.DeviceID, // a newer state replaces an undelivered one
+		})
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		switch {
+		case resp.StatusCode == http.StatusGone || resp.StatusCode == http.StatusNotFound:
+			slog.Info("Push subscription expired, removing", "device_id", n.DeviceID, "email", n.Email)
+			if err := storage.DeletePushSubscription(subs[i].Endpoint, ""); err != nil {
+				lastErr = err
+			}
+		case resp.StatusCode >= 300:
+			lastErr = fmt.Errorf("push service returned %s", resp.Status)
+		}
+	}
+	return lastErr
+}
+
+// pushHTTPClient only connects to public addresses, so a subscription whose host
+// later resolves to an internal one still cannot reach it.
+var pushHTTPClient = &http.Client{
+	Timeout: 15 * time.Second,
+	Transport: &http.Transport{
+		DialContext:         (&net.Dialer{Timeout: 10 * time.Second, Control: publicAddressOnly}).DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+		ForceAttemptHTTP2:   true,
+	},
+}
+
+func publicAddressOnly(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+		return fmt.Errorf("push service address %s is not public", host)
+	}
+	return nil
+}
+
+// pushServiceHosts are the push services of the browsers we support. A leading dot
+// matches any subdomain.
+var pushServiceHosts = []string{
+	"fcm.googleapis.com",         // Chrome, Edge, Opera
+	".push.services.mozilla.com", // Firefox
+	".notify.windows.com",        // legacy Edge
+	".push.apple.com",            // Safari
+}
+
+// lookupPushHost resolves endpoint hosts; tests swap it.
+var lookupPushHost = net.DefaultResolver.LookupIPAddr
+
+var cgnat = &net.IPNet{IP: net.IP{100, 64, 0, 0}, Mask: net.CIDRMask(10, 32)}
+
+func publicIP(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsUnspecified() && !ip.IsLinkLocalUnicast() &&
+		!ip.IsLinkLocalMulticast() && !ip.IsInterfaceLocalMulticast() && !ip.IsMulticast() && !cgnat.Contains(ip)
+}
+
+// checkPushEndpoint accepts only https URLs of a known push service that resolve to
+// public addresses, as the server POSTs to whatever endpoint a browser reports.
+func checkPushEndpoint(ctx context.Context, endpoint string) error {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Scheme != "https" || u.User != nil || (u.Port() != "" && u.Port() != "443") {
+		return errors.New("endpoint must be an https URL")
+	}
+	host := strings.ToLower(u.Hostname())
+	known := false
+	for _, h := range pushServiceHosts {
+		if host == h || strings.HasPrefix(h, ".") && strings.HasSuffix(host, h) {
+			known = true
+			break
+		}
+	}
+	if !known {
+		return fmt.Errorf("unknown push service %s", host)
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	addrs, err := lookupPushHost(ctx, host)
+	if err != nil {
+		return err
+	}
+	for _, a := range addrs {
+		if !publicIP(a.IP) {
+			return fmt.Errorf("%s resolves to %s", host, a.IP)
+		}
+	}
+	return nil
+}
+
+// pushKeyHandler serves the VAPID public key for PushManager.subscribe.
+func pushKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if deliverers["webpush"] == nil {
+		http.Error(w, "web push is not configured", 503)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"public_key": vapidPublicKey})
+}
+
+// pushSubscribeHandler stores (POST) or removes (DELETE) the browser's PushSubscription JSON.
+func pushSubscribeHandler(w http.ResponseWriter, r *http.Request) {
+	email := getSessionEmail(r)
+	if email == "" {
+		http.Error(w, "unauthorized", 401)
+		return
+	}
+	var sub webpush.Subscription
+	if err := json.NewDecoder(r.Body).Decode(&sub); err != nil || sub.Endpoint == "" {
+		http.Error(w, "invalid subscription", 400)
+		return
+	}
+
+	switch r.Method {
+	case "POST":
+		if sub.Keys.P256dh == "" || sub.Keys.Auth == "" {
+			http.Error(w, "invalid subscription", 400)
+			return
+		}
+		if err := checkPushEndpoint(r.Context(), sub.Endpoint); err != nil {
+			requestLog(r).Warn("Rejected push subscription", "email", email, "err", err)
+			http.Error(w, "invalid subscription endpoint", 400)
+			return
+		}
+		err := storage.SavePushSubscription(store.PushSubscription{Endpoint: sub.Endpoint, Email: email, P256dh: sub.Keys.P256dh, Auth: sub.Keys.Auth})
+		if err != nil {
+			http.Error(w, "Database error", 500)
+			return
+		}
+	case "DELETE":
+		if err := storage.DeletePushSubscription(sub.Endpoint, email); err != nil {
+			http.Error(w, "Database error", 500)
+			return
+		}
+	default:
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+	w.Write([]byte("ok"))
+}
+
+// serviceWorkerHandler serves /sw.js from the site root so it can control the dashboard.
+func serviceWorkerHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/javascript")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write([]byte(serviceWorkerJS))
+}
+
+const serviceWorkerJS = `self.addEventListener('push', event => {
+    const data = event.data ? event.data.json() : {};
+    event.waitUntil(self.registration.showNotification(data.title || 'Power Monitor', {
+        body: data.body || '',
+        tag: data.url,
+        silent: !!data.silent,
+        data: {url: data.url || '/dashboard'}
+    }));
+});
+
+self.addEventListener('notificationclick', event => {
+    event.notification.close();
+    event.waitUntil(clients.openWindow(event.notification.data.url));
+});
+`
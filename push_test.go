@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	webpush "github.com/SherClockHolmes/webpush-go"
+)
+
+// fakePushService stands in for a browser vendor's push service: /ok/... accepts
+// messages, /gone/... answers 410 like an expired subscription, /fail/... errors.
+type fakePushService struct {
+	mu       sync.Mutex
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (f *fakePushService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	f.mu.Lock()
+	f.requests = append(f.requests, r)
+	f.bodies = append(f.bodies, body)
+	f.mu.Unlock()
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/ok/"):
+		w.WriteHeader(http.StatusCreated)
+	case strings.HasPrefix(r.URL.Path, "/gone/"):
+		w.WriteHeader(http.StatusGone)
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+func setupPushTest(t *testing.T) *httptest.Server {
+	t.Helper()
+	if err := initDB(filepath.Join(t.TempDir(), "test.db")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	var err error
+	vapidPrivateKey, vapidPublicKey, err = webpush.GenerateVAPIDKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	vapidSubject = "mailto:test@example.com"
+
+	service := httptest.NewServer(&fakePushService{})
+	t.Cleanup(service.Close)
+	// The fake service listens on loopback, which the real client refuses
+	client := pushHTTPClient
+	pushHTTPClient = service.Client()
+	t.Cleanup(func() { pushHTTPClient = client })
+	return service
+}
+
+// addPushSubscription stores a subscription with real browser-style keys, as the
+// payload is encrypted to them.
+func addPushSubscription(t *testing.T, email, endpoint string) {
+	t.Helper()
+	key, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := make([]byte, 16)
+	rand.Read(auth)
+	_, err = db.Exec("INSERT INTO push_subscriptions (endpoint, email, p256dh, auth) VALUES (?, ?, ?, ?)", endpoint, email,
+		base64.RawURLEncoding.EncodeToString(key.PublicKey().Bytes()), base64.RawURLEncoding.EncodeToString(auth))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func pushEndpoints(t *testing.T, email string) []string {
+	t.Helper()
+	rows, err := db.Query("SELECT endpoint FROM push_subscriptions WHERE email = ? ORDER BY endpoint", email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var endpoints []string
+	for rows.Next() {
+		var e string
+		rows.Scan(&e)
+		endpoints = append(endpoints, e)
+	}
+	return endpoints
+}
+
+func TestDeliverWebPush(t *testing.T) {
+	service := setupPushTest(t)
+	fake := service.Config.Handler.(*fakePushService)
+	addPushSubscription(t, "user@example.com", service.URL+"/ok/1")
+	addPushSubscription(t, "user@example.com", service.URL+"/gone/2")
+	addPushSubscription(t, "other@example.com", service.URL+"/ok/3")
+
+	err := deliverWebPush(notification{
+		Email:    "user@example.com",
+		DeviceID: "home",
+		Channel:  "webpush",
+		Subject:  "Дім: Світло зникло",
+		Text:     "🔴 18:05 Світло зникло",
+	})
+	if err != nil {
+		t.Fatalf("deliverWebPush: %v", err)
+	}
+
+	if len(fake.requests) != 2 {
+		t.Fatalf("push service got %d requests, want 2 (only user@example.com's browsers)", len(fake.requests))
+	}
+	for i, r := range fake.requests {
+		if got := r.Header.Get("Content-Encoding"); got != "aes128gcm" {
+			t.Errorf("Content-Encoding = %q, want aes128gcm", got)
+		}
+		if got := r.Header.Get("Authorization"); !strings.HasPrefix(got, "vapid t=") || !strings.Contains(got, "k="+vapidPublicKey) {
+			t.Errorf("Authorization = %q, want a VAPID header with our public key", got)
+		}
+		if got := r.Header.Get("Urgency"); got != "high" {
+			t.Errorf("Urgency = %q, want high", got)
+		}
+		if strings.Contains(string(fake.bodies[i]), "Світло") {
+			t.Error("payload was sent unencrypted")
+		}
+	}
+
+	if got := pushEndpoints(t, "user@example.com"); len(got) != 1 || got[0] != service.URL+"/ok/1" {
+		t.Errorf("subscriptions after delivery = %v, want the 410 one removed", got)
+	}
+	if got := pushEndpoints(t, "other@example.com"); len(got) != 1 {
+		t.Errorf("other user's subscriptions = %v, want untouched", got)
+	}
+}
+
+func TestDeliverWebPushServiceError(t *testing.T) {
+	service := setupPushTest(t)
+	addPushSubscription(t, "user@example.com", service.URL+"/fail/1")
+
+	err := deliverWebPush(notification{Email: "user@example.com", DeviceID: "home", Subject: "s", Text: "t", Silent: true})
+	if err == nil {
+		t.Fatal("want an error when the push service fails")
+	}
+	if got := pushEndpoints(t, "user@example.com"); len(got) != 1 {
+		t.Errorf("subscriptions = %v, want kept after a temporary failure", got)
+	}
+}
+
+func TestCheckPushEndpoint(t *testing.T) {
+	lookup := lookupPushHost
+	t.Cleanup(func() { lookupPushHost = lookup })
+	lookupPushHost = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		if host == "rebound.push.apple.com" {
+			return []net.IPAddr{{IP: net.ParseIP("142.250.1.1")}, {IP: net.ParseIP("10.0.0.5")}}, nil
+		}
+		return []net.IPAddr{{IP: net.ParseIP("142.250.1.1")}}, nil
+	}
+
+	tests := []struct {
+		endpoint string
+		ok       bool
+	}{
+		{"https://fcm.googleapis.com/fcm/send/abc", true},
+		{"https://updates.push.services.mozilla.com/wpush/v2/abc", true},
+		{"https://web.push.apple.com/abc", true},
+		{"https://FCM.googleapis.com/fcm/send/abc", true},
+		{"http://fcm.googleapis.com/fcm/send/abc", false},
+		{"https://fcm.googleapis.com:8443/fcm/send/abc", false},
+		{"https://user@fcm.googleapis.com/fcm/send/abc", false},
+		{"https://evil.example.com/push", false},
+		{"https://fcm.googleapis.com.evil.example.com/push", false},
+		{"https://push.services.mozilla.com.evil/push", false},
+		{"https://127.0.0.1/push", false},
+		{"https://rebound.push.apple.com/abc", false},
+		{"not a url", false},
+	}
+	for _, tt := range tests {
+		if err := checkPushEndpoint(context.Background(), tt.endpoint); (err == nil) != tt.ok {
+			t.Errorf("%s: err = %v, want ok %v", tt.endpoint, err, tt.ok)
+		}
+	}
+}
+
+func TestPublicAddressOnly(t *testing.T) {
+	for addr, ok := range map[string]bool{
+		"142.250.1.1:443":    true,
+		"[2a00:1450::1]:443": true,
+		"127.0.0.1:443":      false,
+		"[::1]:443":          false,
+		"10.1.2.3:443":       false,
+		"192.168.0.1:443":    false,
+		"169.254.169.254:80": false,
+		"100.64.0.1:443":     false,
+		"0.0.0.0:443":        false,
+		"[fd00::1]:443":      false,
+		"[fe80::1]:443":      false,
+	} {
+		if err := publicAddressOnly("tcp", addr, nil); (err == nil) != ok {
+			t.Errorf("%s: err = %v, want ok %v", addr, err, ok)
+		}
+	}
+}
+
+func TestPushSubscribeRejectsInternalEndpoints(t *testing.T) {
+	setupPushTest(t)
+	lookup := lookupPushHost
+	t.Cleanup(func() { lookupPushHost = lookup })
+	lookupPushHost = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		return []net.IPAddr{{IP: net.ParseIP("142.250.1.1")}}, nil
+	}
+
+	subscribe := func(endpoint string) int {
+		body := `{"endpoint": "` + endpoint + `", "keys": {"p256dh": "key", "auth": "auth"}}`
+		r := signIn(t, httptest.NewRequest("POST", "/api/push/subscribe", strings.NewReader(body)), "user@example.com")
+		rec := httptest.NewRecorder()
+		pushSubscribeHandler(rec, r)
+		return rec.Code
+	}
+	for _, endpoint := range []string{"http://169.254.169.254/latest/meta-data", "https://localhost/push", "https://intranet.example.com/push"} {
+		if got := subscribe(endpoint); got != 400 {
+			t.Errorf("%s: %d, want 400", endpoint, got)
+		}
+	}
+	if got := subscribe("https://fcm.googleapis.com/fcm/send/abc"); got != 200 {
+		t.Errorf("push service endpoint: %d, want 200", got)
+	}
+	if got := pushEndpoints(t, "user@example.com"); len(got) != 1 || got[0] != "https://fcm.googleapis.com/fcm/send/abc" {
+		t.Errorf("stored endpoints = %v", got)
+	}
+}
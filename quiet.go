@@ -0,0 +1,239 @@
+package main
+
+import (
+	"log/slog"
+	"strings"
+	"time"
+
+	"power-monitor/store"
+)
+
+const maxHeldInSummary = 20
+
+// inQuietHours reports whether t falls into the device's quiet window.
+func inQuietHours(d *DeviceConfig, t time.Time) bool {
+	return inQuietWindow(d.QuietStart, d.QuietEnd, deviceLocation(d), t)
+}
+
+// inQuietWindow reports whether t falls into the window between the "HH:MM" times
+// start and end in loc. Windows may wrap midnight ("22:00"–"07:00"); an empty or
+// zero-length window is off.
+func inQuietWindow(quietStart, quietEnd string, loc *time.Location, t time.Time) bool {
+	if quietStart == "" || quietEnd == "" || quietStart == quietEnd {
+		return false
+	}
+	start, err1 := time.Parse("15:04", quietStart)
+	end, err2 := time.Parse("15:04", quietEnd)
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	local := t.In(loc)
+	now := local.Hour()*60 + local.Minute()
+	from := start.Hour()*60 + start.Minute()
+	to := end.Hour()*60 + end.Minute()
+	if from < to {
+		return now >= from && now < to
+	}
+	return now >= from || now < to
+}
+
+// subscriberQuietHours is the quiet window of a subscriber's delivery channel, in the
+// device timezone: the subscriber's own, or the device's if they didn't set one.
+func subscriberQuietHours(d *DeviceConfig, p store.SubscriberPref) (start, end, mode string) {
+	if p.QuietStart != "" && p.QuietEnd != "" {
+		return p.QuietStart, p.QuietEnd, p.QuietMode
+	}
+	return d.QuietStart, d.QuietEnd, d.QuietMode
+}
+
+// deliverAlert sends a state-change message to the device chat, honouring quiet hours:
+// "silent" sends it without a sound, "hold" stores it for the summary sent when the
+// window ends. chart is rendered only when the message actually goes out, and avatar
+// (if set) becomes the chat photo.
+func deliverAlert(d *DeviceConfig, text string, chart func() ([]byte, error), avatar string) {
+	quiet := inQuietHours(d, time.Now())
+	if quiet && d.QuietMode == "hold" {
+		holdMessage(store.HeldMessage{DeviceID: d.ID, Text: text})
+		return
+	}
+
+	msgID := 0
+	if chart != nil {
+		if png, err := chart(); err == nil {
+			msgID = sendTelegramPhoto(d.BotToken, d.ChatID, text, png, quiet)
+		} else {
+			slog.Error("Chart render failed", "device_id", d.ID, "err", err)
+		}
+	}
+	if msgID == 0 {
+		msgID = sendTelegramMessage(d.BotToken, d.ChatID, text, quiet)
+	}
+	if avatar != "" {
+		setChatPhoto(d.BotToken, d.ChatID, avatar, msgID)
+	}
+}
+
+func holdMessage(m store.HeldMessage) {
+	slog.Info("Quiet hours, holding message", "device_id", m.DeviceID, "email", m.Email, "delivery", m.Delivery)
+	m.CreatedAt = time.Now()
+	if err := storage.HoldMessage(m); err != nil {
+		slog.Error("Failed to hold message", "device_id", m.DeviceID, "email", m.Email, "delivery", m.Delivery, "err", err)
+		noteError("db", err)
+	}
+}
+
+// quietHoursScheduler sends the messages held for device chats and subscribers as one
+// summary once their quiet window is over.
+func quietHoursScheduler() {
+	for {
+		time.Sleep(time.Minute)
+		now := time.Now()
+
+		type pending struct {
+			config *DeviceConfig
+			isDown bool
+		}
+		var due []pending
+		mu.Lock()
+		for id, d := range devices {
+			if !d.Configured || d.Paused || inQuietHours(d, now) {
+				continue
+			}
+			snapshot := *d
+			p := pending{config: &snapshot}
+			if st, known := tracker.Status(id); known {
+				p.isDown = !st.Up
+			}
+			due = append(due, p)
+		}
+		mu.Unlock()
+
+		for _, p := range due {
+			flushHeldMessages(p.config, p.isDown)
+		}
+
+		prefs, err := storage.HeldPrefs()
+		if err != nil {
+			slog.Error("Failed to load held messages", "err", err)
+			noteError("db", err)
+			continue
+		}
+		for _, p := range prefs {
+			mu.Lock()
+			var d *DeviceConfig
+			if live := devices[p.DeviceID]; live != nil && !live.Paused {
+				snapshot := *live
+				d = &snapshot
+			}
+			mu.Unlock()
+			if d == nil {
+				continue
+			}
+			if start, end, _ := subscriberQuietHours(d, p); !inQuietWindow(start, end, deviceLocation(d), now) {
+				flushSubscriberHeld(d, p)
+			}
+		}
+	}
+}
+
+// heldKey names whose held messages these are: a device chat (no email) or one
+// subscriber's delivery channel.
+type heldKey struct {
+	deviceID, email, delivery string
+}
+
+// heldSent keeps the newest held message sent to each recipient until the sent ones
+// are deleted, so that a failed delete doesn't send them twice. Only the quiet hours
+// scheduler uses it.
+var heldSent = make(map[heldKey]int64)
+
+// unsentHeld loads the messages held for k that weren't sent yet, retrying the delete
+// of the sent ones.
+func unsentHeld(k heldKey) []store.HeldMessage {
+	held, err := storage.HeldMessages(k.deviceID, k.email, k.delivery)
+	if err != nil {
+		slog.Error("Failed to load held messages", "device_id", k.deviceID, "email", k.email, "delivery", k.delivery, "err", err)
+		noteError("db", err)
+		return nil
+	}
+	sent, ok := heldSent[k]
+	if !ok {
+		return held
+	}
+	deleteHeld(k, sent)
+	var unsent []store.HeldMessage
+	for _, m := range held {
+		if m.ID > sent {
+			unsent = append(unsent, m)
+		}
+	}
+	return unsent
+}
+
+// deleteHeld removes the messages held for k up to the sent one upTo.
+func deleteHeld(k heldKey, upTo int64) {
+	heldSent[k] = upTo
+	if err := storage.DeleteHeldMessages(k.deviceID, k.email, k.delivery, upTo); err != nil {
+		slog.Error("Failed to delete sent held messages", "device_id", k.deviceID, "email", k.email, "delivery", k.delivery, "err", err)
+		noteError("db", err)
+		return
+	}
+	delete(heldSent, k)
+}
+
+// heldSummary joins held messages into one, keeping the newest maxHeldInSummary.
+func heldSummary(l *locale, held []store.HeldMessage) string {
+	var b strings.Builder
+	b.WriteString(l.text("held_title") + "\n")
+	if skipped := len(held) - maxHeldInSummary; skipped > 0 {
+		b.WriteString("\n" + l.text("held_skipped", skipped, l.plural3(skipped, l.messages)) + "\n")
+		held = held[skipped:]
+	}
+	for _, m := range held {
+		b.WriteString("\n" + m.Text + "\n")
+	}
+	return strings.TrimSpace(b.String())
+}
+
+func flushHeldMessages(d *DeviceConfig, isDown bool) {
+	k := heldKey{deviceID: d.ID}
+	held := unsentHeld(k)
+	if len(held) == 0 {
+		return
+	}
+	slog.Info("Sending held messages", "device_id", d.ID, "count", len(held))
+	msgID := sendTelegram(d.BotToken, d.ChatID, heldSummary(localeFor(d.Locale), held))
+	if msgID == 0 {
+		return // keep them for the next attempt
+	}
+	avatar := greenAvatar
+	if isDown {
+		avatar = redAvatar
+	}
+	setChatPhoto(d.BotToken, d.ChatID, avatar, msgID)
+	deleteHeld(k, held[len(held)-1].ID)
+}
+
+// flushSubscriberHeld queues the summary of the messages held for a subscriber's
+// delivery channel.
+func flushSubscriberHeld(d *DeviceConfig, p store.SubscriberPref) {
+	k := heldKey{deviceID: d.ID, email: p.Email, delivery: p.Channel}
+	held := unsentHeld(k)
+	if len(held) == 0 {
+		return
+	}
+	slog.Info("Sending held messages", "device_id", d.ID, "email", p.Email, "delivery", p.Channel, "count", len(held))
+	summary := heldSummary(localeFor(d.Locale), held)
+	subject, _, _ := strings.Cut(summary, "\n")
+	if !enqueueNotification(notification{
+		Email:    p.Email,
+		DeviceID: d.ID,
+		Channel:  p.Channel,
+		Subject:  d.Name + ": " + subject,
+		Text:     "🏠 " + d.Name + "\n" + summary,
+		Locale:   d.Locale,
+	}) {
+		return
+	}
+	deleteHeld(k, held[len(held)-1].ID)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"power-monitor/store"
+)
+
+func TestInQuietWindow(t *testing.T) {
+	at := func(h, m int) time.Time { return time.Date(2024, 6, 5, h, m, 0, 0, time.UTC) }
+	tests := []struct {
+		start, end string
+		t          time.Time
+		want       bool
+	}{
+		{"22:00", "07:00", at(23, 0), true},
+		{"22:00", "07:00", at(6, 59), true},
+		{"22:00", "07:00", at(7, 0), false},
+		{"22:00", "07:00", at(12, 0), false},
+		{"13:00", "14:00", at(13, 30), true},
+		{"13:00", "14:00", at(14, 30), false},
+		{"", "07:00", at(6, 0), false},
+		{"07:00", "07:00", at(7, 0), false},
+	}
+	for _, tt := range tests {
+		if got := inQuietWindow(tt.start, tt.end, time.UTC, tt.t); got != tt.want {
+			t.Errorf("%s–%s at %s: %v, want %v", tt.start, tt.end, tt.t.Format("15:04"), got, tt.want)
+		}
+	}
+}
+
+// captureNotifications collects the notifications queued for the "test" channel. The
+// returned function drains the queue, also when a worker left by another test runs.
+func captureNotifications(t *testing.T) func() []notification {
+	var mu sync.Mutex
+	var got []notification
+	capture := func(n notification) error {
+		mu.Lock()
+		defer mu.Unlock()
+		got = append(got, n)
+		return nil
+	}
+	deliverers["test"] = capture
+	t.Cleanup(func() { delete(deliverers, "test") })
+	return func() []notification {
+		for drained := false; !drained; {
+			select {
+			case n := <-notificationQueue:
+				capture(n)
+				pendingNotifications.Done()
+			default:
+				drained = true
+			}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		if !waitGroup(ctx, &pendingNotifications) {
+			t.Fatal("notifications not delivered")
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		delivered := got
+		got = nil
+		return delivered
+	}
+}
+
+func TestSubscriberQuietHours(t *testing.T) {
+	if err := initDB(filepath.Join(t.TempDir(), "test.db")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	delivered := captureNotifications(t)
+
+	kyiv, _ := time.LoadLocation("Europe/Kyiv")
+	now := time.Now().In(kyiv)
+	window := func(from, to time.Duration) (string, string) {
+		return now.Add(from).Format("15:04"), now.Add(to).Format("15:04")
+	}
+	activeStart, activeEnd := window(-time.Hour, time.Hour)
+	laterStart, laterEnd := window(time.Hour, 2*time.Hour)
+
+	d := &DeviceConfig{Device: store.Device{ID: "home", Name: "Дім", Timezone: "Europe/Kyiv",
+		QuietStart: activeStart, QuietEnd: activeEnd, QuietMode: "silent"}}
+	held := store.SubscriberPref{Email: "held@example.com", DeviceID: "home", Channel: "test", Events: []string{"down"},
+		QuietStart: activeStart, QuietEnd: activeEnd, QuietMode: "hold"}
+	for _, p := range []store.SubscriberPref{
+		held,
+		// Follows the device's quiet hours
+		{Email: "device@example.com", DeviceID: "home", Channel: "test", Events: []string{"down"}},
+		// Has quiet hours of its own, not yet
+		{Email: "awake@example.com", DeviceID: "home", Channel: "test", Events: []string{"down"},
+			QuietStart: laterStart, QuietEnd: laterEnd, QuietMode: "hold"},
+	} {
+		if err := storage.SavePref(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	notifySubscribers(d, "down", "🔴 Світло зникло")
+	silent := make(map[string]bool)
+	for _, n := range delivered() {
+		silent[n.Email] = n.Silent
+	}
+	if len(silent) != 2 || !silent["device@example.com"] || silent["awake@example.com"] {
+		t.Errorf("delivered silently: %v, want the device's quiet hours only for device@", silent)
+	}
+	if msgs, _ := storage.HeldMessages("home", "held@example.com", "test"); len(msgs) != 1 || msgs[0].Text != "🔴 Світло зникло" {
+		t.Fatalf("held for the subscriber: %+v", msgs)
+	}
+
+	// Once the window is over the held messages go out as one summary
+	held.QuietStart, held.QuietEnd = laterStart, laterEnd
+	flushSubscriberHeld(d, held)
+	got := delivered()
+	if len(got) != 1 || got[0].Email != "held@example.com" || !strings.Contains(got[0].Text, "🌙") ||
+		!strings.Contains(got[0].Text, "🔴 Світло зникло") || got[0].Silent {
+		t.Errorf("summary = %+v", got)
+	}
+	if msgs, _ := storage.HeldMessages("home", "held@example.com", "test"); len(msgs) != 0 {
+		t.Errorf("held messages left after the summary: %+v", msgs)
+	}
+}
+
+func TestUnsentHeld(t *testing.T) {
+	if err := initDB(filepath.Join(t.TempDir(), "test.db")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	k := heldKey{deviceID: "home"}
+	for _, text := range []string{"sent", "new"} {
+		holdMessage(store.HeldMessage{DeviceID: "home", Text: text})
+	}
+	msgs, _ := storage.HeldMessages("home", "", "")
+
+	// The summary with the first message went out, but deleting it failed
+	heldSent[k] = msgs[0].ID
+	t.Cleanup(func() { delete(heldSent, k) })
+	if unsent := unsentHeld(k); len(unsent) != 1 || unsent[0].Text != "new" {
+		t.Errorf("unsent = %+v, want only the newer message", unsent)
+	}
+	if msgs, _ := storage.HeldMessages("home", "", ""); len(msgs) != 1 {
+		t.Errorf("sent message not deleted on retry: %+v", msgs)
+	}
+	if _, retrying := heldSent[k]; retrying {
+		t.Error("still retrying after the delete succeeded")
+	}
+}
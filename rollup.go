@@ -0,0 +1,267 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+
+	"power-monitor/store"
+)
+
+// Every complete day of every device channel is summed up into daily_rollups, which
+// long timeline ranges and stats read instead of raw events. Raw events older than
+// RETENTION_DAYS (0 = keep forever) are deleted once their days are rolled up.
+
+const (
+	rollupInterval   = time.Hour
+	rollupRange      = 31 * 24 * time.Hour // longer ranges read rollups
+	minRetentionDays = 32                  // shorter ranges, charts and digests need raw events
+	compactThreshold = 1000                // deleted events worth giving the space back for
+)
+
+var retentionDays int
+
+func setupRetention() {
+	s := os.Getenv("RETENTION_DAYS")
+	if s == "" {
+		return
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		fatal("Invalid RETENTION_DAYS", "value", s)
+	}
+	if n > 0 && n < minRetentionDays {
+		slog.Warn("RETENTION_DAYS raised: ranges up to a month are built from raw events", "value", n, "raised_to", minRetentionDays)
+		n = minRetentionDays
+	}
+	retentionDays = n
+	if n > 0 {
+		slog.Info("Keeping raw events", "days", n)
+	}
+}
+
+// rollupScheduler rolls up finished days and then applies the retention, every hour.
+func rollupScheduler() {
+	for {
+		now := time.Now()
+		if rollupAll(now) {
+			pruneEvents(now)
+		}
+		time.Sleep(rollupInterval)
+	}
+}
+
+// rollupAll rolls up every device channel up to yesterday. It reports whether all of
+// them succeeded, so that no event is deleted before its day is summed up.
+func rollupAll(now time.Time) bool {
+	type target struct {
+		id  string
+		loc *time.Location
+	}
+	var targets []target
+	mu.Lock()
+	for _, d := range devices {
+		targets = append(targets, target{d.ID, deviceLocation(d)})
+	}
+	mu.Unlock()
+
+	ok := true
+	for _, t := range targets {
+		channels, err := storage.EventChannels(t.id)
+		if err != nil {
+			slog.Error("Rollup failed", "device_id", t.id, "err", err)
+			noteError("rollup", err)
+			ok = false
+			continue
+		}
+		for _, channel := range append([]string{""}, channels...) {
+			if err := rollupChannel(t.id, channel, t.loc, now); err != nil {
+				slog.Error("Rollup failed", "device_id", t.id, "channel", channel, "err", err)
+				noteError("rollup", err)
+				ok = false
+			}
+		}
+	}
+	return ok
+}
+
+// rollupChannel rolls up the days after the last rolled-up one, or from the first
+// event on, until the day before now.
+func rollupChannel(deviceID, channel string, loc *time.Location, now time.Time) error {
+	var day time.Time
+	last, err := storage.LastRollupDay(deviceID, channel)
+	switch err {
+	case nil:
+		t, err := time.ParseInLocation("2006-01-02", last, loc)
+		if err != nil {
+			return err
+		}
+		day = t.AddDate(0, 0, 1)
+	case store.ErrNotFound:
+		first, err := storage.FirstEvent(deviceID, channel)
+		if err == store.ErrNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		day = bucketStart(first.Time, "day", loc)
+	default:
+		return err
+	}
+
+	return rollupDays(deviceID, channel, loc, day, bucketStart(now, "day", loc))
+}
+
+// rerollup recomputes the rolled-up days from the one containing since on, after
+// events were added to them. Days not rolled up yet are left to the scheduler.
+func rerollup(deviceID, channel string, loc *time.Location, since time.Time) error {
+	last, err := storage.LastRollupDay(deviceID, channel)
+	if err == store.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	t, err := time.ParseInLocation("2006-01-02", last, loc)
+	if err != nil {
+		return err
+	}
+	return rollupDays(deviceID, channel, loc, bucketStart(since, "day", loc), t.AddDate(0, 0, 1))
+}
+
+// rollupDays saves the rollups of the days in [day, until).
+func rollupDays(deviceID, channel string, loc *time.Location, day, until time.Time) error {
+	for ; day.Before(until); day = day.AddDate(0, 0, 1) {
+		next := day.AddDate(0, 0, 1)
+		intervals, err := loadIntervals(deviceID, channel, day, next)
+		if err != nil {
+			return err
+		}
+		b := buildTimeline(intervals, day, next, "day", loc)[0]
+		r := store.Rollup{
+			DeviceID:      deviceID,
+			Channel:       channel,
+			Day:           day.Format("2006-01-02"),
+			UpSeconds:     b.UpSeconds,
+			DownSeconds:   b.DownSeconds,
+			Outages:       b.Outages,
+			LongestOutage: int64(summarize(intervals).Longest.Seconds()),
+		}
+		if err := storage.SaveRollup(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func pruneEvents(now time.Time) {
+	if retentionDays == 0 {
+		return
+	}
+	n, err := storage.DeleteEventsBefore(now.AddDate(0, 0, -retentionDays))
+	if err != nil {
+		slog.Error("Failed to delete old events", "err", err)
+		noteError("rollup", err)
+		return
+	}
+	if n == 0 {
+		return
+	}
+	slog.Info("Deleted old events", "count", n, "older_than_days", retentionDays)
+	if n >= compactThreshold {
+		if err := storage.Compact(); err != nil {
+			slog.Error("Failed to compact the database", "err", err)
+		}
+	}
+}
+
+// dayBuckets returns one bucket per day of [from, to) and the raw intervals it read.
+// Ranges longer than rollupRange take rolled-up days from daily_rollups; those buckets
+// have totals but no segments.
+func dayBuckets(deviceID, channel string, from, to time.Time, loc *time.Location) ([]timelineBucket, []interval, error) {
+	raw := func(from, to time.Time) ([]timelineBucket, []interval, error) {
+		intervals, err := loadIntervals(deviceID, channel, from, to)
+		if err != nil {
+			return nil, nil, err
+		}
+		return buildTimeline(intervals, from, to, "day", loc), intervals, nil
+	}
+	if to.Sub(from) <= rollupRange {
+		return raw(from, to)
+	}
+
+	// Whole days only: a range starting mid-day reads its first day raw
+	first := bucketStart(from, "day", loc)
+	if first.Before(from) {
+		first = first.AddDate(0, 0, 1)
+	}
+	rollups, err := storage.Rollups(deviceID, channel, first.Format("2006-01-02"), to.In(loc).Format("2006-01-02"))
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(rollups) == 0 {
+		return raw(from, to)
+	}
+	byDay := make(map[string]store.Rollup)
+	for _, r := range rollups {
+		byDay[r.Day] = r
+	}
+	cut, _ := time.ParseInLocation("2006-01-02", rollups[len(rollups)-1].Day, loc)
+	cut = cut.AddDate(0, 0, 1)
+
+	var buckets []timelineBucket
+	var intervals []interval
+	if from.Before(first) {
+		b, iv, err := raw(from, first)
+		if err != nil {
+			return nil, nil, err
+		}
+		buckets, intervals = append(buckets, b...), append(intervals, iv...)
+	}
+	for day := first; day.Before(cut); day = day.AddDate(0, 0, 1) {
+		next := day.AddDate(0, 0, 1)
+		r := byDay[day.Format("2006-01-02")] // days before the first event have no rollup
+		buckets = append(buckets, timelineBucket{
+			Start:         day.Format(time.RFC3339),
+			End:           next.Format(time.RFC3339),
+			UpSeconds:     r.UpSeconds,
+			DownSeconds:   r.DownSeconds,
+			NoDataSeconds: int64(next.Sub(day).Seconds()) - r.UpSeconds - r.DownSeconds,
+			Outages:       r.Outages,
+			Segments:      []timelineSegment{},
+		})
+	}
+	if cut.Before(to) {
+		b, iv, err := raw(cut, to)
+		if err != nil {
+			return nil, nil, err
+		}
+		buckets, intervals = append(buckets, b...), append(intervals, iv...)
+	}
+	return buckets, intervals, nil
+}
+
+// weekBuckets merges day buckets into ISO weeks.
+func weekBuckets(days []timelineBucket, loc *time.Location) []timelineBucket {
+	var weeks []timelineBucket
+	for _, b := range days {
+		start, _ := time.Parse(time.RFC3339, b.Start)
+		week := bucketStart(start, "week", loc)
+		if n := len(weeks); n == 0 || weeks[n-1].Start != week.Format(time.RFC3339) {
+			weeks = append(weeks, timelineBucket{
+				Start:    week.Format(time.RFC3339),
+				End:      nextBucket(week, "week").Format(time.RFC3339),
+				Segments: []timelineSegment{},
+			})
+		}
+		w := &weeks[len(weeks)-1]
+		w.UpSeconds += b.UpSeconds
+		w.DownSeconds += b.DownSeconds
+		w.NoDataSeconds += b.NoDataSeconds
+		w.Outages += b.Outages
+		w.Segments = append(w.Segments, b.Segments...)
+	}
+	return weeks
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"power-monitor/store"
+)
+
+func TestRollups(t *testing.T) {
+	if err := initDB(filepath.Join(t.TempDir(), "test.db")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	loc, _ := time.LoadLocation("Europe/Kyiv")
+
+	// Two months of a daily outage 18:00-20:00, crossing the October DST change
+	start := time.Date(2024, 9, 1, 12, 0, 0, 0, loc)
+	saveEvent("home", "", "up", start, 0, false)
+	for day := start; day.Before(start.AddDate(0, 2, 0)); day = day.AddDate(0, 0, 1) {
+		down := time.Date(day.Year(), day.Month(), day.Day(), 18, 0, 0, 0, loc)
+		saveEvent("home", "", "down", down, 0, false)
+		saveEvent("home", "", "up", down.Add(2*time.Hour), 7200, false)
+		if day.Month() == 10 && day.Day() == 10 {
+			// One outage through midnight
+			night := time.Date(2024, 10, 10, 23, 0, 0, 0, loc)
+			saveEvent("home", "", "down", night, 0, false)
+			saveEvent("home", "", "up", night.Add(3*time.Hour), 10800, false)
+		}
+	}
+
+	now := start.AddDate(0, 2, 5)
+	if err := rollupChannel("home", "", loc, now); err != nil {
+		t.Fatal(err)
+	}
+	rollups, err := storage.Rollups("home", "", "2024-01-01", "2025-01-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := int(bucketStart(now, "day", loc).Sub(bucketStart(start, "day", loc)).Hours()/24 + 0.5); len(rollups) != want {
+		t.Fatalf("%d rollups, want %d days up to yesterday", len(rollups), want)
+	}
+	var oct10, oct11 store.Rollup
+	for _, r := range rollups {
+		switch r.Day {
+		case "2024-10-10":
+			oct10 = r
+		case "2024-10-11":
+			oct11 = r
+		}
+	}
+	if oct10.Outages != 2 || oct10.DownSeconds != 3*3600 {
+		t.Errorf("Oct 10 = %+v, want 2 outages and 3h down", oct10)
+	}
+	if oct11.Outages != 1 || oct11.DownSeconds != 4*3600 || oct11.LongestOutage != 2*3600 {
+		t.Errorf("Oct 11 = %+v, want the night outage counted on Oct 10 only", oct11)
+	}
+
+	// A second run only adds the new days
+	if err := rollupChannel("home", "", loc, now.AddDate(0, 0, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if day, _ := storage.LastRollupDay("home", ""); day != now.Format("2006-01-02") {
+		t.Errorf("last rollup day = %s, want %s", day, now.Format("2006-01-02"))
+	}
+
+	// Long ranges give the same totals from rollups as from raw events
+	from := time.Date(2024, 9, 15, 6, 0, 0, 0, loc)
+	to := now.Add(3 * time.Hour)
+	buckets, _, err := dayBuckets("home", "", from, to, loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	intervals, _ := loadIntervals("home", "", from, to)
+	rawBuckets := buildTimeline(intervals, from, to, "day", loc)
+	if len(buckets) != len(rawBuckets) {
+		t.Fatalf("%d buckets from rollups, %d from raw events", len(buckets), len(rawBuckets))
+	}
+	for i := range buckets {
+		b, r := buckets[i], rawBuckets[i]
+		if b.Start != r.Start || b.UpSeconds != r.UpSeconds || b.DownSeconds != r.DownSeconds ||
+			b.NoDataSeconds != r.NoDataSeconds || b.Outages != r.Outages {
+			t.Errorf("day %s: rollups %+v, raw %+v", r.Start, b, r)
+		}
+	}
+	weeks := weekBuckets(buckets, loc)
+	rawWeeks := buildTimeline(intervals, from, to, "week", loc)
+	if len(weeks) != len(rawWeeks) || weeks[2].DownSeconds != rawWeeks[2].DownSeconds || weeks[2].Outages != 7 {
+		t.Errorf("weeks = %+v, want %+v", weeks[2], rawWeeks[2])
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"time"
+
+	"power-monitor/monitor"
+)
+
+// The server records its own runs in server_runs: the start, a heartbeat every minute
+// and the stop. While it is down nobody watches the devices, so the time between runs
+// is "no data" rather than part of an outage. After a start the tracker waits out
+// RESTART_GRACE (default 5m) before timing out devices that are still reconnecting.
+
+const (
+	serverHeartbeatInterval = time.Minute
+	defaultRestartGrace     = 5 * time.Minute
+	minServerGap            = monitor.DefaultTimeout // a quicker restart can't have missed a change
+)
+
+var (
+	serverRunID     int64
+	serverStartedAt time.Time
+	serverDownSince time.Time // end of the previous run, zero if the restart was quick
+	restartGrace    = defaultRestartGrace
+)
+
+// setupServerRun records the start and works out how long the server was down. Call
+// it before the device states are loaded.
+func setupServerRun() {
+	if s := os.Getenv("RESTART_GRACE"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d < 0 {
+			fatal("Invalid RESTART_GRACE", "value", s)
+		}
+		restartGrace = d
+	}
+
+	now := time.Now()
+	runs, err := storage.ServerRuns(now, now)
+	if err != nil {
+		slog.Error("Failed to load server runs", "err", err)
+	} else if n := len(runs); n > 0 {
+		prev := runs[n-1]
+		if prev.StoppedAt.IsZero() {
+			slog.Warn("Server was not shut down cleanly", "last_heartbeat", prev.HeartbeatAt)
+		}
+		if gap := now.Sub(prev.End()); gap >= minServerGap {
+			serverDownSince = prev.End()
+			slog.Info("Server was down, shown as no data", "downtime", gap.Round(time.Second).String())
+		}
+	}
+
+	serverStartedAt = now
+	if serverRunID, err = storage.StartServerRun(now); err != nil {
+		slog.Error("Failed to record server start", "err", err)
+	}
+	tracker.Grace(now.Add(restartGrace))
+}
+
+// serverHeartbeat keeps the end of the current run up to date, so a crash loses at
+// most serverHeartbeatInterval.
+func serverHeartbeat() {
+	for {
+		time.Sleep(serverHeartbeatInterval)
+		if err := storage.ServerHeartbeat(serverRunID, time.Now()); err != nil {
+			slog.Error("Failed to record server heartbeat", "err", err)
+			noteError("db", err)
+		}
+	}
+}
+
+// stopServerRun records a clean shutdown.
+func stopServerRun() {
+	if err := storage.StopServerRun(serverRunID, time.Now()); err != nil {
+		slog.Error("Failed to record server stop", "err", err)
+	}
+}
+
+// resumeAfterGap starts a stored state over at the restart when the server was down
+// long enough to miss its end, so the gap isn't counted as part of it.
+func resumeAfterGap(state *monitor.State) {
+	if serverDownSince.IsZero() {
+		return
+	}
+	if state.IsDown && state.DownSince.Before(serverDownSince) {
+		state.DownSince = serverStartedAt
+	}
+	if !state.IsDown && state.UpSince.Before(serverDownSince) {
+		state.UpSince = serverStartedAt
+	}
+}
+
+// serverGaps returns the times within [from, to) the server was down for at least
+// minServerGap, as "nodata" intervals.
+func serverGaps(from, to time.Time) ([]interval, error) {
+	runs, err := storage.ServerRuns(from, to)
+	if err != nil {
+		return nil, err
+	}
+	var gaps []interval
+	for i := 1; i < len(runs); i++ {
+		start, end := runs[i-1].End(), runs[i].StartedAt
+		if end.Sub(start) < minServerGap {
+			continue
+		}
+		if start.Before(from) {
+			start = from
+		}
+		if end.After(to) {
+			end = to
+		}
+		if end.After(start) {
+			gaps = append(gaps, interval{Start: start, End: end, State: "nodata"})
+		}
+	}
+	return gaps, nil
+}
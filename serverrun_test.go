@@ -0,0 +1,68 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"power-monitor/monitor"
+)
+
+func TestServerGaps(t *testing.T) {
+	if err := initDB(filepath.Join(t.TempDir(), "test.db")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	loc, _ := time.LoadLocation("Europe/Kyiv")
+	at := func(hour, min int) time.Time { return time.Date(2024, 6, 1, hour, min, 0, 0, loc) }
+
+	// An outage from 10:00 to 16:00 with the server down from 12:00 to 14:00, and a
+	// restart at 17:00 too quick to count
+	first, _ := storage.StartServerRun(at(8, 0))
+	storage.StopServerRun(first, at(12, 0))
+	second, _ := storage.StartServerRun(at(14, 0))
+	storage.StopServerRun(second, at(17, 0))
+	storage.StartServerRun(at(17, 1))
+	saveEvent("home", "", "up", at(8, 0), 0, false)
+	saveEvent("home", "", "down", at(10, 0), 7200, false)
+	saveEvent("home", "", "up", at(16, 0), 7200, false)
+
+	intervals, err := loadIntervals("home", "", at(9, 0), at(18, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []interval{
+		{Start: at(9, 0), End: at(10, 0), State: "up"},
+		{Start: at(10, 0), End: at(12, 0), State: "down"},
+		{Start: at(12, 0), End: at(14, 0), State: "nodata"},
+		{Start: at(14, 0), End: at(16, 0), State: "down", Continued: true},
+		{Start: at(16, 0), End: at(18, 0), State: "up"},
+	}
+	if len(intervals) != len(want) {
+		t.Fatalf("intervals = %+v, want %+v", intervals, want)
+	}
+	for i := range want {
+		if iv := intervals[i]; !iv.Start.Equal(want[i].Start) || !iv.End.Equal(want[i].End) ||
+			iv.State != want[i].State || iv.Continued != want[i].Continued {
+			t.Errorf("interval %d = %+v, want %+v", i, iv, want[i])
+		}
+	}
+
+	s := summarize(intervals)
+	if len(s.Outages) != 1 || s.Downtime != 4*time.Hour {
+		t.Errorf("summary = %d outages, %s down; want 1 outage, 4h", len(s.Outages), s.Downtime)
+	}
+	b := buildTimeline(intervals, at(9, 0), at(18, 0), "day", loc)[0]
+	if b.Outages != 1 || b.NoDataSeconds != 2*3600 {
+		t.Errorf("day bucket = %+v, want 1 outage and the gap as no data", b)
+	}
+
+	// A state older than the gap starts over at the restart
+	serverDownSince, serverStartedAt = at(12, 0), at(14, 0)
+	t.Cleanup(func() { serverDownSince, serverStartedAt = time.Time{}, time.Time{} })
+	state := monitor.State{IsDown: true, DownSince: at(10, 0), LastPing: at(10, 0)}
+	resumeAfterGap(&state)
+	if !state.DownSince.Equal(at(14, 0)) || !state.LastPing.Equal(at(10, 0)) {
+		t.Errorf("resumed state = %+v, want down since the restart", state)
+	}
+}
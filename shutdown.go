@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"power-monitor/monitor"
+)
+
+// On SIGINT or SIGTERM the server stops taking pings, lets the tracker finish, waits
+// for event writes and queued notifications within shutdownTimeout, and records a clean
+// stop. Docker kills a container 10s after SIGTERM, so the deadline stays under that.
+
+const shutdownTimeout = 8 * time.Second
+
+// trackerBacklog is how many tracker results may wait to be written before the
+// tracker waits for the writer.
+const trackerBacklog = 16
+
+var (
+	eventsMu sync.Mutex
+	// eventQueue feeds the worker that applies tracker results, nil when none runs:
+	// results are then applied at once.
+	eventQueue chan monitor.Events
+)
+
+// queueEvents makes tracker results and queues them in one step, so the worker applies
+// the results of checks, pings and lost connections in the order the tracker made them.
+func queueEvents(results func() monitor.Events) {
+	eventsMu.Lock()
+	defer eventsMu.Unlock()
+	ev := results()
+	if eventQueue == nil {
+		applyEvents(ev)
+		return
+	}
+	eventQueue <- ev
+}
+
+// runTracker checks device timeouts until ctx is done and starts the worker that
+// applies tracker results. The returned channel closes once stopEvents was called and
+// the worker has applied everything queued before.
+func runTracker(ctx context.Context) <-chan struct{} {
+	queue := make(chan monitor.Events, trackerBacklog)
+	eventsMu.Lock()
+	eventQueue = queue
+	eventsMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for ev := range queue {
+			applyEvents(ev)
+		}
+	}()
+	go tracker.Run(ctx, trackerInterval, func() {
+		trackerTick.Store(time.Now().UnixNano())
+		queueEvents(tracker.Check)
+	})
+	return done
+}
+
+// stopEvents closes the worker's queue. Results made later are applied at once.
+func stopEvents() {
+	eventsMu.Lock()
+	defer eventsMu.Unlock()
+	if eventQueue != nil {
+		close(eventQueue)
+		eventQueue = nil
+	}
+}
+
+// waitGroup waits for wg until ctx is done and reports whether it finished.
+func waitGroup(ctx context.Context, wg *sync.WaitGroup) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// shutdown stops the server in order: inputs first, then what they started.
+func shutdown(srv *http.Server, trackerDone <-chan struct{}) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	// Pings: HTTP handlers have queued their events once Shutdown returns
+	if err := srv.Shutdown(ctx); err != nil {
+		slog.Warn("HTTP shutdown", "err", err)
+	}
+	stopUDP()
+	stopMQTT()
+
+	// Nothing queues any more but the stopping tracker loop, which then applies at once
+	stopEvents()
+	select {
+	case <-trackerDone:
+	case <-ctx.Done():
+		slog.Warn("Shutdown deadline passed with events still being written")
+	}
+	if !waitGroup(ctx, &pendingNotifications) {
+		slog.Warn("Shutdown deadline passed with notifications queued", "queued", len(notificationQueue))
+	}
+
+	stopServerRun()
+	slog.Info("Power monitor stopped")
+}
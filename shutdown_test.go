@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"power-monitor/monitor"
+	"power-monitor/store"
+)
+
+// tickClock fires the tracker's checks when told to.
+type tickClock struct {
+	mu    sync.Mutex
+	now   time.Time
+	ticks chan time.Time
+}
+
+func (c *tickClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *tickClock) After(time.Duration) <-chan time.Time { return c.ticks }
+
+func (c *tickClock) tick(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	now := c.now
+	c.mu.Unlock()
+	c.ticks <- now
+}
+
+func TestRunTrackerAppliesInOrder(t *testing.T) {
+	if err := initDB(filepath.Join(t.TempDir(), "test.db")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	clock := &tickClock{now: time.Now(), ticks: make(chan time.Time)}
+	orig := tracker
+	tracker = monitor.New(clock)
+	t.Cleanup(func() { tracker = orig })
+
+	d := &DeviceConfig{Device: store.Device{ID: "home", Name: "home", Timeout: 60, Paused: true}}
+	devices["home"] = d
+	t.Cleanup(func() { delete(devices, "home") })
+	saveDevice(d)
+	track(d)
+	recordPing("home", nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := runTracker(ctx)
+	t.Cleanup(stopEvents)
+	clock.tick(2 * time.Minute)
+	clock.tick(time.Minute) // the loop is back waiting, so the first check was queued
+	// The ping that ends the outage is applied after it, not next to it
+	recordPing("home", nil)
+	cancel()
+	stopEvents()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("worker not done after its queue was closed")
+	}
+
+	var downs int
+	db.QueryRow("SELECT COUNT(*) FROM events WHERE device_id = 'home' AND event_type = 'down'").Scan(&downs)
+	if last, err := storage.LastEvent("home", ""); err != nil || last.Type != "up" || downs != 1 {
+		t.Errorf("last event = %+v %v after %d outages, want the restore after one", last, err, downs)
+	}
+
+	// Without the worker results are applied at once
+	clock.mu.Lock()
+	clock.now = clock.now.Add(2 * time.Minute)
+	clock.mu.Unlock()
+	queueEvents(tracker.Check)
+	if last, _ := storage.LastEvent("home", ""); last.Type != "down" {
+		t.Errorf("last event = %+v, want the outage applied at once", last)
+	}
+}
+
+func TestShutdownDrainsNotifications(t *testing.T) {
+	release := make(chan struct{})
+	var delivered []string
+	deliverers["test"] = func(n notification) error {
+		<-release
+		delivered = append(delivered, n.Text)
+		return nil
+	}
+	t.Cleanup(func() { delete(deliverers, "test") })
+	go notificationWorker()
+
+	enqueueNotification(notification{Channel: "test", Text: "first"})
+	enqueueNotification(notification{Channel: "test", Text: "second"})
+	enqueueNotification(notification{Channel: "gone", Text: "unconfigured"})
+
+	// A stuck delivery runs into the deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if waitGroup(ctx, &pendingNotifications) {
+		t.Fatal("queue drained while a delivery was blocked")
+	}
+
+	close(release)
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if !waitGroup(ctx, &pendingNotifications) {
+		t.Fatal("queue not drained")
+	}
+	if len(delivered) != 2 || delivered[0] != "first" || delivered[1] != "second" {
+		t.Errorf("delivered %v, want both in order", delivered)
+	}
+
+	var wg sync.WaitGroup
+	if !waitGroup(context.Background(), &wg) {
+		t.Error("waiting for nothing didn't return at once")
+	}
+}
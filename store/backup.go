@@ -0,0 +1,121 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// ErrNoBackup is returned for PostgreSQL, which is backed up with pg_dump instead.
+var ErrNoBackup = errors.New("backups are only built in for SQLite; use pg_dump for PostgreSQL")
+
+// Backup writes a consistent snapshot of the database to a new SQLite file at path
+// with the online backup API, while other connections keep reading and writing. The
+// file appears under its name only once complete.
+func (db *DB) Backup(path string) error {
+	if db.postgres {
+		return ErrNoBackup
+	}
+	tmp := path + ".tmp"
+	os.Remove(tmp)
+	if err := copySQLite(db.DB, tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// copySQLite copies all of src into the SQLite file at destPath, replacing its contents.
+func copySQLite(src *sql.DB, destPath string) error {
+	dest, err := sql.Open("sqlite3", destPath)
+	if err != nil {
+		return err
+	}
+	defer dest.Close()
+
+	ctx := context.Background()
+	destConn, err := dest.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer destConn.Close()
+	srcConn, err := src.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer srcConn.Close()
+
+	return destConn.Raw(func(d interface{}) error {
+		return srcConn.Raw(func(s interface{}) error {
+			b, err := d.(*sqlite3.SQLiteConn).Backup("main", s.(*sqlite3.SQLiteConn), "main")
+			if err != nil {
+				return err
+			}
+			// All pages in one step: writers wait (busy timeout) instead of restarting the copy
+			if _, err := b.Step(-1); err != nil {
+				b.Finish()
+				return err
+			}
+			return b.Finish()
+		})
+	})
+}
+
+// SchemaVersion is the newest applied migration, 0 for an empty database.
+func (db *DB) SchemaVersion() (int, error) {
+	var version int
+	err := db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version)
+	return version, err
+}
+
+// Restore replaces the SQLite database at path with the backup file from, which must be
+// an intact power-monitor database whose schema this build knows. The replaced file is
+// kept as path+".before-restore". It returns the schema version of the backup, which
+// MigrateUp brings up to date. The server must not be running.
+func Restore(from, path string) (int, error) {
+	if _, err := os.Stat(from); err != nil {
+		return 0, err
+	}
+	conn, err := sql.Open("sqlite3", "file:"+from+"?mode=ro")
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	backup := &DB{DB: conn}
+
+	var check string
+	if err := backup.QueryRow("PRAGMA integrity_check").Scan(&check); err != nil {
+		return 0, fmt.Errorf("%s: %v", from, err)
+	}
+	if check != "ok" {
+		return 0, fmt.Errorf("%s is damaged: %s", from, check)
+	}
+	version, err := backup.SchemaVersion()
+	if err != nil {
+		return 0, fmt.Errorf("%s is not a power-monitor database: %v", from, err)
+	}
+	known, err := backup.Migrations()
+	if err != nil {
+		return 0, err
+	}
+	if latest := known[len(known)-1].Version; version > latest {
+		return version, fmt.Errorf("%s has schema version %d, newer than this build knows (%d)", from, version, latest)
+	}
+
+	if _, err := os.Stat(path); err == nil {
+		current, err := sql.Open("sqlite3", path)
+		if err != nil {
+			return version, err
+		}
+		err = copySQLite(current, path+".before-restore")
+		current.Close()
+		if err != nil {
+			return version, fmt.Errorf("saving the current database: %v", err)
+		}
+	}
+	return version, copySQLite(conn, path)
+}
@@ -0,0 +1,71 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBackupRestore(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "power.db")
+	s, err := OpenSQLite(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.DB().MigrateUp(); err != nil {
+		t.Fatal(err)
+	}
+	s.SaveDevice(&Device{ID: "home", Name: "Дім"})
+
+	backup := filepath.Join(dir, "backup.db")
+	if err := s.DB().Backup(backup); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(backup + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary file left behind: %v", err)
+	}
+	s.SaveDevice(&Device{ID: "cottage", Name: "Дача"})
+	s.Close()
+
+	version, err := Restore(backup, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	all, _ := (&DB{}).Migrations()
+	if version != all[len(all)-1].Version {
+		t.Errorf("backup schema version %d, want %d", version, all[len(all)-1].Version)
+	}
+	for file, want := range map[string]int{path: 1, path + ".before-restore": 2} {
+		s, err := OpenSQLite(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		list, err := s.ListDevices()
+		s.Close()
+		if err != nil || len(list) != want {
+			t.Errorf("%s: %d devices (%v), want %d", filepath.Base(file), len(list), err, want)
+		}
+	}
+
+	// A backup from a newer build is refused
+	s, _ = OpenSQLite(backup)
+	s.DB().Exec("INSERT INTO schema_migrations (version, name, applied_at) VALUES (9999, 'future', CURRENT_TIMESTAMP)")
+	s.Close()
+	if _, err := Restore(backup, path); err == nil || !strings.Contains(err.Error(), "newer") {
+		t.Errorf("restoring a newer schema: err = %v", err)
+	}
+
+	// So is a file that isn't a power-monitor database
+	other := filepath.Join(dir, "other.db")
+	s, _ = OpenSQLite(other)
+	s.DB().Exec("CREATE TABLE notes (text TEXT)")
+	s.Close()
+	if _, err := Restore(other, path); err == nil {
+		t.Error("restored a database without schema_migrations")
+	}
+	if _, err := Restore(filepath.Join(dir, "missing.db"), path); err == nil {
+		t.Error("restored a missing file")
+	}
+}
@@ -0,0 +1,65 @@
+package store
+
+import (
+	"database/sql"
+	"strconv"
+	"strings"
+)
+
+// DB wraps the database handle so queries can be written once: Exec, Query and
+// QueryRow take SQLite-style ? placeholders on every backend.
+type DB struct {
+	*sql.DB
+	postgres bool
+}
+
+// Rebind rewrites ? placeholders into $1, $2, ... for PostgreSQL. Question marks inside
+// string literals are left alone.
+func (db *DB) Rebind(query string) string {
+	if !db.postgres || !strings.Contains(query, "?") {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	quoted := false
+	for _, r := range query {
+		switch {
+		case r == '\'':
+			quoted = !quoted
+		case r == '?' && !quoted:
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func (db *DB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return db.DB.Exec(db.Rebind(query), args...)
+}
+
+func (db *DB) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return db.DB.Query(db.Rebind(query), args...)
+}
+
+func (db *DB) QueryRow(query string, args ...interface{}) *sql.Row {
+	return db.DB.QueryRow(db.Rebind(query), args...)
+}
+
+// Postgres reports whether this is a PostgreSQL database.
+func (db *DB) Postgres() bool {
+	return db.postgres
+}
+
+// Size is the space the database takes, in bytes.
+func (db *DB) Size() (int64, error) {
+	var size int64
+	if db.postgres {
+		err := db.QueryRow("SELECT pg_database_size(current_database())").Scan(&size)
+		return size, err
+	}
+	err := db.QueryRow("SELECT page_count * page_size FROM pragma_page_count(), pragma_page_size()").Scan(&size)
+	return size, err
+}
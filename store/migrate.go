@@ -0,0 +1,219 @@
+package store
+
+import (
+	"embed"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Migrations live in migrations/{sqlite,postgres}/NNNN_name.sql, each with an
+// "-- +up" and a "-- +down" section. Both dialects use the same version numbers.
+//
+//go:embed migrations
+var migrationFiles embed.FS
+
+// Migration is one numbered schema change.
+type Migration struct {
+	Version   int
+	Name      string
+	Up        string
+	Down      string
+	AppliedAt time.Time // zero while pending
+}
+
+func (db *DB) dialect() string {
+	if db.postgres {
+		return "postgres"
+	}
+	return "sqlite"
+}
+
+// Migrations lists the migrations for this database's dialect, oldest first.
+func (db *DB) Migrations() ([]Migration, error) {
+	dir := path.Join("migrations", db.dialect())
+	entries, err := migrationFiles.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var list []Migration
+	for _, e := range entries {
+		name := strings.TrimSuffix(e.Name(), ".sql")
+		num, label, ok := strings.Cut(name, "_")
+		version, err := strconv.Atoi(num)
+		if !ok || err != nil {
+			return nil, fmt.Errorf("migration %s: name must be NNNN_name.sql", e.Name())
+		}
+		content, err := migrationFiles.ReadFile(path.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		up, down, err := splitMigration(string(content))
+		if err != nil {
+			return nil, fmt.Errorf("migration %s: %v", e.Name(), err)
+		}
+		list = append(list, Migration{Version: version, Name: label, Up: up, Down: down})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Version < list[j].Version })
+	return list, nil
+}
+
+func splitMigration(content string) (up, down string, err error) {
+	const upMarker, downMarker = "-- +up\n", "-- +down\n"
+	u := strings.Index(content, upMarker)
+	d := strings.Index(content, downMarker)
+	if u < 0 || d < u {
+		return "", "", fmt.Errorf("want a %q section followed by a %q section", "-- +up", "-- +down")
+	}
+	return content[u+len(upMarker) : d], content[d+len(downMarker):], nil
+}
+
+func (db *DB) ensureMigrationsTable() error {
+	timeType := "DATETIME"
+	if db.postgres {
+		timeType = "TIMESTAMPTZ"
+	}
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at ` + timeType + ` NOT NULL
+	)`)
+	return err
+}
+
+// MigrationStatus lists all migrations with the time each was applied.
+func (db *DB) MigrationStatus() ([]Migration, error) {
+	if err := db.ensureMigrationsTable(); err != nil {
+		return nil, err
+	}
+	list, err := db.Migrations()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query("SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var at time.Time
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, err
+		}
+		applied[version] = at
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for i := range list {
+		list[i].AppliedAt = applied[list[i].Version]
+	}
+	return list, nil
+}
+
+// MigrateUp applies every pending migration in order, each in its own transaction,
+// and returns the ones it applied.
+func (db *DB) MigrateUp() ([]Migration, error) {
+	list, err := db.MigrationStatus()
+	if err != nil {
+		return nil, err
+	}
+	var done []Migration
+	for _, m := range list {
+		if !m.AppliedAt.IsZero() {
+			continue
+		}
+		if err := db.apply(m, m.Up, true); err != nil {
+			return done, fmt.Errorf("migration %04d_%s: %v", m.Version, m.Name, err)
+		}
+		done = append(done, m)
+	}
+	return done, nil
+}
+
+// MigrateDown reverts the newest applied migration. It returns false if none is applied.
+func (db *DB) MigrateDown() (Migration, bool, error) {
+	list, err := db.MigrationStatus()
+	if err != nil {
+		return Migration{}, false, err
+	}
+	for i := len(list) - 1; i >= 0; i-- {
+		m := list[i]
+		if m.AppliedAt.IsZero() {
+			continue
+		}
+		if err := db.apply(m, m.Down, false); err != nil {
+			return m, false, fmt.Errorf("migration %04d_%s: %v", m.Version, m.Name, err)
+		}
+		return m, true, nil
+	}
+	return Migration{}, false, nil
+}
+
+// lastLegacyMigration is the newest migration whose columns the ALTERs that ran on
+// every start, before migrations, may already have added.
+const lastLegacyMigration = 15
+
+func (db *DB) apply(m Migration, script string, up bool) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, stmt := range splitStatements(script) {
+		if _, err := tx.Exec(stmt); err != nil {
+			// SQLite databases from before migrations already have some of the columns
+			// the first migrations add
+			if up && !db.postgres && m.Version <= lastLegacyMigration && strings.Contains(err.Error(), "duplicate column name") {
+				continue
+			}
+			return err
+		}
+	}
+	if up {
+		_, err = tx.Exec(db.Rebind("INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)"),
+			m.Version, m.Name, time.Now().UTC())
+	} else {
+		_, err = tx.Exec(db.Rebind("DELETE FROM schema_migrations WHERE version = ?"), m.Version)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// splitStatements cuts a script at semicolons outside string literals and drops
+// comment lines.
+func splitStatements(script string) []string {
+	var lines []string
+	for _, line := range strings.Split(script, "\n") {
+		if !strings.HasPrefix(strings.TrimSpace(line), "--") {
+			lines = append(lines, line)
+		}
+	}
+	script = strings.Join(lines, "\n")
+
+	var stmts []string
+	quoted := false
+	start := 0
+	for i, r := range script {
+		switch {
+		case r == '\'':
+			quoted = !quoted
+		case r == ';' && !quoted:
+			if stmt := strings.TrimSpace(script[start:i]); stmt != "" {
+				stmts = append(stmts, stmt)
+			}
+			start = i + 1
+		}
+	}
+	if stmt := strings.TrimSpace(script[start:]); stmt != "" {
+		stmts = append(stmts, stmt)
+	}
+	return stmts
+}
@@ -0,0 +1,128 @@
+package store
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func openTestSQLite(t *testing.T) *DB {
+	t.Helper()
+	s, err := OpenSQLite(filepath.Join(t.TempDir(), "power.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s.DB()
+}
+
+func TestMigrateUpDown(t *testing.T) {
+	db := openTestSQLite(t)
+	all, err := db.Migrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	applied, err := db.MigrateUp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != len(all) {
+		t.Fatalf("applied %d of %d migrations", len(applied), len(all))
+	}
+	if again, err := db.MigrateUp(); err != nil || len(again) != 0 {
+		t.Fatalf("second up applied %d, err %v; want nothing", len(again), err)
+	}
+
+	// Every down script must undo its up script
+	for i := len(all) - 1; i >= 0; i-- {
+		m, ok, err := db.MigrateDown()
+		if err != nil || !ok || m.Version != all[i].Version {
+			t.Fatalf("down %d: reverted %+v, %v, %v", all[i].Version, m.Version, ok, err)
+		}
+	}
+	if _, ok, _ := db.MigrateDown(); ok {
+		t.Error("down with nothing applied reverted something")
+	}
+	var tables int
+	db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name NOT IN ('schema_migrations', 'sqlite_sequence')").Scan(&tables)
+	if tables != 0 {
+		t.Errorf("%d tables left after reverting everything", tables)
+	}
+
+	if _, err := db.MigrateUp(); err != nil {
+		t.Fatalf("up after a full down: %v", err)
+	}
+	status, _ := db.MigrationStatus()
+	for _, m := range status {
+		if m.AppliedAt.IsZero() {
+			t.Errorf("%04d_%s still pending", m.Version, m.Name)
+		}
+	}
+}
+
+func TestMigrateLegacyDatabase(t *testing.T) {
+	// A database from before migrations: tables created with some of the later
+	// columns, the rest added by ALTER TABLE on every start
+	db := openTestSQLite(t)
+	_, err := db.Exec(`
+		CREATE TABLE events (id INTEGER PRIMARY KEY AUTOINCREMENT, device_id TEXT NOT NULL, event_type TEXT NOT NULL,
+			timestamp DATETIME NOT NULL, duration_seconds INTEGER, channel TEXT NOT NULL DEFAULT '');
+		CREATE TABLE devices (id TEXT PRIMARY KEY, name TEXT NOT NULL, chat_id TEXT, bot_token TEXT,
+			owner_email TEXT, wifi_ssid TEXT, created_at DATETIME DEFAULT CURRENT_TIMESTAMP);
+		ALTER TABLE devices ADD COLUMN paused INTEGER DEFAULT 0;
+		ALTER TABLE devices ADD COLUMN timeout INTEGER DEFAULT 0;
+		INSERT INTO devices (id, name, owner_email, paused) VALUES ('home', 'Дім', 'a@example.com', 1);
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.MigrateUp(); err != nil {
+		t.Fatal(err)
+	}
+	s := &sqlStore{db: db}
+	list, err := s.ListDevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].OwnerEmail != "a@example.com" || !list[0].Paused {
+		t.Errorf("devices after migrating = %+v", list)
+	}
+}
+
+func TestDuplicateColumnOnlyForLegacyMigrations(t *testing.T) {
+	db := openTestSQLite(t)
+	if _, err := db.MigrateUp(); err != nil {
+		t.Fatal(err)
+	}
+	add := "ALTER TABLE devices ADD COLUMN timeout INTEGER DEFAULT 0"
+	db.Exec("DELETE FROM schema_migrations WHERE version = 5")
+	if err := db.apply(Migration{Version: 5, Name: "timeout"}, add, true); err != nil {
+		t.Errorf("legacy migration: %v", err)
+	}
+	if err := db.apply(Migration{Version: 99, Name: "conflict"}, add, true); err == nil {
+		t.Error("a newer migration adding an existing column was applied")
+	}
+}
+
+func TestMigrationDialectsMatch(t *testing.T) {
+	sqlite, err := (&DB{}).Migrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	postgres, err := (&DB{postgres: true}).Migrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sqlite) != len(postgres) {
+		t.Fatalf("%d SQLite migrations, %d PostgreSQL", len(sqlite), len(postgres))
+	}
+	for i := range sqlite {
+		if sqlite[i].Version != i+1 {
+			t.Errorf("migration %d has version %d", i+1, sqlite[i].Version)
+		}
+		if sqlite[i].Version != postgres[i].Version || sqlite[i].Name != postgres[i].Name {
+			t.Errorf("%04d_%s vs %04d_%s", sqlite[i].Version, sqlite[i].Name, postgres[i].Version, postgres[i].Name)
+		}
+	}
+}
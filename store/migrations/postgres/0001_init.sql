@@ -0,0 +1,21 @@
+-- +up
+CREATE TABLE IF NOT EXISTS events (
+	id BIGSERIAL PRIMARY KEY,
+	device_id TEXT NOT NULL,
+	event_type TEXT NOT NULL,
+	timestamp TIMESTAMPTZ NOT NULL,
+	duration_seconds BIGINT
+);
+CREATE INDEX IF NOT EXISTS idx_device_time ON events(device_id, timestamp DESC);
+
+CREATE TABLE IF NOT EXISTS devices (
+	id TEXT PRIMARY KEY,
+	name TEXT NOT NULL,
+	chat_id TEXT,
+	bot_token TEXT,
+	created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+-- +down
+DROP TABLE devices;
+DROP TABLE events;
@@ -0,0 +1,5 @@
+-- +up
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS paused BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- +down
+ALTER TABLE devices DROP COLUMN paused;
@@ -0,0 +1,5 @@
+-- +up
+ALTER TABLE events ADD COLUMN IF NOT EXISTS channel TEXT NOT NULL DEFAULT '';
+
+-- +down
+ALTER TABLE events DROP COLUMN channel;
@@ -0,0 +1,11 @@
+-- +up
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS timezone TEXT;
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS digest_frequency TEXT;
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS digest_time TEXT;
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS digest_sent_at TIMESTAMPTZ;
+
+-- +down
+ALTER TABLE devices DROP COLUMN digest_sent_at;
+ALTER TABLE devices DROP COLUMN digest_time;
+ALTER TABLE devices DROP COLUMN digest_frequency;
+ALTER TABLE devices DROP COLUMN timezone;
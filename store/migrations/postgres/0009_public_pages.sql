@@ -0,0 +1,14 @@
+-- +up
+-- Opt-in public status pages (/s/{slug}) for a device or a group of devices
+CREATE TABLE IF NOT EXISTS public_pages (
+	slug TEXT PRIMARY KEY,
+	owner_email TEXT NOT NULL,
+	title TEXT,
+	device_ids TEXT NOT NULL,
+	hide_times BOOLEAN NOT NULL DEFAULT FALSE,
+	hide_name BOOLEAN NOT NULL DEFAULT FALSE,
+	created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+-- +down
+DROP TABLE public_pages;
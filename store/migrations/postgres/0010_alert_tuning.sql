@@ -0,0 +1,13 @@
+-- +up
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS min_outage INTEGER DEFAULT 0;
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS min_stable_up INTEGER DEFAULT 0;
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS flap_threshold INTEGER DEFAULT 0;
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS flap_window INTEGER DEFAULT 0;
+ALTER TABLE events ADD COLUMN IF NOT EXISTS suppressed BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- +down
+ALTER TABLE events DROP COLUMN suppressed;
+ALTER TABLE devices DROP COLUMN flap_window;
+ALTER TABLE devices DROP COLUMN flap_threshold;
+ALTER TABLE devices DROP COLUMN min_stable_up;
+ALTER TABLE devices DROP COLUMN min_outage;
@@ -0,0 +1,18 @@
+-- +up
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS quiet_start TEXT;
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS quiet_end TEXT;
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS quiet_mode TEXT;
+
+-- Notifications held back during quiet hours, sent as one summary afterwards
+CREATE TABLE IF NOT EXISTS held_messages (
+	id BIGSERIAL PRIMARY KEY,
+	device_id TEXT NOT NULL,
+	text TEXT NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL
+);
+
+-- +down
+DROP TABLE held_messages;
+ALTER TABLE devices DROP COLUMN quiet_mode;
+ALTER TABLE devices DROP COLUMN quiet_end;
+ALTER TABLE devices DROP COLUMN quiet_start;
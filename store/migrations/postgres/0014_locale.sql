@@ -0,0 +1,7 @@
+-- +up
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS locale TEXT;
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS templates TEXT;
+
+-- +down
+ALTER TABLE devices DROP COLUMN templates;
+ALTER TABLE devices DROP COLUMN locale;
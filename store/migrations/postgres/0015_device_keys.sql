@@ -0,0 +1,7 @@
+-- +up
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS device_key TEXT;
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS udp_seq BIGINT DEFAULT 0;
+
+-- +down
+ALTER TABLE devices DROP COLUMN udp_seq;
+ALTER TABLE devices DROP COLUMN device_key;
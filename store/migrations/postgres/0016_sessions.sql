@@ -0,0 +1,9 @@
+-- +up
+CREATE TABLE IF NOT EXISTS sessions (
+	id TEXT PRIMARY KEY,
+	email TEXT NOT NULL,
+	expires_at TIMESTAMPTZ NOT NULL
+);
+
+-- +down
+DROP TABLE sessions;
@@ -0,0 +1,17 @@
+-- +up
+-- One row per device channel and calendar day in the device timezone
+CREATE TABLE IF NOT EXISTS daily_rollups (
+	device_id TEXT NOT NULL,
+	channel TEXT NOT NULL DEFAULT '',
+	day TEXT NOT NULL,
+	up_seconds BIGINT NOT NULL,
+	down_seconds BIGINT NOT NULL,
+	outages INTEGER NOT NULL,
+	longest_outage_seconds BIGINT NOT NULL,
+	PRIMARY KEY (device_id, channel, day)
+);
+CREATE INDEX IF NOT EXISTS idx_events_time ON events(timestamp);
+
+-- +down
+DROP INDEX idx_events_time;
+DROP TABLE daily_rollups;
@@ -0,0 +1,13 @@
+-- +up
+-- One row per server process: when it started, last said it was alive and stopped
+CREATE TABLE IF NOT EXISTS server_runs (
+	id BIGSERIAL PRIMARY KEY,
+	started_at TIMESTAMPTZ NOT NULL,
+	heartbeat_at TIMESTAMPTZ NOT NULL,
+	stopped_at TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS idx_server_runs_started ON server_runs(started_at);
+
+-- +down
+DROP INDEX idx_server_runs_started;
+DROP TABLE server_runs;
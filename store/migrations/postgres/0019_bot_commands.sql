@@ -0,0 +1,5 @@
+-- +up
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS bot_commands BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- +down
+ALTER TABLE devices DROP COLUMN bot_commands;
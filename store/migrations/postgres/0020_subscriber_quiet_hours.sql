@@ -0,0 +1,16 @@
+-- +up
+-- Quiet hours of each subscriber's delivery channel, in the device timezone
+ALTER TABLE subscriber_prefs ADD COLUMN IF NOT EXISTS quiet_start TEXT NOT NULL DEFAULT '';
+ALTER TABLE subscriber_prefs ADD COLUMN IF NOT EXISTS quiet_end TEXT NOT NULL DEFAULT '';
+ALTER TABLE subscriber_prefs ADD COLUMN IF NOT EXISTS quiet_mode TEXT NOT NULL DEFAULT '';
+
+-- Held messages of a subscriber's delivery channel; empty for the device chat
+ALTER TABLE held_messages ADD COLUMN IF NOT EXISTS email TEXT NOT NULL DEFAULT '';
+ALTER TABLE held_messages ADD COLUMN IF NOT EXISTS delivery TEXT NOT NULL DEFAULT '';
+
+-- +down
+ALTER TABLE held_messages DROP COLUMN delivery;
+ALTER TABLE held_messages DROP COLUMN email;
+ALTER TABLE subscriber_prefs DROP COLUMN quiet_mode;
+ALTER TABLE subscriber_prefs DROP COLUMN quiet_end;
+ALTER TABLE subscriber_prefs DROP COLUMN quiet_start;
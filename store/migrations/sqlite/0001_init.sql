@@ -0,0 +1,21 @@
+-- +up
+CREATE TABLE IF NOT EXISTS events (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	device_id TEXT NOT NULL,
+	event_type TEXT NOT NULL,
+	timestamp DATETIME NOT NULL,
+	duration_seconds INTEGER
+);
+CREATE INDEX IF NOT EXISTS idx_device_time ON events(device_id, timestamp DESC);
+
+CREATE TABLE IF NOT EXISTS devices (
+	id TEXT PRIMARY KEY,
+	name TEXT NOT NULL,
+	chat_id TEXT,
+	bot_token TEXT,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+-- +down
+DROP TABLE devices;
+DROP TABLE events;
@@ -0,0 +1,5 @@
+-- +up
+ALTER TABLE devices ADD COLUMN owner_email TEXT;
+
+-- +down
+ALTER TABLE devices DROP COLUMN owner_email;
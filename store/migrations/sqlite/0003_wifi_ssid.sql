@@ -0,0 +1,5 @@
+-- +up
+ALTER TABLE devices ADD COLUMN wifi_ssid TEXT;
+
+-- +down
+ALTER TABLE devices DROP COLUMN wifi_ssid;
@@ -0,0 +1,5 @@
+-- +up
+ALTER TABLE devices ADD COLUMN paused INTEGER DEFAULT 0;
+
+-- +down
+ALTER TABLE devices DROP COLUMN paused;
@@ -0,0 +1,5 @@
+-- +up
+ALTER TABLE devices ADD COLUMN timeout INTEGER DEFAULT 0;
+
+-- +down
+ALTER TABLE devices DROP COLUMN timeout;
@@ -0,0 +1,10 @@
+-- +up
+CREATE TABLE IF NOT EXISTS subscriptions (
+	email TEXT NOT NULL,
+	device_id TEXT NOT NULL,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (email, device_id)
+);
+
+-- +down
+DROP TABLE subscriptions;
@@ -0,0 +1,14 @@
+-- +up
+-- Opt-in public status pages (/s/{slug}) for a device or a group of devices
+CREATE TABLE IF NOT EXISTS public_pages (
+	slug TEXT PRIMARY KEY,
+	owner_email TEXT NOT NULL,
+	title TEXT,
+	device_ids TEXT NOT NULL,
+	hide_times INTEGER DEFAULT 0,
+	hide_name INTEGER DEFAULT 0,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+-- +down
+DROP TABLE public_pages;
@@ -0,0 +1,13 @@
+-- +up
+ALTER TABLE devices ADD COLUMN min_outage INTEGER DEFAULT 0;
+ALTER TABLE devices ADD COLUMN min_stable_up INTEGER DEFAULT 0;
+ALTER TABLE devices ADD COLUMN flap_threshold INTEGER DEFAULT 0;
+ALTER TABLE devices ADD COLUMN flap_window INTEGER DEFAULT 0;
+ALTER TABLE events ADD COLUMN suppressed INTEGER DEFAULT 0;
+
+-- +down
+ALTER TABLE events DROP COLUMN suppressed;
+ALTER TABLE devices DROP COLUMN flap_window;
+ALTER TABLE devices DROP COLUMN flap_threshold;
+ALTER TABLE devices DROP COLUMN min_stable_up;
+ALTER TABLE devices DROP COLUMN min_outage;
@@ -0,0 +1,24 @@
+-- +up
+-- Per-subscriber delivery: which events go to which of their channels
+CREATE TABLE IF NOT EXISTS subscriber_prefs (
+	email TEXT NOT NULL,
+	device_id TEXT NOT NULL,
+	channel TEXT NOT NULL,
+	events TEXT NOT NULL,
+	PRIMARY KEY (email, device_id, channel)
+);
+CREATE TABLE IF NOT EXISTS user_telegram (
+	email TEXT PRIMARY KEY,
+	chat_id TEXT NOT NULL,
+	linked_at DATETIME
+);
+CREATE TABLE IF NOT EXISTS telegram_links (
+	token TEXT PRIMARY KEY,
+	email TEXT NOT NULL,
+	created_at DATETIME NOT NULL
+);
+
+-- +down
+DROP TABLE telegram_links;
+DROP TABLE user_telegram;
+DROP TABLE subscriber_prefs;
@@ -0,0 +1,12 @@
+-- +up
+-- Browser PushSubscriptions for Web Push, one row per browser
+CREATE TABLE IF NOT EXISTS push_subscriptions (
+	endpoint TEXT PRIMARY KEY,
+	email TEXT NOT NULL,
+	p256dh TEXT NOT NULL,
+	auth TEXT NOT NULL,
+	created_at DATETIME
+);
+
+-- +down
+DROP TABLE push_subscriptions;
@@ -0,0 +1,18 @@
+-- +up
+ALTER TABLE devices ADD COLUMN quiet_start TEXT;
+ALTER TABLE devices ADD COLUMN quiet_end TEXT;
+ALTER TABLE devices ADD COLUMN quiet_mode TEXT;
+
+-- Notifications held back during quiet hours, sent as one summary afterwards
+CREATE TABLE IF NOT EXISTS held_messages (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	device_id TEXT NOT NULL,
+	text TEXT NOT NULL,
+	created_at DATETIME NOT NULL
+);
+
+-- +down
+DROP TABLE held_messages;
+ALTER TABLE devices DROP COLUMN quiet_mode;
+ALTER TABLE devices DROP COLUMN quiet_end;
+ALTER TABLE devices DROP COLUMN quiet_start;
@@ -0,0 +1,7 @@
+-- +up
+ALTER TABLE devices ADD COLUMN device_key TEXT;
+ALTER TABLE devices ADD COLUMN udp_seq INTEGER DEFAULT 0;
+
+-- +down
+ALTER TABLE devices DROP COLUMN udp_seq;
+ALTER TABLE devices DROP COLUMN device_key;
@@ -0,0 +1,10 @@
+-- +up
+-- Secrets the server generates once and keeps across restarts, such as the key that
+-- signs unsubscribe links
+CREATE TABLE IF NOT EXISTS secrets (
+	name TEXT PRIMARY KEY,
+	value TEXT NOT NULL
+);
+
+-- +down
+DROP TABLE secrets;
@@ -0,0 +1,647 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+// sqlStore implements Store for both backends; the queries are portable and DB
+// rebinds placeholders.
+type sqlStore struct {
+	db *DB
+}
+
+func (s *sqlStore) DB() *DB      { return s.db }
+func (s *sqlStore) Close() error { return s.db.Close() }
+
+func (s *sqlStore) Compact() error {
+	// PostgreSQL reclaims space with autovacuum
+	if s.db.postgres {
+		return nil
+	}
+	_, err := s.db.Exec("VACUUM")
+	return err
+}
+
+// ts prepares a time argument. SQLite compares timestamps as text, so they must all be
+// written in one zone; PostgreSQL keeps microseconds, so times read back and compared
+// for equality must not carry more.
+func (s *sqlStore) ts(t time.Time) time.Time {
+	if t.IsZero() {
+		return t
+	}
+	if s.db.postgres {
+		return t.Truncate(time.Microsecond)
+	}
+	return t.In(time.Local)
+}
+
+const deviceColumns = `id, name, chat_id, bot_token, owner_email, wifi_ssid, paused, timeout,
+	timezone, digest_frequency, digest_time, digest_sent_at,
+	min_outage, min_stable_up, flap_threshold, flap_window,
+	quiet_start, quiet_end, quiet_mode, locale, templates, device_key, udp_seq, bot_commands`
+
+func (s *sqlStore) ListDevices() ([]Device, error) {
+	rows, err := s.db.Query(`SELECT id, name, chat_id, bot_token, owner_email, wifi_ssid, paused, COALESCE(timeout, 0),
+		timezone, digest_frequency, digest_time, digest_sent_at,
+		COALESCE(min_outage, 0), COALESCE(min_stable_up, 0), COALESCE(flap_threshold, 0), COALESCE(flap_window, 0),
+		quiet_start, quiet_end, quiet_mode, locale, templates, device_key, COALESCE(udp_seq, 0), bot_commands FROM devices`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var devices []Device
+	for rows.Next() {
+		var d Device
+		var chatID, botToken, ownerEmail, wifiSSID sql.NullString
+		var timezone, digestFrequency, digestTime sql.NullString
+		var quietStart, quietEnd, quietMode sql.NullString
+		var locale, templates, deviceKey sql.NullString
+		var digestSentAt sql.NullTime
+		var paused, botCommands sql.NullBool
+		err := rows.Scan(&d.ID, &d.Name, &chatID, &botToken, &ownerEmail, &wifiSSID, &paused, &d.Timeout,
+			&timezone, &digestFrequency, &digestTime, &digestSentAt,
+			&d.MinOutage, &d.MinStableUp, &d.FlapThreshold, &d.FlapWindow,
+			&quietStart, &quietEnd, &quietMode, &locale, &templates, &deviceKey, &d.UDPSeq, &botCommands)
+		if err != nil {
+			return nil, err
+		}
+		d.ChatID = chatID.String
+		d.BotToken = botToken.String
+		d.OwnerEmail = ownerEmail.String
+		d.WifiSSID = wifiSSID.String
+		d.Paused = paused.Bool
+		d.Timezone = timezone.String
+		d.DigestFrequency = digestFrequency.String
+		d.DigestTime = digestTime.String
+		d.DigestSentAt = digestSentAt.Time
+		d.QuietStart = quietStart.String
+		d.QuietEnd = quietEnd.String
+		d.QuietMode = quietMode.String
+		d.Locale = locale.String
+		if templates.String != "" {
+			json.Unmarshal([]byte(templates.String), &d.Templates)
+		}
+		d.DeviceKey = deviceKey.String
+		d.BotCommands = botCommands.Bool
+		devices = append(devices, d)
+	}
+	return devices, rows.Err()
+}
+
+func (s *sqlStore) SaveDevice(d *Device) error {
+	var templates string
+	if len(d.Templates) > 0 {
+		b, _ := json.Marshal(d.Templates)
+		templates = string(b)
+	}
+	_, err := s.db.Exec(`
+		INSERT INTO devices (`+deviceColumns+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET
+			name = excluded.name, chat_id = excluded.chat_id, bot_token = excluded.bot_token,
+			owner_email = excluded.owner_email, wifi_ssid = excluded.wifi_ssid,
+			paused = excluded.paused, timeout = excluded.timeout, timezone = excluded.timezone,
+			digest_frequency = excluded.digest_frequency, digest_time = excluded.digest_time,
+			digest_sent_at = excluded.digest_sent_at,
+			min_outage = excluded.min_outage, min_stable_up = excluded.min_stable_up,
+			flap_threshold = excluded.flap_threshold, flap_window = excluded.flap_window,
+			quiet_start = excluded.quiet_start, quiet_end = excluded.quiet_end, quiet_mode = excluded.quiet_mode,
+			locale = excluded.locale, templates = excluded.templates,
+			device_key = excluded.device_key, udp_seq = excluded.udp_seq, bot_commands = excluded.bot_commands
+	`, d.ID, d.Name, d.ChatID, d.BotToken, d.OwnerEmail, d.WifiSSID, d.Paused, d.Timeout,
+		d.Timezone, d.DigestFrequency, d.DigestTime, s.ts(d.DigestSentAt),
+		d.MinOutage, d.MinStableUp, d.FlapThreshold, d.FlapWindow,
+		d.QuietStart, d.QuietEnd, d.QuietMode, d.Locale, templates, d.DeviceKey, int64(d.UDPSeq), d.BotCommands)
+	return err
+}
+
+func (s *sqlStore) DeleteDevice(id string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, table := range []string{"devices WHERE id", "events WHERE device_id", "daily_rollups WHERE device_id", "subscriptions WHERE device_id",
+		"subscriber_prefs WHERE device_id", "held_messages WHERE device_id"} {
+		if _, err := tx.Exec(s.db.Rebind("DELETE FROM "+table+" = ?"), id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) SetUDPSeq(id string, seq uint32) error {
+	_, err := s.db.Exec("UPDATE devices SET udp_seq = ? WHERE id = ?", int64(seq), id)
+	return err
+}
+
+func (s *sqlStore) AddEvent(e Event) error {
+	_, err := s.db.Exec(
+		"INSERT INTO events (device_id, channel, event_type, timestamp, duration_seconds, suppressed) VALUES (?, ?, ?, ?, ?, ?)",
+		e.DeviceID, e.Channel, e.Type, s.ts(e.Time), e.Duration, e.Suppressed,
+	)
+	return err
+}
+
+func (s *sqlStore) ImportEvents(events, updated []Event) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, e := range events {
+		_, err := tx.Exec(s.db.Rebind("INSERT INTO events (device_id, channel, event_type, timestamp, duration_seconds, suppressed) VALUES (?, ?, ?, ?, ?, ?)"),
+			e.DeviceID, e.Channel, e.Type, s.ts(e.Time), e.Duration, e.Suppressed)
+		if err != nil {
+			return err
+		}
+	}
+	for _, e := range updated {
+		_, err := tx.Exec(s.db.Rebind("UPDATE events SET duration_seconds = ? WHERE device_id = ? AND channel = ? AND timestamp = ?"),
+			e.Duration, e.DeviceID, e.Channel, s.ts(e.Time))
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+const eventColumns = "device_id, channel, event_type, timestamp, duration_seconds, COALESCE(suppressed, FALSE)"
+
+func scanEvents(rows *sql.Rows, err error) ([]Event, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var events []Event
+	for rows.Next() {
+		var e Event
+		if err := rows.Scan(&e.DeviceID, &e.Channel, &e.Type, &e.Time, &e.Duration, &e.Suppressed); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+func (s *sqlStore) LastEvent(deviceID, channel string) (Event, error) {
+	events, err := scanEvents(s.db.Query(
+		"SELECT "+eventColumns+" FROM events WHERE device_id = ? AND channel = ? ORDER BY timestamp DESC LIMIT 1",
+		deviceID, channel))
+	return firstEvent(events, err)
+}
+
+func (s *sqlStore) LastEventBefore(deviceID, channel string, before time.Time) (Event, error) {
+	events, err := scanEvents(s.db.Query(
+		"SELECT "+eventColumns+" FROM events WHERE device_id = ? AND channel = ? AND timestamp < ? ORDER BY timestamp DESC LIMIT 1",
+		deviceID, channel, s.ts(before)))
+	return firstEvent(events, err)
+}
+
+func (s *sqlStore) EventAfter(deviceID, channel string, after time.Time) (Event, error) {
+	events, err := scanEvents(s.db.Query(
+		"SELECT "+eventColumns+" FROM events WHERE device_id = ? AND channel = ? AND timestamp > ? ORDER BY timestamp ASC LIMIT 1",
+		deviceID, channel, s.ts(after)))
+	return firstEvent(events, err)
+}
+
+func (s *sqlStore) FirstEvent(deviceID, channel string) (Event, error) {
+	events, err := scanEvents(s.db.Query(
+		"SELECT "+eventColumns+" FROM events WHERE device_id = ? AND channel = ? ORDER BY timestamp ASC LIMIT 1",
+		deviceID, channel))
+	return firstEvent(events, err)
+}
+
+func firstEvent(events []Event, err error) (Event, error) {
+	if err != nil {
+		return Event{}, err
+	}
+	if len(events) == 0 {
+		return Event{}, ErrNotFound
+	}
+	return events[0], nil
+}
+
+func (s *sqlStore) Events(deviceID, channel string, from, to time.Time) ([]Event, error) {
+	return scanEvents(s.db.Query(
+		"SELECT "+eventColumns+" FROM events WHERE device_id = ? AND channel = ? AND timestamp >= ? AND timestamp < ? ORDER BY timestamp ASC",
+		deviceID, channel, s.ts(from), s.ts(to)))
+}
+
+func (s *sqlStore) RecentEvents(deviceID, channel string, limit int) ([]Event, error) {
+	return scanEvents(s.db.Query(
+		"SELECT "+eventColumns+" FROM events WHERE device_id = ? AND channel = ? ORDER BY timestamp DESC LIMIT ?",
+		deviceID, channel, limit))
+}
+
+func (s *sqlStore) EventChannels(deviceID string) ([]string, error) {
+	rows, err := s.db.Query("SELECT DISTINCT channel FROM events WHERE device_id = ? AND channel != '' ORDER BY channel", deviceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var channels []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		channels = append(channels, name)
+	}
+	return channels, rows.Err()
+}
+
+func (s *sqlStore) MarkSuppressed(deviceID, channel string, ts time.Time) error {
+	_, err := s.db.Exec("UPDATE events SET suppressed = ? WHERE device_id = ? AND channel = ? AND timestamp = ?",
+		true, deviceID, channel, s.ts(ts))
+	return err
+}
+
+func (s *sqlStore) CountEvents(from, to time.Time) (int, error) {
+	var n int
+	err := s.db.QueryRow("SELECT COUNT(*) FROM events WHERE timestamp >= ? AND timestamp < ?", s.ts(from), s.ts(to)).Scan(&n)
+	return n, err
+}
+
+func (s *sqlStore) DeleteEventsBefore(cutoff time.Time) (int64, error) {
+	cutoff = s.ts(cutoff)
+	res, err := s.db.Exec(`DELETE FROM events WHERE timestamp < ? AND EXISTS (
+		SELECT 1 FROM events newer WHERE newer.device_id = events.device_id AND newer.channel = events.channel
+			AND newer.timestamp > events.timestamp AND newer.timestamp < ?)`, cutoff, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (s *sqlStore) SaveRollup(r Rollup) error {
+	_, err := s.db.Exec(`
+		INSERT INTO daily_rollups (device_id, channel, day, up_seconds, down_seconds, outages, longest_outage_seconds)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (device_id, channel, day) DO UPDATE SET
+			up_seconds = excluded.up_seconds, down_seconds = excluded.down_seconds,
+			outages = excluded.outages, longest_outage_seconds = excluded.longest_outage_seconds
+	`, r.DeviceID, r.Channel, r.Day, r.UpSeconds, r.DownSeconds, r.Outages, r.LongestOutage)
+	return err
+}
+
+func (s *sqlStore) Rollups(deviceID, channel, fromDay, toDay string) ([]Rollup, error) {
+	rows, err := s.db.Query(`SELECT device_id, channel, day, up_seconds, down_seconds, outages, longest_outage_seconds
+		FROM daily_rollups WHERE device_id = ? AND channel = ? AND day >= ? AND day < ? ORDER BY day`,
+		deviceID, channel, fromDay, toDay)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var rollups []Rollup
+	for rows.Next() {
+		var r Rollup
+		if err := rows.Scan(&r.DeviceID, &r.Channel, &r.Day, &r.UpSeconds, &r.DownSeconds, &r.Outages, &r.LongestOutage); err != nil {
+			return nil, err
+		}
+		rollups = append(rollups, r)
+	}
+	return rollups, rows.Err()
+}
+
+func (s *sqlStore) LastRollupDay(deviceID, channel string) (string, error) {
+	var day sql.NullString
+	err := s.db.QueryRow("SELECT MAX(day) FROM daily_rollups WHERE device_id = ? AND channel = ?", deviceID, channel).Scan(&day)
+	if err != nil {
+		return "", err
+	}
+	if !day.Valid {
+		return "", ErrNotFound
+	}
+	return day.String, nil
+}
+
+func (s *sqlStore) Subscribe(email, deviceID string) error {
+	_, err := s.db.Exec("INSERT INTO subscriptions (email, device_id) VALUES (?, ?) ON CONFLICT DO NOTHING", email, deviceID)
+	return err
+}
+
+func (s *sqlStore) Unsubscribe(email, deviceID string) error {
+	_, err := s.db.Exec("DELETE FROM subscriptions WHERE email = ? AND device_id = ?", email, deviceID)
+	return err
+}
+
+func (s *sqlStore) Subscriptions(email string) ([]string, error) {
+	rows, err := s.db.Query("SELECT device_id FROM subscriptions WHERE email = ? ORDER BY created_at, device_id", email)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func (s *sqlStore) IsSubscribed(email, deviceID string) (bool, error) {
+	var n int
+	err := s.db.QueryRow("SELECT COUNT(*) FROM subscriptions WHERE email = ? AND device_id = ?", email, deviceID).Scan(&n)
+	return n > 0, err
+}
+
+func (s *sqlStore) CreateSession(sess Session) error {
+	_, err := s.db.Exec("INSERT INTO sessions (id, email, expires_at) VALUES (?, ?, ?)", sess.ID, sess.Email, s.ts(sess.ExpiresAt))
+	return err
+}
+
+func (s *sqlStore) Session(id string) (Session, error) {
+	sess := Session{ID: id}
+	err := s.db.QueryRow("SELECT email, expires_at FROM sessions WHERE id = ?", id).Scan(&sess.Email, &sess.ExpiresAt)
+	if errors.Is(err, sql.ErrNoRows) || err == nil && !time.Now().Before(sess.ExpiresAt) {
+		return Session{}, ErrNotFound
+	}
+	return sess, err
+}
+
+func (s *sqlStore) DeleteSession(id string) error {
+	_, err := s.db.Exec("DELETE FROM sessions WHERE id = ?", id)
+	return err
+}
+
+func (s *sqlStore) DeleteExpiredSessions(now time.Time) error {
+	_, err := s.db.Exec("DELETE FROM sessions WHERE expires_at <= ?", s.ts(now))
+	return err
+}
+
+func (s *sqlStore) StartServerRun(at time.Time) (int64, error) {
+	var id int64
+	err := s.db.QueryRow("INSERT INTO server_runs (started_at, heartbeat_at) VALUES (?, ?) RETURNING id",
+		s.ts(at), s.ts(at)).Scan(&id)
+	return id, err
+}
+
+func (s *sqlStore) ServerHeartbeat(id int64, at time.Time) error {
+	_, err := s.db.Exec("UPDATE server_runs SET heartbeat_at = ? WHERE id = ?", s.ts(at), id)
+	return err
+}
+
+func (s *sqlStore) StopServerRun(id int64, at time.Time) error {
+	_, err := s.db.Exec("UPDATE server_runs SET heartbeat_at = ?, stopped_at = ? WHERE id = ?", s.ts(at), s.ts(at), id)
+	return err
+}
+
+func (s *sqlStore) ServerRuns(from, to time.Time) ([]ServerRun, error) {
+	rows, err := s.db.Query(`
+		SELECT id, started_at, heartbeat_at, stopped_at FROM server_runs
+		WHERE started_at < ? AND started_at >= COALESCE((SELECT MAX(started_at) FROM server_runs WHERE started_at <= ?), ?)
+		ORDER BY started_at`, s.ts(to), s.ts(from), s.ts(from))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var runs []ServerRun
+	for rows.Next() {
+		var r ServerRun
+		var stopped sql.NullTime
+		if err := rows.Scan(&r.ID, &r.StartedAt, &r.HeartbeatAt, &stopped); err != nil {
+			return nil, err
+		}
+		r.StoppedAt = stopped.Time
+		runs = append(runs, r)
+	}
+	return runs, rows.Err()
+}
+
+func (s *sqlStore) PublicPages() ([]PublicPage, error) {
+	rows, err := s.db.Query("SELECT slug, owner_email, title, device_ids, hide_times, hide_name FROM public_pages ORDER BY slug")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var pages []PublicPage
+	for rows.Next() {
+		var p PublicPage
+		var title sql.NullString
+		var deviceIDs string
+		if err := rows.Scan(&p.Slug, &p.OwnerEmail, &title, &deviceIDs, &p.HideTimes, &p.HideName); err != nil {
+			return nil, err
+		}
+		p.Title = title.String
+		p.DeviceIDs = strings.Split(deviceIDs, ",")
+		pages = append(pages, p)
+	}
+	return pages, rows.Err()
+}
+
+func (s *sqlStore) SavePublicPage(p PublicPage) error {
+	_, err := s.db.Exec(`
+		INSERT INTO public_pages (slug, owner_email, title, device_ids, hide_times, hide_name)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (slug) DO UPDATE SET owner_email = excluded.owner_email, title = excluded.title,
+			device_ids = excluded.device_ids, hide_times = excluded.hide_times, hide_name = excluded.hide_name`,
+		p.Slug, p.OwnerEmail, p.Title, strings.Join(p.DeviceIDs, ","), p.HideTimes, p.HideName)
+	return err
+}
+
+func (s *sqlStore) DeletePublicPage(slug string) error {
+	_, err := s.db.Exec("DELETE FROM public_pages WHERE slug = ?", slug)
+	return err
+}
+
+func (s *sqlStore) queryPrefs(query string, args ...interface{}) ([]SubscriberPref, error) {
+	rows, err := s.db.Query(`SELECT email, device_id, channel, events, quiet_start, quiet_end, quiet_mode FROM subscriber_prefs p
+		WHERE `+query+" ORDER BY email, device_id, channel", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var prefs []SubscriberPref
+	for rows.Next() {
+		var p SubscriberPref
+		var events string
+		if err := rows.Scan(&p.Email, &p.DeviceID, &p.Channel, &events, &p.QuietStart, &p.QuietEnd, &p.QuietMode); err != nil {
+			return nil, err
+		}
+		p.Events = strings.Split(events, ",")
+		prefs = append(prefs, p)
+	}
+	return prefs, rows.Err()
+}
+
+func (s *sqlStore) DevicePrefs(deviceID string) ([]SubscriberPref, error) {
+	return s.queryPrefs("device_id = ?", deviceID)
+}
+
+func (s *sqlStore) UserPrefs(email string) ([]SubscriberPref, error) {
+	return s.queryPrefs("email = ?", email)
+}
+
+func (s *sqlStore) SavePref(p SubscriberPref) error {
+	_, err := s.db.Exec(`INSERT INTO subscriber_prefs (email, device_id, channel, events, quiet_start, quiet_end, quiet_mode)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (email, device_id, channel) DO UPDATE SET events = excluded.events,
+			quiet_start = excluded.quiet_start, quiet_end = excluded.quiet_end, quiet_mode = excluded.quiet_mode`,
+		p.Email, p.DeviceID, p.Channel, strings.Join(p.Events, ","), p.QuietStart, p.QuietEnd, p.QuietMode)
+	return err
+}
+
+func (s *sqlStore) DeletePrefs(email, deviceID, channel string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	prefs := "DELETE FROM subscriber_prefs WHERE email = ? AND device_id = ?"
+	held := "DELETE FROM held_messages WHERE email = ? AND device_id = ?"
+	args := []interface{}{email, deviceID}
+	if channel != "" {
+		prefs += " AND channel = ?"
+		held += " AND delivery = ?"
+		args = append(args, channel)
+	}
+	for _, query := range []string{prefs, held} {
+		if _, err := tx.Exec(s.db.Rebind(query), args...); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) DigestDevices() ([]string, error) {
+	rows, err := s.db.Query("SELECT DISTINCT device_id FROM subscriber_prefs WHERE ',' || events || ',' LIKE '%,digest,%' ORDER BY device_id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func (s *sqlStore) PushSubscriptions(email string) ([]PushSubscription, error) {
+	rows, err := s.db.Query("SELECT endpoint, email, p256dh, auth FROM push_subscriptions WHERE email = ? ORDER BY created_at, endpoint", email)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var subs []PushSubscription
+	for rows.Next() {
+		var p PushSubscription
+		if err := rows.Scan(&p.Endpoint, &p.Email, &p.P256dh, &p.Auth); err != nil {
+			return nil, err
+		}
+		subs = append(subs, p)
+	}
+	return subs, rows.Err()
+}
+
+func (s *sqlStore) SavePushSubscription(p PushSubscription) error {
+	_, err := s.db.Exec(`INSERT INTO push_subscriptions (endpoint, email, p256dh, auth, created_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (endpoint) DO UPDATE SET email = excluded.email, p256dh = excluded.p256dh, auth = excluded.auth, created_at = excluded.created_at`,
+		p.Endpoint, p.Email, p.P256dh, p.Auth, s.ts(time.Now()))
+	return err
+}
+
+func (s *sqlStore) DeletePushSubscription(endpoint, email string) error {
+	if email == "" {
+		_, err := s.db.Exec("DELETE FROM push_subscriptions WHERE endpoint = ?", endpoint)
+		return err
+	}
+	_, err := s.db.Exec("DELETE FROM push_subscriptions WHERE endpoint = ? AND email = ?", endpoint, email)
+	return err
+}
+
+func (s *sqlStore) HoldMessage(m HeldMessage) error {
+	_, err := s.db.Exec("INSERT INTO held_messages (device_id, email, delivery, text, created_at) VALUES (?, ?, ?, ?, ?)",
+		m.DeviceID, m.Email, m.Delivery, m.Text, s.ts(m.CreatedAt))
+	return err
+}
+
+func (s *sqlStore) HeldMessages(deviceID, email, delivery string) ([]HeldMessage, error) {
+	rows, err := s.db.Query("SELECT id, text, created_at FROM held_messages WHERE device_id = ? AND email = ? AND delivery = ? ORDER BY id",
+		deviceID, email, delivery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var held []HeldMessage
+	for rows.Next() {
+		m := HeldMessage{DeviceID: deviceID, Email: email, Delivery: delivery}
+		if err := rows.Scan(&m.ID, &m.Text, &m.CreatedAt); err != nil {
+			return nil, err
+		}
+		held = append(held, m)
+	}
+	return held, rows.Err()
+}
+
+func (s *sqlStore) DeleteHeldMessages(deviceID, email, delivery string, upTo int64) error {
+	_, err := s.db.Exec("DELETE FROM held_messages WHERE device_id = ? AND email = ? AND delivery = ? AND id <= ?",
+		deviceID, email, delivery, upTo)
+	return err
+}
+
+func (s *sqlStore) HeldPrefs() ([]SubscriberPref, error) {
+	return s.queryPrefs(`EXISTS (SELECT 1 FROM held_messages h
+		WHERE h.device_id = p.device_id AND h.email = p.email AND h.delivery = p.channel)`)
+}
+
+func (s *sqlStore) CreateTelegramLink(token, email string, at time.Time) error {
+	_, err := s.db.Exec("INSERT INTO telegram_links (token, email, created_at) VALUES (?, ?, ?)", token, email, s.ts(at))
+	return err
+}
+
+func (s *sqlStore) TelegramLink(token string) (string, time.Time, error) {
+	var email string
+	var created time.Time
+	err := s.db.QueryRow("SELECT email, created_at FROM telegram_links WHERE token = ?", token).Scan(&email, &created)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", time.Time{}, ErrNotFound
+	}
+	return email, created, err
+}
+
+func (s *sqlStore) DeleteTelegramLink(token string) error {
+	_, err := s.db.Exec("DELETE FROM telegram_links WHERE token = ?", token)
+	return err
+}
+
+func (s *sqlStore) LinkTelegramChat(email, chatID string, at time.Time) error {
+	_, err := s.db.Exec(`INSERT INTO user_telegram (email, chat_id, linked_at) VALUES (?, ?, ?)
+		ON CONFLICT (email) DO UPDATE SET chat_id = excluded.chat_id, linked_at = excluded.linked_at`, email, chatID, s.ts(at))
+	return err
+}
+
+func (s *sqlStore) TelegramChat(email string) (string, error) {
+	var chatID string
+	err := s.db.QueryRow("SELECT chat_id FROM user_telegram WHERE email = ?", email).Scan(&chatID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrNotFound
+	}
+	return chatID, err
+}
+
+func (s *sqlStore) UnlinkTelegramChat(chatID string) error {
+	_, err := s.db.Exec("DELETE FROM user_telegram WHERE chat_id = ?", chatID)
+	return err
+}
+
+func (s *sqlStore) Secret(name, value string) (string, error) {
+	if _, err := s.db.Exec("INSERT INTO secrets (name, value) VALUES (?, ?) ON CONFLICT (name) DO NOTHING", name, value); err != nil {
+		return "", err
+	}
+	var stored string
+	err := s.db.QueryRow("SELECT value FROM secrets WHERE name = ?", name).Scan(&stored)
+	return stored, err
+}
@@ -0,0 +1,16 @@
+package store
+
+import (
+	"database/sql"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// OpenSQLite opens the database file at path. Call MigrateUp before use.
+func OpenSQLite(path string) (Store, error) {
+	conn, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	return &sqlStore{db: &DB{DB: conn}}, nil
+}
@@ -0,0 +1,299 @@
+// Package store keeps devices, events, subscriptions, delivery settings and sessions
+// in SQLite or PostgreSQL behind one set of interfaces.
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned when a looked-up row doesn't exist.
+var ErrNotFound = errors.New("not found")
+
+// Device is a device's stored configuration.
+type Device struct {
+	ID         string
+	Name       string
+	ChatID     string
+	BotToken   string
+	OwnerEmail string
+	WifiSSID   string
+	Paused     bool
+	Timeout    int    // seconds, 0 = default (90)
+	Timezone   string // IANA name, empty = server default
+
+	DigestFrequency string // "", "daily" or "weekly"
+	DigestTime      string // "HH:MM" in the device timezone
+	DigestSentAt    time.Time
+
+	MinOutage     int // seconds an outage must last before it is announced
+	MinStableUp   int // seconds power must stay back before "light on" is announced
+	FlapThreshold int // transitions within FlapWindow that count as flapping, 0 = off
+	FlapWindow    int // seconds, 0 = default (600)
+
+	Locale    string            // "uk", "en", "pl", "de"; empty = uk
+	Templates map[string]string // message kind -> text/template
+
+	QuietStart string // "HH:MM" in the device timezone, empty = no quiet hours
+	QuietEnd   string
+	QuietMode  string // "silent" (no sound) or "hold" (summary after the window)
+
+	BotCommands bool // the server polls the device bot to answer /chart
+
+	DeviceKey string // shared secret for MQTT pings and UDP heartbeats
+	UDPSeq    uint32 // last accepted heartbeat sequence number
+}
+
+// Event is a recorded change of a device or channel state.
+type Event struct {
+	DeviceID   string
+	Channel    string // "" for the device itself
+	Type       string // "up" or "down"
+	Time       time.Time
+	Duration   sql.NullInt64 // seconds the previous state lasted
+	Suppressed bool          // never announced on its own
+}
+
+// Rollup sums up one calendar day of a device channel, in the device timezone.
+type Rollup struct {
+	DeviceID string
+	Channel  string
+	Day      string // YYYY-MM-DD
+
+	// Seconds with and without power; the rest of the day has no data
+	UpSeconds   int64
+	DownSeconds int64
+
+	Outages       int   // outages that started that day
+	LongestOutage int64 // seconds, counting only the part within the day
+}
+
+// Session is a signed-in browser, or a pending OAuth state when Email is empty.
+type Session struct {
+	ID        string
+	Email     string
+	ExpiresAt time.Time
+}
+
+// ServerRun is one run of the server process, so that the time it was down can be
+// told apart from outages.
+type ServerRun struct {
+	ID          int64
+	StartedAt   time.Time
+	HeartbeatAt time.Time // last sign of life
+	StoppedAt   time.Time // zero while running or after a crash
+}
+
+// End is when the run is known to have stopped: its shutdown, or its last heartbeat.
+func (r ServerRun) End() time.Time {
+	if !r.StoppedAt.IsZero() {
+		return r.StoppedAt
+	}
+	return r.HeartbeatAt
+}
+
+// PublicPage is an opt-in status page for one device or a group of them.
+type PublicPage struct {
+	Slug       string
+	OwnerEmail string
+	Title      string
+	DeviceIDs  []string
+	HideTimes  bool
+	HideName   bool
+}
+
+// SubscriberPref is the events a user gets about a device over one delivery channel.
+type SubscriberPref struct {
+	Email    string
+	DeviceID string
+	Channel  string // "telegram", "email" or "webpush"
+	Events   []string
+
+	// Quiet hours of this delivery channel, like the device's; empty uses the device's
+	QuietStart string
+	QuietEnd   string
+	QuietMode  string
+}
+
+// PushSubscription is a browser's Web Push subscription.
+type PushSubscription struct {
+	Endpoint string
+	Email    string
+	P256dh   string
+	Auth     string
+}
+
+// HeldMessage is a message kept back during quiet hours, for the device chat or for
+// one subscriber's delivery channel.
+type HeldMessage struct {
+	ID        int64
+	DeviceID  string
+	Email     string // "" for the device chat
+	Delivery  string // the subscriber's delivery channel
+	Text      string
+	CreatedAt time.Time
+}
+
+type DeviceStore interface {
+	ListDevices() ([]Device, error)
+	SaveDevice(d *Device) error
+	// DeleteDevice removes the device with its events, rollups, subscriptions, delivery
+	// preferences and held messages.
+	DeleteDevice(id string) error
+	SetUDPSeq(id string, seq uint32) error
+}
+
+type EventStore interface {
+	AddEvent(e Event) error
+	// ImportEvents adds events and replaces the Duration of the existing events in
+	// updated, found by device, channel and time, in one transaction.
+	ImportEvents(events, updated []Event) error
+	// LastEvent returns the newest event of a device channel, ErrNotFound if there is none.
+	LastEvent(deviceID, channel string) (Event, error)
+	// LastEventBefore is LastEvent among events older than before.
+	LastEventBefore(deviceID, channel string, before time.Time) (Event, error)
+	// EventAfter is the oldest event newer than after, ErrNotFound if there is none.
+	EventAfter(deviceID, channel string, after time.Time) (Event, error)
+	// Events lists the events in [from, to), oldest first.
+	Events(deviceID, channel string, from, to time.Time) ([]Event, error)
+	// RecentEvents lists up to limit events, newest first.
+	RecentEvents(deviceID, channel string, limit int) ([]Event, error)
+	// EventChannels lists the named channels a device has events for.
+	EventChannels(deviceID string) ([]string, error)
+	// FirstEvent returns the oldest event of a device channel, ErrNotFound if there is none.
+	FirstEvent(deviceID, channel string) (Event, error)
+	MarkSuppressed(deviceID, channel string, ts time.Time) error
+	CountEvents(from, to time.Time) (int, error)
+	// DeleteEventsBefore removes events older than cutoff except the newest one of each
+	// device channel, which still tells the state at the cutoff.
+	DeleteEventsBefore(cutoff time.Time) (int64, error)
+}
+
+type RollupStore interface {
+	// SaveRollup replaces the rollup of the same device channel and day.
+	SaveRollup(r Rollup) error
+	// Rollups lists the rollups for days in [fromDay, toDay), oldest first.
+	Rollups(deviceID, channel, fromDay, toDay string) ([]Rollup, error)
+	// LastRollupDay returns the newest rolled-up day, ErrNotFound if there is none.
+	LastRollupDay(deviceID, channel string) (string, error)
+}
+
+type SubscriptionStore interface {
+	// Subscribe is a no-op if the subscription exists.
+	Subscribe(email, deviceID string) error
+	Unsubscribe(email, deviceID string) error
+	Subscriptions(email string) ([]string, error)
+	IsSubscribed(email, deviceID string) (bool, error)
+}
+
+type SessionStore interface {
+	CreateSession(s Session) error
+	// Session returns an unexpired session, ErrNotFound otherwise.
+	Session(id string) (Session, error)
+	DeleteSession(id string) error
+	DeleteExpiredSessions(now time.Time) error
+}
+
+type ServerRunStore interface {
+	// StartServerRun records a server start and returns the id of the run.
+	StartServerRun(at time.Time) (int64, error)
+	ServerHeartbeat(id int64, at time.Time) error
+	StopServerRun(id int64, at time.Time) error
+	// ServerRuns lists the runs that started before to, from the last one started by
+	// from on, oldest first: the gaps between them are the server's downtime.
+	ServerRuns(from, to time.Time) ([]ServerRun, error)
+}
+
+type PublicPageStore interface {
+	PublicPages() ([]PublicPage, error)
+	// SavePublicPage adds the page or replaces the one with the same slug.
+	SavePublicPage(p PublicPage) error
+	DeletePublicPage(slug string) error
+}
+
+type SubscriberPrefStore interface {
+	// DevicePrefs lists the preferences of everyone who gets messages about a device.
+	DevicePrefs(deviceID string) ([]SubscriberPref, error)
+	UserPrefs(email string) ([]SubscriberPref, error)
+	// SavePref replaces the preference of the same user, device and delivery channel.
+	SavePref(p SubscriberPref) error
+	// DeletePrefs removes a user's preferences for a device, on one delivery channel or,
+	// when channel is empty, on all of them, with the messages held for them.
+	DeletePrefs(email, deviceID, channel string) error
+	// DigestDevices lists the devices someone chose to get digests of.
+	DigestDevices() ([]string, error)
+}
+
+type PushStore interface {
+	PushSubscriptions(email string) ([]PushSubscription, error)
+	// SavePushSubscription adds the subscription or replaces the one with the same endpoint.
+	SavePushSubscription(p PushSubscription) error
+	// DeletePushSubscription removes a subscription of the user, or of anyone when email is empty.
+	DeletePushSubscription(endpoint, email string) error
+}
+
+type HeldMessageStore interface {
+	HoldMessage(m HeldMessage) error
+	// HeldMessages lists the messages held for a device chat (empty email) or for a
+	// subscriber's delivery channel, oldest first.
+	HeldMessages(deviceID, email, delivery string) ([]HeldMessage, error)
+	// DeleteHeldMessages removes the held messages HeldMessages lists up to and
+	// including the id upTo.
+	DeleteHeldMessages(deviceID, email, delivery string, upTo int64) error
+	// HeldPrefs lists the subscriber preferences that have messages held for them.
+	HeldPrefs() ([]SubscriberPref, error)
+}
+
+// TelegramStore keeps the chats users linked to the system bot and the one-time link
+// tokens that link them.
+type TelegramStore interface {
+	CreateTelegramLink(token, email string, at time.Time) error
+	// TelegramLink returns the user and creation time of a link token, ErrNotFound if
+	// there is no such token.
+	TelegramLink(token string) (email string, created time.Time, err error)
+	DeleteTelegramLink(token string) error
+	// LinkTelegramChat replaces the chat linked for the user.
+	LinkTelegramChat(email, chatID string, at time.Time) error
+	// TelegramChat returns the user's linked chat, ErrNotFound if there is none.
+	TelegramChat(email string) (string, error)
+	UnlinkTelegramChat(chatID string) error
+}
+
+// SecretStore keeps secrets generated by the server, so they survive restarts.
+type SecretStore interface {
+	// Secret returns the named secret, storing value first if there is none yet. Servers
+	// sharing the database all get the value stored first.
+	Secret(name, value string) (string, error)
+}
+
+type Store interface {
+	DeviceStore
+	EventStore
+	RollupStore
+	SubscriptionStore
+	SessionStore
+	ServerRunStore
+	PublicPageStore
+	SubscriberPrefStore
+	PushStore
+	HeldMessageStore
+	TelegramStore
+	SecretStore
+
+	// DB is the underlying database, for the tables not behind an interface.
+	DB() *DB
+	// Compact returns the space of deleted rows to the operating system.
+	Compact() error
+	Close() error
+}
+
+// Open opens PostgreSQL for postgres:// and postgresql:// URLs, SQLite otherwise. The
+// schema is left as it is; see DB.MigrateUp.
+func Open(dsn string) (Store, error) {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		return OpenPostgres(dsn)
+	}
+	return OpenSQLite(dsn)
+}
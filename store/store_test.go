@@ -0,0 +1,664 @@
+package store
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	embeddedpostgres "github.com/fergusstrange/embedded-postgres"
+)
+
+func TestSQLite(t *testing.T) {
+	s, err := OpenSQLite(filepath.Join(t.TempDir(), "power.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err := s.DB().MigrateUp(); err != nil {
+		t.Fatal(err)
+	}
+	testStore(t, s)
+}
+
+// TestPostgres runs the suite on a PostgreSQL server it starts itself, or on the one
+// at POSTGRES_TEST_DSN. The server binaries are downloaded on the first run and cached
+// in ~/.embedded-postgres-go; when the server can't start the test fails on CI and is
+// skipped elsewhere.
+func TestPostgres(t *testing.T) {
+	dsn := os.Getenv("POSTGRES_TEST_DSN")
+	if dsn == "" {
+		dsn = startPostgres(t)
+	}
+	s, err := OpenPostgres(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err := s.DB().MigrateUp(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.DB().Exec(`TRUNCATE devices, events, daily_rollups, subscriptions, sessions, server_runs,
+		public_pages, subscriber_prefs, push_subscriptions, held_messages, telegram_links, user_telegram, secrets`); err != nil {
+		t.Fatal(err)
+	}
+	testStore(t, s)
+}
+
+func startPostgres(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := uint32(l.Addr().(*net.TCPAddr).Port)
+	l.Close()
+
+	dir := t.TempDir()
+	var log bytes.Buffer
+	config := embeddedpostgres.DefaultConfig().Version(embeddedpostgres.V16).Port(port).
+		RuntimePath(filepath.Join(dir, "runtime")).DataPath(filepath.Join(dir, "data")).Logger(&log)
+	pg := embeddedpostgres.NewDatabase(config)
+	if err := pg.Start(); err != nil {
+		if os.Getenv("CI") != "" {
+			t.Fatalf("start PostgreSQL: %v\n%s", err, &log)
+		}
+		t.Skipf("can't start PostgreSQL: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := pg.Stop(); err != nil {
+			t.Error(err)
+		}
+	})
+	return config.GetConnectionURL() + "?sslmode=disable"
+}
+
+// testStore is the conformance suite every backend must pass.
+func testStore(t *testing.T, s Store) {
+	t.Run("Devices", func(t *testing.T) { testDevices(t, s) })
+	t.Run("Events", func(t *testing.T) { testEvents(t, s) })
+	t.Run("Rollups", func(t *testing.T) { testRollups(t, s) })
+	t.Run("Retention", func(t *testing.T) { testRetention(t, s) })
+	t.Run("Subscriptions", func(t *testing.T) { testSubscriptions(t, s) })
+	t.Run("Sessions", func(t *testing.T) { testSessions(t, s) })
+	t.Run("ServerRuns", func(t *testing.T) { testServerRuns(t, s) })
+	t.Run("PublicPages", func(t *testing.T) { testPublicPages(t, s) })
+	t.Run("SubscriberPrefs", func(t *testing.T) { testSubscriberPrefs(t, s) })
+	t.Run("PushSubscriptions", func(t *testing.T) { testPushSubscriptions(t, s) })
+	t.Run("HeldMessages", func(t *testing.T) { testHeldMessages(t, s) })
+	t.Run("Telegram", func(t *testing.T) { testTelegram(t, s) })
+	t.Run("Secrets", func(t *testing.T) { testSecrets(t, s) })
+	t.Run("DeleteDevice", func(t *testing.T) { testDeleteDevice(t, s) })
+}
+
+func testDevices(t *testing.T, s Store) {
+	d := Device{
+		ID: "home", Name: "Дім", ChatID: "-100", BotToken: "token", OwnerEmail: "a@example.com",
+		Timeout: 120, Timezone: "Europe/Kyiv", DigestFrequency: "daily", DigestTime: "08:00",
+		DigestSentAt: time.Date(2024, 6, 1, 8, 0, 0, 0, time.UTC),
+		MinOutage:    60, FlapThreshold: 4, Locale: "en",
+		Templates:  map[string]string{"down": "{{.Name}} off"},
+		QuietStart: "23:00", QuietEnd: "07:00", QuietMode: "hold",
+		DeviceKey: "key", UDPSeq: 4000000000,
+	}
+	if err := s.SaveDevice(&d); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SaveDevice(&Device{ID: "cottage", Name: "Дача"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Saving again updates in place
+	d.Name = "Квартира"
+	d.Paused = true
+	d.BotCommands = true
+	if err := s.SaveDevice(&d); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetUDPSeq("home", 4000000001); err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := s.ListDevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 {
+		t.Fatalf("%d devices, want 2", len(list))
+	}
+	var got Device
+	for _, dev := range list {
+		if dev.ID == "home" {
+			got = dev
+		}
+	}
+	if got.Name != "Квартира" || !got.Paused || !got.BotCommands || got.Timeout != 120 || got.Locale != "en" ||
+		got.QuietMode != "hold" || got.DeviceKey != "key" || got.UDPSeq != 4000000001 {
+		t.Errorf("device = %+v", got)
+	}
+	if !got.DigestSentAt.Equal(d.DigestSentAt) {
+		t.Errorf("digest sent at %v, want %v", got.DigestSentAt, d.DigestSentAt)
+	}
+	if got.Templates["down"] != "{{.Name}} off" {
+		t.Errorf("templates = %v", got.Templates)
+	}
+}
+
+func testEvents(t *testing.T, s Store) {
+	if _, err := s.LastEvent("home", ""); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("no events: err = %v, want ErrNotFound", err)
+	}
+
+	base := time.Date(2024, 6, 1, 12, 0, 0, 123456789, time.UTC)
+	add := func(channel, typ string, at time.Duration, dur int64) {
+		t.Helper()
+		e := Event{DeviceID: "home", Channel: channel, Type: typ, Time: base.Add(at)}
+		if dur > 0 {
+			e.Duration = sql.NullInt64{Int64: dur, Valid: true}
+		}
+		if err := s.AddEvent(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	add("", "down", 0, 0)
+	add("", "up", time.Hour, 3600)
+	add("L1", "down", 2*time.Hour, 0)
+	add("", "down", 3*time.Hour, 7200)
+	add("L2", "up", 4*time.Hour, 0)
+
+	last, err := s.LastEvent("home", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last.Type != "down" || !last.Time.Truncate(time.Microsecond).Equal(base.Add(3*time.Hour).Truncate(time.Microsecond)) ||
+		last.Duration.Int64 != 7200 || last.Suppressed {
+		t.Errorf("last event = %+v", last)
+	}
+
+	before, err := s.LastEventBefore("home", "", base.Add(3*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before.Type != "up" {
+		t.Errorf("event before 3h = %+v, want the up at 1h", before)
+	}
+	if first, err := s.FirstEvent("home", ""); err != nil || first.Type != "down" || first.Duration.Valid {
+		t.Errorf("first event = %+v, %v", first, err)
+	}
+	if _, err := s.LastEventBefore("home", "", base); !errors.Is(err, ErrNotFound) {
+		t.Errorf("event before the first: err = %v, want ErrNotFound", err)
+	}
+
+	events, err := s.Events("home", "", base, base.Add(3*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[0].Type != "down" || events[1].Type != "up" || events[0].Duration.Valid {
+		t.Errorf("events in [0h, 3h) = %+v", events)
+	}
+
+	recent, err := s.RecentEvents("home", "", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recent) != 2 || !recent[0].Time.After(recent[1].Time) {
+		t.Errorf("recent events = %+v, want the last two newest first", recent)
+	}
+
+	channels, err := s.EventChannels("home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(channels) != 2 || channels[0] != "L1" || channels[1] != "L2" {
+		t.Errorf("channels = %v, want [L1 L2]", channels)
+	}
+
+	// The tracker refers to events by the full-precision time it recorded them with
+	if err := s.MarkSuppressed("home", "", base.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	events, _ = s.Events("home", "", base, base.Add(4*time.Hour))
+	for _, e := range events {
+		if want := e.Type == "up"; e.Suppressed != want {
+			t.Errorf("event %+v suppressed = %v, want %v", e, e.Suppressed, want)
+		}
+	}
+
+	if next, err := s.EventAfter("home", "", base.Add(time.Hour)); err != nil || next.Type != "down" || next.Duration.Int64 != 7200 {
+		t.Errorf("event after 1h = %+v, %v, want the down at 3h", next, err)
+	}
+	if _, err := s.EventAfter("home", "", base.Add(3*time.Hour)); !errors.Is(err, ErrNotFound) {
+		t.Errorf("event after the last: err = %v, want ErrNotFound", err)
+	}
+
+	// An outage imported into the uptime between 1h and 3h shortens the down at 3h
+	err = s.ImportEvents([]Event{
+		{DeviceID: "home", Type: "down", Time: base.Add(90 * time.Minute), Duration: sql.NullInt64{Int64: 1800, Valid: true}},
+		{DeviceID: "home", Type: "up", Time: base.Add(2 * time.Hour), Duration: sql.NullInt64{Int64: 1800, Valid: true}},
+	}, []Event{
+		{DeviceID: "home", Type: "down", Time: base.Add(3 * time.Hour), Duration: sql.NullInt64{Int64: 3600, Valid: true}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, _ = s.Events("home", "", base.Add(time.Hour), base.Add(4*time.Hour))
+	if len(events) != 4 || events[1].Type != "down" || events[2].Type != "up" || events[3].Duration.Int64 != 3600 {
+		t.Errorf("events after import = %+v", events)
+	}
+
+	// Bounds given in another zone mean the same instants
+	kyiv := time.FixedZone("EEST", 3*3600)
+	n, err := s.CountEvents(base.In(kyiv), base.Add(3*time.Hour).In(kyiv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 5 {
+		t.Errorf("%d events in [0h, 3h), want 5", n)
+	}
+}
+
+func testRollups(t *testing.T, s Store) {
+	if _, err := s.LastRollupDay("home", ""); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("no rollups: err = %v, want ErrNotFound", err)
+	}
+	for _, r := range []Rollup{
+		{DeviceID: "home", Day: "2024-06-01", UpSeconds: 80000, DownSeconds: 6400, Outages: 2, LongestOutage: 3600},
+		{DeviceID: "home", Day: "2024-06-02", UpSeconds: 86400},
+		{DeviceID: "home", Channel: "L1", Day: "2024-06-03", UpSeconds: 1},
+		{DeviceID: "home", Day: "2024-06-02", UpSeconds: 86000, DownSeconds: 400, Outages: 1, LongestOutage: 400},
+	} {
+		if err := s.SaveRollup(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := s.Rollups("home", "", "2024-06-01", "2024-06-03")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].Day != "2024-06-01" || got[0].LongestOutage != 3600 || got[1].Outages != 1 {
+		t.Errorf("rollups = %+v, want both days with the second replaced", got)
+	}
+	if got, _ := s.Rollups("home", "", "2024-06-02", "2024-06-02"); len(got) != 0 {
+		t.Errorf("empty range = %+v", got)
+	}
+	if day, err := s.LastRollupDay("home", ""); err != nil || day != "2024-06-02" {
+		t.Errorf("last rollup day = %q, %v", day, err)
+	}
+}
+
+func testRetention(t *testing.T, s Store) {
+	base := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, typ := range []string{"down", "up", "down", "up"} {
+		if err := s.AddEvent(Event{DeviceID: "old", Type: typ, Time: base.Add(time.Duration(i) * time.Hour)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.AddEvent(Event{DeviceID: "old", Channel: "L1", Type: "down", Time: base})
+
+	n, err := s.DeleteEventsBefore(base.Add(150 * time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("deleted %d events, want the first two", n)
+	}
+	// The down at 2h still gives the state at the cutoff; L1's only event is kept too
+	if e, err := s.FirstEvent("old", ""); err != nil || !e.Time.Equal(base.Add(2*time.Hour)) {
+		t.Errorf("oldest kept event = %+v, %v", e, err)
+	}
+	if _, err := s.FirstEvent("old", "L1"); err != nil {
+		t.Errorf("L1 event: %v", err)
+	}
+	if err := s.Compact(); err != nil {
+		t.Errorf("compact: %v", err)
+	}
+}
+
+func testSubscriptions(t *testing.T, s Store) {
+	for _, id := range []string{"home", "cottage", "home"} {
+		if err := s.Subscribe("b@example.com", id); err != nil {
+			t.Fatalf("subscribe %s: %v", id, err)
+		}
+	}
+	ids, err := s.Subscriptions("b@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 2 {
+		t.Errorf("subscriptions = %v, want two", ids)
+	}
+	if ok, _ := s.IsSubscribed("b@example.com", "cottage"); !ok {
+		t.Error("not subscribed to cottage")
+	}
+
+	if err := s.Unsubscribe("b@example.com", "cottage"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := s.IsSubscribed("b@example.com", "cottage"); ok {
+		t.Error("still subscribed after unsubscribe")
+	}
+	if ids, _ := s.Subscriptions("nobody@example.com"); len(ids) != 0 {
+		t.Errorf("unknown email has %v", ids)
+	}
+}
+
+func testSessions(t *testing.T, s Store) {
+	now := time.Now()
+	if err := s.CreateSession(Session{ID: "live", Email: "a@example.com", ExpiresAt: now.Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CreateSession(Session{ID: "old", Email: "a@example.com", ExpiresAt: now.Add(-time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+
+	sess, err := s.Session("live")
+	if err != nil || sess.Email != "a@example.com" {
+		t.Errorf("live session = %+v, %v", sess, err)
+	}
+	if _, err := s.Session("old"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expired session: err = %v, want ErrNotFound", err)
+	}
+	if _, err := s.Session("missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("missing session: err = %v, want ErrNotFound", err)
+	}
+
+	if err := s.DeleteExpiredSessions(now); err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	s.DB().QueryRow("SELECT COUNT(*) FROM sessions").Scan(&n)
+	if n != 1 {
+		t.Errorf("%d sessions after cleanup, want 1", n)
+	}
+
+	if err := s.DeleteSession("live"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Session("live"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("deleted session: err = %v, want ErrNotFound", err)
+	}
+}
+
+func testServerRuns(t *testing.T, s Store) {
+	base := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	at := func(h float64) time.Time { return base.Add(time.Duration(h * float64(time.Hour))) }
+
+	// A clean stop at 2h, a crash after the heartbeat at 5h, then the current run
+	first, err := s.StartServerRun(at(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.ServerHeartbeat(first, at(1))
+	s.StopServerRun(first, at(2))
+	second, _ := s.StartServerRun(at(3))
+	s.ServerHeartbeat(second, at(5))
+	third, _ := s.StartServerRun(at(8))
+	if third <= second || second <= first {
+		t.Errorf("run ids %d, %d, %d are not increasing", first, second, third)
+	}
+
+	runs, err := s.ServerRuns(at(4), at(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 2 || runs[0].ID != second || runs[1].ID != third {
+		t.Fatalf("runs from 4h = %+v, want the second and third", runs)
+	}
+	if !runs[0].StoppedAt.IsZero() || !runs[0].End().Equal(at(5)) {
+		t.Errorf("crashed run = %+v, want it to end at its last heartbeat", runs[0])
+	}
+
+	runs, _ = s.ServerRuns(at(-1), at(3))
+	if len(runs) != 1 || runs[0].ID != first || !runs[0].End().Equal(at(2)) || !runs[0].HeartbeatAt.Equal(at(2)) {
+		t.Errorf("runs before 3h = %+v, want the first, stopped at 2h", runs)
+	}
+}
+
+func testPublicPages(t *testing.T, s Store) {
+	page := PublicPage{Slug: "street", OwnerEmail: "a@example.com", DeviceIDs: []string{"home", "cottage"}, HideTimes: true}
+	if err := s.SavePublicPage(page); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SavePublicPage(PublicPage{Slug: "dacha", OwnerEmail: "a@example.com", Title: "Дача", DeviceIDs: []string{"cottage"}}); err != nil {
+		t.Fatal(err)
+	}
+	page.Title = "Вулиця"
+	page.DeviceIDs = []string{"home"}
+	page.HideName = true
+	if err := s.SavePublicPage(page); err != nil {
+		t.Fatal(err)
+	}
+
+	pages, err := s.PublicPages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pages) != 2 || pages[1].Slug != "street" || pages[1].Title != "Вулиця" || len(pages[1].DeviceIDs) != 1 ||
+		!pages[1].HideTimes || !pages[1].HideName || pages[0].Title != "Дача" || pages[0].HideName {
+		t.Errorf("pages = %+v", pages)
+	}
+
+	if err := s.DeletePublicPage("dacha"); err != nil {
+		t.Fatal(err)
+	}
+	if pages, _ := s.PublicPages(); len(pages) != 1 || pages[0].Slug != "street" {
+		t.Errorf("pages after delete = %+v", pages)
+	}
+}
+
+func testSubscriberPrefs(t *testing.T, s Store) {
+	for _, p := range []SubscriberPref{
+		{Email: "b@example.com", DeviceID: "home", Channel: "telegram", Events: []string{"down"}},
+		{Email: "b@example.com", DeviceID: "home", Channel: "email", Events: []string{"digest"}},
+		{Email: "b@example.com", DeviceID: "cottage", Channel: "email", Events: []string{"down", "up"}},
+		{Email: "c@example.com", DeviceID: "cottage", Channel: "webpush", Events: []string{"up", "digest"},
+			QuietStart: "22:00", QuietEnd: "07:00", QuietMode: "hold"},
+		// Saving again replaces the events
+		{Email: "b@example.com", DeviceID: "home", Channel: "telegram", Events: []string{"down", "up"}},
+	} {
+		if err := s.SavePref(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	prefs, err := s.DevicePrefs("home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prefs) != 2 || prefs[1].Channel != "telegram" || len(prefs[1].Events) != 2 || prefs[1].Events[1] != "up" {
+		t.Errorf("home prefs = %+v", prefs)
+	}
+	if prefs, _ := s.UserPrefs("b@example.com"); len(prefs) != 3 {
+		t.Errorf("user prefs = %+v, want three", prefs)
+	}
+	ids, err := s.DigestDevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 2 || ids[0] != "cottage" || ids[1] != "home" {
+		t.Errorf("digest devices = %v", ids)
+	}
+
+	if err := s.DeletePrefs("b@example.com", "home", "email"); err != nil {
+		t.Fatal(err)
+	}
+	if prefs, _ := s.DevicePrefs("home"); len(prefs) != 1 || prefs[0].Channel != "telegram" {
+		t.Errorf("home prefs after deleting one channel = %+v", prefs)
+	}
+	if err := s.DeletePrefs("b@example.com", "cottage", ""); err != nil {
+		t.Fatal(err)
+	}
+	prefs, _ = s.DevicePrefs("cottage")
+	if len(prefs) != 1 || prefs[0].Email != "c@example.com" || prefs[0].QuietStart != "22:00" || prefs[0].QuietMode != "hold" {
+		t.Errorf("cottage prefs after deleting all channels = %+v", prefs)
+	}
+}
+
+func testPushSubscriptions(t *testing.T, s Store) {
+	sub := PushSubscription{Endpoint: "https://push.example.com/1", Email: "a@example.com", P256dh: "key", Auth: "auth"}
+	if err := s.SavePushSubscription(sub); err != nil {
+		t.Fatal(err)
+	}
+	// The same browser signed in as someone else
+	sub.Email = "b@example.com"
+	sub.Auth = "auth2"
+	if err := s.SavePushSubscription(sub); err != nil {
+		t.Fatal(err)
+	}
+	if subs, _ := s.PushSubscriptions("a@example.com"); len(subs) != 0 {
+		t.Errorf("previous user's subscriptions = %+v", subs)
+	}
+	subs, err := s.PushSubscriptions("b@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(subs) != 1 || subs[0] != sub {
+		t.Errorf("subscriptions = %+v, want %+v", subs, sub)
+	}
+
+	// Only the owner removes a subscription, anyone when the push service dropped it
+	if err := s.DeletePushSubscription(sub.Endpoint, "a@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if subs, _ := s.PushSubscriptions("b@example.com"); len(subs) != 1 {
+		t.Error("another user removed the subscription")
+	}
+	if err := s.DeletePushSubscription(sub.Endpoint, ""); err != nil {
+		t.Fatal(err)
+	}
+	if subs, _ := s.PushSubscriptions("b@example.com"); len(subs) != 0 {
+		t.Errorf("subscriptions after delete = %+v", subs)
+	}
+}
+
+func testHeldMessages(t *testing.T, s Store) {
+	base := time.Date(2024, 6, 1, 23, 0, 0, 0, time.UTC)
+	for i, text := range []string{"first", "second", "third"} {
+		if err := s.HoldMessage(HeldMessage{DeviceID: "home", Text: text, CreatedAt: base.Add(time.Duration(i) * time.Minute)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.HoldMessage(HeldMessage{DeviceID: "cottage", Text: "other", CreatedAt: base})
+	s.HoldMessage(HeldMessage{DeviceID: "cottage", Email: "c@example.com", Delivery: "webpush", Text: "subscriber", CreatedAt: base})
+
+	held, err := s.HeldMessages("home", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(held) != 3 || held[0].Text != "first" || held[2].Text != "third" || !held[1].CreatedAt.Equal(base.Add(time.Minute)) {
+		t.Fatalf("held = %+v", held)
+	}
+
+	// A message held while the summary was being sent stays for the next one
+	if err := s.DeleteHeldMessages("home", "", "", held[1].ID); err != nil {
+		t.Fatal(err)
+	}
+	if held, _ := s.HeldMessages("home", "", ""); len(held) != 1 || held[0].Text != "third" {
+		t.Errorf("held after delete = %+v", held)
+	}
+	if held, _ := s.HeldMessages("cottage", "", ""); len(held) != 1 || held[0].Text != "other" {
+		t.Errorf("another device's held messages = %+v", held)
+	}
+
+	// A subscriber's messages are kept apart from the device chat's
+	held, _ = s.HeldMessages("cottage", "c@example.com", "webpush")
+	if len(held) != 1 || held[0].Text != "subscriber" || held[0].Email != "c@example.com" {
+		t.Errorf("subscriber's held messages = %+v", held)
+	}
+	prefs, err := s.HeldPrefs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prefs) != 1 || prefs[0].Email != "c@example.com" || prefs[0].Channel != "webpush" {
+		t.Errorf("prefs with held messages = %+v", prefs)
+	}
+	if err := s.DeletePrefs("c@example.com", "cottage", "webpush"); err != nil {
+		t.Fatal(err)
+	}
+	if held, _ := s.HeldMessages("cottage", "c@example.com", "webpush"); len(held) != 0 {
+		t.Errorf("held messages survived the preference: %+v", held)
+	}
+	if prefs, _ := s.HeldPrefs(); len(prefs) != 0 {
+		t.Errorf("prefs with held messages after delete = %+v", prefs)
+	}
+}
+
+func testTelegram(t *testing.T, s Store) {
+	created := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	if err := s.CreateTelegramLink("token", "a@example.com", created); err != nil {
+		t.Fatal(err)
+	}
+	email, at, err := s.TelegramLink("token")
+	if err != nil || email != "a@example.com" || !at.Equal(created) {
+		t.Errorf("link = %s %v %v", email, at, err)
+	}
+	if err := s.DeleteTelegramLink("token"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.TelegramLink("token"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("used link: err = %v, want ErrNotFound", err)
+	}
+
+	if _, err := s.TelegramChat("a@example.com"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("unlinked user: err = %v, want ErrNotFound", err)
+	}
+	s.LinkTelegramChat("a@example.com", "100", created)
+	if err := s.LinkTelegramChat("a@example.com", "200", created.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if chat, err := s.TelegramChat("a@example.com"); err != nil || chat != "200" {
+		t.Errorf("linked chat = %s %v, want the latest", chat, err)
+	}
+	if err := s.UnlinkTelegramChat("200"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.TelegramChat("a@example.com"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("unlinked chat: err = %v, want ErrNotFound", err)
+	}
+}
+
+func testSecrets(t *testing.T, s Store) {
+	first, err := s.Secret("unsubscribe", "first")
+	if err != nil || first != "first" {
+		t.Fatalf("new secret = %q %v", first, err)
+	}
+	// A restarted server keeps the stored secret
+	if again, err := s.Secret("unsubscribe", "second"); err != nil || again != "first" {
+		t.Errorf("existing secret = %q %v, want the first value", again, err)
+	}
+	if other, _ := s.Secret("other", "other"); other != "other" {
+		t.Errorf("secrets are not kept by name: %q", other)
+	}
+}
+
+func testDeleteDevice(t *testing.T, s Store) {
+	if err := s.DeleteDevice("home"); err != nil {
+		t.Fatal(err)
+	}
+	list, _ := s.ListDevices()
+	if len(list) != 1 || list[0].ID != "cottage" {
+		t.Errorf("devices after delete = %+v", list)
+	}
+	if _, err := s.LastEvent("home", ""); !errors.Is(err, ErrNotFound) {
+		t.Errorf("events survived the device: err = %v", err)
+	}
+	if ok, _ := s.IsSubscribed("b@example.com", "home"); ok {
+		t.Error("subscription survived the device")
+	}
+	if _, err := s.LastRollupDay("home", ""); !errors.Is(err, ErrNotFound) {
+		t.Errorf("rollups survived the device: err = %v", err)
+	}
+	if prefs, _ := s.DevicePrefs("home"); len(prefs) != 0 {
+		t.Errorf("delivery preferences survived the device: %+v", prefs)
+	}
+	if held, _ := s.HeldMessages("home", "", ""); len(held) != 0 {
+		t.Errorf("held messages survived the device: %+v", held)
+	}
+	if held, _ := s.HeldMessages("cottage", "", ""); len(held) != 1 {
+		t.Errorf("another device's held messages = %+v", held)
+	}
+}
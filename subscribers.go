@@ -0,0 +1,354 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"power-monitor/store"
+)
+
+const telegramLinkTTL = time.Hour
+
+// System bot for subscribers' personal chats, separate from the per-device bots owners
+// configure. Subscribers link their chat through https://t.me/{name}?start={token}.
+var (
+	systemBotToken string
+	systemBotName  string
+)
+
+// Event types a subscriber can choose.
+var subscriberEvents = []string{"down", "up", "digest"}
+
+// notification is one message for one subscriber over one delivery channel.
+type notification struct {
+	Email    string
+	DeviceID string
+	Channel  string // "telegram", "email" or "webpush"
+	Subject  string
+	Text     string
+	Silent   bool   // quiet hours
+	Locale   string // the device's, for the parts of the message added on delivery
+}
+
+// deliverers send a notification over a delivery channel. Only configured channels
+// are registered, see setupSubscriberDelivery.
+var deliverers = make(map[string]func(n notification) error)
+
+var notificationQueue = make(chan notification, 1000)
+
+func setupSubscriberDelivery() {
+	systemBotToken = os.Getenv("TELEGRAM_BOT_TOKEN")
+	systemBotName = os.Getenv("TELEGRAM_BOT_NAME")
+	if systemBotToken != "" && systemBotName != "" {
+		deliverers["telegram"] = deliverTelegram
+	}
+}
+
+// deliveryChannels lists the configured channels in display order.
+func deliveryChannels() []string {
+	var channels []string
+	for _, c := range []string{"telegram", "email", "webpush"} {
+		if deliverers[c] != nil {
+			channels = append(channels, c)
+		}
+	}
+	return channels
+}
+
+// pendingNotifications counts the queued notifications not delivered yet, for shutdown.
+var pendingNotifications sync.WaitGroup
+
+// enqueueNotification queues n for delivery, false if the queue is full.
+func enqueueNotification(n notification) bool {
+	pendingNotifications.Add(1)
+	select {
+	case notificationQueue <- n:
+		return true
+	default:
+		pendingNotifications.Done()
+		slog.Warn("Notification queue full, dropping message", "device_id", n.DeviceID, "delivery", n.Channel, "email", n.Email)
+		return false
+	}
+}
+
+// notificationWorker delivers queued subscriber notifications one at a time, so a slow
+// mail server or push service never holds up state tracking.
+func notificationWorker() {
+	for n := range notificationQueue {
+		// The channel may have been configured when the preference was saved, but not any more
+		if deliver := deliverers[n.Channel]; deliver != nil {
+			if err := deliver(n); err != nil {
+				slog.Error("Notification delivery failed", "device_id", n.DeviceID, "delivery", n.Channel, "email", n.Email, "err", err)
+				noteError(n.Channel, err)
+			} else {
+				slog.Debug("Notification delivered", "device_id", n.DeviceID, "delivery", n.Channel, "email", n.Email)
+			}
+		}
+		pendingNotifications.Done()
+	}
+}
+
+// subscriberWants maps an alert kind to the event types that receive it. Flapping
+// notices go to everyone who follows either outages or restores.
+func subscriberWants(events []string, kind string) bool {
+	for _, e := range events {
+		switch {
+		case e == kind:
+			return true
+		case (kind == "unstable" || kind == "stable") && (e == "down" || e == "up"):
+			return true
+		}
+	}
+	return false
+}
+
+// notifySubscribers queues text for every subscriber of the device who wants this kind
+// of message, on each of their delivery channels. During a channel's quiet hours the
+// message goes without a sound, or is held for the summary sent when they end.
+func notifySubscribers(d *DeviceConfig, kind, text string) {
+	prefs, err := storage.DevicePrefs(d.ID)
+	if err != nil {
+		slog.Error("Failed to load subscribers", "device_id", d.ID, "err", err)
+		noteError("db", err)
+		return
+	}
+
+	subject, _, _ := strings.Cut(text, "\n")
+	now := time.Now()
+	queued, held := 0, 0
+	for _, p := range prefs {
+		if !subscriberWants(p.Events, kind) {
+			continue
+		}
+		start, end, mode := subscriberQuietHours(d, p)
+		quiet := inQuietWindow(start, end, deviceLocation(d), now)
+		if quiet && mode == "hold" {
+			holdMessage(store.HeldMessage{DeviceID: d.ID, Email: p.Email, Delivery: p.Channel, Text: text})
+			held++
+			continue
+		}
+		enqueueNotification(notification{
+			Email:    p.Email,
+			DeviceID: d.ID,
+			Channel:  p.Channel,
+			Subject:  d.Name + ": " + subject,
+			Text:     "🏠 " + d.Name + "\n" + text,
+			Silent:   quiet,
+			Locale:   d.Locale,
+		})
+		queued++
+	}
+	slog.Debug("Notifying subscribers", "device_id", d.ID, "kind", kind, "queued", queued, "held", held)
+}
+
+func deliverTelegram(n notification) error {
+	chatID, err := storage.TelegramChat(n.Email)
+	if err != nil {
+		return fmt.Errorf("no linked chat: %v", err)
+	}
+	if sendTelegramMessage(systemBotToken, chatID, n.Text, n.Silent) == 0 {
+		return fmt.Errorf("sendMessage failed")
+	}
+	return nil
+}
+
+// linkTelegramChat completes a deep link: /start {token} in a private chat with the system bot.
+func linkTelegramChat(token, chatID string) (string, bool) {
+	email, created, err := storage.TelegramLink(token)
+	if err != nil || time.Since(created) > telegramLinkTTL {
+		return "", false
+	}
+	if err := storage.DeleteTelegramLink(token); err != nil {
+		slog.Error("Failed to delete Telegram link", "err", err)
+		return "", false
+	}
+	if err := storage.LinkTelegramChat(email, chatID, time.Now()); err != nil {
+		slog.Error("Failed to link Telegram chat", "chat_id", chatID, "email", email, "err", err)
+		noteError("db", err)
+		return "", false
+	}
+	slog.Info("Linked Telegram chat", "chat_id", chatID, "email", email)
+	return email, true
+}
+
+// handleSystemBotCommand answers /start {token} and /stop sent to the system bot, in
+// the language of the sender's Telegram app.
+func handleSystemBotCommand(chatID string, l *locale, command string, args []string) {
+	switch command {
+	case "/start":
+		if len(args) == 0 {
+			sendTelegram(systemBotToken, chatID, l.text("bot_start"))
+			return
+		}
+		email, ok := linkTelegramChat(args[0], chatID)
+		if !ok {
+			sendTelegram(systemBotToken, chatID, l.text("bot_link_invalid"))
+			return
+		}
+		sendTelegram(systemBotToken, chatID, l.text("bot_linked", email))
+	case "/stop":
+		if err := storage.UnlinkTelegramChat(chatID); err != nil {
+			slog.Error("Failed to unlink Telegram chat", "chat_id", chatID, "err", err)
+			noteError("db", err)
+			return
+		}
+		sendTelegram(systemBotToken, chatID, l.text("bot_stopped"))
+	}
+}
+
+// telegramLinkHandler creates a one-time deep link to the system bot:
+// POST /api/telegram/link -> {"url": "https://t.me/bot?start=..."}
+func telegramLinkHandler(w http.ResponseWriter, r *http.Request) {
+	email := getSessionEmail(r)
+	if email == "" {
+		http.Error(w, "unauthorized", 401)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+	if deliverers["telegram"] == nil {
+		http.Error(w, "telegram is not configured", 503)
+		return
+	}
+	// Telegram limits start parameters to 64 chars of [A-Za-z0-9_-]
+	token := generateSessionID()[:32]
+	if err := storage.CreateTelegramLink(token, email, time.Now()); err != nil {
+		http.Error(w, "Database error", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"url": "https://t.me/" + systemBotName + "?start=" + token})
+}
+
+// notificationPrefsHandler reads and updates a user's delivery preferences:
+// GET  /api/notification-prefs
+// PUT  /api/notification-prefs {"device_id": "...", "channel": "telegram", "events": ["down", "up"], "quiet_start": "22:00", "quiet_end": "07:00", "quiet_mode": "hold"}
+// An empty events list turns the channel off for that device. Without quiet hours of
+// its own the channel follows the device's.
+func notificationPrefsHandler(w http.ResponseWriter, r *http.Request) {
+	email := getSessionEmail(r)
+	if email == "" {
+		http.Error(w, "unauthorized", 401)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		stored, err := storage.UserPrefs(email)
+		if err != nil {
+			http.Error(w, "Database error", 500)
+			return
+		}
+		prefs := make(map[string]map[string][]string)
+		quiet := make(map[string]map[string]map[string]string)
+		for _, p := range stored {
+			if prefs[p.DeviceID] == nil {
+				prefs[p.DeviceID] = make(map[string][]string)
+				quiet[p.DeviceID] = make(map[string]map[string]string)
+			}
+			prefs[p.DeviceID][p.Channel] = p.Events
+			if p.QuietStart != "" {
+				quiet[p.DeviceID][p.Channel] = map[string]string{"start": p.QuietStart, "end": p.QuietEnd, "mode": p.QuietMode}
+			}
+		}
+		_, err = storage.TelegramChat(email)
+		if err != nil && !errors.Is(err, store.ErrNotFound) {
+			http.Error(w, "Database error", 500)
+			return
+		}
+		linked := err == nil
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"channels":        deliveryChannels(),
+			"events":          subscriberEvents,
+			"telegram_linked": linked,
+			"prefs":           prefs,
+			"quiet":           quiet,
+		})
+
+	case "PUT":
+		var req struct {
+			DeviceID   string   `json:"device_id"`
+			Channel    string   `json:"channel"`
+			Events     []string `json:"events"`
+			QuietStart string   `json:"quiet_start"`
+			QuietEnd   string   `json:"quiet_end"`
+			QuietMode  string   `json:"quiet_mode"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid json", 400)
+			return
+		}
+		if deliverers[req.Channel] == nil {
+			http.Error(w, "unknown channel", 400)
+			return
+		}
+		for _, e := range req.Events {
+			if !containsString(subscriberEvents, e) {
+				http.Error(w, "unknown event "+e, 400)
+				return
+			}
+		}
+		if (req.QuietStart == "") != (req.QuietEnd == "") {
+			http.Error(w, "invalid quiet hours", 400)
+			return
+		}
+		for _, t := range []string{req.QuietStart, req.QuietEnd} {
+			if _, err := time.Parse("15:04", t); t != "" && err != nil {
+				http.Error(w, "invalid quiet hours", 400)
+				return
+			}
+		}
+		switch req.QuietMode {
+		case "", "silent", "hold":
+		default:
+			http.Error(w, "invalid quiet_mode", 400)
+			return
+		}
+
+		mu.Lock()
+		d, exists := devices[req.DeviceID]
+		owner := exists && d.OwnerEmail == email
+		mu.Unlock()
+		subscribed, _ := storage.IsSubscribed(email, req.DeviceID)
+		if !exists || (!owner && !subscribed) {
+			http.Error(w, "device not found", 404)
+			return
+		}
+
+		var err error
+		if len(req.Events) == 0 {
+			err = storage.DeletePrefs(email, req.DeviceID, req.Channel)
+		} else {
+			err = storage.SavePref(store.SubscriberPref{Email: email, DeviceID: req.DeviceID, Channel: req.Channel, Events: req.Events,
+				QuietStart: req.QuietStart, QuietEnd: req.QuietEnd, QuietMode: req.QuietMode})
+		}
+		if err != nil {
+			http.Error(w, "Database error", 500)
+			return
+		}
+		w.Write([]byte("ok"))
+
+	default:
+		http.Error(w, "method not allowed", 405)
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
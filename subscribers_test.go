@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"power-monitor/store"
+)
+
+func TestSubscriberWants(t *testing.T) {
+	tests := []struct {
+		events []string
+		kind   string
+		want   bool
+	}{
+		{[]string{"down"}, "down", true},
+		{[]string{"down"}, "up", false},
+		{[]string{"up"}, "unstable", true},
+		{[]string{"down"}, "stable", true},
+		{[]string{"digest"}, "unstable", false},
+		{[]string{"digest"}, "digest", true},
+		{[]string{"down", "up"}, "digest", false},
+		{nil, "down", false},
+	}
+	for _, tt := range tests {
+		if got := subscriberWants(tt.events, tt.kind); got != tt.want {
+			t.Errorf("%v wants %s: %v, want %v", tt.events, tt.kind, got, tt.want)
+		}
+	}
+}
+
+func TestNotifySubscribers(t *testing.T) {
+	if err := initDB(filepath.Join(t.TempDir(), "test.db")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	delivered := captureNotifications(t)
+
+	d := &DeviceConfig{Device: store.Device{ID: "home", Name: "Дім", Timezone: "Europe/Kyiv", Locale: "en"}}
+	for _, p := range []store.SubscriberPref{
+		{Email: "down@example.com", DeviceID: "home", Channel: "test", Events: []string{"down"}},
+		{Email: "up@example.com", DeviceID: "home", Channel: "test", Events: []string{"up"}},
+		{Email: "digest@example.com", DeviceID: "home", Channel: "test", Events: []string{"digest"}},
+		{Email: "other@example.com", DeviceID: "cottage", Channel: "test", Events: []string{"down"}},
+	} {
+		if err := storage.SavePref(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	notifySubscribers(d, "down", "🔴 Power is off\nfor 2 hours")
+	got := delivered()
+	if len(got) != 1 {
+		t.Fatalf("delivered %+v, want one notification", got)
+	}
+	n := got[0]
+	if n.Email != "down@example.com" || n.DeviceID != "home" || n.Channel != "test" || n.Locale != "en" || n.Silent ||
+		n.Subject != "Дім: 🔴 Power is off" || n.Text != "🏠 Дім\n🔴 Power is off\nfor 2 hours" {
+		t.Errorf("notification = %+v", n)
+	}
+
+	notifySubscribers(d, "unstable", "⚠️ Flapping")
+	var emails []string
+	for _, n := range delivered() {
+		emails = append(emails, n.Email)
+	}
+	sort.Strings(emails)
+	if strings.Join(emails, ",") != "down@example.com,up@example.com" {
+		t.Errorf("flapping notice went to %v, want the outage and restore subscribers", emails)
+	}
+}
+
+func TestNotificationPrefsAuthorization(t *testing.T) {
+	if err := initDB(filepath.Join(t.TempDir(), "test.db")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	captureNotifications(t)
+
+	devices["home"] = &DeviceConfig{Device: store.Device{ID: "home", Name: "home", OwnerEmail: "owner@example.com"}}
+	t.Cleanup(func() { delete(devices, "home") })
+	if err := storage.Subscribe("subscriber@example.com", "home"); err != nil {
+		t.Fatal(err)
+	}
+
+	put := func(email, body string) int {
+		r := httptest.NewRequest("PUT", "/api/notification-prefs", strings.NewReader(body))
+		if email != "" {
+			signIn(t, r, email)
+		}
+		rec := httptest.NewRecorder()
+		notificationPrefsHandler(rec, r)
+		return rec.Code
+	}
+	body := `{"device_id": "home", "channel": "test", "events": ["down"]}`
+	tests := []struct {
+		email string
+		body  string
+		want  int
+	}{
+		{"", body, 401},
+		{"owner@example.com", body, 200},
+		{"subscriber@example.com", body, 200},
+		{"stranger@example.com", body, 404},
+		{"owner@example.com", `{"device_id": "cottage", "channel": "test", "events": ["down"]}`, 404},
+		{"owner@example.com", `{"device_id": "home", "channel": "fax", "events": ["down"]}`, 400},
+		{"owner@example.com", `{"device_id": "home", "channel": "test", "events": ["sideways"]}`, 400},
+		{"owner@example.com", `{"device_id": "home", "channel": "test", "events": ["down"], "quiet_start": "22:00"}`, 400},
+	}
+	for _, tt := range tests {
+		if got := put(tt.email, tt.body); got != tt.want {
+			t.Errorf("%q %s: %d, want %d", tt.email, tt.body, got, tt.want)
+		}
+	}
+
+	prefs, err := storage.DevicePrefs("home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var emails []string
+	for _, p := range prefs {
+		emails = append(emails, p.Email)
+	}
+	sort.Strings(emails)
+	if strings.Join(emails, ",") != "owner@example.com,subscriber@example.com" {
+		t.Errorf("saved preferences for %v", emails)
+	}
+
+	// An empty events list turns the channel off
+	if got := put("subscriber@example.com", `{"device_id": "home", "channel": "test", "events": []}`); got != 200 {
+		t.Fatalf("turning off: %d", got)
+	}
+	if prefs, _ := storage.UserPrefs("subscriber@example.com"); len(prefs) != 0 {
+		t.Errorf("preferences left after turning off: %+v", prefs)
+	}
+}
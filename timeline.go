@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const maxTimelineRange = 366 * 24 * time.Hour
+
+var (
+	locationCache   = make(map[string]*time.Location)
+	locationCacheMu sync.Mutex
+)
+
+// deviceLocation is the timezone used for day boundaries, digests and message times of a device.
+func deviceLocation(d *DeviceConfig) *time.Location {
+	if d == nil || d.Timezone == "" {
+		return defaultLoc
+	}
+	locationCacheMu.Lock()
+	defer locationCacheMu.Unlock()
+	if loc, ok := locationCache[d.Timezone]; ok {
+		return loc
+	}
+	loc, err := time.LoadLocation(d.Timezone)
+	if err != nil {
+		slog.Warn("Unknown timezone", "device_id", d.ID, "timezone", d.Timezone, "err", err)
+		loc = defaultLoc
+	}
+	locationCache[d.Timezone] = loc
+	return loc
+}
+
+type timelineSegment struct {
+	State string `json:"state"`
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+type timelineBucket struct {
+	Start         string            `json:"start"`
+	End           string            `json:"end"`
+	UpSeconds     int64             `json:"up_seconds"`
+	DownSeconds   int64             `json:"down_seconds"`
+	NoDataSeconds int64             `json:"nodata_seconds"`
+	Outages       int               `json:"outages"` // outages that started in the bucket
+	Segments      []timelineSegment `json:"segments"`
+}
+
+// bucketStart truncates t to the start of its day or ISO week in loc.
+func bucketStart(t time.Time, bucket string, loc *time.Location) time.Time {
+	t = t.In(loc)
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+	if bucket == "week" {
+		offset := (int(day.Weekday()) + 6) % 7 // Monday = 0
+		day = day.AddDate(0, 0, -offset)
+	}
+	return day
+}
+
+func nextBucket(t time.Time, bucket string) time.Time {
+	if bucket == "week" {
+		return t.AddDate(0, 0, 7)
+	}
+	return t.AddDate(0, 0, 1)
+}
+
+// parseTimelineTime accepts a date (YYYY-MM-DD, in the device timezone) or an RFC3339 timestamp.
+func parseTimelineTime(s string, loc *time.Location) (time.Time, bool) {
+	if t, err := time.ParseInLocation("2006-01-02", s, loc); err == nil {
+		return t, true
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, true
+	}
+	return time.Time{}, false
+}
+
+// buildTimeline splits the on/off intervals into day or week buckets clipped to bucket boundaries.
+func buildTimeline(intervals []interval, from, to time.Time, bucket string, loc *time.Location) []timelineBucket {
+	var buckets []timelineBucket
+	i := 0
+	for start := bucketStart(from, bucket, loc); start.Before(to); start = nextBucket(start, bucket) {
+		end := nextBucket(start, bucket)
+		b := timelineBucket{Start: start.Format(time.RFC3339), End: end.Format(time.RFC3339), Segments: []timelineSegment{}}
+		for ; i < len(intervals); i++ {
+			iv := intervals[i]
+			segStart, segEnd := iv.Start, iv.End
+			if segStart.Before(start) {
+				segStart = start
+			}
+			if segEnd.After(end) {
+				segEnd = end
+			}
+			if segEnd.After(segStart) {
+				b.Segments = append(b.Segments, timelineSegment{
+					State: iv.State,
+					Start: segStart.In(loc).Format(time.RFC3339),
+					End:   segEnd.In(loc).Format(time.RFC3339),
+				})
+				sec := int64(segEnd.Sub(segStart).Seconds())
+				switch iv.State {
+				case "up":
+					b.UpSeconds += sec
+				case "down":
+					b.DownSeconds += sec
+					// One already going on at from started before the range
+					if segStart.Equal(iv.Start) && iv.Start.After(from) && !iv.Continued {
+						b.Outages++
+					}
+				default:
+					b.NoDataSeconds += sec
+				}
+			}
+			if iv.End.After(end) {
+				break // continues in the next bucket
+			}
+		}
+		buckets = append(buckets, b)
+	}
+	return buckets
+}
+
+// devicesAPIHandler routes /api/devices/{id}/... requests.
+func devicesAPIHandler(w http.ResponseWriter, r *http.Request) {
+	rest := r.URL.Path[len("/api/devices/"):]
+	id, action, _ := strings.Cut(rest, "/")
+	switch action {
+	case "timeline":
+		timelineHandler(w, r, id)
+	case "import":
+		importHandler(w, r, id)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// timelineHandler serves precomputed on/off segments for the calendar and timeline views:
+// GET /api/devices/{id}/timeline?from=2024-01-01&to=2024-02-01&bucket=day|week&channel=
+// Ranges over a month read daily rollups: rolled-up days have totals but no segments.
+// server_gaps lists the times the server itself was down, shown as nodata.
+func timelineHandler(w http.ResponseWriter, r *http.Request, deviceID string) {
+	mu.Lock()
+	d, exists := devices[deviceID]
+	mu.Unlock()
+	if !exists {
+		http.Error(w, "device not found", 404)
+		return
+	}
+
+	q := r.URL.Query()
+	loc := deviceLocation(d)
+	now := time.Now()
+	bucket := q.Get("bucket")
+	if bucket != "week" {
+		bucket = "day"
+	}
+
+	to := now
+	if s := q.Get("to"); s != "" {
+		t, ok := parseTimelineTime(s, loc)
+		if !ok {
+			http.Error(w, "invalid to", 400)
+			return
+		}
+		to = t
+	}
+	if to.After(now) {
+		to = now
+	}
+	from := bucketStart(to, "day", loc).AddDate(0, 0, -6)
+	if s := q.Get("from"); s != "" {
+		t, ok := parseTimelineTime(s, loc)
+		if !ok {
+			http.Error(w, "invalid from", 400)
+			return
+		}
+		from = t
+	}
+	if !from.Before(to) {
+		http.Error(w, "from must be before to", 400)
+		return
+	}
+	if to.Sub(from) > maxTimelineRange {
+		http.Error(w, "range too large", 400)
+		return
+	}
+
+	channel := q.Get("channel")
+	var buckets []timelineBucket
+	var intervals []interval
+	var err error
+	if to.Sub(from) > rollupRange {
+		buckets, intervals, err = dayBuckets(deviceID, channel, from, to, loc)
+		if bucket == "week" {
+			buckets = weekBuckets(buckets, loc)
+		}
+	} else {
+		intervals, err = loadIntervals(deviceID, channel, from, to)
+		buckets = buildTimeline(intervals, from, to, bucket, loc)
+	}
+	if err != nil {
+		requestLog(r).Error("Timeline failed", "device_id", deviceID, "err", err)
+		http.Error(w, "Database error", 500)
+		return
+	}
+
+	gaps := []timelineSegment{}
+	for _, iv := range intervals {
+		if iv.State == "nodata" {
+			gaps = append(gaps, timelineSegment{State: iv.State, Start: iv.Start.In(loc).Format(time.RFC3339), End: iv.End.In(loc).Format(time.RFC3339)})
+		}
+	}
+	// The server's own downtime, part of the gaps above
+	down, err := serverGaps(from, to)
+	if err != nil {
+		requestLog(r).Error("Timeline failed", "device_id", deviceID, "err", err)
+	}
+	serverDown := []timelineSegment{}
+	for _, iv := range down {
+		serverDown = append(serverDown, timelineSegment{State: iv.State, Start: iv.Start.In(loc).Format(time.RFC3339), End: iv.End.In(loc).Format(time.RFC3339)})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"device":   deviceID,
+		"channel":  channel,
+		"timezone": loc.String(),
+		"bucket":   bucket,
+		"from":     from.In(loc).Format(time.RFC3339),
+		"to":       to.In(loc).Format(time.RFC3339),
+		"buckets":  buckets,
+		"gaps":     gaps,
+
+		"server_gaps": serverDown,
+	})
+}
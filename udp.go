@@ -0,0 +1,177 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+)
+
+// UDP heartbeats for battery and constrained devices, enabled with UDP_ADDR (e.g.
+// ":8091"). A packet, integers big-endian:
+//
+//	"PM"        magic
+//	version     1 byte, udpVersion
+//	flags       1 byte, reserved (0)
+//	seq         uint32, strictly increasing per device key
+//	id length   1 byte, then the device ID
+//	telemetry   TLV records until the MAC: type 1 byte, length 1 byte, value
+//	mac         first 16 bytes of HMAC-SHA256(device key, everything before it)
+//
+// The device key is the one shown in the dashboard; regenerating it restarts the
+// sequence. Nothing is sent back.
+const (
+	udpVersion = 1
+	udpMACSize = 16
+	udpMaxSize = 512
+)
+
+// Telemetry record types. Unknown types are skipped so devices can send newer ones.
+const (
+	tlvChannels = 1 // "L1:1,L2:0", as /ping takes
+	tlvBattery  = 2 // uint16, millivolts
+	tlvRSSI     = 3 // int8, dBm
+	tlvUptime   = 4 // uint32, seconds
+)
+
+type heartbeat struct {
+	DeviceID  string
+	Seq       uint32
+	Channels  map[string]bool
+	Telemetry map[string]int
+	signed    []byte // packet without the MAC
+	mac       []byte
+}
+
+var errBadPacket = errors.New("malformed packet")
+
+var udpConn net.PacketConn
+
+func setupUDP() {
+	addr := os.Getenv("UDP_ADDR")
+	if addr == "" {
+		return
+	}
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		slog.Error("UDP listener failed", "err", err)
+		return
+	}
+	slog.Info("UDP heartbeats enabled", "addr", conn.LocalAddr().String())
+	udpConn = conn
+	go serveUDP(conn)
+}
+
+// stopUDP stops taking heartbeats.
+func stopUDP() {
+	if udpConn != nil {
+		udpConn.Close()
+	}
+}
+
+func serveUDP(conn net.PacketConn) {
+	buf := make([]byte, udpMaxSize)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		hb, err := parseHeartbeat(buf[:n])
+		if err != nil {
+			continue // noise on a public port isn't worth a log line
+		}
+		if err := acceptHeartbeat(hb); err != nil {
+			slog.Warn("UDP heartbeat rejected", "device_id", hb.DeviceID, "from", from.String(), "err", err)
+			continue
+		}
+		recordPing(hb.DeviceID, hb.Channels)
+		if len(hb.Telemetry) > 0 {
+			mu.Lock()
+			telemetry[hb.DeviceID] = hb.Telemetry
+			mu.Unlock()
+		}
+	}
+}
+
+func parseHeartbeat(p []byte) (*heartbeat, error) {
+	if len(p) < 9+udpMACSize || p[0] != 'P' || p[1] != 'M' {
+		return nil, errBadPacket
+	}
+	if p[2] != udpVersion {
+		return nil, errors.New("unsupported version")
+	}
+	hb := &heartbeat{
+		Seq:    binary.BigEndian.Uint32(p[4:8]),
+		signed: p[:len(p)-udpMACSize],
+		mac:    p[len(p)-udpMACSize:],
+	}
+	body := hb.signed[8:]
+	idLen := int(body[0])
+	if idLen == 0 || len(body) < 1+idLen {
+		return nil, errBadPacket
+	}
+	hb.DeviceID = string(body[1 : 1+idLen])
+
+	for tlv := body[1+idLen:]; len(tlv) > 0; {
+		if len(tlv) < 2 || len(tlv) < 2+int(tlv[1]) {
+			return nil, errBadPacket
+		}
+		typ, value := tlv[0], tlv[2:2+int(tlv[1])]
+		tlv = tlv[2+len(value):]
+		switch {
+		case typ == tlvChannels:
+			hb.Channels = parseChannels(string(value))
+		case typ == tlvBattery && len(value) == 2:
+			hb.setTelemetry("battery_mv", int(binary.BigEndian.Uint16(value)))
+		case typ == tlvRSSI && len(value) == 1:
+			hb.setTelemetry("rssi", int(int8(value[0])))
+		case typ == tlvUptime && len(value) == 4:
+			hb.setTelemetry("uptime", int(binary.BigEndian.Uint32(value)))
+		}
+	}
+	return hb, nil
+}
+
+func (hb *heartbeat) setTelemetry(name string, v int) {
+	if hb.Telemetry == nil {
+		hb.Telemetry = make(map[string]int)
+	}
+	hb.Telemetry[name] = v
+}
+
+// acceptHeartbeat checks the MAC against the device key and rejects sequence numbers
+// that were already seen, so a captured packet can't keep a device "up".
+func acceptHeartbeat(hb *heartbeat) error {
+	mu.Lock()
+	defer mu.Unlock()
+	d := devices[hb.DeviceID]
+	if d == nil || d.DeviceKey == "" {
+		return errors.New("unknown device")
+	}
+	mac := hmac.New(sha256.New, []byte(d.DeviceKey))
+	mac.Write(hb.signed)
+	if !hmac.Equal(hb.mac, mac.Sum(nil)[:udpMACSize]) {
+		return errors.New("bad signature")
+	}
+	if hb.Seq <= d.UDPSeq {
+		return errors.New("replayed sequence number")
+	}
+	d.UDPSeq = hb.Seq
+	saveSeq(d)
+	return nil
+}
+
+// saveSeq stores the device's last accepted sequence number. Call it with mu held, so
+// concurrent heartbeats can't leave an older number in the database.
+func saveSeq(d *DeviceConfig) {
+	if err := storage.SetUDPSeq(d.ID, d.UDPSeq); err != nil {
+		slog.Error("Failed to save heartbeat sequence", "device_id", d.ID, "err", err)
+		noteError("db", err)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"path/filepath"
+	"testing"
+
+	"power-monitor/store"
+)
+
+// buildHeartbeat encodes a packet the way device firmware does.
+func buildHeartbeat(key, deviceID string, seq uint32, tlv ...[]byte) []byte {
+	p := []byte{'P', 'M', udpVersion, 0}
+	p = binary.BigEndian.AppendUint32(p, seq)
+	p = append(p, byte(len(deviceID)))
+	p = append(p, deviceID...)
+	for _, r := range tlv {
+		p = append(p, r...)
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(p)
+	return append(p, mac.Sum(nil)[:udpMACSize]...)
+}
+
+func tlvRecord(typ byte, value []byte) []byte {
+	return append([]byte{typ, byte(len(value))}, value...)
+}
+
+func TestHeartbeat(t *testing.T) {
+	if err := initDB(filepath.Join(t.TempDir(), "test.db")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	d := &DeviceConfig{Device: store.Device{ID: "sensor", Name: "sensor", DeviceKey: "secret"}}
+	devices["sensor"] = d
+	saveDevice(d)
+	t.Cleanup(func() { delete(devices, "sensor") })
+
+	p := buildHeartbeat("secret", "sensor", 7,
+		tlvRecord(tlvChannels, []byte("L1:1,L2:0")),
+		tlvRecord(tlvBattery, []byte{0x0e, 0x74}),
+		tlvRecord(tlvRSSI, []byte{0xb5}),
+		tlvRecord(99, []byte("from a newer firmware")))
+	hb, err := parseHeartbeat(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hb.DeviceID != "sensor" || hb.Seq != 7 {
+		t.Errorf("device %q seq %d", hb.DeviceID, hb.Seq)
+	}
+	if !hb.Channels["L1"] || hb.Channels["L2"] {
+		t.Errorf("channels = %v", hb.Channels)
+	}
+	if hb.Telemetry["battery_mv"] != 3700 || hb.Telemetry["rssi"] != -75 {
+		t.Errorf("telemetry = %v", hb.Telemetry)
+	}
+	if err := acceptHeartbeat(hb); err != nil {
+		t.Fatalf("valid heartbeat rejected: %v", err)
+	}
+
+	// The same packet again is a replay
+	hb, _ = parseHeartbeat(p)
+	if err := acceptHeartbeat(hb); err == nil {
+		t.Error("replayed heartbeat accepted")
+	}
+	// So is an older sequence number, even correctly signed
+	hb, _ = parseHeartbeat(buildHeartbeat("secret", "sensor", 6))
+	if err := acceptHeartbeat(hb); err == nil {
+		t.Error("old sequence number accepted")
+	}
+	// A wrong key fails the MAC
+	hb, _ = parseHeartbeat(buildHeartbeat("guess", "sensor", 8))
+	if err := acceptHeartbeat(hb); err == nil {
+		t.Error("heartbeat with a wrong key accepted")
+	}
+
+	var stored uint32
+	db.QueryRow("SELECT udp_seq FROM devices WHERE id = 'sensor'").Scan(&stored)
+	if d.UDPSeq != 7 || stored != 7 {
+		t.Errorf("UDPSeq = %d, stored %d; want 7", d.UDPSeq, stored)
+	}
+
+	for _, bad := range [][]byte{
+		[]byte("GET / HTTP/1.1\r\n\r\n"),
+		buildHeartbeat("secret", "sensor", 9, []byte{tlvChannels, 200, '1'}),
+		append([]byte("PM\x02"), make([]byte, 30)...),
+	} {
+		if _, err := parseHeartbeat(bad); err == nil {
+			t.Errorf("parseHeartbeat(%q) accepted", bad)
+		}
+	}
+}